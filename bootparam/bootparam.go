@@ -11,11 +11,23 @@ import (
 
 const (
 	MagicSignature = 0x53726448
+	BootFlag       = 0xaa55
+
+	// SectorSize is the unit of SetupSects.
+	SectorSize = 512
+
+	// defaultSetupSects is used by old images with SetupSects 0.
+	defaultSetupSects = 4
 
 	LoadedHigh   = uint8(1 << 0)
 	KeepSegments = uint8(1 << 6)
 	CanUseHeap   = uint8(1 << 7)
 
+	// XLFKernel64 in XloadFlags says the kernel has a 64-bit entry point
+	// at Startup64Offset from where the protected-mode kernel is loaded.
+	XLFKernel64     = uint16(1 << 0)
+	Startup64Offset = 0x200
+
 	EddMbrSigMax = 16
 	E820Max      = 128
 	E820Ram      = 1
@@ -100,6 +112,12 @@ var ErrorSignatureNotMatch = errors.New("signature not match in bzImage")
 
 var ErrorOldProtocolVersion = errors.New("old protocol version")
 
+var ErrorBadBootFlag = errors.New("boot flag is not 0xaa55 in bzImage")
+
+var ErrorTruncated = errors.New("bzImage is truncated")
+
+var ErrorInvalidE820 = errors.New("invalid e820 map")
+
 func New(r io.ReaderAt) (*BootParam, error) {
 	b := &BootParam{}
 
@@ -116,26 +134,49 @@ func New(r io.ReaderAt) (*BootParam, error) {
 		return b, err
 	}
 
-	if err := b.isValid(); err != nil {
+	if b.Hdr.SetupSects == 0 {
+		b.Hdr.SetupSects = defaultSetupSects
+	}
+
+	if err := b.isValid(r); err != nil {
 		return b, err
 	}
 
 	return b, nil
 }
 
-func (b *BootParam) isValid() error {
+func (b *BootParam) isValid(r io.ReaderAt) error {
 	if b.Hdr.Header != MagicSignature {
 		return ErrorSignatureNotMatch
 	}
 
+	if b.Hdr.BootFlag != BootFlag {
+		return fmt.Errorf("%w: 0x%x", ErrorBadBootFlag, b.Hdr.BootFlag)
+	}
+
 	// Protocol 2.06+ is required.
 	if b.Hdr.Version < 0x0206 {
 		return fmt.Errorf("%w: 0x%x", ErrorOldProtocolVersion, b.Hdr.Version)
 	}
 
+	// The boot sector and setup code are followed by the protected-mode
+	// kernel, which is SysSize paragraphs long.
+	size := (int64(b.Hdr.SetupSects)+1)*SectorSize + int64(b.Hdr.SysSize)*16
+
+	var last [1]byte
+	if _, err := r.ReadAt(last[:], size-1); err != nil {
+		return fmt.Errorf("%w: want at least %d bytes: %v", ErrorTruncated, size, err)
+	}
+
 	return nil
 }
 
+// Has64BitEntry reports whether the kernel can be entered in long mode.
+// This needs protocol 2.12+.
+func (b *BootParam) Has64BitEntry() bool {
+	return b.Hdr.Version >= 0x020c && b.Hdr.XloadFlags&XLFKernel64 != 0
+}
+
 func (b *BootParam) AddE820Entry(addr, size uint64, typ uint32) {
 	i := b.E820Entries
 	b.E820Map[i] = E820Entry{
@@ -146,6 +187,73 @@ func (b *BootParam) AddE820Entry(addr, size uint64, typ uint32) {
 	b.E820Entries = i + 1
 }
 
+// ValidateE820 checks that the E820 map is sorted, that no entry is
+// empty, that RAM does not overlap any other entry, and that there is RAM
+// both at 0 for real mode and at 1 MiB for the kernel.
+func (b *BootParam) ValidateE820() error {
+	entries := b.E820Map[:b.E820Entries]
+
+	// How far any entry, and any RAM entry, reaches so far, and which
+	// entry that is. An entry may overlap one that is not just before it.
+	var (
+		end, ramEnd   uint64
+		last, lastRAM int
+	)
+
+	for i, e := range entries {
+		if e.Size == 0 {
+			return fmt.Errorf("%w: entry %d at %#x is empty", ErrorInvalidE820, i, e.Addr)
+		}
+
+		if i > 0 && e.Addr < entries[i-1].Addr {
+			return fmt.Errorf("%w: entry %d at %#x is before entry %d at %#x",
+				ErrorInvalidE820, i, e.Addr, i-1, entries[i-1].Addr)
+		}
+
+		over := -1
+
+		switch {
+		case e.Addr < ramEnd:
+			over = lastRAM
+		case e.Type == E820Ram && e.Addr < end:
+			over = last
+		}
+
+		if over >= 0 {
+			prev := entries[over]
+
+			return fmt.Errorf("%w: RAM overlaps: [%#x, %#x) and [%#x, %#x)",
+				ErrorInvalidE820, prev.Addr, prev.Addr+prev.Size, e.Addr, e.Addr+e.Size)
+		}
+
+		if e.Addr+e.Size > end {
+			end, last = e.Addr+e.Size, i
+		}
+
+		if e.Type == E820Ram && e.Addr+e.Size > ramEnd {
+			ramEnd, lastRAM = e.Addr+e.Size, i
+		}
+	}
+
+	for _, addr := range []uint64{0, 0x100000} {
+		if !b.isE820Ram(addr) {
+			return fmt.Errorf("%w: no RAM at %#x", ErrorInvalidE820, addr)
+		}
+	}
+
+	return nil
+}
+
+func (b *BootParam) isE820Ram(addr uint64) bool {
+	for _, e := range b.E820Map[:b.E820Entries] {
+		if e.Type == E820Ram && e.Addr <= addr && addr < e.Addr+e.Size {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (b *BootParam) Bytes() ([]byte, error) {
 	buf := new(bytes.Buffer)
 
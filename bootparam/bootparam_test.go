@@ -3,6 +3,7 @@ package bootparam_test
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
 	"testing"
@@ -88,3 +89,170 @@ func TestAddE820Entry(t *testing.T) {
 		t.Fatalf("invalid e820 type: %v", actual.Type)
 	}
 }
+
+// fakeBzImage returns an image with a valid setup header, followed by
+// setupSects sectors of setup code and a sysSize*16 byte kernel.
+func fakeBzImage(t *testing.T, setupSects uint8, sysSize uint32) []byte {
+	t.Helper()
+
+	hdr := bootparam.SetupHeader{
+		SetupSects: setupSects,
+		SysSize:    sysSize,
+		BootFlag:   bootparam.BootFlag,
+		Header:     bootparam.MagicSignature,
+		Version:    0x020f,
+	}
+
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+
+	img := make([]byte, (int(setupSects)+1)*bootparam.SectorSize+int(sysSize)*16)
+	copy(img[0x1f1:], buf.Bytes())
+
+	return img
+}
+
+func TestNewValidation(t *testing.T) {
+	t.Parallel()
+
+	good := fakeBzImage(t, 4, 0x100)
+
+	badFlag := fakeBzImage(t, 4, 0x100)
+	badFlag[0x1fe] = 0
+
+	for _, tt := range []struct {
+		name string
+		img  []byte
+		want error
+	}{
+		{name: "good", img: good},
+		{name: "truncated kernel", img: good[:len(good)-1], want: bootparam.ErrorTruncated},
+		{name: "truncated setup", img: good[:0x400], want: bootparam.ErrorTruncated},
+		{name: "bad boot flag", img: badFlag, want: bootparam.ErrorBadBootFlag},
+	} {
+		if _, err := bootparam.New(bytes.NewReader(tt.img)); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestNewDefaultSetupSects(t *testing.T) {
+	t.Parallel()
+
+	// A SetupSects of 0 means 4.
+	img := fakeBzImage(t, 0, 0x10)
+	img = append(img, make([]byte, 4*bootparam.SectorSize)...)
+
+	b, err := bootparam.New(bytes.NewReader(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Hdr.SetupSects != 4 {
+		t.Fatalf("SetupSects: got %d, want 4", b.Hdr.SetupSects)
+	}
+}
+
+func TestHas64BitEntry(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		version    uint16
+		xloadFlags uint16
+		want       bool
+	}{
+		{version: 0x020f, xloadFlags: bootparam.XLFKernel64, want: true},
+		{version: 0x020f, xloadFlags: 0, want: false},
+		{version: 0x020b, xloadFlags: bootparam.XLFKernel64, want: false},
+	} {
+		b := &bootparam.BootParam{}
+		b.Hdr.Version, b.Hdr.XloadFlags = tt.version, tt.xloadFlags
+
+		if got := b.Has64BitEntry(); got != tt.want {
+			t.Errorf("Has64BitEntry() for version %#x, xloadflags %#x: got %v, want %v",
+				tt.version, tt.xloadFlags, got, tt.want)
+		}
+	}
+}
+
+func TestValidateE820(t *testing.T) {
+	t.Parallel()
+
+	type entry struct {
+		addr, size uint64
+		typ        uint32
+	}
+
+	for _, tt := range []struct {
+		name    string
+		entries []entry
+		want    error
+	}{
+		{
+			name: "good",
+			entries: []entry{
+				{0, bootparam.EBDAStart, bootparam.E820Ram},
+				{bootparam.EBDAStart, bootparam.VGARAMBegin - bootparam.EBDAStart, bootparam.E820Reserved},
+				{bootparam.MBBIOSBegin, bootparam.MBBIOSEnd - bootparam.MBBIOSBegin, bootparam.E820Reserved},
+				{0x100000, 0x1000000, bootparam.E820Ram},
+			},
+		},
+		{
+			name: "overlap",
+			entries: []entry{
+				{0, 0xa0000, bootparam.E820Ram},
+				{bootparam.EBDAStart, bootparam.VGARAMBegin - bootparam.EBDAStart, bootparam.E820Reserved},
+				{0x100000, 0x1000000, bootparam.E820Ram},
+			},
+			want: bootparam.ErrorInvalidE820,
+		},
+		{
+			// The RAM at 0x400000 is past the entry just before it, but
+			// inside the reserved entry before that.
+			name: "overlap past the previous entry",
+			entries: []entry{
+				{0, bootparam.EBDAStart, bootparam.E820Ram},
+				{0x100000, 0x100000, bootparam.E820Ram},
+				{0x200000, 0x1000000, bootparam.E820Reserved},
+				{0x300000, 0x1000, bootparam.E820Reserved},
+				{0x400000, 0x1000000, bootparam.E820Ram},
+			},
+			want: bootparam.ErrorInvalidE820,
+		},
+		{
+			name: "reserved overlaps reserved",
+			entries: []entry{
+				{0, bootparam.EBDAStart, bootparam.E820Ram},
+				{bootparam.EBDAStart, 0x10000, bootparam.E820Reserved},
+				{bootparam.EBDAStart + 0x1000, 0x1000, bootparam.E820Reserved},
+				{0x100000, 0x1000000, bootparam.E820Ram},
+			},
+		},
+		{
+			name: "unsorted",
+			entries: []entry{
+				{0x100000, 0x1000000, bootparam.E820Ram},
+				{0, bootparam.EBDAStart, bootparam.E820Ram},
+			},
+			want: bootparam.ErrorInvalidE820,
+		},
+		{
+			name: "no high memory",
+			entries: []entry{
+				{0, bootparam.EBDAStart, bootparam.E820Ram},
+			},
+			want: bootparam.ErrorInvalidE820,
+		},
+	} {
+		b := &bootparam.BootParam{}
+		for _, e := range tt.entries {
+			b.AddE820Entry(e.addr, e.size, e.typ)
+		}
+
+		if err := b.ValidateE820(); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
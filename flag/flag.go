@@ -4,22 +4,76 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
 )
 
-var ErrorInvalidSubcommands = errors.New("expected 'boot' or 'probe' subcommands")
+var ErrorInvalidSubcommands = errors.New("expected 'boot', 'validate' or 'probe' subcommands")
+
+var ErrorParamsConflict = errors.New("-p and -params-file are mutually exclusive")
+
+var ErrorInvalidTraceRange = errors.New("expected -trace-range as start-end")
+
+var ErrorInvalidName = errors.New("expected -name as a hostname of letters, digits, '-' and '.'")
+
+var ErrorRebootsNeedOneCPU = errors.New("-max-reboots needs -c 1")
 
 type BootArgs struct {
 	Kernel     string
 	MemSize    int
 	NCPUs      int
+	CPULimit   int
 	Dev        string
 	Initrd     string
 	Params     string
-	TapIfName  string
-	Disk       string
+	TapIfNames []string
+	Disk       []string
+	BlockSize  int
+	DiskSerial string
+	DiskMmap   bool
+	Rng        bool
 	TraceCount int
+	TraceStart uint64
+	TraceEnd   uint64
+	PidFile    string
+	UUID       string
+	Serial     string
+	MemInit    string
+	Exception  string
+	IRQChip    string
+	CPUModel   string
+	Name       string
+	Paused     bool
+	Debug      bool
+	Prealloc   bool
+	MemFD      bool
+	// DisableExits lets the guest idle without exiting on HLT, PAUSE,
+	// MWAIT and C-states.
+	DisableExits bool
+	// CoalescedPIO buffers writes to chatty output ports in KVM.
+	CoalescedPIO bool
+	// MSIX gives the virtio devices MSI-X.
+	MSIX bool
+	// Entry32 boots a bzImage through its 32-bit entry point.
+	Entry32 bool
+	// SerialLog is a file that also gets the guest serial output. It is
+	// rotated at SerialLogSize bytes, and SerialLogKeep old ones are kept.
+	SerialLog     string
+	SerialLogSize int
+	SerialLogKeep int
+	// Serial2 is a file that gets the output of the second serial
+	// port, ttyS1.
+	Serial2 string
+	// MaxReboots is how many times in a row a guest reset reboots the
+	// guest before gokvm gives up; 0 means a reset stops gokvm.
+	MaxReboots int
+	// CPUID holds CPUID overrides, as function:index:register:ops.
+	CPUID []string
+
+	// Validate is set for the validate subcommand, which checks the
+	// images given with the boot flags instead of booting them.
+	Validate bool
 }
 
 func parseBootArgs(args []string) (*BootArgs, error) {
@@ -39,16 +93,62 @@ func parseBootArgs(args []string) (*BootArgs, error) {
 		`virtio_pci.force_legacy=1 rdinit=/init init=/init `+
 		`gokvm.ipv4_addr=192.168.20.1/24`,
 		"kernel command-line parameters")
-	bootCmd.StringVar(&c.TapIfName, "t", "", `name of tap interface. `+
-		`If the string is an empty, no tap intarface is created. (default"")`)
-	bootCmd.StringVar(&c.Disk, "d", "", "path of disk file (for /dev/vda)")
+	paramsFile := bootCmd.String("params-file", "",
+		"path of a file holding the kernel command-line parameters, instead of -p")
+	bootCmd.Var((*stringList)(&c.TapIfNames), "t", `name of tap interface. `+
+		`Repeat for more network interfaces. If not given, no tap interface is created.`)
+	bootCmd.Var((*stringList)(&c.Disk), "d", `path of disk file, for /dev/vda. `+
+		`Repeat for more disks, which become /dev/vdb, /dev/vdc and so on.`)
+	bootCmd.Var((*stringList)(&c.CPUID), "cpuid", `change a CPUID register as function:index:register:ops, `+
+		`ops being clear=mask and set=mask separated by commas, e.g. 1:0:ecx:clear=0x40000000 to hide rdrand. `+
+		`Repeat for more changes.`)
+	bootCmd.IntVar(&c.BlockSize, "blocksize", 0,
+		"logical and physical block size of the disk advertised to the guest, e.g. 4096 for 4Kn; 0 leaves it unset")
+	bootCmd.StringVar(&c.DiskSerial, "disk-serial", "", "serial of the disk, up to 20 bytes, as seen in /dev/disk/by-id")
+	bootCmd.StringVar(&c.PidFile, "pidfile", "", "path of file to write the process id to")
+	bootCmd.StringVar(&c.UUID, "uuid", "", "system UUID reported to the guest via SMBIOS")
+	bootCmd.StringVar(&c.Serial, "smbios-serial", "", "system serial number reported to the guest via SMBIOS")
+	bootCmd.StringVar(&c.Name, "name", "",
+		"guest hostname, passed as systemd.hostname= and reported as SMBIOS product name")
+	bootCmd.StringVar(&c.SerialLog, "serial-log", "", "also write guest serial output to this file")
+	bootCmd.StringVar(&c.Serial2, "serial2", "", "write the output of the second serial port, ttyS1, to this file")
+	bootCmd.IntVar(&c.SerialLogKeep, "serial-log-keep", 3, "how many rotated serial logs to keep")
+	bootCmd.StringVar(&c.Exception, "exception", "abort",
+		"what to do when a vCPU exits on a guest exception: abort, reinject or log")
+	bootCmd.StringVar(&c.IRQChip, "irqchip", "kernel",
+		"interrupt controllers: kernel, or split for the LAPICs in the kernel and the IOAPIC in gokvm, without PICs or PIT")
+	bootCmd.StringVar(&c.CPUModel, "cpu", "kvm64",
+		"CPU model: kvm64, or host to pass through all CPU features KVM supports, including perfmon")
+	bootCmd.StringVar(&c.MemInit, "meminit", "poison",
+		"initial contents of guest memory: poison, zero, also after a reboot, or none")
+
+	bootCmd.BoolVar(&c.DiskMmap, "disk-mmap", false, "serve disk reads and writes from a memory mapping of the disk file")
+	bootCmd.BoolVar(&c.Rng, "rng", false, "add a virtio-rng device that feeds the guest entropy pool from the host")
+	bootCmd.BoolVar(&c.Debug, "debug", false, "print once a second how often the guest wrote each virtio register")
+	bootCmd.BoolVar(&c.Prealloc, "prealloc", false, "fault in all of guest memory at startup")
+	bootCmd.BoolVar(&c.MemFD, "memfd", false, "back guest memory with a memfd that other processes can map")
+	bootCmd.BoolVar(&c.DisableExits, "disable-exits", false,
+		"let the guest idle on HLT, PAUSE, MWAIT and C-states without exiting, if the host allows it")
+	bootCmd.BoolVar(&c.CoalescedPIO, "coalesce-pio", false,
+		"buffer guest writes to the VGA, POST code and debug ports in KVM, so that they cost fewer exits")
+	bootCmd.BoolVar(&c.MSIX, "msix", false, "give the virtio devices MSI-X, so that each queue interrupts on its own vector")
+	bootCmd.BoolVar(&c.Entry32, "entry32", false,
+		"boot a bzImage through its 32-bit entry point, even if it has a 64-bit one")
+	bootCmd.BoolVar(&c.Paused, "S", false, "do not start the vCPUs until the process gets SIGUSR1")
 
 	bootCmd.IntVar(&c.NCPUs, "c", 1, "number of cpus")
+	bootCmd.IntVar(&c.CPULimit, "cpu-limit", 0, "percent of a host CPU each vCPU may use; 0 means no limit")
+	bootCmd.IntVar(&c.MaxReboots, "max-reboots", 0,
+		"reboot the guest on reset, at most this many times before it reports booting; 0 stops on reset; needs -c 1")
 
 	msize := bootCmd.String("m", "1G",
 		"memory size: as number[gGmM], optional units, defaults to G")
 	tc := bootCmd.String("T", "0",
 		"how many instructions to skip between trace prints -- 0 means tracing disabled")
+	serialLogSize := bootCmd.String("serial-log-size", "10M",
+		"size at which the serial log is rotated: as number[gGmMkK], defaults to bytes")
+	traceRange := bootCmd.String("trace-range", "",
+		"only trace instructions with start <= RIP < end, given as start-end, e.g. 0x100000-0x100100")
 
 	var err error
 
@@ -56,6 +156,12 @@ func parseBootArgs(args []string) (*BootArgs, error) {
 		return nil, err
 	}
 
+	if len(*paramsFile) > 0 {
+		if c.Params, err = readParams(bootCmd, *paramsFile); err != nil {
+			return nil, err
+		}
+	}
+
 	if c.MemSize, err = ParseSize(*msize, "g"); err != nil {
 		return nil, err
 	}
@@ -64,9 +170,101 @@ func parseBootArgs(args []string) (*BootArgs, error) {
 		return nil, err
 	}
 
+	if c.SerialLogSize, err = ParseSize(*serialLogSize, ""); err != nil {
+		return nil, err
+	}
+
+	if !validName(c.Name) {
+		return nil, fmt.Errorf("%q: %w", c.Name, ErrorInvalidName)
+	}
+
+	if c.MaxReboots > 0 && c.NCPUs > 1 {
+		return nil, fmt.Errorf("-c %d: %w", c.NCPUs, ErrorRebootsNeedOneCPU)
+	}
+
+	if len(*traceRange) > 0 {
+		if c.TraceStart, c.TraceEnd, err = parseRange(*traceRange); err != nil {
+			return nil, err
+		}
+	}
+
 	return c, nil
 }
 
+// readParams reads the kernel command line from path, without the
+// trailing newline(s) an editor leaves.
+func readParams(fs *flag.FlagSet, path string) (string, error) {
+	var err error
+
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "p" {
+			err = ErrorParamsConflict
+		}
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// parseRange parses start-end, each in any base strconv accepts.
+func parseRange(s string) (uint64, uint64, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("%q: %w", s, ErrorInvalidTraceRange)
+	}
+
+	start, err := strconv.ParseUint(from, 0, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	end, err := strconv.ParseUint(to, 0, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return start, end, nil
+}
+
+// validName reports whether name can go on the kernel command line
+// as a hostname. An empty name means none.
+func validName(name string) bool {
+	if len(name) > 64 {
+		return false
+	}
+
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// stringList is a flag that may be given more than once.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+
+	return nil
+}
+
 type ProbeArgs struct{}
 
 func parseProbeArgs(args []string) (*ProbeArgs, error) {
@@ -91,6 +289,16 @@ func ParseArgs(args []string) (*BootArgs, *ProbeArgs, error) {
 
 		return conf, nil, err
 
+	case "validate":
+		conf, err := parseBootArgs(args[2:])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		conf.Validate = true
+
+		return conf, nil, nil
+
 	case "probe":
 		conf, err := parseProbeArgs(args[2:])
 
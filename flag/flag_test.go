@@ -2,6 +2,8 @@ package flag_test
 
 import (
 	"errors"
+	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
 
@@ -51,14 +53,64 @@ func TestParseBootArgs(t *testing.T) {
 		"params",
 		"-t",
 		"tap_if_name",
+		"-t",
+		"tap_if_name2",
 		"-c",
 		"2",
 		"-d",
 		"disk_path",
+		"-d",
+		"disk_path2",
 		"-m",
 		"1G",
 		"-T",
 		"1M",
+		"-pidfile",
+		"/run/gokvm.pid",
+		"-uuid",
+		"5b4e1f3a-8c2d-4e6f-9a0b-1c2d3e4f5a6b",
+		"-smbios-serial",
+		"GOKVM-0001",
+		"-meminit",
+		"zero",
+		"-S",
+		"-exception",
+		"reinject",
+		"-blocksize",
+		"4096",
+		"-disk-serial",
+		"GOKVM-DISK-0001",
+		"-disk-mmap",
+		"-rng",
+		"-irqchip",
+		"split",
+		"-debug",
+		"-prealloc",
+		"-memfd",
+		"-disable-exits",
+		"-coalesce-pio",
+		"-msix",
+		"-entry32",
+		"-cpu-limit",
+		"25",
+		"-trace-range",
+		"0x100000-0x100100",
+		"-name",
+		"web-01",
+		"-serial-log",
+		"/var/log/gokvm/serial.log",
+		"-serial-log-size",
+		"1M",
+		"-serial-log-keep",
+		"5",
+		"-serial2",
+		"/var/log/gokvm/ttyS1.log",
+		"-cpu",
+		"host",
+		"-cpuid",
+		"1:0:ecx:clear=0x40000000",
+		"-cpuid",
+		"7:0:ebx:set=0x200",
 	}
 
 	c, _, err := flag.ParseArgs(args)
@@ -82,12 +134,12 @@ func TestParseBootArgs(t *testing.T) {
 		t.Error("invalid kernel command-line parameters")
 	}
 
-	if c.TapIfName != "tap_if_name" {
+	if len(c.TapIfNames) != 2 || c.TapIfNames[0] != "tap_if_name" || c.TapIfNames[1] != "tap_if_name2" {
 		t.Error("invalid name of tap interface")
 	}
 
-	if c.Disk != "disk_path" {
-		t.Errorf("invalid path of disk file: got %v, want %v", c.Disk, "disk_path")
+	if len(c.Disk) != 2 || c.Disk[0] != "disk_path" || c.Disk[1] != "disk_path2" {
+		t.Errorf("invalid path of disk file: got %v, want %v", c.Disk, []string{"disk_path", "disk_path2"})
 	}
 
 	if c.NCPUs != 2 {
@@ -101,6 +153,107 @@ func TestParseBootArgs(t *testing.T) {
 	if c.TraceCount != 1<<20 {
 		t.Errorf("trace: got %#x, want %#x", c.TraceCount, 1<<20)
 	}
+
+	if c.PidFile != "/run/gokvm.pid" {
+		t.Errorf("pidfile: got %q, want %q", c.PidFile, "/run/gokvm.pid")
+	}
+
+	if c.UUID != "5b4e1f3a-8c2d-4e6f-9a0b-1c2d3e4f5a6b" {
+		t.Errorf("uuid: got %q", c.UUID)
+	}
+
+	if c.Serial != "GOKVM-0001" {
+		t.Errorf("smbios-serial: got %q, want %q", c.Serial, "GOKVM-0001")
+	}
+
+	if c.MemInit != "zero" {
+		t.Errorf("meminit: got %q, want %q", c.MemInit, "zero")
+	}
+
+	if !c.Paused {
+		t.Error("paused: got false, want true")
+	}
+
+	if c.Exception != "reinject" {
+		t.Errorf("exception: got %q, want %q", c.Exception, "reinject")
+	}
+
+	if c.BlockSize != 4096 {
+		t.Errorf("blocksize: got %d, want 4096", c.BlockSize)
+	}
+
+	if c.DiskSerial != "GOKVM-DISK-0001" {
+		t.Errorf("disk-serial: got %q, want %q", c.DiskSerial, "GOKVM-DISK-0001")
+	}
+
+	if !c.DiskMmap {
+		t.Error("disk-mmap: got false, want true")
+	}
+
+	if !c.Rng {
+		t.Error("rng: got false, want true")
+	}
+
+	if c.IRQChip != "split" {
+		t.Errorf("irqchip: got %q, want %q", c.IRQChip, "split")
+	}
+
+	if !c.Debug {
+		t.Error("debug: got false, want true")
+	}
+
+	if !c.Prealloc {
+		t.Error("prealloc: got false, want true")
+	}
+
+	if !c.MemFD {
+		t.Error("memfd: got false, want true")
+	}
+
+	if c.CPULimit != 25 {
+		t.Errorf("cpu-limit: got %d, want 25", c.CPULimit)
+	}
+
+	if !c.CoalescedPIO {
+		t.Error("coalesce-pio: got false, want true")
+	}
+
+	if !c.MSIX {
+		t.Error("msix: got false, want true")
+	}
+
+	if !c.Entry32 {
+		t.Error("entry32: got false, want true")
+	}
+
+	if !c.DisableExits {
+		t.Error("disable-exits: got false, want true")
+	}
+
+	if c.TraceStart != 0x100000 || c.TraceEnd != 0x100100 {
+		t.Errorf("trace-range: got %#x-%#x, want 0x100000-0x100100", c.TraceStart, c.TraceEnd)
+	}
+
+	if c.Name != "web-01" {
+		t.Errorf("name: got %q, want %q", c.Name, "web-01")
+	}
+
+	if c.SerialLog != "/var/log/gokvm/serial.log" || c.SerialLogSize != 1<<20 || c.SerialLogKeep != 5 {
+		t.Errorf("serial-log: got %q, %d, %d, want %q, %d, 5",
+			c.SerialLog, c.SerialLogSize, c.SerialLogKeep, "/var/log/gokvm/serial.log", 1<<20)
+	}
+
+	if c.Serial2 != "/var/log/gokvm/ttyS1.log" {
+		t.Errorf("serial2: got %q, want %q", c.Serial2, "/var/log/gokvm/ttyS1.log")
+	}
+
+	if c.CPUModel != "host" {
+		t.Errorf("cpu: got %q, want %q", c.CPUModel, "host")
+	}
+
+	if len(c.CPUID) != 2 || c.CPUID[0] != "1:0:ecx:clear=0x40000000" || c.CPUID[1] != "7:0:ebx:set=0x200" {
+		t.Errorf("cpuid: got %q", c.CPUID)
+	}
 }
 
 func TestParseBootArgsWithDefaults(t *testing.T) {
@@ -139,12 +292,12 @@ func TestParseBootArgsWithDefaults(t *testing.T) {
 		t.Error("invalid kernel command-line parameters")
 	}
 
-	if c.TapIfName != "" {
+	if len(c.TapIfNames) != 0 {
 		t.Error("invalid name of tap interface")
 	}
 
-	if c.Disk != "" {
-		t.Errorf("invalid path of disk file: got %v, want %v", c.Disk, "disk_path")
+	if len(c.Disk) != 0 {
+		t.Errorf("invalid path of disk file: got %v, want none", c.Disk)
 	}
 
 	if c.NCPUs != 1 {
@@ -158,6 +311,93 @@ func TestParseBootArgsWithDefaults(t *testing.T) {
 	if c.TraceCount != 0 {
 		t.Errorf("trace: got %#x, want %#x", c.TraceCount, 1<<20)
 	}
+
+	if c.MemInit != "poison" {
+		t.Errorf("meminit: got %q, want %q", c.MemInit, "poison")
+	}
+
+	if c.Exception != "abort" {
+		t.Errorf("exception: got %q, want %q", c.Exception, "abort")
+	}
+
+	if c.IRQChip != "kernel" {
+		t.Errorf("irqchip: got %q, want %q", c.IRQChip, "kernel")
+	}
+}
+
+func TestParseBootArgsParamsFile(t *testing.T) {
+	t.Parallel()
+
+	want := `console=ttyS0 earlyprintk=serial dyndbg="file drivers/net/virtio_net.c +plf"`
+	path := filepath.Join(t.TempDir(), "cmdline")
+
+	if err := os.WriteFile(path, []byte(want+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, _, err := flag.ParseArgs([]string{"gokvm", "boot", "-params-file", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Params != want {
+		t.Errorf("params: got %q, want %q", c.Params, want)
+	}
+
+	_, _, err = flag.ParseArgs([]string{"gokvm", "boot", "-p", "quiet", "-params-file", path})
+	if !errors.Is(err, flag.ErrorParamsConflict) {
+		t.Errorf("-p with -params-file: got %v, want %v", err, flag.ErrorParamsConflict)
+	}
+}
+
+func TestParseBootArgsBadTraceRange(t *testing.T) {
+	t.Parallel()
+
+	_, _, err := flag.ParseArgs([]string{"gokvm", "boot", "-trace-range", "0x100000"})
+	if !errors.Is(err, flag.ErrorInvalidTraceRange) {
+		t.Errorf("got %v, want %v", err, flag.ErrorInvalidTraceRange)
+	}
+}
+
+func TestParseBootArgsBadName(t *testing.T) {
+	t.Parallel()
+
+	_, _, err := flag.ParseArgs([]string{"gokvm", "boot", "-name", "web 01"})
+	if !errors.Is(err, flag.ErrorInvalidName) {
+		t.Errorf("got %v, want %v", err, flag.ErrorInvalidName)
+	}
+}
+
+func TestParseBootArgsMaxReboots(t *testing.T) {
+	t.Parallel()
+
+	c, _, err := flag.ParseArgs([]string{"gokvm", "boot", "-max-reboots", "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.MaxReboots != 3 {
+		t.Errorf("max-reboots: got %d, want 3", c.MaxReboots)
+	}
+
+	_, _, err = flag.ParseArgs([]string{"gokvm", "boot", "-c", "2", "-max-reboots", "3"})
+	if !errors.Is(err, flag.ErrorRebootsNeedOneCPU) {
+		t.Errorf("got %v, want %v", err, flag.ErrorRebootsNeedOneCPU)
+	}
+}
+
+func TestParseValidateArgs(t *testing.T) {
+	t.Parallel()
+
+	c, _, err := flag.ParseArgs([]string{"gokvm", "validate", "-k", "kernel_path", "-d", "disk_path"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.Validate || c.Kernel != "kernel_path" || len(c.Disk) != 1 || c.Disk[0] != "disk_path" {
+		t.Errorf("got validate %v, kernel %q, disk %q, want true, %q, %q", c.Validate, c.Kernel, c.Disk,
+			"kernel_path", "disk_path")
+	}
 }
 
 func TestParseProbeArgs(t *testing.T) {
@@ -7,6 +7,8 @@ import (
 
 type ACPIPMTimer struct {
 	Start time.Time
+	// Clock supplies the elapsed time; nil means the host clock.
+	Clock Clock
 }
 
 const (
@@ -15,8 +17,14 @@ const (
 )
 
 func NewACPIPMTimer() *ACPIPMTimer {
+	return NewACPIPMTimerWithClock(nil)
+}
+
+// NewACPIPMTimerWithClock returns a PM timer counting from c's now.
+func NewACPIPMTimerWithClock(c Clock) *ACPIPMTimer {
 	return &ACPIPMTimer{
-		Start: time.Now(),
+		Start: now(c),
+		Clock: c,
 	}
 }
 
@@ -25,7 +33,7 @@ func (a *ACPIPMTimer) Read(base uint64, data []byte) error {
 		return errDataLenInvalid
 	}
 
-	since := time.Since(a.Start)
+	since := now(a.Clock).Sub(a.Start)
 	nanos := since.Nanoseconds()
 	counter := (nanos * int64(pmTimerFreqHz)) / int64(nanosPerSecond)
 	counter32 := uint32(counter & 0xFFFF_FFFF)
@@ -1,14 +1,19 @@
 package iodev
 
-import "log"
+import (
+	"errors"
+	"fmt"
+	"log"
+)
 
 // This device is used by EDK2/CloudHv to let the host know about a shutdown.
-// No implementation of handling the event on host side yet.
 // See: https://github.com/cloud-hypervisor/edk2/blob/ch/OvmfPkg/Include/IndustryStandard/CloudHv.h
 
+// ErrGuestPoweroff indicates the guest put itself in S5, soft off.
+var ErrGuestPoweroff = errors.New("guest powered off")
+
 type ACPIShutDown struct {
 	Port uint64
-	// ExitEvent  chan int
 	// ResetEvent chan int
 }
 
@@ -34,8 +39,7 @@ func (a *ACPIShutDown) Write(base uint64, data []byte) error {
 	SleepValBit := uint8(2)
 
 	if data[0] == (S5SleepVal<<SleepValBit)|(1<<SleepStatusENBit) {
-		// a.ExitEvent <- 1
-		log.Println("ACPI Shutdown signalled")
+		return fmt.Errorf("write %#x to ACPI shutdown: %w", data[0], ErrGuestPoweroff)
 	}
 
 	return nil
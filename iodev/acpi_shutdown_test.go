@@ -0,0 +1,30 @@
+package iodev_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/iodev"
+)
+
+func TestACPIShutDownWrite(t *testing.T) {
+	t.Parallel()
+
+	a := iodev.NewACPIShutDownEvent()
+
+	for _, tt := range []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{name: "S5", data: []byte{0x34}, want: iodev.ErrGuestPoweroff},
+		{name: "S5 as a word", data: []byte{0x34, 0x00}, want: iodev.ErrGuestPoweroff},
+		{name: "S5 without SLP_EN", data: []byte{0x14}},
+		{name: "S3", data: []byte{0x2c}},
+		{name: "reboot", data: []byte{0x01}},
+	} {
+		if err := a.Write(a.IOPort(), tt.data); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package iodev
+
+import "time"
+
+// Clock tells devices that model wall clock or elapsed time what time it
+// is, so that tests can control it.
+type Clock interface {
+	Now() time.Time
+}
+
+// RealClock is the host's clock.
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// now returns c.Now(), or the host time if c is nil.
+func now(c Clock) time.Time {
+	if c == nil {
+		return time.Now()
+	}
+
+	return c.Now()
+}
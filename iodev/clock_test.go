@@ -0,0 +1,68 @@
+package iodev_test
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/iodev"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.t
+}
+
+func TestCMOSClock(t *testing.T) {
+	t.Parallel()
+
+	clk := &fakeClock{t: time.Date(2024, 2, 29, 23, 59, 58, 0, time.UTC)}
+	c := iodev.NewCMOS(0xC000_0000, 0x0)
+	c.Clock = clk
+
+	read := func(index byte) byte {
+		t.Helper()
+
+		if err := c.Write(0x70, []byte{index}); err != nil {
+			t.Fatal(err)
+		}
+
+		b := []byte{0}
+		if err := c.Read(0x71, b); err != nil {
+			t.Fatal(err)
+		}
+
+		return b[0]
+	}
+
+	if s, m := read(0x00), read(0x02); s != 0x58 || m != 0x59 {
+		t.Fatalf("seconds, minutes: got %#x, %#x, want 0x58, 0x59", s, m)
+	}
+
+	clk.t = clk.t.Add(3 * time.Second)
+
+	if s, d, mon := read(0x00), read(0x07), read(0x08); s != 0x01 || d != 0x01 || mon != 0x03 {
+		t.Fatalf("after 3s: seconds, day, month: got %#x, %#x, %#x, want 0x01, 0x01, 0x03", s, d, mon)
+	}
+}
+
+func TestACPIPMTimerClock(t *testing.T) {
+	t.Parallel()
+
+	clk := &fakeClock{t: time.Unix(1_000_000, 0)}
+	p := iodev.NewACPIPMTimerWithClock(clk)
+
+	b := make([]byte, 4)
+	if err := p.Read(p.IOPort(), b); err != nil || binary.LittleEndian.Uint32(b) != 0 {
+		t.Fatalf("at start: got (%d, %v), want (0, nil)", binary.LittleEndian.Uint32(b), err)
+	}
+
+	clk.t = clk.t.Add(time.Second)
+
+	if err := p.Read(p.IOPort(), b); err != nil || binary.LittleEndian.Uint32(b) != 3_579_545 {
+		t.Fatalf("after 1s: got (%d, %v), want (3579545, nil)", binary.LittleEndian.Uint32(b), err)
+	}
+}
@@ -1,9 +1,5 @@
 package iodev
 
-import (
-	"time"
-)
-
 const (
 	indexMask   = uint8(0x7F)
 	indexOffset = uint64(0x70)
@@ -14,6 +10,8 @@ const (
 type CMOS struct {
 	Index uint8
 	Data  []uint8
+	// Clock supplies the RTC time; nil means the host clock.
+	Clock Clock
 }
 
 func NewCMOS(memBelow4G, memAbove4G uint64) *CMOS {
@@ -51,7 +49,7 @@ func (c *CMOS) Read(base uint64, data []byte) error {
 	case indexOffset:
 		data[0] = c.Index
 	case dataOffset:
-		dt := time.Now()
+		dt := now(c.Clock)
 		secs := dt.Second()
 		min := dt.Minute()
 		hour := dt.Hour()
@@ -104,18 +102,23 @@ func (c *CMOS) Write(base uint64, data []byte) error {
 	case indexOffset:
 		c.Index = data[0]
 	case dataOffset:
-		if c.Index == 0x8F && data[0] == 0 {
-			// CMOS reset - we ignore for now
-		} else {
-			c.Data[c.Index&indexMask] = data[0]
-		}
+		// Bit 7 of the index only masks NMIs, so e.g. Linux writing its
+		// shutdown status through index 0x8f lands in register 0x0f.
+		c.Data[c.Index&indexMask] = data[0]
 	}
 
 	return nil
 }
 
+// Reset clears the index register. CMOS RAM is battery backed, so its
+// contents, including the shutdown status byte at 0x0f that tells the
+// guest what kind of reset happened, survive a reset.
+func (c *CMOS) Reset() {
+	c.Index = 0
+}
+
 func toBCD(v uint8) uint8 {
-	return ((v / 100) << 4) | (v % 10)
+	return ((v / 10) << 4) | (v % 10)
 }
 
 func (c *CMOS) IOPort() uint64 {
@@ -0,0 +1,46 @@
+package iodev_test
+
+import (
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/iodev"
+)
+
+func TestCMOSShutdownStatusSurvivesReset(t *testing.T) {
+	t.Parallel()
+
+	c := iodev.NewCMOS(0xC000_0000, 0x0)
+
+	// Select the shutdown status register with NMIs disabled,
+	// the way Linux does before a reset, and write a warm boot code.
+	for _, w := range []struct {
+		port uint64
+		data byte
+	}{
+		{port: 0x70, data: 0x8f},
+		{port: 0x71, data: 0x0a},
+	} {
+		if err := c.Write(w.port, []byte{w.data}); err != nil {
+			t.Fatalf("Write(%#x, %#x): got %v, want nil", w.port, w.data, err)
+		}
+	}
+
+	c.Reset()
+
+	if c.Index != 0 {
+		t.Errorf("Index after Reset: got %#x, want 0", c.Index)
+	}
+
+	if err := c.Write(0x70, []byte{0x0f}); err != nil {
+		t.Fatalf("Write(0x70, 0x0f): got %v, want nil", err)
+	}
+
+	b := []byte{0}
+	if err := c.Read(0x71, b); err != nil {
+		t.Fatalf("Read(0x71): got %v, want nil", err)
+	}
+
+	if b[0] != 0x0a {
+		t.Errorf("shutdown status: got %#x, want %#x", b[0], 0x0a)
+	}
+}
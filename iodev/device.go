@@ -13,3 +13,9 @@ type Device interface {
 	IOPort() uint64
 	Size() uint64
 }
+
+// Resetter is implemented by devices that have state to restore
+// when the machine is reset.
+type Resetter interface {
+	Reset()
+}
@@ -0,0 +1,65 @@
+package iodev
+
+// GuestStatusPort is where the guest reports how far it got, by
+// writing a GuestStatusCode byte, e.g. from init:
+//
+//	printf '\2' | dd of=/dev/port bs=1 seek=$((0x4f0)) 2>/dev/null
+//
+// Reading the port returns GuestStatusMagic, so the guest can check
+// that it runs on gokvm before writing.
+const GuestStatusPort = 0x4f0
+
+// GuestStatusMagic is what the guest reads from GuestStatusPort.
+const GuestStatusMagic = 0x5a
+
+// GuestStatusCode is a status reported by the guest.
+type GuestStatusCode uint8
+
+const (
+	// GuestBooted means the kernel has started userspace.
+	GuestBooted GuestStatusCode = 1
+	// GuestReady means the workload is up, e.g. init has finished.
+	GuestReady GuestStatusCode = 2
+	// GuestPanic means the guest is going down on an error.
+	GuestPanic GuestStatusCode = 3
+)
+
+// GuestStatus passes the codes written to GuestStatusPort to Notify.
+// Other values are ignored, so new codes can be added without
+// breaking older hosts.
+type GuestStatus struct {
+	Notify func(GuestStatusCode)
+}
+
+func (g *GuestStatus) Read(port uint64, data []byte) error {
+	if len(data) != 1 {
+		return errDataLenInvalid
+	}
+
+	data[0] = GuestStatusMagic
+
+	return nil
+}
+
+func (g *GuestStatus) Write(port uint64, data []byte) error {
+	if len(data) != 1 {
+		return errDataLenInvalid
+	}
+
+	switch c := GuestStatusCode(data[0]); c {
+	case GuestBooted, GuestReady, GuestPanic:
+		if g.Notify != nil {
+			g.Notify(c)
+		}
+	}
+
+	return nil
+}
+
+func (g *GuestStatus) IOPort() uint64 {
+	return GuestStatusPort
+}
+
+func (g *GuestStatus) Size() uint64 {
+	return 0x1
+}
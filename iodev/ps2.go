@@ -0,0 +1,106 @@
+package iodev
+
+import "sync"
+
+const (
+	ps2DataPort    = 0x60
+	ps2CommandPort = 0x64
+
+	// ps2Status is what a read of the controller returns with nothing queued.
+	ps2Status = 0x20
+	// ps2StatusOutputFull tells the guest a byte waits at the data port.
+	ps2StatusOutputFull = 0x01
+
+	// ps2CmdPulseReset pulses the CPU reset line low.
+	ps2CmdPulseReset = 0xfe
+
+	// ps2QueueSize bounds the scancodes queued for the guest;
+	// further keys are dropped, much like a real keyboard's buffer.
+	ps2QueueSize = 16
+)
+
+// PS2 is a minimal 8042 PS/2 controller.
+//
+// In ubuntu 20.04 on wsl2, the output to IO port 0x64 continued
+// infinitely. To deal with this issue, refer to kvmtool and
+// configure the input to the Status Register of the PS2 controller.
+//
+// Scancodes queued with SendKey are handed out one at a time at the
+// data port, and IRQ is called for each of them.
+//
+// refs:
+// https://github.com/kvmtool/kvmtool/blob/0e1882a49f81cb15d328ef83a78849c0ea26eecc/hw/i8042.c#L312
+// https://git.kernel.org/pub/scm/linux/kernel/git/will/kvmtool.git/tree/hw/i8042.c#n312
+// https://wiki.osdev.org/%228042%22_PS/2_Controller
+type PS2 struct {
+	// Reset is called when the guest pulses the reset line
+	// by writing 0xfe to the command port.
+	Reset func() error
+	// IRQ raises IRQ 1; nil means the guest has to poll.
+	IRQ func() error
+
+	mu    sync.Mutex
+	queue []byte
+}
+
+func NewPS2(reset func() error) *PS2 {
+	return &PS2{
+		Reset: reset,
+	}
+}
+
+// SendKey queues a scancode for the guest and raises IRQ.
+// A full queue drops the scancode.
+func (p *PS2) SendKey(scancode byte) error {
+	p.mu.Lock()
+	if len(p.queue) >= ps2QueueSize {
+		p.mu.Unlock()
+
+		return nil
+	}
+
+	p.queue = append(p.queue, scancode)
+	p.mu.Unlock()
+
+	if p.IRQ == nil {
+		return nil
+	}
+
+	return p.IRQ()
+}
+
+func (p *PS2) Read(port uint64, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch {
+	case port == ps2DataPort && len(p.queue) > 0:
+		data[0] = p.queue[0]
+		p.queue = p.queue[1:]
+	case port == ps2DataPort:
+		data[0] = 0
+	case len(p.queue) > 0:
+		// Bit 5 would mark the byte as coming from the mouse.
+		data[0] = ps2StatusOutputFull
+	default:
+		data[0] = ps2Status
+	}
+
+	return nil
+}
+
+func (p *PS2) Write(port uint64, data []byte) error {
+	if port == ps2CommandPort && len(data) == 1 && data[0] == ps2CmdPulseReset && p.Reset != nil {
+		return p.Reset()
+	}
+
+	return nil
+}
+
+func (p *PS2) IOPort() uint64 {
+	return ps2DataPort
+}
+
+func (p *PS2) Size() uint64 {
+	return 0x10
+}
@@ -0,0 +1,103 @@
+package iodev_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/iodev"
+)
+
+var errReset = errors.New("reset")
+
+func TestPS2Reset(t *testing.T) {
+	t.Parallel()
+
+	called := 0
+	p := iodev.NewPS2(func() error {
+		called++
+
+		return errReset
+	})
+
+	if err := p.Write(0x64, []byte{0xfe}); !errors.Is(err, errReset) {
+		t.Fatalf("Write(0x64, 0xfe): got %v, want %v", err, errReset)
+	}
+
+	if called != 1 {
+		t.Fatalf("reset called %d times, want 1", called)
+	}
+
+	// Other commands and the data port must not reset.
+	for _, tt := range []struct {
+		port uint64
+		data byte
+	}{
+		{port: 0x64, data: 0xad},
+		{port: 0x60, data: 0xfe},
+	} {
+		if err := p.Write(tt.port, []byte{tt.data}); err != nil {
+			t.Errorf("Write(%#x, %#x): got %v, want nil", tt.port, tt.data, err)
+		}
+	}
+
+	if called != 1 {
+		t.Fatalf("reset called %d times, want 1", called)
+	}
+}
+
+func TestPS2Status(t *testing.T) {
+	t.Parallel()
+
+	p := iodev.NewPS2(nil)
+	b := []byte{0}
+
+	if err := p.Read(0x64, b); err != nil {
+		t.Fatalf("Read(0x64): got %v, want nil", err)
+	}
+
+	if b[0] != 0x20 {
+		t.Errorf("status: got %#x, want %#x", b[0], 0x20)
+	}
+
+	if err := p.Write(0x64, []byte{0xfe}); err != nil {
+		t.Errorf("Write(0x64, 0xfe) without reset func: got %v, want nil", err)
+	}
+}
+
+func TestPS2SendKey(t *testing.T) {
+	t.Parallel()
+
+	irqs := 0
+	p := iodev.NewPS2(nil)
+	p.IRQ = func() error {
+		irqs++
+
+		return nil
+	}
+
+	for _, sc := range []byte{0x1e, 0x9e} {
+		if err := p.SendKey(sc); err != nil {
+			t.Fatalf("SendKey(%#x): got %v, want nil", sc, err)
+		}
+	}
+
+	if irqs != 2 {
+		t.Errorf("IRQ called %d times, want 2", irqs)
+	}
+
+	b := []byte{0}
+
+	for _, want := range []byte{0x1e, 0x9e} {
+		if err := p.Read(0x64, b); err != nil || b[0] != 0x01 {
+			t.Fatalf("status: got (%#x, %v), want (0x1, nil)", b[0], err)
+		}
+
+		if err := p.Read(0x60, b); err != nil || b[0] != want {
+			t.Fatalf("data: got (%#x, %v), want (%#x, nil)", b[0], err, want)
+		}
+	}
+
+	if err := p.Read(0x64, b); err != nil || b[0] != 0x20 {
+		t.Errorf("status when empty: got (%#x, %v), want (0x20, nil)", b[0], err)
+	}
+}
@@ -1,5 +1,7 @@
 package kvm
 
+import "unsafe"
+
 // Capability is a virtual machine capability type.
 //
 //go:generate stringer -type=Capability
@@ -229,3 +231,31 @@ const (
 func CheckExtension(kvmfd uintptr, c Capability) (uintptr, error) {
 	return Ioctl(kvmfd, IIO(kvmCheckExtension), uintptr(c))
 }
+
+// Exits that CapX86DisableExits can leave to the guest, so the vCPU
+// idles in guest mode instead of exiting to KVM.
+const (
+	X86DisableExitsMWait  = 1 << 0
+	X86DisableExitsHLT    = 1 << 1
+	X86DisableExitsPause  = 1 << 2
+	X86DisableExitsCState = 1 << 3
+)
+
+type enableCap struct {
+	Cap   uint32
+	Flags uint32
+	Args  [4]uint64
+	_     [64]uint8
+}
+
+// EnableCap enables a capability on a VM or vCPU fd, with up to four args.
+func EnableCap(fd uintptr, c Capability, args ...uint64) error {
+	ec := enableCap{Cap: uint32(c)}
+	copy(ec.Args[:], args)
+
+	_, err := Ioctl(fd,
+		IIOW(kvmEnableCap, unsafe.Sizeof(ec)),
+		uintptr(unsafe.Pointer(&ec)))
+
+	return err
+}
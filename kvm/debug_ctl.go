@@ -3,7 +3,7 @@ package kvm
 import "unsafe"
 
 // debugControl controls guest debug.
-type debugControl struct { // nolint:unused
+type debugControl struct {
 	Control  uint32
 	_        uint32
 	DebugReg [8]uint64
@@ -36,3 +36,25 @@ func SingleStep(vmFd uintptr, onoff bool) error {
 
 	return err
 }
+
+// Guest debug control bits for SetGuestDebug.
+const (
+	GuestDebugEnable     = 1
+	GuestDebugSingleStep = 2
+	// GuestDebugUseHWBP makes the debug registers passed to
+	// SetGuestDebug take effect, instead of the guest's own.
+	GuestDebugUseHWBP = 0x20000
+)
+
+// SetGuestDebug sets the guest debug control of a vCPU. debugRegs are
+// DR0-DR7, and only used with GuestDebugUseHWBP.
+func SetGuestDebug(vcpuFd uintptr, control uint32, debugRegs [8]uint64) error {
+	debug := debugControl{
+		Control:  control,
+		DebugReg: debugRegs,
+	}
+
+	_, err := Ioctl(vcpuFd, IIOW(0x9b, unsafe.Sizeof(debugControl{})), uintptr(unsafe.Pointer(&debug)))
+
+	return err
+}
@@ -26,15 +26,28 @@ func _() {
 	_ = x[EXITDCR-15]
 	_ = x[EXITNMI-16]
 	_ = x[EXITINTERNALERROR-17]
+	_ = x[EXITX86RDMSR-29]
+	_ = x[EXITX86WRMSR-30]
 }
 
-const _ExitType_name = "EXITUNKNOWNEXITEXCEPTIONEXITIOEXITHYPERCALLEXITDEBUGEXITHLTEXITMMIOEXITIRQWINDOWOPENEXITSHUTDOWNEXITFAILENTRYEXITINTREXITSETTPREXITTPRACCESSEXITS390SIEICEXITS390RESETEXITDCREXITNMIEXITINTERNALERROR"
+const (
+	_ExitType_name_0 = "EXITUNKNOWNEXITEXCEPTIONEXITIOEXITHYPERCALLEXITDEBUGEXITHLTEXITMMIOEXITIRQWINDOWOPENEXITSHUTDOWNEXITFAILENTRYEXITINTREXITSETTPREXITTPRACCESSEXITS390SIEICEXITS390RESETEXITDCREXITNMIEXITINTERNALERROR"
+	_ExitType_name_1 = "EXITX86RDMSREXITX86WRMSR"
+)
 
-var _ExitType_index = [...]uint8{0, 11, 24, 30, 43, 52, 59, 67, 84, 96, 109, 117, 127, 140, 153, 166, 173, 180, 197}
+var (
+	_ExitType_index_0 = [...]uint8{0, 11, 24, 30, 43, 52, 59, 67, 84, 96, 109, 117, 127, 140, 153, 166, 173, 180, 197}
+	_ExitType_index_1 = [...]uint8{0, 12, 24}
+)
 
 func (i ExitType) String() string {
-	if i >= ExitType(len(_ExitType_index)-1) {
+	switch {
+	case i <= 17:
+		return _ExitType_name_0[_ExitType_index_0[i]:_ExitType_index_0[i+1]]
+	case 29 <= i && i <= 30:
+		i -= 29
+		return _ExitType_name_1[_ExitType_index_1[i]:_ExitType_index_1[i+1]]
+	default:
 		return "ExitType(" + strconv.FormatInt(int64(i), 10) + ")"
 	}
-	return _ExitType_name[_ExitType_index[i]:_ExitType_index[i+1]]
 }
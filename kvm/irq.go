@@ -142,12 +142,63 @@ type IRQRoutingIRQChip struct {
 	Pin     uint32
 }
 
+const (
+	IRQRoutingTypeIRQChip = 1
+	IRQRoutingTypeMSI     = 2
+)
+
 type IRQRoutingEntry struct {
 	GSI   uint32
 	Type  uint32
 	Flags uint32
 	_     uint32
 	IRQRoutingIRQChip
+	// The rest of the 32-byte union. An MSI route keeps its data in Pad[0].
+	Pad [6]uint32
+}
+
+// NewMSIRoutingEntry routes gsi to a message signalled interrupt.
+func NewMSIRoutingEntry(gsi uint32, addr uint64, data uint32) IRQRoutingEntry {
+	return IRQRoutingEntry{
+		GSI:  gsi,
+		Type: IRQRoutingTypeMSI,
+		IRQRoutingIRQChip: IRQRoutingIRQChip{
+			IRQChip: uint32(addr),       // address_lo
+			Pin:     uint32(addr >> 32), // address_hi
+		},
+		Pad: [6]uint32{data},
+	}
+}
+
+// MSI is a message signaled interrupt: data written to address.
+type MSI struct {
+	AddressLo uint32
+	AddressHi uint32
+	Data      uint32
+	Flags     uint32
+	DevID     uint32
+	_         [12]uint8
+}
+
+// ErrMSIBlocked is returned by SignalMSI when the guest blocked the
+// interrupt, e.g. because its LAPIC is disabled.
+var ErrMSIBlocked = errors.New("MSI blocked by the guest")
+
+// SignalMSI injects an MSI directly, without a GSI route. It needs
+// KVM_CAP_SIGNAL_MSI and an in-kernel LAPIC.
+func SignalMSI(vmFd uintptr, msi *MSI) error {
+	ret, err := Ioctl(vmFd,
+		IIOW(kvmSignalMSI, unsafe.Sizeof(MSI{})),
+		uintptr(unsafe.Pointer(msi)))
+	if err != nil {
+		return err
+	}
+
+	if ret == 0 {
+		return ErrMSIBlocked
+	}
+
+	return nil
 }
 
 type IRQRouting struct {
@@ -2,6 +2,7 @@ package kvm
 
 import (
 	"errors"
+	"fmt"
 	"syscall"
 	"unsafe"
 )
@@ -51,6 +52,9 @@ const (
 	kvmGetMSRS = 0x88
 	kvmSetMSRS = 0x89
 
+	kvmGetFPU = 0x8c
+	kvmSetFPU = 0x8d
+
 	kvmGetLAPIC = 0x8e
 	kvmSetLAPIC = 0x8f
 
@@ -76,11 +80,17 @@ const (
 	kvmSetTSCKHz = 0xA2
 	kvmGetTSCKHz = 0xA3
 
+	kvmEnableCap = 0xA3
+
+	kvmSignalMSI = 0xA5
+
 	kvmGetXCRS = 0xA6
 	kvmSetXCRS = 0xA7
 
 	kvmSMI = 0xB7
 
+	kvmX86SetMSRFilter = 0xC6
+
 	kvmGetSRegs2 = 0xCC
 	kvmSetSRegs2 = 0xCD
 
@@ -111,6 +121,8 @@ const (
 	EXITDCR           ExitType = 15
 	EXITNMI           ExitType = 16
 	EXITINTERNALERROR ExitType = 17
+	EXITX86RDMSR      ExitType = 29
+	EXITX86WRMSR      ExitType = 30
 
 	EXITIOIN  = 0
 	EXITIOOUT = 1
@@ -121,6 +133,11 @@ const (
 	CPUIDFeatures   = 0x40000001
 	CPUIDSignature  = 0x40000000
 	CPUIDFuncPerMon = 0x0A
+	CPUIDFuncInfo   = 0x01
+
+	// CPUIDInfoECXTSCDeadline is the TSC-deadline LAPIC timer bit of
+	// CPUIDFuncInfo ECX.
+	CPUIDInfoECXTSCDeadline = 1 << 24
 )
 
 var (
@@ -156,6 +173,78 @@ func (r *RunData) IO() (uint64, uint64, uint64, uint64, uint64) {
 	return direction, size, port, count, offset
 }
 
+// Exception interprets a KVM_EXIT_EXCEPTION, by unpacking RunData.Data[0].
+// It returns the exception vector and error code.
+func (r *RunData) Exception() (uint32, uint32) {
+	return uint32(r.Data[0]), uint32(r.Data[0] >> 32)
+}
+
+// MSR interprets a KVM_EXIT_X86_RDMSR or KVM_EXIT_X86_WRMSR, by unpacking
+// RunData.Data[1:3]. It returns the MSR index and, for a write, the value.
+func (r *RunData) MSR() (uint32, uint64) {
+	return uint32(r.Data[1] >> 32), r.Data[2]
+}
+
+// CompleteMSR completes a MSR exit: a read returns data, and if fault is
+// set the guest gets a #GP instead.
+func (r *RunData) CompleteMSR(data uint64, fault bool) {
+	r.Data[0] = 0
+	if fault {
+		r.Data[0] = 1
+	}
+
+	r.Data[2] = data
+}
+
+// MMIO interprets a KVM_EXIT_MMIO, by unpacking RunData.Data[0:3].
+// It returns the guest physical address, the data, which a read must
+// fill in, and whether the access is a write.
+func (r *RunData) MMIO() (uint64, []byte, bool) {
+	size := uint32(r.Data[2])
+	if size > 8 {
+		size = 8
+	}
+
+	data := unsafe.Slice((*byte)(unsafe.Pointer(&r.Data[1])), size)
+
+	return r.Data[0], data, (r.Data[2]>>32)&0xff != 0
+}
+
+// VT-x basic exit reasons seen as hardware entry failure reasons,
+// see Intel SDM Vol. 3, Appendix C.
+// On AMD, KVM reports SVM_EXIT_ERR, i.e. -1, instead.
+var failEntryReasons = map[uint64]string{
+	33:                 "invalid guest state",
+	34:                 "MSR loading",
+	41:                 "machine-check event",
+	0xffffffffffffffff: "invalid VMCB (SVM_EXIT_ERR)",
+}
+
+// FailEntry interprets a KVM_EXIT_FAIL_ENTRY, by unpacking RunData.Data[0:1].
+// It returns the hardware entry failure reason and the host cpu.
+func (r *RunData) FailEntry() (uint64, uint32) {
+	return r.Data[0], uint32(r.Data[1])
+}
+
+// FailEntryError returns an error describing why the guest could not
+// be entered.
+func (r *RunData) FailEntryError() error {
+	reason, cpu := r.FailEntry()
+
+	desc, ok := failEntryReasons[reason]
+	if !ok {
+		// VT-x sets bit 31 to flag an entry failure.
+		desc, ok = failEntryReasons[reason&0xffff]
+	}
+
+	if !ok {
+		desc = "unknown reason"
+	}
+
+	return fmt.Errorf("%w: EXITFAILENTRY: %s (hardware reason %#x, host cpu %d)",
+		ErrUnexpectedExitReason, desc, reason, cpu)
+}
+
 // GetAPIVersion gets the qemu API version, which changes rarely if at all.
 func GetAPIVersion(kvmFd uintptr) (uintptr, error) {
 	return Ioctl(kvmFd, IIO(kvmGetAPIVersion), uintptr(0))
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"math"
 	"os"
+	"strings"
 	"syscall"
 	"testing"
 	"unsafe"
@@ -563,6 +564,64 @@ func TestCoalescedMMIO(t *testing.T) {
 	}
 }
 
+func TestCoalescedPIO(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	if ok, err := kvm.CheckExtension(devKVM.Fd(), kvm.CapCoalescedPIO); err != nil || ok == 0 {
+		t.Skipf("KVM_CAP_COALESCED_PIO is not supported")
+	}
+
+	vmFd, err := kvm.CreateVM(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kvm.RegisterCoalescedPIO(vmFd, 0x402, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kvm.UnregisterCoalescedPIO(vmFd, 0x402, 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCoalescedRingDrain(t *testing.T) {
+	t.Parallel()
+
+	r := &kvm.CoalescedRing{}
+
+	for i, b := range []byte{'a', 'b', 'c'} {
+		r.Entries[i] = kvm.CoalescedEntry{Addr: 0x402, Len: 1, PIO: 1, Data: [8]byte{b}}
+	}
+
+	r.Last = 3
+
+	var got []byte
+
+	if err := r.Drain(func(e *kvm.CoalescedEntry) error {
+		got = append(got, e.Data[:e.Len]...)
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != "abc" || r.First != r.Last {
+		t.Errorf("got %q with first %d, last %d, want \"abc\" with first == last", got, r.First, r.Last)
+	}
+}
+
 func TestSetNrMMUPages(t *testing.T) {
 	if os.Getuid() != 0 {
 		t.Skipf("Skipping test since we are not root")
@@ -1093,6 +1152,11 @@ func TestGetSetMPState(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	// States other than runnable need the LAPIC in the kernel.
+	if err := kvm.CreateIRQChip(vmFd); err != nil {
+		t.Fatal(err)
+	}
+
 	vcpuFd, err := kvm.CreateVCPU(vmFd, 0)
 	if err != nil {
 		t.Fatal(err)
@@ -1111,13 +1175,30 @@ func TestGetSetMPState(t *testing.T) {
 		State: kvm.MPStateUninitialized,
 	}
 
+	// vCPU 0 is the BSP, which starts out runnable.
 	if err := kvm.GetMPState(vcpuFd, mps); err != nil {
 		t.Fatal(err)
 	}
 
+	if mps.State != kvm.MPStateRunnable {
+		t.Errorf("GetMPState: got %d, want %d", mps.State, kvm.MPStateRunnable)
+	}
+
+	mps.State = kvm.MPStateHalted
+
 	if err := kvm.SetMPState(vcpuFd, mps); err != nil {
 		t.Fatal(err)
 	}
+
+	mps.State = kvm.MPStateRunnable
+
+	if err := kvm.GetMPState(vcpuFd, mps); err != nil {
+		t.Fatal(err)
+	}
+
+	if mps.State != kvm.MPStateHalted {
+		t.Errorf("GetMPState after SetMPState: got %d, want %d", mps.State, kvm.MPStateHalted)
+	}
 }
 
 func TestX86MCE(t *testing.T) {
@@ -1254,6 +1335,59 @@ func TestGetSetDebugRegs(t *testing.T) {
 	}
 }
 
+func TestGetSetFPU(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	vmFd, err := kvm.CreateVM(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vcpuFd, err := kvm.CreateVCPU(vmFd, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if unsafe.Sizeof(kvm.FPU{}) != 416 {
+		t.Fatalf("sizeof FPU: got %d, want 416", unsafe.Sizeof(kvm.FPU{}))
+	}
+
+	fpu := &kvm.FPU{}
+	if err := kvm.GetFPU(vcpuFd, fpu); err != nil {
+		t.Fatal(err)
+	}
+
+	if fpu.FCW != 0x37f {
+		t.Errorf("FCW after creation: got %#x, want 0x37f", fpu.FCW)
+	}
+
+	fpu.FCW = 0x27f // double precision
+
+	if err := kvm.SetFPU(vcpuFd, fpu); err != nil {
+		t.Fatal(err)
+	}
+
+	got := &kvm.FPU{}
+	if err := kvm.GetFPU(vcpuFd, got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.FCW != fpu.FCW {
+		t.Errorf("FCW: got %#x, want %#x", got.FCW, fpu.FCW)
+	}
+}
+
 func TestGetSetXCRS(t *testing.T) {
 	if os.Getuid() != 0 {
 		t.Skipf("Skipping test since we are not root")
@@ -1449,3 +1583,171 @@ func TestGetSetMSRS(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestFailEntryError(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		reason uint64
+		want   string
+	}{
+		{reason: 0x80000021, want: "invalid guest state"},
+		{reason: 0x80000022, want: "MSR loading"},
+		{reason: 0xffffffffffffffff, want: "SVM_EXIT_ERR"},
+		{reason: 0x1234, want: "unknown reason"},
+	} {
+		r := kvm.RunData{ExitReason: uint32(kvm.EXITFAILENTRY)}
+		r.Data[0], r.Data[1] = tt.reason, 3
+
+		err := r.FailEntryError()
+		if !errors.Is(err, kvm.ErrUnexpectedExitReason) {
+			t.Errorf("reason %#x: got %v, want %v", tt.reason, err, kvm.ErrUnexpectedExitReason)
+		}
+
+		if !strings.Contains(err.Error(), tt.want) || !strings.Contains(err.Error(), "host cpu 3") {
+			t.Errorf("reason %#x: %q does not contain %q", tt.reason, err, tt.want)
+		}
+	}
+}
+
+func TestEnableCapSplitIRQChip(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	if ok, err := kvm.CheckExtension(devKVM.Fd(), kvm.CapSplitIRQChip); err != nil || ok == 0 {
+		t.Skipf("KVM_CAP_SPLIT_IRQCHIP is not supported")
+	}
+
+	vmFd, err := kvm.CreateVM(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kvm.EnableCap(vmFd, kvm.CapSplitIRQChip, 24); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only one irqchip can be created.
+	if err := kvm.CreateIRQChip(vmFd); err == nil {
+		t.Fatal("CreateIRQChip after split irqchip: got nil, want error")
+	}
+
+	irqR := &kvm.IRQRouting{
+		Nr: 2,
+		Entries: []kvm.IRQRoutingEntry{
+			kvm.NewMSIRoutingEntry(0, 0xfee00000, 0x30),
+			kvm.NewMSIRoutingEntry(1, 0xfee00000, 0x31),
+		},
+	}
+
+	if err := kvm.SetGSIRouting(vmFd, irqR); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunDataMSR(t *testing.T) {
+	t.Parallel()
+
+	r := &kvm.RunData{ExitReason: uint32(kvm.EXITX86WRMSR)}
+	r.Data[1] = 0x3b<<32 | 4 // index, reason KVM_MSR_EXIT_REASON_FILTER
+	r.Data[2] = 0x1234
+
+	if index, data := r.MSR(); index != 0x3b || data != 0x1234 {
+		t.Fatalf("MSR: got (%#x, %#x), want (0x3b, 0x1234)", index, data)
+	}
+
+	r.CompleteMSR(0, true)
+
+	if r.Data[0]&0xff != 1 {
+		t.Fatalf("error: got %d, want 1", r.Data[0]&0xff)
+	}
+
+	if s := kvm.EXITX86WRMSR.String(); s != "EXITX86WRMSR" {
+		t.Fatalf("String: got %q, want %q", s, "EXITX86WRMSR")
+	}
+}
+
+func TestEnableCapVCPU(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	vmFd, err := kvm.CreateVM(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vcpuFd, err := kvm.CreateVCPU(vmFd, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Harmless for a guest that does not use Hyper-V. Older kernels
+	// do not know it, and say so with EINVAL.
+	if err := kvm.EnableCap(vcpuFd, kvm.CapHyperVEnforceCPUID, 1); err != nil && !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("EnableCap(vcpu, CapHyperVEnforceCPUID): got %v, want nil or %v", err, syscall.EINVAL)
+	}
+
+	// A cap that is not enabled this way is always rejected.
+	if err := kvm.EnableCap(vcpuFd, kvm.CapNRMemSlots); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("EnableCap(vcpu, CapNRMemSlots): got %v, want %v", err, syscall.EINVAL)
+	}
+}
+
+func TestSignalMSI(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	if ret, err := kvm.CheckExtension(devKVM.Fd(), kvm.CapSignalMSI); err != nil || ret == 0 {
+		t.Skip("Skipping test since CapSignalMSI is disable")
+	}
+
+	vmFd, err := kvm.CreateVM(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kvm.CreateIRQChip(vmFd); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := kvm.CreateVCPU(vmFd, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// The LAPIC of the vCPU is still disabled, as after reset, so it
+	// may not take the message; it must not be an error though.
+	msi := &kvm.MSI{AddressLo: 0xfee00000, Data: 0x41}
+	if err := kvm.SignalMSI(vmFd, msi); err != nil && !errors.Is(err, kvm.ErrMSIBlocked) {
+		t.Fatalf("SignalMSI: got %v, want nil or %v", err, kvm.ErrMSIBlocked)
+	}
+}
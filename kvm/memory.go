@@ -2,6 +2,7 @@ package kvm
 
 import (
 	"errors"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 )
@@ -120,3 +121,78 @@ func UnregisterCoalescedMMIO(vmFd uintptr, addr uint64, size uint32) error {
 
 	return err
 }
+
+// RegisterCoalescedPIO makes KVM buffer guest writes to the IO ports
+// [port, port+size) in the coalesced ring instead of exiting on each.
+// Reads still exit.
+func RegisterCoalescedPIO(vmFd uintptr, port uint64, size uint32) error {
+	zone := &coalescedMMIOZone{
+		Addr:   port,
+		Size:   size,
+		PadPio: 1,
+	}
+
+	_, err := Ioctl(vmFd,
+		IIOW(kvmResgisterCoalescedMMIO, unsafe.Sizeof(coalescedMMIOZone{})),
+		uintptr(unsafe.Pointer(zone)))
+
+	return err
+}
+
+// UnregisterCoalescedPIO undoes RegisterCoalescedPIO.
+func UnregisterCoalescedPIO(vmFd uintptr, port uint64, size uint32) error {
+	zone := &coalescedMMIOZone{
+		Addr:   port,
+		Size:   size,
+		PadPio: 1,
+	}
+
+	_, err := Ioctl(vmFd,
+		IIOW(kvmUnResgisterCoalescedMMIO, unsafe.Sizeof(coalescedMMIOZone{})),
+		uintptr(unsafe.Pointer(zone)))
+
+	return err
+}
+
+// CoalescedPageOffset is the page of the vCPU mmap that holds the
+// CoalescedRing, KVM_COALESCED_MMIO_PAGE_OFFSET on x86.
+const CoalescedPageOffset = 2
+
+// coalescedRingEntries is how many entries fit in the ring page.
+const coalescedRingEntries = (4096 - 8) / 24
+
+// CoalescedEntry is a write buffered by KVM, struct kvm_coalesced_mmio.
+type CoalescedEntry struct {
+	Addr uint64
+	Len  uint32
+	PIO  uint32
+	Data [8]byte
+}
+
+// CoalescedRing is struct kvm_coalesced_mmio_ring. KVM adds entries
+// at Last, userspace takes them from First.
+type CoalescedRing struct {
+	First   uint32
+	Last    uint32
+	Entries [coalescedRingEntries]CoalescedEntry
+}
+
+// Drain calls f with each buffered write in the order the guest made
+// them, and frees its entry. It stops at the first error from f, after
+// freeing that entry.
+func (r *CoalescedRing) Drain(f func(e *CoalescedEntry) error) error {
+	for {
+		first := atomic.LoadUint32(&r.First)
+		if first == atomic.LoadUint32(&r.Last) {
+			return nil
+		}
+
+		err := f(&r.Entries[first])
+
+		atomic.StoreUint32(&r.First, (first+1)%coalescedRingEntries)
+
+		if err != nil {
+			return err
+		}
+	}
+}
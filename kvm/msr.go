@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"runtime"
 	"unsafe"
 )
 
@@ -275,3 +277,76 @@ func GetMSRs(vcpuFd uintptr, msrs *MSRS) error {
 
 	return err
 }
+
+const (
+	// MSRFilterRead and MSRFilterWrite say which accesses a
+	// MSRFilterRange applies to.
+	MSRFilterRead  = 1 << 0
+	MSRFilterWrite = 1 << 1
+
+	// MSRFilterDefaultDeny denies accesses to MSRs outside all ranges.
+	MSRFilterDefaultDeny = 1 << 0
+
+	// MSRExitReasonFilter makes accesses denied by the MSR filter exit to
+	// userspace, rather than inject a #GP. It is an argument to
+	// EnableCap(vmFd, CapX86UserSpaceMSR, ...).
+	MSRExitReasonFilter = 1 << 2
+
+	msrFilterMaxRanges = 16
+)
+
+// ErrTooManyMSRFilterRanges is returned for more than 16 ranges.
+var ErrTooManyMSRFilterRanges = errors.New("too many MSR filter ranges")
+
+// MSRFilterRange covers NMSRs MSRs from Base. Bit n of Bitmap allows the
+// access to Base+n; a clear bit denies it.
+type MSRFilterRange struct {
+	Flags  uint32
+	NMSRs  uint32
+	Base   uint32
+	Bitmap []byte
+}
+
+type msrFilterRange struct {
+	Flags  uint32
+	NMSRs  uint32
+	Base   uint32
+	_      uint32
+	Bitmap uintptr
+}
+
+type msrFilter struct {
+	Flags  uint32
+	_      uint32
+	Ranges [msrFilterMaxRanges]msrFilterRange
+}
+
+// SetMSRFilter replaces the MSR filter of a VM. flags is 0 or
+// MSRFilterDefaultDeny; no ranges removes the filter.
+func SetMSRFilter(vmFd uintptr, flags uint32, ranges []MSRFilterRange) error {
+	if len(ranges) > msrFilterMaxRanges {
+		return fmt.Errorf("%d ranges: %w", len(ranges), ErrTooManyMSRFilterRanges)
+	}
+
+	f := msrFilter{Flags: flags}
+
+	for i, r := range ranges {
+		f.Ranges[i] = msrFilterRange{
+			Flags: r.Flags,
+			NMSRs: r.NMSRs,
+			Base:  r.Base,
+		}
+
+		if len(r.Bitmap) > 0 {
+			f.Ranges[i].Bitmap = uintptr(unsafe.Pointer(&r.Bitmap[0]))
+		}
+	}
+
+	_, err := Ioctl(vmFd,
+		IIOW(kvmX86SetMSRFilter, unsafe.Sizeof(f)),
+		uintptr(unsafe.Pointer(&f)))
+
+	runtime.KeepAlive(ranges)
+
+	return err
+}
@@ -101,6 +101,35 @@ type Descriptor struct {
 	_     [3]uint16
 }
 
+// FPU is the x87 and SSE state of a vcpu.
+type FPU struct {
+	FPR        [8][16]uint8
+	FCW        uint16
+	FSW        uint16
+	FTWX       uint8
+	_          uint8
+	LastOpcode uint16
+	LastIP     uint64
+	LastDP     uint64
+	XMM        [16][16]uint8
+	MXCSR      uint32
+	_          uint32
+}
+
+// GetFPU reads the floating point state of a vcpu.
+func GetFPU(vcpuFd uintptr, fpu *FPU) error {
+	_, err := Ioctl(vcpuFd, IIOR(kvmGetFPU, unsafe.Sizeof(FPU{})), uintptr(unsafe.Pointer(fpu)))
+
+	return err
+}
+
+// SetFPU sets the floating point state of a vcpu.
+func SetFPU(vcpuFd uintptr, fpu *FPU) error {
+	_, err := Ioctl(vcpuFd, IIOW(kvmSetFPU, unsafe.Sizeof(FPU{})), uintptr(unsafe.Pointer(fpu)))
+
+	return err
+}
+
 type DebugRegs struct {
 	DB    [4]uint64
 	DR6   uint64
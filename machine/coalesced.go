@@ -0,0 +1,59 @@
+package machine
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// coalescedPIORanges are the ports whose writes need no immediate
+// answer, and that guests write a lot: VGA, the POST code port and the
+// firmware debug port.
+var coalescedPIORanges = []struct {
+	port uint64
+	size uint32
+}{
+	{port: 0x3c0, size: 0x1b},
+	{port: 0x3b4, size: 0x2},
+	{port: 0x80, size: 0x1},
+	{port: 0x402, size: 0x1},
+}
+
+// initCoalescedPIO registers coalescedPIORanges, if KVM can coalesce PIO.
+func (m *Machine) initCoalescedPIO() error {
+	if ok, err := kvm.CheckExtension(m.kvmFd, kvm.CapCoalescedPIO); err != nil || ok == 0 {
+		return nil
+	}
+
+	for _, r := range coalescedPIORanges {
+		if err := kvm.RegisterCoalescedPIO(m.vmFd, r.port, r.size); err != nil {
+			return fmt.Errorf("coalesced PIO at %#x: %w", r.port, err)
+		}
+	}
+
+	// The ring is shared by the VM; any vCPU's mapping will do.
+	m.coalesced = (*kvm.CoalescedRing)(unsafe.Add(unsafe.Pointer(m.runs[0]),
+		kvm.CoalescedPageOffset*os.Getpagesize()))
+
+	return nil
+}
+
+// drainCoalescedPIO hands the writes KVM buffered to the port handlers.
+func (m *Machine) drainCoalescedPIO() error {
+	if m.coalesced == nil {
+		return nil
+	}
+
+	m.coalescedMu.Lock()
+	defer m.coalescedMu.Unlock()
+
+	return m.coalesced.Drain(func(e *kvm.CoalescedEntry) error {
+		if e.PIO == 0 || e.Len > uint32(len(e.Data)) {
+			return nil
+		}
+
+		return m.ioportHandlers[e.Addr&0xffff][kvm.EXITIOOUT](e.Addr, e.Data[:e.Len])
+	})
+}
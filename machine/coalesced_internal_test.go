@@ -0,0 +1,79 @@
+package machine
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestCoalescedPIO(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := NewWithOptions("/dev/kvm", 1, MinMemSize, Options{CoalescedPIO: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	if m.coalesced == nil {
+		t.Skipf("Skipping test since KVM_CAP_COALESCED_PIO is not supported")
+	}
+
+	var got []byte
+
+	m.registerIOPortHandler(0x80, 0x81, func(port uint64, b []byte) error {
+		return nil
+	}, func(port uint64, b []byte) error {
+		got = append(got, b...)
+
+		return nil
+	})
+
+	code := []byte{
+		0xb0, 0x01, // mov al, 1
+		0xe6, 0x80, // out 0x80, al
+		0xb0, 0x02, // mov al, 2
+		0xe6, 0x80, // out 0x80, al
+		0xb0, 0x03, // mov al, 3
+		0xe6, 0x80, // out 0x80, al
+		0xb0, 0xfe, // mov al, 0xfe
+		0xe6, 0x64, // out 0x64, al (reset)
+	}
+
+	if _, err := m.WriteAt(code, 0x1_00_000); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetupRegs(0x1_00_000, 0x10_000, true); err != nil {
+		t.Fatal(err)
+	}
+
+	exits := 0
+
+	for {
+		exits++
+
+		if _, err := m.RunOnce(0); err != nil {
+			if !errors.Is(err, ErrWriteToCF9) {
+				t.Fatalf("RunOnce: got %v, want %v", err, ErrWriteToCF9)
+			}
+
+			break
+		}
+	}
+
+	if want := []byte{1, 2, 3}; !bytes.Equal(got, want) {
+		t.Errorf("writes to 0x80: got %v, want %v", got, want)
+	}
+
+	// Only the reset exits; the POST codes come out of the ring with it.
+	if exits != 1 {
+		t.Errorf("got %d exits, want 1", exits)
+	}
+}
@@ -0,0 +1,229 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// CPUModel selects which of the CPU features KVM supports the guest sees.
+type CPUModel int
+
+const (
+	// CPUModelKVM64 hides perfmon and fast short rep mov.
+	CPUModelKVM64 CPUModel = iota
+	// CPUModelHost passes through everything KVM supports.
+	CPUModelHost
+)
+
+var cpuModelNames = [...]string{
+	CPUModelKVM64: "kvm64",
+	CPUModelHost:  "host",
+}
+
+// ErrBadCPUModel is returned for an unknown CPU model.
+var ErrBadCPUModel = errors.New("CPU model must be kvm64 or host")
+
+func (c CPUModel) String() string {
+	if c < 0 || int(c) >= len(cpuModelNames) {
+		return fmt.Sprintf("CPUModel(%d)", int(c))
+	}
+
+	return cpuModelNames[c]
+}
+
+// ParseCPUModel returns the model named s.
+func ParseCPUModel(s string) (CPUModel, error) {
+	for i, n := range cpuModelNames {
+		if n == s {
+			return CPUModel(i), nil
+		}
+	}
+
+	return CPUModelKVM64, fmt.Errorf("%q: %w", s, ErrBadCPUModel)
+}
+
+// modelCPUID turns the CPUID KVM supports into what a guest of model
+// sees. Either way, the KVM signature leaf is filled in and the
+// TSC-deadline timer is shown or hidden as tscDeadline says.
+//
+// https://www.kernel.org/doc/html/latest/virt/kvm/cpuid.html
+func modelCPUID(cpuid *kvm.CPUID, model CPUModel, tscDeadline bool) {
+	for i := range cpuid.Entries[:cpuid.Nent] {
+		e := &cpuid.Entries[i]
+
+		switch e.Function {
+		case kvm.CPUIDFuncInfo:
+			if tscDeadline {
+				e.Ecx |= kvm.CPUIDInfoECXTSCDeadline
+			} else {
+				e.Ecx &^= kvm.CPUIDInfoECXTSCDeadline
+			}
+
+		case kvm.CPUIDFuncPerMon:
+			if model == CPUModelKVM64 {
+				e.Eax = 0 // disable
+			}
+
+		case kvm.CPUIDSignature:
+			e.Eax = kvm.CPUIDFeatures
+			e.Ebx = 0x4b4d564b // KVMK
+			e.Ecx = 0x564b4d56 // VMKV
+			e.Edx = 0x4d       // M
+
+		case 7:
+			if model == CPUModelKVM64 {
+				// Unset X86_FEATURE_FSRM (Fast Short Rep Mov)
+				e.Edx &= ^(uint32(1) << 4)
+			}
+		}
+	}
+}
+
+// SetCPUModel sets the CPU model of all vCPUs. The default is
+// CPUModelKVM64. It must be called before the vCPUs first run.
+func (m *Machine) SetCPUModel(model CPUModel) error {
+	m.cpuModel = model
+
+	for cpu := range m.vcpuFds {
+		if err := m.initCPUID(cpu); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ErrBadCPUIDOverride is returned for a CPUID override that does not
+// parse or names a leaf KVM does not have.
+var ErrBadCPUIDOverride = errors.New("CPUID override must be function:index:register:clear=mask or set=mask")
+
+// CPUIDOverride changes one register of one CPUID leaf: the bits in
+// ClearMask are cleared, then those in SetMask are set.
+type CPUIDOverride struct {
+	Function     uint32
+	Index        uint32
+	RegisterName string // eax, ebx, ecx or edx
+	ClearMask    uint32
+	SetMask      uint32
+}
+
+func (o CPUIDOverride) String() string {
+	return fmt.Sprintf("%#x:%d:%s:clear=%#x,set=%#x", o.Function, o.Index, o.RegisterName, o.ClearMask, o.SetMask)
+}
+
+// ParseCPUIDOverride parses function:index:register:ops, where ops is
+// a comma separated list of clear=mask and set=mask, e.g.
+// 1:0:ecx:clear=0x40000000 to hide rdrand. Numbers are in any base
+// strconv accepts.
+func ParseCPUIDOverride(s string) (CPUIDOverride, error) {
+	var o CPUIDOverride
+
+	f := strings.Split(s, ":")
+	if len(f) != 4 {
+		return o, fmt.Errorf("%q: %w", s, ErrBadCPUIDOverride)
+	}
+
+	fn, err := strconv.ParseUint(f[0], 0, 32)
+	if err != nil {
+		return o, fmt.Errorf("%q: %w", s, ErrBadCPUIDOverride)
+	}
+
+	idx, err := strconv.ParseUint(f[1], 0, 32)
+	if err != nil {
+		return o, fmt.Errorf("%q: %w", s, ErrBadCPUIDOverride)
+	}
+
+	o.Function, o.Index, o.RegisterName = uint32(fn), uint32(idx), strings.ToLower(f[2])
+
+	if o.register(&kvm.CPUIDEntry2{}) == nil {
+		return o, fmt.Errorf("%q: %w", s, ErrBadCPUIDOverride)
+	}
+
+	for _, op := range strings.Split(f[3], ",") {
+		name, val, ok := strings.Cut(op, "=")
+		if !ok {
+			return o, fmt.Errorf("%q: %w", s, ErrBadCPUIDOverride)
+		}
+
+		mask, err := strconv.ParseUint(val, 0, 32)
+		if err != nil {
+			return o, fmt.Errorf("%q: %w", s, ErrBadCPUIDOverride)
+		}
+
+		switch name {
+		case "clear":
+			o.ClearMask |= uint32(mask)
+		case "set":
+			o.SetMask |= uint32(mask)
+		default:
+			return o, fmt.Errorf("%q: %w", s, ErrBadCPUIDOverride)
+		}
+	}
+
+	return o, nil
+}
+
+// register returns the register of e that o changes, or nil.
+func (o CPUIDOverride) register(e *kvm.CPUIDEntry2) *uint32 {
+	switch o.RegisterName {
+	case "eax":
+		return &e.Eax
+	case "ebx":
+		return &e.Ebx
+	case "ecx":
+		return &e.Ecx
+	case "edx":
+		return &e.Edx
+	}
+
+	return nil
+}
+
+// applyCPUIDOverrides applies overrides, in order, to the entries of
+// cpuid. An override for a leaf cpuid does not have is an error, since
+// the guest would never see it.
+func applyCPUIDOverrides(cpuid *kvm.CPUID, overrides []CPUIDOverride) error {
+	for _, o := range overrides {
+		found := false
+
+		for i := range cpuid.Entries[:cpuid.Nent] {
+			e := &cpuid.Entries[i]
+			if e.Function != o.Function || e.Index != o.Index {
+				continue
+			}
+
+			r := o.register(e)
+			if r == nil {
+				return fmt.Errorf("%v: %w", o, ErrBadCPUIDOverride)
+			}
+
+			*r = *r&^o.ClearMask | o.SetMask
+			found = true
+		}
+
+		if !found {
+			return fmt.Errorf("%v: no such leaf: %w", o, ErrBadCPUIDOverride)
+		}
+	}
+
+	return nil
+}
+
+// SetCPUIDOverrides applies overrides to the CPUID of all vCPUs, after
+// the changes gokvm makes itself. Each call replaces the previous
+// overrides. It must be called before the vCPUs first run.
+func (m *Machine) SetCPUIDOverrides(overrides []CPUIDOverride) error {
+	m.cpuidOverrides = overrides
+
+	for cpu := range m.vcpuFds {
+		if err := m.initCPUID(cpu); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
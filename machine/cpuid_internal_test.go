@@ -0,0 +1,182 @@
+package machine
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+func TestSupportedCPUIDGrows(t *testing.T) {
+	t.Parallel()
+
+	// The fake has more leaves than the first buffer holds.
+	const want = 300
+
+	calls := 0
+
+	cpuid, err := supportedCPUID(func(c *kvm.CPUID) error {
+		calls++
+
+		if c.Nent < want {
+			return syscall.E2BIG
+		}
+
+		c.Nent = want
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cpuid.Nent != want || len(cpuid.Entries) < want {
+		t.Errorf("got Nent %d with %d entries, want %d", cpuid.Nent, len(cpuid.Entries), want)
+	}
+
+	if calls != 3 {
+		t.Errorf("got %d calls, want 3", calls)
+	}
+}
+
+func TestSupportedCPUIDGivesUp(t *testing.T) {
+	t.Parallel()
+
+	_, err := supportedCPUID(func(c *kvm.CPUID) error {
+		return syscall.E2BIG
+	})
+	if !errors.Is(err, syscall.E2BIG) {
+		t.Errorf("got %v, want %v", err, syscall.E2BIG)
+	}
+
+	_, err = supportedCPUID(func(c *kvm.CPUID) error {
+		return syscall.EINVAL
+	})
+	if !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("got %v, want %v", err, syscall.EINVAL)
+	}
+}
+
+func TestParseCPUIDOverride(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		in   string
+		want CPUIDOverride
+	}{
+		{"1:0:ecx:clear=0x40000000", CPUIDOverride{Function: 1, RegisterName: "ecx", ClearMask: 0x40000000}},
+		{"0x7:0:EBX:set=4", CPUIDOverride{Function: 7, RegisterName: "ebx", SetMask: 4}},
+		{"1:0:edx:clear=1,set=2", CPUIDOverride{Function: 1, RegisterName: "edx", ClearMask: 1, SetMask: 2}},
+	} {
+		got, err := ParseCPUIDOverride(tt.in)
+		if err != nil {
+			t.Errorf("ParseCPUIDOverride(%q): %v", tt.in, err)
+
+			continue
+		}
+
+		if got != tt.want {
+			t.Errorf("ParseCPUIDOverride(%q): got %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "1:0:ecx", "1:0:esp:clear=1", "x:0:ecx:set=1", "1:0:ecx:flip=1", "1:0:ecx:set"} {
+		if _, err := ParseCPUIDOverride(in); !errors.Is(err, ErrBadCPUIDOverride) {
+			t.Errorf("ParseCPUIDOverride(%q): got %v, want %v", in, err, ErrBadCPUIDOverride)
+		}
+	}
+}
+
+func TestApplyCPUIDOverrides(t *testing.T) {
+	t.Parallel()
+
+	cpuid := &kvm.CPUID{
+		Nent: 2,
+		Entries: []kvm.CPUIDEntry2{
+			{Function: 1, Ecx: 0xc0000001, Edx: 0xff},
+			{Function: 7, Index: 0, Ebx: 0x1},
+			{Function: 1, Ecx: 0x40000000}, // past Nent
+		},
+	}
+
+	err := applyCPUIDOverrides(cpuid, []CPUIDOverride{
+		{Function: 1, RegisterName: "ecx", ClearMask: 0x40000000},
+		{Function: 1, RegisterName: "ecx", SetMask: 0x2},
+		{Function: 7, RegisterName: "ebx", ClearMask: 0x1, SetMask: 0x1 << 9},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := cpuid.Entries[0].Ecx, uint32(0x80000003); got != want {
+		t.Errorf("leaf 1 ecx: got %#x, want %#x", got, want)
+	}
+
+	if got, want := cpuid.Entries[0].Edx, uint32(0xff); got != want {
+		t.Errorf("leaf 1 edx: got %#x, want %#x", got, want)
+	}
+
+	if got, want := cpuid.Entries[1].Ebx, uint32(0x200); got != want {
+		t.Errorf("leaf 7 ebx: got %#x, want %#x", got, want)
+	}
+
+	if got, want := cpuid.Entries[2].Ecx, uint32(0x40000000); got != want {
+		t.Errorf("entry past Nent: got %#x, want %#x", got, want)
+	}
+
+	err = applyCPUIDOverrides(cpuid, []CPUIDOverride{{Function: 7, Index: 1, RegisterName: "eax", SetMask: 1}})
+	if !errors.Is(err, ErrBadCPUIDOverride) {
+		t.Errorf("missing leaf: got %v, want %v", err, ErrBadCPUIDOverride)
+	}
+}
+
+func TestModelCPUID(t *testing.T) {
+	t.Parallel()
+
+	const fsrm = uint32(1) << 4
+
+	table := func() *kvm.CPUID {
+		return &kvm.CPUID{
+			Nent: 3,
+			Entries: []kvm.CPUIDEntry2{
+				{Function: kvm.CPUIDFuncPerMon, Eax: 0x07300805},
+				{Function: 7, Edx: fsrm | 1},
+				{Function: kvm.CPUIDSignature},
+			},
+		}
+	}
+
+	for _, tt := range []struct {
+		model  string
+		perMon uint32
+		leaf7  uint32
+	}{
+		{"kvm64", 0, 1},
+		{"host", 0x07300805, fsrm | 1},
+	} {
+		model, err := ParseCPUModel(tt.model)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cpuid := table()
+		modelCPUID(cpuid, model, false)
+
+		if got := cpuid.Entries[0].Eax; got != tt.perMon {
+			t.Errorf("%v: perfmon eax: got %#x, want %#x", model, got, tt.perMon)
+		}
+
+		if got := cpuid.Entries[1].Edx; got != tt.leaf7 {
+			t.Errorf("%v: leaf 7 edx: got %#x, want %#x", model, got, tt.leaf7)
+		}
+
+		if got := cpuid.Entries[2].Ebx; got != 0x4b4d564b {
+			t.Errorf("%v: signature ebx: got %#x, want KVMK", model, got)
+		}
+	}
+
+	if _, err := ParseCPUModel("486"); !errors.Is(err, ErrBadCPUModel) {
+		t.Errorf("ParseCPUModel(486): got %v, want %v", err, ErrBadCPUModel)
+	}
+}
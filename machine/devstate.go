@@ -0,0 +1,55 @@
+package machine
+
+import (
+	"encoding/json"
+
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+// SerialState is the state of the serial port.
+type SerialState struct {
+	IER byte `json:"ier"`
+	LCR byte `json:"lcr"`
+	// TriggerLevel is the receive FIFO interrupt trigger level.
+	TriggerLevel int `json:"trigger_level"`
+	// THRE is whether a THRE interrupt is latched in IIR.
+	THRE bool `json:"thre"`
+}
+
+// DeviceStates is the state of the devices of a Machine, for debugging.
+type DeviceStates struct {
+	Serial SerialState          `json:"serial"`
+	Net    []virtio.DeviceState `json:"net"`
+	Blk    []virtio.BlkState    `json:"blk"`
+}
+
+// DeviceStates returns the state of the serial port and the virtio
+// devices. It may be called while the guest runs.
+func (m *Machine) DeviceStates() DeviceStates {
+	uart := m.serial.GetState()
+
+	s := DeviceStates{
+		Serial: SerialState{
+			IER: uart.IER, LCR: uart.LCR,
+			TriggerLevel: uart.TriggerLevel(), THRE: uart.THRE,
+		},
+		Net: []virtio.DeviceState{},
+		Blk: []virtio.BlkState{},
+	}
+
+	for _, d := range m.pci.Devices {
+		switch v := d.(type) {
+		case *virtio.Net:
+			s.Net = append(s.Net, v.State())
+		case *virtio.Blk:
+			s.Blk = append(s.Blk, v.State())
+		}
+	}
+
+	return s
+}
+
+// DeviceStatesJSON returns DeviceStates as indented JSON.
+func (m *Machine) DeviceStatesJSON() ([]byte, error) {
+	return json.MarshalIndent(m.DeviceStates(), "", "  ")
+}
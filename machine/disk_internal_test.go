@@ -0,0 +1,69 @@
+package machine
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+func TestAddDiskMultiple(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := New("/dev/kvm", 1, MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	disk := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(disk, make([]byte, 1<<20), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i <= len(extraBlkIRQs); i++ {
+		if err := m.AddDisk(disk); err != nil {
+			t.Fatalf("disk %d: %v", i, err)
+		}
+	}
+
+	if err := m.AddDisk(disk); !errors.Is(err, ErrTooManyDisks) {
+		t.Errorf("one disk too many: got %v, want %v", err, ErrTooManyDisks)
+	}
+
+	var blks []*virtio.Blk
+
+	for _, dev := range m.pci.Devices {
+		if b, ok := dev.(*virtio.Blk); ok {
+			blks = append(blks, b)
+		}
+	}
+
+	if len(blks) != len(extraBlkIRQs)+1 {
+		t.Fatalf("got %d virtio-blk devices, want %d", len(blks), len(extraBlkIRQs)+1)
+	}
+
+	ports := map[uint64]bool{}
+	irqs := map[uint8]bool{}
+
+	for _, b := range blks {
+		h := b.GetDeviceHeader()
+
+		if ports[b.IOPort()] || irqs[h.InterruptLine] {
+			t.Errorf("IO port %#x or IRQ %d used twice", b.IOPort(), h.InterruptLine)
+		}
+
+		ports[b.IOPort()] = true
+		irqs[h.InterruptLine] = true
+
+		if h.BAR[0] != uint32(b.IOPort())|1 {
+			t.Errorf("BAR0 %#x does not match IO port %#x", h.BAR[0], b.IOPort())
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// ExceptionPolicy says what to do when a vCPU exits with KVM_EXIT_EXCEPTION.
+type ExceptionPolicy int
+
+const (
+	// ExceptionAbort stops the vCPU with an error.
+	ExceptionAbort ExceptionPolicy = iota
+	// ExceptionReinject raises the exception in the guest again.
+	ExceptionReinject
+	// ExceptionLogContinue logs the exception and resumes the guest.
+	ExceptionLogContinue
+)
+
+var exceptionPolicyNames = [...]string{
+	ExceptionAbort:       "abort",
+	ExceptionReinject:    "reinject",
+	ExceptionLogContinue: "log",
+}
+
+// ErrBadExceptionPolicy is returned for an unknown exception policy.
+var ErrBadExceptionPolicy = errors.New("exception policy must be abort, reinject or log")
+
+func (p ExceptionPolicy) String() string {
+	if p < 0 || int(p) >= len(exceptionPolicyNames) {
+		return fmt.Sprintf("ExceptionPolicy(%d)", int(p))
+	}
+
+	return exceptionPolicyNames[p]
+}
+
+// ParseExceptionPolicy returns the policy named s.
+func ParseExceptionPolicy(s string) (ExceptionPolicy, error) {
+	for i, n := range exceptionPolicyNames {
+		if n == s {
+			return ExceptionPolicy(i), nil
+		}
+	}
+
+	return ExceptionAbort, fmt.Errorf("%q: %w", s, ErrBadExceptionPolicy)
+}
+
+// SetExceptionPolicy sets what RunOnce does on an exception exit.
+func (m *Machine) SetExceptionPolicy(p ExceptionPolicy) {
+	m.exceptionPolicy = p
+}
+
+// hasErrorCode reports whether the exception pushes an error code.
+// See Intel SDM Vol. 3, 6.3.1.
+func hasErrorCode(vector uint32) bool {
+	switch vector {
+	case 8, 10, 11, 12, 13, 14, 17, 21, 29, 30:
+		return true
+	}
+
+	return false
+}
+
+// handleException handles an exception exit according to the policy,
+// and returns like RunOnce.
+func (m *Machine) handleException(cpu int) (bool, error) {
+	vector, code := m.runs[cpu].Exception()
+
+	switch m.exceptionPolicy {
+	case ExceptionReinject:
+		fd, err := m.CPUToFD(cpu)
+		if err != nil {
+			return false, err
+		}
+
+		events := &kvm.VCPUEvents{}
+		if err := kvm.GetVCPUEvents(fd, events); err != nil {
+			return false, err
+		}
+
+		events.E.Inject = 1
+		events.E.Nr = uint8(vector)
+		events.E.HadErrorCode = 0
+		events.E.ErrorCode = 0
+
+		if hasErrorCode(vector) {
+			events.E.HadErrorCode = 1
+			events.E.ErrorCode = code
+		}
+
+		if err := kvm.SetVCPUEvents(fd, events); err != nil {
+			return false, fmt.Errorf("reinject exception %d: %w", vector, err)
+		}
+
+		return true, nil
+	case ExceptionLogContinue:
+		log.Printf("cpu %d: exception %d, error code %#x", cpu, vector, code)
+
+		return true, nil
+	case ExceptionAbort:
+	}
+
+	return false, fmt.Errorf("%w: EXITEXCEPTION: vector %d, error code %#x",
+		kvm.ErrUnexpectedExitReason, vector, code)
+}
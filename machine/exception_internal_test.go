@@ -0,0 +1,65 @@
+package machine
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+func TestHandleException(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := New("/dev/kvm", 1, MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// #GP with error code 0x18.
+	m.runs[0].ExitReason = uint32(kvm.EXITEXCEPTION)
+	m.runs[0].Data[0] = 0x18<<32 | 13
+
+	if ok, err := m.handleException(0); ok || !errors.Is(err, kvm.ErrUnexpectedExitReason) {
+		t.Errorf("abort: got (%v, %v), want (false, %v)", ok, err, kvm.ErrUnexpectedExitReason)
+	}
+
+	m.SetExceptionPolicy(ExceptionLogContinue)
+
+	if ok, err := m.handleException(0); !ok || err != nil {
+		t.Errorf("log: got (%v, %v), want (true, nil)", ok, err)
+	}
+
+	m.SetExceptionPolicy(ExceptionReinject)
+
+	if ok, err := m.handleException(0); !ok || err != nil {
+		t.Fatalf("reinject: got (%v, %v), want (true, nil)", ok, err)
+	}
+
+	events := &kvm.VCPUEvents{}
+	if err := kvm.GetVCPUEvents(m.vcpuFds[0], events); err != nil {
+		t.Fatal(err)
+	}
+
+	if events.E.Nr != 13 || events.E.HadErrorCode != 1 || events.E.ErrorCode != 0x18 {
+		t.Errorf("pending exception: got %+v, want #GP(0x18)", events.E)
+	}
+}
+
+func TestParseExceptionPolicy(t *testing.T) {
+	t.Parallel()
+
+	for _, p := range []ExceptionPolicy{ExceptionAbort, ExceptionReinject, ExceptionLogContinue} {
+		if got, err := ParseExceptionPolicy(p.String()); err != nil || got != p {
+			t.Errorf("ParseExceptionPolicy(%q): got (%v, %v), want (%v, nil)", p, got, err, p)
+		}
+	}
+
+	if _, err := ParseExceptionPolicy("ignore"); !errors.Is(err, ErrBadExceptionPolicy) {
+		t.Errorf("ParseExceptionPolicy(ignore): got %v, want %v", err, ErrBadExceptionPolicy)
+	}
+}
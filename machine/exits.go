@@ -0,0 +1,20 @@
+package machine
+
+import "github.com/bobuhiro11/gokvm/kvm"
+
+// supportedDisableExits returns the kvm.X86DisableExits* bits the host
+// supports, or 0 if it has no KVM_CAP_X86_DISABLE_EXITS.
+func supportedDisableExits(kvmFd uintptr) uint64 {
+	mask, err := kvm.CheckExtension(kvmFd, kvm.CapX86DisableExits)
+	if err != nil {
+		return 0
+	}
+
+	return uint64(mask)
+}
+
+// DisabledExits returns the kvm.X86DisableExits* bits in effect, that
+// is those asked for in Options.DisableExits that the host supports.
+func (m *Machine) DisabledExits() uint64 {
+	return m.disabledExits
+}
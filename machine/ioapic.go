@@ -0,0 +1,180 @@
+package machine
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+const (
+	// ioapicBase is where the IOAPIC is on a PC, and where the MP table
+	// says it is.
+	ioapicBase = 0xfec00000
+	ioapicSize = 0x20
+
+	// The IOAPIC is reached through a select register and a window.
+	ioapicRegSel = 0x00
+	ioapicWin    = 0x10
+
+	ioapicID      = 0x00
+	ioapicVersion = 0x01
+	ioapicArb     = 0x02
+	ioapicRedTbl  = 0x10
+
+	// Version 0x11, with the index of the last redirection entry above.
+	ioapicVersionValue = 0x11 | (splitIRQRoutes-1)<<16
+
+	redirVector   = 0xff
+	redirDelMode  = 0x7 << 8
+	redirDestMode = 1 << 11
+	redirMask     = 1 << 16
+	redirDestID   = 56
+	// The delivery status and remote IRR bits are read only, and always
+	// read as 0 here, as EOIs are not tracked.
+	redirWritable = ^uint64(1<<12 | 1<<14)
+)
+
+// ioapic is the IOAPIC of a split irqchip. The guest programs its
+// redirection table through MMIO, and every unmasked entry becomes an
+// MSI route in KVM, so that an IRQ line raised with KVM_IRQ_LINE or an
+// irqfd is delivered to the LAPICs without exiting to userspace. Level
+// triggered entries are delivered like edge triggered ones.
+type ioapic struct {
+	mu     sync.Mutex
+	vmFd   uintptr
+	sel    uint32
+	id     uint32
+	redTbl [splitIRQRoutes]uint64
+}
+
+// newIOAPIC returns an IOAPIC as it is at power on, with every entry
+// masked.
+func newIOAPIC(vmFd uintptr) (*ioapic, error) {
+	a := &ioapic{vmFd: vmFd}
+
+	if err := a.reset(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// reset masks every entry again.
+func (a *ioapic) reset() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.sel, a.id = 0, 0
+
+	for i := range a.redTbl {
+		a.redTbl[i] = redirMask
+	}
+
+	return a.route()
+}
+
+// route hands the unmasked entries to KVM as MSI routes. A masked pin
+// has no route, so raising it does nothing.
+func (a *ioapic) route() error {
+	r := &kvm.IRQRouting{}
+
+	for gsi, e := range a.redTbl {
+		if e&redirMask != 0 {
+			continue
+		}
+
+		r.Entries = append(r.Entries, kvm.NewMSIRoutingEntry(uint32(gsi), redirMSIAddr(e), redirMSIData(e)))
+	}
+
+	r.Nr = uint32(len(r.Entries))
+
+	return kvm.SetGSIRouting(a.vmFd, r)
+}
+
+// redirMSIAddr returns the MSI address of redirection entry e: its
+// destination and destination mode.
+func redirMSIAddr(e uint64) uint64 {
+	addr := uint64(msiAddrBase) | (e>>redirDestID)<<12
+
+	if e&redirDestMode != 0 {
+		addr |= 1 << 2
+	}
+
+	return addr
+}
+
+// redirMSIData returns the MSI data of redirection entry e: its vector
+// and delivery mode, as an asserted edge.
+func redirMSIData(e uint64) uint32 {
+	return uint32(e & (redirVector | redirDelMode))
+}
+
+// mmio handles a guest access to the IOAPIC registers.
+func (a *ioapic) mmio(addr uint64, data []byte, write bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var b [4]byte
+
+	if !write {
+		switch addr - ioapicBase {
+		case ioapicRegSel:
+			binary.LittleEndian.PutUint32(b[:], a.sel)
+		case ioapicWin:
+			binary.LittleEndian.PutUint32(b[:], a.read(a.sel))
+		}
+
+		copy(data, b[:])
+
+		return nil
+	}
+
+	copy(b[:], data)
+	v := binary.LittleEndian.Uint32(b[:])
+
+	switch addr - ioapicBase {
+	case ioapicRegSel:
+		a.sel = v & 0xff
+	case ioapicWin:
+		return a.write(a.sel, v)
+	}
+
+	return nil
+}
+
+// read returns the register at index reg.
+func (a *ioapic) read(reg uint32) uint32 {
+	switch {
+	case reg == ioapicID:
+		return a.id
+	case reg == ioapicVersion:
+		return ioapicVersionValue
+	case reg == ioapicArb:
+		return a.id
+	case reg >= ioapicRedTbl && reg < ioapicRedTbl+2*splitIRQRoutes:
+		e := a.redTbl[(reg-ioapicRedTbl)/2]
+
+		return uint32(e >> (32 * (reg % 2)))
+	}
+
+	return 0
+}
+
+// write sets the register at index reg, and the routes if it is part of
+// a redirection entry.
+func (a *ioapic) write(reg, v uint32) error {
+	switch {
+	case reg == ioapicID:
+		a.id = v & (0xf << 24)
+	case reg >= ioapicRedTbl && reg < ioapicRedTbl+2*splitIRQRoutes:
+		e := &a.redTbl[(reg-ioapicRedTbl)/2]
+		shift := 32 * (reg % 2)
+
+		*e = (*e &^ (0xffffffff << shift)) | (uint64(v)<<shift)&redirWritable
+
+		return a.route()
+	}
+
+	return nil
+}
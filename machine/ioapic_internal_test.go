@@ -0,0 +1,48 @@
+package machine
+
+import "testing"
+
+func TestIOAPICRedirectionToMSI(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name     string
+		entry    uint64
+		wantAddr uint64
+		wantData uint32
+	}{
+		{name: "fixed to APIC 0", entry: 0x34, wantAddr: 0xfee00000, wantData: 0x34},
+		{name: "fixed to APIC 3", entry: 3<<56 | 0x41, wantAddr: 0xfee03000, wantData: 0x41},
+		{name: "lowest priority, logical", entry: 1<<56 | 1<<11 | 1<<8 | 0x30, wantAddr: 0xfee01004, wantData: 0x130},
+		{name: "level triggered as edge", entry: 1<<15 | 0x39, wantAddr: 0xfee00000, wantData: 0x39},
+	} {
+		if got := redirMSIAddr(tt.entry); got != tt.wantAddr {
+			t.Errorf("%s: address: got %#x, want %#x", tt.name, got, tt.wantAddr)
+		}
+
+		if got := redirMSIData(tt.entry); got != tt.wantData {
+			t.Errorf("%s: data: got %#x, want %#x", tt.name, got, tt.wantData)
+		}
+	}
+}
+
+func TestIOAPICRead(t *testing.T) {
+	t.Parallel()
+
+	a := &ioapic{}
+	a.redTbl[2] = 0x0100_0000_0001_0033
+
+	for _, tt := range []struct {
+		reg  uint32
+		want uint32
+	}{
+		{reg: ioapicVersion, want: 0x17_0011},
+		{reg: ioapicRedTbl + 4, want: 0x0001_0033},
+		{reg: ioapicRedTbl + 5, want: 0x0100_0000},
+		{reg: ioapicRedTbl + 2*splitIRQRoutes, want: 0},
+	} {
+		if got := a.read(tt.reg); got != tt.want {
+			t.Errorf("register %#x: got %#x, want %#x", tt.reg, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// IRQChip selects where the interrupt controllers are emulated.
+type IRQChip int
+
+const (
+	// IRQChipKernel emulates the PICs, IOAPIC, LAPICs and PIT in the kernel.
+	IRQChipKernel IRQChip = iota
+	// IRQChipSplit keeps only the LAPICs in the kernel. The IOAPIC is
+	// emulated in userspace, see ioapic; there is no PIC or PIT.
+	IRQChipSplit
+)
+
+const (
+	// splitIRQRoutes is the number of IOAPIC pins the kernel reserves
+	// routes for.
+	splitIRQRoutes = 24
+
+	msiAddrBase = 0xfee00000
+)
+
+var irqChipNames = [...]string{
+	IRQChipKernel: "kernel",
+	IRQChipSplit:  "split",
+}
+
+// ErrBadIRQChip is returned for an unknown irqchip mode.
+var ErrBadIRQChip = errors.New("irqchip must be kernel or split")
+
+func (c IRQChip) String() string {
+	if c < 0 || int(c) >= len(irqChipNames) {
+		return fmt.Sprintf("IRQChip(%d)", int(c))
+	}
+
+	return irqChipNames[c]
+}
+
+// ParseIRQChip returns the irqchip mode named s.
+func ParseIRQChip(s string) (IRQChip, error) {
+	for i, n := range irqChipNames {
+		if n == s {
+			return IRQChip(i), nil
+		}
+	}
+
+	return IRQChipKernel, fmt.Errorf("%q: %w", s, ErrBadIRQChip)
+}
+
+// createIRQChip creates the in-kernel interrupt controllers for mode.
+// It must run before any vCPU is created.
+func createIRQChip(vmFd uintptr, mode IRQChip) error {
+	if mode == IRQChipSplit {
+		if err := kvm.EnableCap(vmFd, kvm.CapSplitIRQChip, splitIRQRoutes); err != nil {
+			return fmt.Errorf("split irqchip: %w", err)
+		}
+
+		return nil
+	}
+
+	if err := kvm.CreateIRQChip(vmFd); err != nil {
+		return err
+	}
+
+	return kvm.CreatePIT2(vmFd)
+}
@@ -0,0 +1,97 @@
+package machine
+
+import (
+	"sort"
+	"unsafe"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+const (
+	picMaster = 0
+	picSlave  = 1
+
+	// The IRR and ISR are 8 32-bit registers, 16 bytes apart.
+	lapicISR = 0x100
+	lapicIRR = 0x200
+)
+
+// PendingIRQs returns the vectors that are requested or in service,
+// either at one of the 8259 PICs or at the LAPIC of any vCPU. A vector
+// that stays here while the guest runs points to a missing EOI.
+func (m *Machine) PendingIRQs() ([]uint32, error) {
+	seen := map[uint32]bool{}
+
+	for _, id := range m.pics() {
+		chip := kvm.IRQChip{ChipID: id}
+		if err := kvm.GetIRQChip(m.vmFd, &chip); err != nil {
+			return nil, err
+		}
+
+		pic := (*kvm.PICState)(unsafe.Pointer(&chip.Chip[0]))
+
+		for line := uint32(0); line < 8; line++ {
+			if (pic.IRR|pic.ISR)&(1<<line) != 0 {
+				seen[uint32(pic.IRQBase)+line] = true
+			}
+		}
+	}
+
+	for _, fd := range m.vcpuFds {
+		lapic := kvm.LAPICState{}
+		if err := kvm.GetLocalAPIC(fd, &lapic); err != nil {
+			return nil, err
+		}
+
+		for vec := uint32(0); vec < 256; vec++ {
+			reg := vec / 32 * 16
+
+			isr := *(*uint32)(unsafe.Pointer(&lapic.Regs[lapicISR+reg]))
+			irr := *(*uint32)(unsafe.Pointer(&lapic.Regs[lapicIRR+reg]))
+
+			if (isr|irr)&(1<<(vec%32)) != 0 {
+				seen[vec] = true
+			}
+		}
+	}
+
+	vecs := make([]uint32, 0, len(seen))
+	for v := range seen {
+		vecs = append(vecs, v)
+	}
+
+	sort.Slice(vecs, func(i, j int) bool { return vecs[i] < vecs[j] })
+
+	return vecs, nil
+}
+
+// ClearPendingIRQs drops all interrupts requested or in service at the
+// PICs, as if they had been acknowledged and EOIed. It is meant for
+// getting a guest with a stuck interrupt going again while debugging.
+func (m *Machine) ClearPendingIRQs() error {
+	for _, id := range m.pics() {
+		chip := kvm.IRQChip{ChipID: id}
+		if err := kvm.GetIRQChip(m.vmFd, &chip); err != nil {
+			return err
+		}
+
+		pic := (*kvm.PICState)(unsafe.Pointer(&chip.Chip[0]))
+		pic.IRR = 0
+		pic.ISR = 0
+
+		if err := kvm.SetIRQChip(m.vmFd, &chip); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pics returns the in-kernel PICs; with a split irqchip there are none.
+func (m *Machine) pics() []uint32 {
+	if m.irqChip == IRQChipSplit {
+		return nil
+	}
+
+	return []uint32{picMaster, picSlave}
+}
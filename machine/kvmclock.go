@@ -0,0 +1,31 @@
+package machine
+
+import (
+	"time"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// GetGuestTime returns the guest's kvmclock, the time since the VM was
+// created as the guest sees it.
+func (m *Machine) GetGuestTime() (time.Duration, error) {
+	var cd kvm.ClockData
+
+	if err := kvm.GetClock(m.vmFd, &cd); err != nil {
+		return 0, err
+	}
+
+	return time.Duration(cd.Clock), nil
+}
+
+// SetClockOffset moves the guest's kvmclock by d, e.g. to test how the
+// guest copes with time drift. A negative d moves it back, which a
+// running guest may not take well.
+func (m *Machine) SetClockOffset(d time.Duration) error {
+	now, err := m.GetGuestTime()
+	if err != nil {
+		return err
+	}
+
+	return kvm.SetClock(m.vmFd, &kvm.ClockData{Clock: uint64(now + d)})
+}
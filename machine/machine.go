@@ -2,6 +2,7 @@ package machine
 
 import (
 	"bytes"
+	"compress/gzip"
 	"debug/elf"
 	"encoding/binary"
 	"encoding/hex"
@@ -9,9 +10,12 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
 	"reflect"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 
@@ -22,9 +26,11 @@ import (
 	"github.com/bobuhiro11/gokvm/pci"
 	"github.com/bobuhiro11/gokvm/pvh"
 	"github.com/bobuhiro11/gokvm/serial"
+	"github.com/bobuhiro11/gokvm/smbios"
 	"github.com/bobuhiro11/gokvm/tap"
 	"github.com/bobuhiro11/gokvm/virtio"
 	"golang.org/x/arch/x86/x86asm"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -34,13 +40,32 @@ const (
 	initrdAddr  = 0xf000000
 	highMemBase = 0x100000
 
+	keyboardIRQ  = 1
+	serial2IRQ   = 3
 	serialIRQ    = 4
 	virtioNetIRQ = 9
 	virtioBlkIRQ = 10
+	virtioRngIRQ = 6
+
+	// The first network device uses virtioNetIRQ and virtio.NetIOPortStart;
+	// the others get the next free IRQs and IO ports from here on.
+	extraNetIOPortStart = 0x7000
 
 	pageTableBase = 0x30_000
 
+	// bootGDTAddr is where the GDT for a 64-bit entry goes, where PVH
+	// puts its GDT too.
+	bootGDTAddr = pvh.BootGDTStart
+
+	// __BOOT_CS and __BOOT_DS of the Linux boot protocol.
+	bootCS = 0x10
+	bootDS = 0x18
+
 	MinMemSize = 1 << 25
+
+	// MaxCmdlineSize is the longest kernel command line that fits between
+	// cmdlineAddr and the page tables, leaving room for the NUL.
+	MaxCmdlineSize = pageTableBase - cmdlineAddr - 1
 )
 
 const (
@@ -115,6 +140,10 @@ var ErrZeroSizeKernel = errors.New("kernel is 0 bytes")
 // ErrWriteToCF9 indicates a write to cf9, the standard x86 reset port.
 var ErrWriteToCF9 = fmt.Errorf("power cycle via 0xcf9")
 
+// ErrGuestPoweroff indicates the guest put itself in S5, soft off,
+// through the ACPI shutdown device.
+var ErrGuestPoweroff = iodev.ErrGuestPoweroff
+
 // ErrBadVA indicates a bad virtual address was used.
 var ErrBadVA = fmt.Errorf("bad virtual address")
 
@@ -129,37 +158,193 @@ var ErrMemTooSmall = fmt.Errorf("mem request must be at least 1<<20")
 
 var ErrNotELF64File = fmt.Errorf("file is not ELF64")
 
+// ErrNoEntryPoint indicates no kernel entry point has been set up yet.
+var ErrNoEntryPoint = errors.New("no entry point set up")
+
+// ErrInitrdTooLarge is returned if an initrd, decompressed if need be,
+// does not fit in memory below the MMIO hole.
+var ErrInitrdTooLarge = errors.New("initrd does not fit in memory")
+
+// ErrTooManyNICs is returned when no IRQ is left for another network device.
+var ErrTooManyNICs = errors.New("too many network interfaces")
+
+// ErrTooManyDisks is returned when no IRQ is left for another disk.
+var ErrTooManyDisks = errors.New("too many disks")
+
+// ErrCmdlineTooLong indicates the kernel command line is over MaxCmdlineSize.
+var ErrCmdlineTooLong = errors.New("kernel command line too long")
+
+// extraNetIRQs are the IRQs for network devices after the first.
+var extraNetIRQs = [...]uint8{11, 5, 7}
+
+// extraBlkIRQs are the IRQs for disks after the first, whose IO ports
+// follow virtio.BlkIOPortStart.
+var extraBlkIRQs = [...]uint8{12, 14, 15}
+
 var errPTNoteHasNoFSize = fmt.Errorf("elf programm PT_NOTE has file size equel zero")
 
 type Machine struct {
-	kvmFd, vmFd    uintptr
-	vcpuFds        []uintptr
-	mem            []byte
-	runs           []*kvm.RunData
-	pci            *pci.PCI
-	serial         *serial.Serial
-	devices        []iodev.Device
-	ioportHandlers [0x10000][2]func(port uint64, bytes []byte) error
+	kvmFd, vmFd     uintptr
+	vcpuFds         []uintptr
+	mem             []byte
+	runs            []*kvm.RunData
+	pci             *pci.PCI
+	serial          *serial.Serial
+	serial2         *serial.Serial
+	ps2             *iodev.PS2
+	guestStatus     *iodev.GuestStatus
+	devices         []iodev.Device
+	entry           func(vcpufd uintptr) error
+	reload          func() error
+	powerOn         []powerOn
+	vmPowerOn       vmPowerOn
+	vcpuStates      []atomic.Int32
+	vcpuTids        []atomic.Int32
+	hostCPUs        int
+	shutdown        atomic.Bool
+	tscDeadline     bool
+	cpuModel        CPUModel
+	cpuidOverrides  []CPUIDOverride
+	exceptionPolicy ExceptionPolicy
+	nics            int
+	disks           int
+	irqChip         IRQChip
+	ioapic          *ioapic
+	entry32         bool
+	memInit         MemInit
+	prealloc        bool
+	msrHandler      MSRHandler
+	clock           Clock
+	memFd           int
+	disabledExits   uint64
+	cpuLimit        int
+	coalesced       *kvm.CoalescedRing
+	coalescedMu     sync.Mutex
+	traceStart      uint64
+	traceEnd        uint64
+	symbols         []elf.Symbol
+	deviceThreads   sync.WaitGroup
+	quiesceOnce     sync.Once
+	closeOnce       sync.Once
+	closeErr        error
+	mmio            []mmioRange
+	msix            bool
+	msixBARs        int
+	ioportHandlers  [0x10000][2]func(port uint64, bytes []byte) error
 }
 
 // New creates a new KVM. This includes opening the kvm device, creating VM, creating
 // vCPUs, and attaching memory, disk (if needed), and tap (if needed).
+// Memory is poisoned.
 func New(kvmPath string, nCpus int, memSize int) (*Machine, error) {
+	return NewWithMemInit(kvmPath, nCpus, memSize, MemInitPoison)
+}
+
+// NewWithMemInit is like New, but initializes memory as mode says.
+func NewWithMemInit(kvmPath string, nCpus int, memSize int, mode MemInit) (*Machine, error) {
+	return NewWithOptions(kvmPath, nCpus, memSize, Options{MemInit: mode})
+}
+
+// Options are the less common settings of a Machine. The zero value is
+// what New uses.
+type Options struct {
+	MemInit MemInit
+	IRQChip IRQChip
+	// Prealloc faults in all of guest memory up front, so the guest does
+	// not take a page fault on the first touch of each page.
+	Prealloc bool
+	// Clock is what the RTC and ACPI PM timer read; nil means the host
+	// clock.
+	Clock Clock
+	// MemFD backs guest memory with a memfd, see Machine.MemFD.
+	MemFD bool
+	// DisableExits is a mask of kvm.X86DisableExits* bits. The vCPUs
+	// then idle in the guest rather than exit, which costs latency.
+	// Bits the host does not support are dropped, see DisabledExits.
+	DisableExits uint64
+	// CoalescedPIO buffers guest writes to the VGA, POST code and
+	// firmware debug ports in KVM, if it supports that, and handles
+	// them at the next exit. Output to those ports then shows up late.
+	CoalescedPIO bool
+	// MSIX gives the virtio devices an MSI-X capability, so the guest
+	// can use a vector per queue instead of a shared INTx line. It needs
+	// KVM_CAP_SIGNAL_MSI.
+	MSIX bool
+	// Entry32 starts a bzImage at its 32-bit entry point even if it has
+	// a 64-bit one.
+	Entry32 bool
+}
+
+// Clock is the time source of the device models.
+type Clock = iodev.Clock
+
+// NewWithOptions is like New, with the settings in opts.
+func NewWithOptions(kvmPath string, nCpus int, memSize int, opts Options) (*Machine, error) {
 	if memSize < MinMemSize {
 		return nil, fmt.Errorf("memory size %d:%w", memSize, ErrMemTooSmall)
 	}
 
-	m := &Machine{}
+	m := &Machine{
+		irqChip:  opts.IRQChip,
+		clock:    opts.Clock,
+		entry32:  opts.Entry32,
+		memInit:  opts.MemInit,
+		prealloc: opts.Prealloc,
+	}
+	if m.clock == nil {
+		m.clock = iodev.RealClock{}
+	}
 
 	m.pci = pci.New(pci.NewBridge())
+	m.guestStatus = &iodev.GuestStatus{}
+
+	// The 8042 reset is handled exactly like a reset via cf9.
+	m.ps2 = iodev.NewPS2(func() error {
+		return fmt.Errorf("write 0xfe to 0x64: %w", ErrWriteToCF9)
+	})
 
 	var err error
 
-	m.kvmFd, m.vmFd, m.vcpuFds, m.runs, err = initVMandVCPU(kvmPath, nCpus)
+	m.kvmFd, m.vmFd, m.vcpuFds, m.runs, err = initVMandVCPU(kvmPath, nCpus, opts)
 	if err != nil {
 		return nil, err
 	}
 
+	m.checkOvercommit()
+
+	if m.irqChip == IRQChipSplit {
+		if m.ioapic, err = newIOAPIC(m.vmFd); err != nil {
+			return nil, err
+		}
+
+		m.RegisterMMIO(ioapicBase, ioapicSize, m.ioapic.mmio)
+	}
+
+	if opts.DisableExits != 0 {
+		m.disabledExits = opts.DisableExits & supportedDisableExits(m.kvmFd)
+	}
+
+	if opts.CoalescedPIO {
+		if err := m.initCoalescedPIO(); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.MSIX {
+		if err := m.initMSIX(); err != nil {
+			return nil, err
+		}
+	}
+
+	m.vcpuStates = make([]atomic.Int32, len(m.vcpuFds))
+	m.vcpuTids = make([]atomic.Int32, len(m.vcpuFds))
+	m.ps2.IRQ = irqLine{vmFd: m.vmFd, irq: keyboardIRQ}.inject
+
+	// Offer the TSC-deadline timer if the in-kernel LAPIC can emulate it.
+	if ok, err := kvm.CheckExtension(m.kvmFd, kvm.CapTSCDeadlineTimer); err == nil && ok != 0 {
+		m.tscDeadline = true
+	}
+
 	// initCPUIDs here manually
 	for cpuNr := range m.runs {
 		if err := m.initCPUID(cpuNr); err != nil {
@@ -167,60 +352,258 @@ func New(kvmPath string, nCpus int, memSize int) (*Machine, error) {
 		}
 	}
 
+	if err := m.savePowerOn(); err != nil {
+		return nil, err
+	}
+
+	flags := syscall.MAP_SHARED | syscall.MAP_ANONYMOUS
+	if opts.Prealloc {
+		flags |= syscall.MAP_POPULATE
+	}
+
+	m.memFd = -1
+
+	// Past mmioHoleStart, RAM continues at 4G.
+	span := memSpan(memSize)
+
+	if opts.MemFD {
+		if m.memFd, err = newMemFD(span); err != nil {
+			return m, err
+		}
+
+		flags &^= syscall.MAP_ANONYMOUS
+	}
+
 	// Another coding anti-pattern reguired by golangci-lint.
 	// Would not pass review in Google.
-	if m.mem, err = syscall.Mmap(-1, 0, memSize,
-		syscall.PROT_READ|syscall.PROT_WRITE,
-		syscall.MAP_SHARED|syscall.MAP_ANONYMOUS); err != nil {
+	if m.mem, err = syscall.Mmap(m.memFd, 0, span,
+		syscall.PROT_READ|syscall.PROT_WRITE, flags); err != nil {
 		return m, err
 	}
 
-	err = kvm.SetUserMemoryRegion(m.vmFd, &kvm.UserspaceMemoryRegion{
-		Slot: 0, Flags: 0, GuestPhysAddr: 0, MemorySize: uint64(memSize),
-		UserspaceAddr: uint64(uintptr(unsafe.Pointer(&m.mem[0]))),
-	})
-	if err != nil {
+	if err := m.setMemoryRegions(memSize); err != nil {
 		return m, err
 	}
 
-	// Poison memory.
-	// 0 is valid instruction and if you start running in the middle of all those
-	// 0's it is impossible to diagnore.
-	for i := highMemBase; i < len(m.mem); i += len(Poison) {
-		copy(m.mem[i:], Poison)
+	if m.serial, err = serial.New(m); err != nil {
+		return m, err
 	}
 
+	if m.serial2, err = serial.NewAt(serial.COM2Addr, irqLine{vmFd: m.vmFd, irq: serial2IRQ}); err != nil {
+		return m, err
+	}
+
+	m.serial2.SetOutput(io.Discard)
+
+	// Where the CloudHv firmware puts the guest in S5.
+	m.AddDevice(iodev.NewACPIShutDownEvent())
+
+	// Until a kernel is loaded only the fixed ports are handled.
+	m.initIOPortHandlers()
+
+	m.initMemory(opts.MemInit)
+
 	return m, nil
 }
 
 func (m *Machine) AddTapIf(tapIfName string) error {
+	if m.nics > len(extraNetIRQs) {
+		return fmt.Errorf("tap %s: %w", tapIfName, ErrTooManyNICs)
+	}
+
 	t, err := tap.New(tapIfName)
 	if err != nil {
 		return err
 	}
 
-	v := virtio.NewNet(virtioNetIRQ, m, t, m.mem)
-	go v.TxThreadEntry()
-	go v.RxThreadEntry()
-	// 00:01.0 for Virtio net
+	var v *virtio.Net
+
+	if m.nics == 0 {
+		v = virtio.NewNet(virtioNetIRQ, m, t, m.mem)
+	} else {
+		irq := extraNetIRQs[m.nics-1]
+		port := extraNetIOPortStart + uint64(m.nics-1)*virtio.NetIOPortSize
+		v = virtio.NewNetAt(port, irq, irqLine{vmFd: m.vmFd, irq: uint32(irq)}, t, m.mem)
+	}
+
+	m.nics++
+
+	// Config changes, Rx and Tx.
+	m.addMSIX(v, 3)
+
+	m.goDevice(v.TxThreadEntry)
+	m.goDevice(v.RxThreadEntry)
+	// 00:01.0 for the first Virtio net
 	m.pci.Devices = append(m.pci.Devices, v)
 
 	return nil
 }
 
+// AddDisk attaches diskPath as the next virtio block device, /dev/vda
+// for the first, /dev/vdb for the second and so on.
 func (m *Machine) AddDisk(diskPath string) error {
-	v, err := virtio.NewBlk(diskPath, virtioBlkIRQ, m, m.mem)
+	f, err := os.OpenFile(diskPath, os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	return m.addBlk(f, uint64(fi.Size()), false)
+}
+
+// AddDiskMmap attaches diskPath like AddDisk, but serves requests from
+// a shared mapping of the file rather than with pread and pwrite. It
+// falls back to the latter if the file cannot be mapped.
+func (m *Machine) AddDiskMmap(diskPath string) error {
+	f, err := os.OpenFile(diskPath, os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	b, err := virtio.NewMmapBackend(f, false)
 	if err != nil {
 		return err
 	}
 
-	go v.IOThreadEntry()
-	// 00:02.0 for Virtio blk
+	return m.addBlk(b, uint64(fi.Size()), false)
+}
+
+// AddDiskFD attaches a disk that has already been opened, e.g. by a parent
+// process, like AddDisk. The fd is used as is and not reopened.
+func (m *Machine) AddDiskFD(fd int, readonly bool) error {
+	if fd < 0 {
+		return fmt.Errorf("disk fd %d: %w", fd, syscall.EBADF)
+	}
+
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("fd:%d", fd))
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	return m.addBlk(f, uint64(fi.Size()), readonly)
+}
+
+// addBlk attaches a virtio block device of size bytes served by b.
+func (m *Machine) addBlk(b virtio.DiskBackend, size uint64, readonly bool) error {
+	if m.disks > len(extraBlkIRQs) {
+		return fmt.Errorf("disk %d: %w", m.disks, ErrTooManyDisks)
+	}
+
+	var (
+		v   *virtio.Blk
+		err error
+	)
+
+	if m.disks == 0 {
+		v, err = virtio.NewBlkFromBackend(b, size, readonly, virtioBlkIRQ, m, m.mem)
+	} else {
+		irq := extraBlkIRQs[m.disks-1]
+		port := virtio.BlkIOPortStart + uint64(m.disks)*virtio.BlkIOPortSize
+		v, err = virtio.NewBlkFromBackendAt(port, b, size, readonly, irq,
+			irqLine{vmFd: m.vmFd, irq: uint32(irq)}, m.mem)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	m.disks++
+
+	m.addMSIX(v, 2)
+
+	m.goDevice(v.IOThreadEntry)
+	// 00:02.0 for the first Virtio blk
 	m.pci.Devices = append(m.pci.Devices, v)
 
 	return nil
 }
 
+// AddRng attaches a virtio entropy device, which feeds the guest
+// /dev/hwrng, and through it the entropy pool, from source.
+func (m *Machine) AddRng(source io.Reader) error {
+	v := virtio.NewRng(virtioRngIRQ, m, m.mem, source)
+	m.addMSIX(v, 2)
+
+	m.goDevice(v.IOThreadEntry)
+	m.pci.Devices = append(m.pci.Devices, v)
+
+	return nil
+}
+
+// SetDiskBlockSize advertises the logical and physical block sizes of
+// the first disk, e.g. 4096 and 4096 for a 4K native image.
+func (m *Machine) SetDiskBlockSize(logical, physical uint32) error {
+	v, err := m.disk()
+	if err != nil {
+		return err
+	}
+
+	return v.SetBlockSize(logical, physical)
+}
+
+// SetDiskSerial sets the serial the guest reads from the first disk, as
+// used for /dev/disk/by-id.
+func (m *Machine) SetDiskSerial(serial string) error {
+	v, err := m.disk()
+	if err != nil {
+		return err
+	}
+
+	return v.SetSerial(serial)
+}
+
+// SetVirtioDebugOutput has all virtio devices print counts of guest
+// register writes to w, at most once a second each. A nil w turns it off.
+func (m *Machine) SetVirtioDebugOutput(w io.Writer) {
+	for _, d := range m.pci.Devices {
+		if v, ok := d.(interface{ SetDebugOutput(w io.Writer) }); ok {
+			v.SetDebugOutput(w)
+		}
+	}
+}
+
+func (m *Machine) disk() (*virtio.Blk, error) {
+	for _, d := range m.pci.Devices {
+		if v, ok := d.(*virtio.Blk); ok {
+			return v, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no disk: %w", ErrUnsupported)
+}
+
+// LoadSMBIOS installs SMBIOS tables reporting the given system UUID,
+// serial number and product name in the legacy BIOS region.
+// An empty product keeps the default name.
+func (m *Machine) LoadSMBIOS(uuid, serial, product string) error {
+	s, err := smbios.New(uuid, serial)
+	if err != nil {
+		return err
+	}
+
+	s.Product = product
+
+	b, err := s.Bytes()
+	if err != nil {
+		return err
+	}
+
+	copy(m.mem[smbios.Start:], b)
+
+	return nil
+}
+
 // Translate translates a virtual address for all active CPUs
 // and returns a []*Translate or error.
 func (m *Machine) Translate(vaddr uint64) ([]*kvm.Translation, error) {
@@ -243,12 +626,16 @@ func (m *Machine) Translate(vaddr uint64) ([]*kvm.Translation, error) {
 // SetupRegs sets up the general purpose registers,
 // including a RIP and BP.
 func (m *Machine) SetupRegs(rip, bp uint64, amd64 bool) error {
-	for _, cpu := range m.vcpuFds {
-		if err := m.initRegs(cpu, rip, bp); err != nil {
+	m.entry = func(vcpufd uintptr) error {
+		if err := m.initRegs(vcpufd, rip, bp); err != nil {
 			return err
 		}
 
-		if err := m.initSregs(cpu, amd64); err != nil {
+		return m.initSregs(vcpufd, amd64)
+	}
+
+	for _, cpu := range m.vcpuFds {
+		if err := m.entry(cpu); err != nil {
 			return err
 		}
 	}
@@ -256,12 +643,89 @@ func (m *Machine) SetupRegs(rip, bp uint64, amd64 bool) error {
 	return nil
 }
 
+// Reset puts every vCPU, and the in-kernel interrupt controllers and
+// PIT, back as they were at power on, and resets the devices that
+// support it. With MemInitZero, RAM above 1 MiB is cleared. The images
+// given to LoadLinux or LoadPVH are loaded again, so that whatever the
+// guest wrote over them is gone, and the vCPUs start at their entry
+// point; without a loaded image, the vCPUs start at the entry point set
+// up by the last SetupRegs. The rest of guest memory is left as it is.
+// The vCPUs must not be running.
+func (m *Machine) Reset() error {
+	if m.entry == nil {
+		return fmt.Errorf("reset: %w", ErrNoEntryPoint)
+	}
+
+	if err := m.restoreVMPowerOn(); err != nil {
+		return fmt.Errorf("reset: %w", err)
+	}
+
+	for cpu, fd := range m.vcpuFds {
+		if err := m.restorePowerOn(cpu); err != nil {
+			return fmt.Errorf("reset cpu %d: %w", cpu, err)
+		}
+
+		if m.reload != nil {
+			continue
+		}
+
+		if err := m.entry(fd); err != nil {
+			return fmt.Errorf("reset cpu %d: %w", cpu, err)
+		}
+	}
+
+	if err := m.resetMemory(); err != nil {
+		return fmt.Errorf("reset: %w", err)
+	}
+
+	if m.reload != nil {
+		if err := m.reload(); err != nil {
+			return fmt.Errorf("reset: reload: %w", err)
+		}
+	}
+
+	for _, dev := range m.devices {
+		if r, ok := dev.(iodev.Resetter); ok {
+			r.Reset()
+		}
+	}
+
+	return nil
+}
+
 // RunData returns the kvm.RunData for the VM.
 func (m *Machine) RunData() []*kvm.RunData {
 	return m.runs
 }
 
+// LoadPVH loads a PVH kernel or firmware, an optional initrd, and a
+// command line. Reset loads them again.
 func (m *Machine) LoadPVH(kern, initrd *os.File, cmdline string) error {
+	if err := m.loadPVH(kern, initrd, cmdline); err != nil {
+		return err
+	}
+
+	m.reload = func() error {
+		return m.loadPVH(kern, initrd, cmdline)
+	}
+
+	if initrd != nil {
+		m.AddDevice(&iodev.Noop{Port: 0x80, Psize: 0x30}) // DMA Page Registers (Commonly 74L612 Chip)
+	} else {
+		m.AddDevice(&iodev.PostCode{}) // Port 0x80
+	}
+
+	m.AddDevice(&iodev.FWDebug{}) // Port 0x402
+	m.AddDevice(m.newCMOS(0xC000000, 0x0))
+	m.AddDevice(iodev.NewACPIPMTimerWithClock(m.clock))
+	m.initIOPortHandlers()
+
+	return nil
+}
+
+// loadPVH puts the PVH images into guest memory and the vCPUs at their
+// entry point.
+func (m *Machine) loadPVH(kern, initrd *os.File, cmdline string) error {
 	// Set EDBA-Pointer
 	edbaval := uint32(bootparam.EBDAStart >> 4)
 	edbabytes := make([]byte, 4)
@@ -326,12 +790,16 @@ func (m *Machine) LoadPVH(kern, initrd *os.File, cmdline string) error {
 		continue
 	}
 
-	for _, cpu := range m.vcpuFds {
-		if err := pvh.InitRegs(cpu, ripAddr); err != nil {
+	m.entry = func(vcpufd uintptr) error {
+		if err := pvh.InitRegs(vcpufd, ripAddr); err != nil {
 			return err
 		}
 
-		if err := pvh.InitSRegs(cpu, gdt); err != nil {
+		return pvh.InitSRegs(vcpufd, gdt)
+	}
+
+	for _, cpu := range m.vcpuFds {
+		if err := m.entry(cpu); err != nil {
 			return err
 		}
 	}
@@ -339,12 +807,16 @@ func (m *Machine) LoadPVH(kern, initrd *os.File, cmdline string) error {
 	pvhstartinfo := pvh.NewStartInfo(bootparam.EBDAStart, cmdlineAddr)
 
 	if initrd != nil {
-		initrdSize, err := initrd.ReadAt(m.mem[initrdAddr:], 0)
-		if err != nil && initrdSize == 0 && !errors.Is(err, io.EOF) {
-			return fmt.Errorf("initrd: (%v, %w)", initrdSize, err)
+		initrdSize, err := m.LoadInitrd(initrd)
+		if err != nil {
+			return err
 		}
 
 		// Load kernel command-line parameters
+		if len(cmdline) > MaxCmdlineSize {
+			return fmt.Errorf("%d bytes: %w", len(cmdline), ErrCmdlineTooLong)
+		}
+
 		copy(m.mem[cmdlineAddr:], cmdline)
 		m.mem[cmdlineAddr+len(cmdline)] = 0 // for null terminated string
 
@@ -359,10 +831,6 @@ func (m *Machine) LoadPVH(kern, initrd *os.File, cmdline string) error {
 		}
 
 		copy(m.mem[pvh.PVHModlistStart:], ramdiskmodbytes)
-
-		m.AddDevice(&iodev.Noop{Port: 0x80, Psize: 0x30}) // DMA Page Registers (Commonly 74L612 Chip)
-	} else {
-		m.AddDevice(&iodev.PostCode{}) // Port 0x80
 	}
 
 	memmapentries := make([]*pvh.HVMMemMapTableEntry, 0)
@@ -373,12 +841,10 @@ func (m *Machine) LoadPVH(kern, initrd *os.File, cmdline string) error {
 
 	memmapentries = append(memmapentries, entry0)
 
-	entry := pvh.NewMemMapTableEntry(
-		pvh.HighRAMStart,
-		uint64(len(m.mem)-pvh.HighRAMStart),
-		bootparam.E820Ram)
-
-	memmapentries = append(memmapentries, entry)
+	for _, r := range m.ramAbove(pvh.HighRAMStart) {
+		memmapentries = append(memmapentries,
+			pvh.NewMemMapTableEntry(r.start, r.size, bootparam.E820Ram))
+	}
 
 	pvhstartinfo.MemMapEntries = uint32(len(memmapentries))
 
@@ -404,21 +870,73 @@ func (m *Machine) LoadPVH(kern, initrd *os.File, cmdline string) error {
 
 	copy(m.mem[pvh.PVHInfoStart:], pvhstartinfob)
 
-	if m.serial, err = serial.New(m); err != nil {
+	return nil
+}
+
+// LoadInitrd copies an initrd into guest memory and returns its size.
+// A gzipped initrd is decompressed first, and the decompressed size is
+// returned.
+func (m *Machine) LoadInitrd(initrd io.ReaderAt) (int, error) {
+	var magic [2]byte
+
+	// The initrd must not run into the MMIO hole.
+	mem := m.ramFrom(initrdAddr)[initrdAddr:]
+
+	if n, _ := initrd.ReadAt(magic[:], 0); n < len(magic) || magic != [2]byte{0x1f, 0x8b} {
+		size, err := initrd.ReadAt(mem, 0)
+		if err != nil && size == 0 && !errors.Is(err, io.EOF) {
+			return 0, fmt.Errorf("initrd: (%v, %w)", size, err)
+		}
+
+		if size == len(mem) {
+			// Memory is full; make sure nothing is left over.
+			if n, _ := initrd.ReadAt(make([]byte, 1), int64(size)); n > 0 {
+				return 0, ErrInitrdTooLarge
+			}
+		}
+
+		return size, nil
+	}
+
+	zr, err := gzip.NewReader(io.NewSectionReader(initrd, 0, math.MaxInt64))
+	if err != nil {
+		return 0, fmt.Errorf("initrd: %w", err)
+	}
+
+	size, err := io.ReadFull(zr, mem)
+	if err == nil {
+		// Memory is full; make sure nothing is left over.
+		if n, _ := zr.Read(make([]byte, 1)); n > 0 {
+			return 0, ErrInitrdTooLarge
+		}
+	} else if !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return 0, fmt.Errorf("initrd: (%v, %w)", size, err)
+	}
+
+	return size, nil
+}
+
+// LoadLinux loads a bzImage or ELF file, an optional initrd, and
+// optional params. Reset loads them again.
+func (m *Machine) LoadLinux(kernel, initrd io.ReaderAt, params string) error {
+	if err := m.loadLinux(kernel, initrd, params); err != nil {
 		return err
 	}
 
-	m.AddDevice(&iodev.FWDebug{}) // Port 0x402
-	m.AddDevice(iodev.NewCMOS(0xC000000, 0x0))
-	m.AddDevice(iodev.NewACPIPMTimer())
+	m.reload = func() error {
+		return m.loadLinux(kernel, initrd, params)
+	}
+
+	m.AddDevice(m.newCMOS(0xC000_0000, 0x0))
+	m.AddDevice(&iodev.Noop{Port: 0x80, Psize: 0xA0})
 	m.initIOPortHandlers()
 
 	return nil
 }
 
-// LoadLinux loads a bzImage or ELF file, an optional initrd, and
-// optional params.
-func (m *Machine) LoadLinux(kernel, initrd io.ReaderAt, params string) error {
+// loadLinux puts the kernel, initrd, boot params and command line into
+// guest memory and the vCPUs at the kernel entry point.
+func (m *Machine) loadLinux(kernel, initrd io.ReaderAt, params string) error {
 	var (
 		DefaultKernelAddr = uint64(highMemBase)
 		err               error
@@ -439,13 +957,17 @@ func (m *Machine) LoadLinux(kernel, initrd io.ReaderAt, params string) error {
 	// Load initrd
 	var initrdSize int
 	if initrd != nil {
-		initrdSize, err = initrd.ReadAt(m.mem[initrdAddr:], 0)
-		if err != nil && initrdSize == 0 && !errors.Is(err, io.EOF) {
-			return fmt.Errorf("initrd: (%v, %w)", initrdSize, err)
+		initrdSize, err = m.LoadInitrd(initrd)
+		if err != nil {
+			return err
 		}
 	}
 
 	// Load kernel command-line parameters
+	if len(params) > MaxCmdlineSize {
+		return fmt.Errorf("%d bytes: %w", len(params), ErrCmdlineTooLong)
+	}
+
 	copy(m.mem[cmdlineAddr:], params)
 	m.mem[cmdlineAddr+len(params)] = 0 // for null terminated string
 
@@ -485,11 +1007,13 @@ func (m *Machine) LoadLinux(kernel, initrd io.ReaderAt, params string) error {
 		bootparam.MBBIOSEnd-bootparam.MBBIOSBegin,
 		bootparam.E820Reserved,
 	)
-	bootParam.AddE820Entry(
-		highMemBase,
-		uint64(len(m.mem)-highMemBase),
-		bootparam.E820Ram,
-	)
+	for _, r := range m.ramAbove(highMemBase) {
+		bootParam.AddE820Entry(r.start, r.size, bootparam.E820Ram)
+	}
+
+	if err := bootParam.ValidateE820(); err != nil {
+		return err
+	}
 
 	bootParam.Hdr.VidMode = 0xFFFF                                                                  // Proto ALL
 	bootParam.Hdr.TypeOfLoader = 0xFF                                                               // Proto 2.00+
@@ -523,13 +1047,24 @@ func (m *Machine) LoadLinux(kernel, initrd io.ReaderAt, params string) error {
 		// be loaded at address 0x10000 for Image/zImage kernels and highMemBase for bzImage kernels.
 		//
 		// refs: https://www.kernel.org/doc/html/latest/x86/boot.html#loading-the-rest-of-the-kernel
-		setupsz := int(bootParam.Hdr.SetupSects+1) * 512
+		setupsz := (int(bootParam.Hdr.SetupSects) + 1) * bootparam.SectorSize
 
 		kernSize, err = kernel.ReadAt(m.mem[DefaultKernelAddr:], int64(setupsz))
 
 		if err != nil && !errors.Is(err, io.EOF) {
 			return fmt.Errorf("kernel: (%v, %w)", kernSize, err)
 		}
+
+		// Prefer the 64-bit entry point when there is one, unless
+		// Options.Entry32 says otherwise. It expects long mode with the
+		// kernel, boot params and command line identity mapped, and boot
+		// params in RSI, as SetupRegs does for amd64.
+		//
+		// refs: https://www.kernel.org/doc/html/latest/x86/boot.html#id1
+		if bootParam.Has64BitEntry() && !m.entry32 {
+			DefaultKernelAddr += bootparam.Startup64Offset
+			amd64 = true
+		}
 	case true:
 		if k.Class == elf.ELFCLASS64 {
 			amd64 = true
@@ -537,6 +1072,10 @@ func (m *Machine) LoadLinux(kernel, initrd io.ReaderAt, params string) error {
 
 		DefaultKernelAddr = k.Entry
 
+		if syms, err := k.Symbols(); err == nil {
+			m.setSymbols(syms)
+		}
+
 		for i, p := range k.Progs {
 			if p.Type != elf.PT_LOAD {
 				continue
@@ -557,19 +1096,7 @@ func (m *Machine) LoadLinux(kernel, initrd io.ReaderAt, params string) error {
 		return ErrZeroSizeKernel
 	}
 
-	if err := m.SetupRegs(DefaultKernelAddr, bootParamAddr, amd64); err != nil {
-		return err
-	}
-
-	if m.serial, err = serial.New(m); err != nil {
-		return err
-	}
-
-	m.AddDevice(iodev.NewCMOS(0xC000_0000, 0x0))
-	m.AddDevice(&iodev.Noop{Port: 0x80, Psize: 0xA0})
-	m.initIOPortHandlers()
-
-	return nil
+	return m.SetupRegs(DefaultKernelAddr, bootParamAddr, amd64)
 }
 
 // GetInputChan returns a chan <- byte for serial.
@@ -597,6 +1124,46 @@ func (m *Machine) GetSRegs(cpu int) (*kvm.Sregs, error) {
 	return kvm.GetSregs(fd)
 }
 
+// AllRegs gets the regs of every vCPU, indexed by cpu. If some cannot be
+// read, their entries are nil and the errors are joined.
+// A vCPU that is in KVM_RUN is only read once it exits.
+func (m *Machine) AllRegs() ([]*kvm.Regs, error) {
+	regs := make([]*kvm.Regs, len(m.vcpuFds))
+	var errs []error
+
+	for cpu := range m.vcpuFds {
+		r, err := m.GetRegs(cpu)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cpu %d: %w", cpu, err))
+
+			continue
+		}
+
+		regs[cpu] = r
+	}
+
+	return regs, errors.Join(errs...)
+}
+
+// AllSRegs is AllRegs for the sregs.
+func (m *Machine) AllSRegs() ([]*kvm.Sregs, error) {
+	sregs := make([]*kvm.Sregs, len(m.vcpuFds))
+	var errs []error
+
+	for cpu := range m.vcpuFds {
+		s, err := m.GetSRegs(cpu)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cpu %d: %w", cpu, err))
+
+			continue
+		}
+
+		sregs[cpu] = s
+	}
+
+	return sregs, errors.Join(errs...)
+}
+
 // SetRegs sets regs for vCPU.
 func (m *Machine) SetRegs(cpu int, r *kvm.Regs) error {
 	fd, err := m.CPUToFD(cpu)
@@ -636,6 +1203,12 @@ func (m *Machine) initRegs(vcpufd uintptr, rip, bp uint64) error {
 	return nil
 }
 
+// bootGDT has flat 64-bit code at bootCS and flat data at bootDS.
+var bootGDT = [4]uint64{
+	bootCS >> 3: pvh.GdtEntry(0xa09b, 0, 0xfffff),
+	bootDS >> 3: pvh.GdtEntry(0xc093, 0, 0xfffff),
+}
+
 func (m *Machine) initSregs(vcpufd uintptr, amd64 bool) error {
 	sregs, err := kvm.GetSregs(vcpufd)
 	if err != nil {
@@ -725,25 +1298,21 @@ func (m *Machine) initSregs(vcpufd uintptr, amd64 bool) error {
 	sregs.CR0 = CR0xPE | CR0xMP | CR0xET | CR0xNE | CR0xWP | CR0xAM | CR0xPG
 	sregs.EFER = EFERxLME | EFERxLMA
 
-	seg := kvm.Segment{
-		Base:     0,
-		Limit:    0xffffffff,
-		Selector: 1 << 3,
-		Typ:      11, /* Code: execute, read, accessed */
-		Present:  1,
-		DPL:      0,
-		DB:       0,
-		S:        1, /* Code/data */
-		L:        1,
-		G:        1, /* 4KB granularity */
-		AVL:      0,
+	// The 64-bit entry wants a GDT loaded with flat segments at
+	// __BOOT_CS and __BOOT_DS, and those in the segment registers.
+	//
+	// refs: https://www.kernel.org/doc/html/latest/x86/boot.html#id1
+	for i, e := range bootGDT {
+		binary.LittleEndian.PutUint64(m.mem[bootGDTAddr+8*i:], e)
 	}
 
-	sregs.CS = seg
+	sregs.GDT = kvm.Descriptor{Base: bootGDTAddr, Limit: uint16(8*len(bootGDT) - 1)}
 
-	seg.Typ = 3 /* Data: read/write, accessed */
-	seg.Selector = 2 << 3
-	sregs.DS, sregs.ES, sregs.FS, sregs.GS, sregs.SS = seg, seg, seg, seg, seg
+	code := pvh.SegmentFromGDT(bootGDT[bootCS>>3], bootCS>>3)
+	data := pvh.SegmentFromGDT(bootGDT[bootDS>>3], bootDS>>3)
+
+	sregs.CS = code
+	sregs.DS, sregs.ES, sregs.FS, sregs.GS, sregs.SS = data, data, data, data, data
 
 	if err := kvm.SetSregs(vcpufd, sregs); err != nil {
 		return err
@@ -752,39 +1321,68 @@ func (m *Machine) initSregs(vcpufd uintptr, amd64 bool) error {
 	return nil
 }
 
-func (m *Machine) initCPUID(cpu int) error {
-	cpuid := kvm.CPUID{
-		Nent:    100,
-		Entries: make([]kvm.CPUIDEntry2, 100),
+// cpuidMaxEntries bounds how far supportedCPUID grows its buffer;
+// KVM itself caps it at KVM_MAX_CPUID_ENTRIES, currently 256.
+const cpuidMaxEntries = 4096
+
+// supportedCPUID calls get, e.g. kvm.GetSupportedCPUID, with a buffer
+// that is doubled for as long as get says it is too small (E2BIG), so
+// that no entries are dropped.
+func supportedCPUID(get func(*kvm.CPUID) error) (*kvm.CPUID, error) {
+	for n := 100; ; n *= 2 {
+		cpuid := &kvm.CPUID{
+			Nent:    uint32(n),
+			Entries: make([]kvm.CPUIDEntry2, n),
+		}
+
+		err := get(cpuid)
+		if err == nil {
+			return cpuid, nil
+		}
+
+		if !errors.Is(err, syscall.E2BIG) || n >= cpuidMaxEntries {
+			return nil, fmt.Errorf("KVM_GET_SUPPORTED_CPUID with %d entries: %w", n, err)
+		}
 	}
+}
 
-	if err := kvm.GetSupportedCPUID(m.kvmFd, &cpuid); err != nil {
+func (m *Machine) initCPUID(cpu int) error {
+	cpuid, err := supportedCPUID(func(c *kvm.CPUID) error {
+		return kvm.GetSupportedCPUID(m.kvmFd, c)
+	})
+	if err != nil {
 		return err
 	}
 
-	// https://www.kernel.org/doc/html/latest/virt/kvm/cpuid.html
-	for i := 0; i < int(cpuid.Nent); i++ {
-		switch cpuid.Entries[i].Function {
-		case kvm.CPUIDFuncPerMon:
-			cpuid.Entries[i].Eax = 0 // disable
+	modelCPUID(cpuid, m.cpuModel, m.tscDeadline)
 
-		case kvm.CPUIDSignature:
-			cpuid.Entries[i].Eax = kvm.CPUIDFeatures
-			cpuid.Entries[i].Ebx = 0x4b4d564b // KVMK
-			cpuid.Entries[i].Ecx = 0x564b4d56 // VMKV
-			cpuid.Entries[i].Edx = 0x4d       // M
+	if err := applyCPUIDOverrides(cpuid, m.cpuidOverrides); err != nil {
+		return err
+	}
 
-		case 7:
-			// Unset X86_FEATURE_FSRM (Fast Short Rep Mov)
-			cpuid.Entries[i].Edx &= ^(uint32(1) << 4)
+	if err := kvm.SetCPUID2(m.vcpuFds[cpu], cpuid); err != nil {
+		return err
+	}
 
-		default:
-			continue
+	return nil
+}
+
+// SetTSCDeadline shows or hides the TSC-deadline timer in the CPUID of
+// all vCPUs. It is on by default when KVM supports it, and must be
+// changed before the vCPUs first run.
+func (m *Machine) SetTSCDeadline(on bool) error {
+	if on {
+		if ok, err := kvm.CheckExtension(m.kvmFd, kvm.CapTSCDeadlineTimer); err != nil || ok == 0 {
+			return fmt.Errorf("TSC deadline timer: %w", ErrUnsupported)
 		}
 	}
 
-	if err := kvm.SetCPUID2(m.vcpuFds[cpu], &cpuid); err != nil {
-		return err
+	m.tscDeadline = on
+
+	for cpu := range m.vcpuFds {
+		if err := m.initCPUID(cpu); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -801,7 +1399,8 @@ func (m *Machine) SingleStep(onoff bool) error {
 	return nil
 }
 
-// RunInfiniteLoop runs the guest cpu until there is an error.
+// RunInfiniteLoop runs the guest cpu until there is an error or
+// the guest halts or Shutdown is called, in which case it returns nil.
 // If the error is ErrExitDebug, this function can be called again.
 func (m *Machine) RunInfiniteLoop(cpu int) error {
 	// https://www.kernel.org/doc/Documentation/virtual/kvm/api.txt
@@ -821,8 +1420,29 @@ func (m *Machine) RunInfiniteLoop(cpu int) error {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
+	m.vcpuTids[cpu].Store(int32(unix.Gettid()))
+	defer m.vcpuTids[cpu].Store(0)
+
+	var th *throttle
+	if m.cpuLimit > 0 && m.cpuLimit < 100 {
+		th = newThrottle(unix.Gettid(), m.cpuLimit)
+	}
+
 	for {
+		if m.shutdown.Load() {
+			return nil
+		}
+
+		if th != nil {
+			th.enter()
+		}
+
 		isContinue, err := m.RunOnce(cpu)
+
+		if th != nil {
+			th.leave()
+		}
+
 		if isContinue {
 			if err != nil {
 				fmt.Printf("%v\r\n", err)
@@ -831,32 +1451,67 @@ func (m *Machine) RunInfiniteLoop(cpu int) error {
 			continue
 		}
 
-		if err != nil {
-			return err
-		}
+		return err
 	}
 }
 
 // RunOnce runs the guest vCPU until it exits.
-func (m *Machine) RunOnce(cpu int) (bool, error) {
+// The state reported by VCPUState is updated around the run.
+func (m *Machine) RunOnce(cpu int) (isContinue bool, err error) { // nolint:nonamedreturns
 	fd, err := m.CPUToFD(cpu)
 	if err != nil {
 		return false, err
 	}
 
+	state := &m.vcpuStates[cpu]
+	state.Store(int32(RunStateRunning))
+
+	// KVM returns EINTR without touching exit_reason if the vCPU was
+	// kicked before it entered the guest, so do not leave a stale one.
+	m.runs[cpu].ExitReason = uint32(kvm.EXITINTR)
+
 	_ = kvm.Run(fd)
 	exit := kvm.ExitType(m.runs[cpu].ExitReason)
 
+	// Buffered writes happened before whatever caused this exit.
+	if err := m.drainCoalescedPIO(); err != nil {
+		return false, err
+	}
+
+	defer func() {
+		state.Store(int32(exitState(exit, isContinue, err)))
+	}()
+
 	switch exit {
 	case kvm.EXITHLT:
 		return false, err
 	case kvm.EXITIO:
 		direction, size, port, count, offset := m.runs[cpu].IO()
+		if err := checkIO(size, count, offset); err != nil {
+			return false, err
+		}
+
+		// A guest printing to the console exits once per byte.
+		if port == serial.COM1Addr && direction == kvm.EXITIOOUT && size == 1 && count == 1 &&
+			m.serial.WriteTHR(*(*byte)(unsafe.Add(unsafe.Pointer(m.runs[cpu]), offset))) {
+			return true, nil
+		}
+
 		f := m.ioportHandlers[port][direction]
 
-		bytes := (*(*[100]byte)(unsafe.Pointer(uintptr(unsafe.Pointer(m.runs[cpu])) + uintptr(offset))))[0:size]
-		for i := 0; i < int(count); i++ {
-			if err := f(port, bytes); err != nil {
+		// For string IO (ins/outs), the count elements follow each other.
+		data := unsafe.Slice((*byte)(unsafe.Add(unsafe.Pointer(m.runs[cpu]), offset)), count*size)
+		for i := uint64(0); i < count; i++ {
+			err := f(port, data[i*size:(i+1)*size])
+			if errors.Is(err, ErrGuestPoweroff) {
+				// Like a halt, but for all vCPUs: their run loops
+				// return nil.
+				m.Shutdown()
+
+				return false, nil
+			}
+
+			if err != nil {
 				return false, err
 			}
 		}
@@ -871,13 +1526,22 @@ func (m *Machine) RunOnce(cpu int) (bool, error) {
 	case kvm.EXITDEBUG:
 		return false, kvm.ErrDebug
 
+	case kvm.EXITFAILENTRY:
+		return false, m.runs[cpu].FailEntryError()
+
+	case kvm.EXITEXCEPTION:
+		return m.handleException(cpu)
+
+	case kvm.EXITX86RDMSR, kvm.EXITX86WRMSR:
+		return m.handleMSR(cpu, exit)
+
+	case kvm.EXITMMIO:
+		return m.handleMMIO(cpu)
+
 	case kvm.EXITDCR,
-		kvm.EXITEXCEPTION,
-		kvm.EXITFAILENTRY,
 		kvm.EXITHYPERCALL,
 		kvm.EXITINTERNALERROR,
 		kvm.EXITIRQWINDOWOPEN,
-		kvm.EXITMMIO,
 		kvm.EXITNMI,
 		kvm.EXITS390RESET,
 		kvm.EXITS390SIEIC,
@@ -888,6 +1552,10 @@ func (m *Machine) RunOnce(cpu int) (bool, error) {
 			return false, err
 		}
 
+		if err := m.poisonError(cpu, exit); err != nil {
+			return false, err
+		}
+
 		return false, fmt.Errorf("%w: %s", kvm.ErrUnexpectedExitReason, exit.String())
 	default:
 		if err != nil {
@@ -945,36 +1613,26 @@ func (m *Machine) initIOPortHandlers() {
 		return fmt.Errorf("write %#x to cf9: %w", bytes, ErrWriteToCF9)
 	}
 
-	// In ubuntu 20.04 on wsl2, the output to IO port 0x64 continued
-	// infinitely. To deal with this issue, refer to kvmtool and
-	// configure the input to the Status Register of the PS2 controller.
-	//
-	// refs:
-	// https://github.com/kvmtool/kvmtool/blob/0e1882a49f81cb15d328ef83a78849c0ea26eecc/hw/i8042.c#L312
-	// https://git.kernel.org/pub/scm/linux/kernel/git/will/kvmtool.git/tree/hw/i8042.c#n312
-	// https://wiki.osdev.org/%228042%22_PS/2_Controller
-	funcInbPS2 := func(port uint64, bytes []byte) error {
-		bytes[0] = 0x20
-
-		return nil
-	}
-
 	m.registerIOPortHandler(0, 0x10000, funcError, funcError)    // default handler
 	m.registerIOPortHandler(0xcf9, 0xcfa, funcNone, funcOutbCF9) // CF9
 	m.registerIOPortHandler(0x3c0, 0x3db, funcNone, funcNone)    // VGA
 	m.registerIOPortHandler(0x3b4, 0x3b6, funcNone, funcNone)    // VGA
-	m.registerIOPortHandler(0x2f8, 0x300, funcNone, funcNone)    // Serial port 2
 	m.registerIOPortHandler(0x3e8, 0x3f0, funcNone, funcNone)    // Serial port 3
 	m.registerIOPortHandler(0x2e8, 0x2f0, funcNone, funcNone)    // Serial port 4
 	m.registerIOPortHandler(0xcfe, 0xcff, funcNone, funcNone)    // unknown
 	m.registerIOPortHandler(0xcfa, 0xcfc, funcNone, funcNone)    // unknown
 	m.registerIOPortHandler(0xc000, 0xd000, funcNone, funcNone)  // PCI Configuration Space Access Mechanism #2
-	m.registerIOPortHandler(0x60, 0x70, funcInbPS2, funcNone)    // PS/2 Keyboard (Always 8042 Chip)
-	m.registerIOPortHandler(0xed, 0xee, funcNone, funcNone)      // 0xed is the new standard delay port.
+	m.registerIOPortHandler(0x60, 0x70, m.ps2.Read, m.ps2.Write) // PS/2 Keyboard (Always 8042 Chip)
+	m.registerIOPortHandler(iodev.GuestStatusPort, iodev.GuestStatusPort+1,
+		m.guestStatus.Read, m.guestStatus.Write)
+	m.registerIOPortHandler(0xed, 0xee, funcNone, funcNone) // 0xed is the new standard delay port.
 
 	// Serial port 1
 	m.registerIOPortHandler(serial.COM1Addr, serial.COM1Addr+8, m.serial.In, m.serial.Out)
 
+	// Serial port 2
+	m.registerIOPortHandler(serial.COM2Addr, serial.COM2Addr+8, m.serial2.In, m.serial2.Out)
+
 	// PCI configuration
 	//
 	// 0xcf8 for address register for PCI Config Space
@@ -992,19 +1650,50 @@ func (m *Machine) initIOPortHandlers() {
 	for _, dev := range m.pci.Devices {
 		m.registerIOPortHandler(dev.IOPort(), dev.IOPort()+dev.Size(), dev.Read, dev.Write)
 	}
+
+	if m.irqChip == IRQChipSplit {
+		// Nothing emulates the PICs and the PIT; they read as absent.
+		funcAbsent := func(port uint64, bytes []byte) error {
+			for i := range bytes {
+				bytes[i] = 0xff
+			}
+
+			return nil
+		}
+
+		m.registerIOPortHandler(0x20, 0x22, funcAbsent, funcNone)   // PIC master
+		m.registerIOPortHandler(0xa0, 0xa2, funcAbsent, funcNone)   // PIC slave
+		m.registerIOPortHandler(0x4d0, 0x4d2, funcAbsent, funcNone) // ELCR
+		m.registerIOPortHandler(0x40, 0x44, funcAbsent, funcNone)   // PIT
+	}
 }
 
-// InjectSerialIRQ injects a serial interrupt.
-func (m *Machine) InjectSerialIRQ() error {
-	if err := kvm.IRQLineStatus(m.vmFd, serialIRQ, 0); err != nil {
-		return err
+// SendKey queues a PS/2 set 1 scancode, e.g. 0x1e for 'a' pressed and
+// 0x9e for it released, at the 8042 data port and raises IRQ 1. It is
+// for guests that read the keyboard rather than the serial port.
+func (m *Machine) SendKey(scancode byte) error {
+	return m.ps2.SendKey(scancode)
+}
+
+// InjectSMI queues a system management interrupt on cpu. The guest
+// enters SMM the next time the vCPU runs.
+func (m *Machine) InjectSMI(cpu int) error {
+	if ok, err := kvm.CheckExtension(m.kvmFd, kvm.CapX86SMM); err != nil || ok == 0 {
+		return fmt.Errorf("SMI: %w", ErrUnsupported)
 	}
 
-	if err := kvm.IRQLineStatus(m.vmFd, serialIRQ, 1); err != nil {
+	fd, err := m.CPUToFD(cpu)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	return kvm.PutSMI(fd)
+}
+
+// InjectSerialIRQ injects a serial interrupt for the first serial port.
+// The second one interrupts on its own line.
+func (m *Machine) InjectSerialIRQ() error {
+	return irqLine{vmFd: m.vmFd, irq: serialIRQ}.inject()
 }
 
 // InjectViortNetIRQ injects a virtio net interrupt.
@@ -1033,20 +1722,110 @@ func (m *Machine) InjectVirtioBlkIRQ() error {
 	return nil
 }
 
+// irqLine injects a fixed IRQ, for devices that have a line of their own.
+type irqLine struct {
+	vmFd uintptr
+	irq  uint32
+}
+
+func (l irqLine) inject() error {
+	if err := kvm.IRQLineStatus(l.vmFd, l.irq, 0); err != nil {
+		return err
+	}
+
+	return kvm.IRQLineStatus(l.vmFd, l.irq, 1)
+}
+
+func (l irqLine) InjectSerialIRQ() error {
+	return l.inject()
+}
+
+func (l irqLine) InjectVirtioNetIRQ() error {
+	return l.inject()
+}
+
+func (l irqLine) InjectVirtioBlkIRQ() error {
+	return l.inject()
+}
+
+func (l irqLine) InjectVirtioRngIRQ() error {
+	return l.inject()
+}
+
+// InjectVirtioRngIRQ injects a virtio rng interrupt.
+func (m *Machine) InjectVirtioRngIRQ() error {
+	if err := kvm.IRQLineStatus(m.vmFd, virtioRngIRQ, 0); err != nil {
+		return err
+	}
+
+	if err := kvm.IRQLineStatus(m.vmFd, virtioRngIRQ, 1); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// newMemFD returns a memfd of size bytes to back guest memory.
+func newMemFD(size int) (int, error) {
+	fd, err := unix.MemfdCreate("gokvm-ram", unix.MFD_CLOEXEC)
+	if err != nil {
+		return -1, fmt.Errorf("memfd_create: %w", err)
+	}
+
+	if err := unix.Ftruncate(fd, int64(size)); err != nil {
+		unix.Close(fd)
+
+		return -1, err
+	}
+
+	return fd, nil
+}
+
+// MemFD returns the memfd backing guest memory, or -1 if the machine was
+// not created with Options.MemFD. Other processes, e.g. analysis tools,
+// can mmap it, through /proc/<pid>/fd or after it is passed to them, to
+// see guest RAM live. Guest physical address N is at offset N.
+func (m *Machine) MemFD() int {
+	return m.memFd
+}
+
+func (m *Machine) newCMOS(memBelow4G, memAbove4G uint64) *iodev.CMOS {
+	c := iodev.NewCMOS(memBelow4G, memAbove4G)
+	c.Clock = m.clock
+
+	return c
+}
+
 // ReadAt implements io.ReadAt for the kvm guest pvh.
+// Reading from the MMIO hole fails with ErrNotRAM, and a read that runs
+// into it stops there.
 func (m *Machine) ReadAt(b []byte, off int64) (int, error) {
-	mem := bytes.NewReader(m.mem)
+	if off >= 0 && off < int64(len(m.mem)) && !m.isRAM(uint64(off), 1) {
+		return 0, fmt.Errorf("%#x: %w", off, ErrNotRAM)
+	}
+
+	mem := bytes.NewReader(m.ramFrom(off))
 
 	return mem.ReadAt(b, off)
 }
 
 // WriteAt implements io.WriteAt for the kvm guest pvh.
+// A write that runs past the end of guest memory, or into the MMIO hole,
+// is cut short, and returns the bytes written with io.ErrShortWrite.
+// Writing to the MMIO hole fails with ErrNotRAM.
 func (m *Machine) WriteAt(b []byte, off int64) (int, error) {
-	if off > int64(len(m.mem)) {
+	if off < 0 || off > int64(len(m.mem)) {
 		return 0, syscall.EFBIG
 	}
 
-	n := copy(m.mem[off:], b)
+	if off < int64(len(m.mem)) && !m.isRAM(uint64(off), 1) {
+		return 0, fmt.Errorf("%#x: %w", off, ErrNotRAM)
+	}
+
+	n := copy(m.ramFrom(off)[off:], b)
+	if n < len(b) {
+		return n, io.ErrShortWrite
+	}
 
 	return n, nil
 }
@@ -1103,7 +1882,7 @@ func (m *Machine) VtoP(cpu int, vaddr uint64) (int64, error) {
 
 	// There can exist a valid translation for memory that does not exist.
 	// For now, we call that an error.
-	if t.Valid == 0 || t.PhysicalAddress > uint64(len(m.mem)) {
+	if t.Valid == 0 || !m.isRAM(t.PhysicalAddress, 1) {
 		return -1, fmt.Errorf("%#x:valid not set:%w", vaddr, ErrBadVA)
 	}
 
@@ -1190,6 +1969,7 @@ func GetReg(r *kvm.Regs, reg x86asm.Reg) (*uint64, error) {
 func initVMandVCPU(
 	kvmPath string,
 	nCpus int,
+	opts Options,
 ) (uintptr, uintptr, []uintptr, []*kvm.RunData, error) {
 	var err error
 
@@ -1215,12 +1995,15 @@ func initVMandVCPU(
 		return 0, 0, nil, nil, err
 	}
 
-	if err := kvm.CreateIRQChip(vmFd); err != nil {
+	if err := createIRQChip(vmFd, opts.IRQChip); err != nil {
 		return 0, 0, nil, nil, err
 	}
 
-	if err := kvm.CreatePIT2(vmFd); err != nil {
-		return 0, 0, nil, nil, err
+	// This has to happen before any vCPU is created.
+	if mask := opts.DisableExits & supportedDisableExits(kvmFd); mask != 0 {
+		if err := kvm.EnableCap(vmFd, kvm.CapX86DisableExits, mask); err != nil {
+			return 0, 0, nil, nil, fmt.Errorf("disable exits %#x: %w", mask, err)
+		}
 	}
 
 	mmapSize, err := kvm.GetVCPUMMmapSize(kvmFd)
@@ -1249,6 +2032,10 @@ func initVMandVCPU(
 }
 
 func (m *Machine) VCPU(stdout io.Writer, cpu, traceCount int) error {
+	if m.traceEnd != 0 {
+		return m.vcpuTraceRange(stdout, cpu, traceCount)
+	}
+
 	trace := traceCount > 0
 
 	var err error
@@ -1258,7 +2045,7 @@ func (m *Machine) VCPU(stdout io.Writer, cpu, traceCount int) error {
 	for tc := 0; ; tc++ {
 		err = m.RunInfiniteLoop(cpu)
 		if err == nil {
-			continue
+			return nil
 		}
 
 		if !errors.Is(err, kvm.ErrDebug) {
@@ -1286,6 +2073,19 @@ func (m *Machine) GetSerial() *serial.Serial {
 	return m.serial
 }
 
+// GetSerial2 returns the second serial port, ttyS1 in Linux. Its output
+// is discarded unless set with SetOutput.
+func (m *Machine) GetSerial2() *serial.Serial {
+	return m.serial2
+}
+
+// OnGuestStatus sets f to be called with each status the guest writes
+// to iodev.GuestStatusPort. It runs on the vCPU thread, so it must not
+// block. It must be called before the guest runs.
+func (m *Machine) OnGuestStatus(f func(iodev.GuestStatusCode)) {
+	m.guestStatus.Notify = f
+}
+
 func (m *Machine) AddDevice(dev iodev.Device) {
 	m.devices = append(m.devices, dev)
 }
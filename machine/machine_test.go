@@ -2,14 +2,23 @@ package machine_test
 
 import (
 	"bytes"
+	"compress/gzip"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/bobuhiro11/gokvm/bootparam"
 	"github.com/bobuhiro11/gokvm/kvm"
 	"github.com/bobuhiro11/gokvm/machine"
 	"github.com/bobuhiro11/gokvm/pvh"
@@ -268,6 +277,16 @@ func TestReadWriteAt(t *testing.T) {
 		t.Fatalf("WriteAt(_, 1<<30): (%d, %v) != (%d, %v)", n, err, 0, syscall.EFBIG)
 	}
 
+	if n, err := m.WriteAt(zeros[:], -1); !errors.Is(err, syscall.EFBIG) {
+		t.Fatalf("WriteAt(_, -1): (%d, %v) != (%d, %v)", n, err, 0, syscall.EFBIG)
+	}
+
+	// A write straddling the end of memory stops there.
+	end := int64(machine.MinMemSize)
+	if n, err := m.WriteAt(zeros[:], end-3); !errors.Is(err, io.ErrShortWrite) || n != 3 {
+		t.Fatalf("WriteAt(_, %#x): (%d, %v) != (%d, %v)", end-3, n, err, 3, io.ErrShortWrite)
+	}
+
 	var got [8]byte
 	if n, err := m.ReadAt(got[:], off); err != nil || n != len(got) {
 		t.Fatalf("ReedAt(got, %#x): (%d,%v) != (%d,nil)", off, n, err, len(got))
@@ -619,3 +638,1783 @@ func TestGetReg(t *testing.T) { // nolint:paralleltest
 		t.Errorf("GetReg(r, x86asm.AL): got nil, want err")
 	}
 }
+
+func TestReset(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 2, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("Open: got %v, want nil", err)
+	}
+
+	if err := m.Reset(); !errors.Is(err, machine.ErrNoEntryPoint) {
+		t.Fatalf("Reset before SetupRegs: got %v, want %v", err, machine.ErrNoEntryPoint)
+	}
+
+	const rip = 0x1_00_000
+
+	if err := m.SetupRegs(rip, 0x10_000, true); err != nil {
+		t.Fatalf("SetupRegs: got %v, want nil", err)
+	}
+
+	for cpu := 0; cpu < 2; cpu++ {
+		r, err := m.GetRegs(cpu)
+		if err != nil {
+			t.Fatalf("GetRegs(%d): got %v, want nil", cpu, err)
+		}
+
+		r.RIP, r.RAX = 0x1234, 0x5678
+
+		if err := m.SetRegs(cpu, r); err != nil {
+			t.Fatalf("SetRegs(%d): got %v, want nil", cpu, err)
+		}
+	}
+
+	if err := m.Reset(); err != nil {
+		t.Fatalf("Reset: got %v, want nil", err)
+	}
+
+	for cpu := 0; cpu < 2; cpu++ {
+		r, err := m.GetRegs(cpu)
+		if err != nil {
+			t.Fatalf("GetRegs(%d): got %v, want nil", cpu, err)
+		}
+
+		if r.RIP != rip || r.RAX != 0 {
+			t.Errorf("cpu %d after Reset: RIP %#x, RAX %#x, want %#x, 0", cpu, r.RIP, r.RAX, rip)
+		}
+	}
+}
+
+func TestResetToPowerOn(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("Open: got %v, want nil", err)
+	}
+
+	// A guest that got as far as long mode, with paging on and a
+	// SYSCALL entry point.
+	if err := m.SetupRegs(0x1_00_000, 0x10_000, true); err != nil {
+		t.Fatalf("SetupRegs: got %v, want nil", err)
+	}
+
+	fd, err := m.CPUToFD(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const lstar = 0xc0000082
+
+	msrs := &kvm.MSRS{NMSRs: 1, Entries: []kvm.MSREntry{{Index: lstar, Data: 0xffffffff81000000}}}
+	if err := kvm.SetMSRs(fd, msrs); err != nil {
+		t.Fatalf("SetMSRs: got %v, want nil", err)
+	}
+
+	// The 32-bit entry only sets CR0.PE on top of what it finds.
+	if err := m.SetupRegs(0x1_00_000, 0x10_000, false); err != nil {
+		t.Fatalf("SetupRegs: got %v, want nil", err)
+	}
+
+	if err := m.Reset(); err != nil {
+		t.Fatalf("Reset: got %v, want nil", err)
+	}
+
+	s, err := m.GetSRegs(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.CR0&(1<<31) != 0 || s.CR0&1 == 0 || s.CR4&(1<<5) != 0 || s.CR3 != 0 || s.EFER != 0 {
+		t.Errorf("after Reset: CR0 %#x, CR3 %#x, CR4 %#x, EFER %#x, want protected mode without paging",
+			s.CR0, s.CR3, s.CR4, s.EFER)
+	}
+
+	msrs = &kvm.MSRS{NMSRs: 1, Entries: []kvm.MSREntry{{Index: lstar}}}
+	if err := kvm.GetMSRs(fd, msrs); err != nil {
+		t.Fatalf("GetMSRs: got %v, want nil", err)
+	}
+
+	if got := msrs.Entries[0].Data; got != 0 {
+		t.Errorf("LSTAR after Reset: got %#x, want 0", got)
+	}
+}
+
+func TestResetReloadsImages(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const entry = 0x1_00_000
+
+	// An ELF kernel of a single segment: mov al, 0xfe; out 0x64, al
+	code := []byte{0xb0, 0xfe, 0xe6, 0x64}
+
+	var kern bytes.Buffer
+
+	hdr := elf.Header64{
+		Ident:     [elf.EI_NIDENT]byte{0x7f, 'E', 'L', 'F', byte(elf.ELFCLASS64), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT)},
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Entry:     entry,
+		Phoff:     64,
+		Ehsize:    64,
+		Phentsize: 56,
+		Phnum:     1,
+	}
+	prog := elf.Prog64{
+		Type:   uint32(elf.PT_LOAD),
+		Flags:  uint32(elf.PF_R | elf.PF_X),
+		Off:    64 + 56,
+		Vaddr:  entry,
+		Paddr:  entry,
+		Filesz: uint64(len(code)),
+		Memsz:  uint64(len(code)),
+	}
+
+	for _, v := range []any{hdr, prog, code} {
+		if err := binary.Write(&kern, binary.LittleEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := m.LoadLinux(bytes.NewReader(kern.Bytes()), nil, "console=ttyS0"); err != nil {
+		t.Fatalf("LoadLinux: got %v, want nil", err)
+	}
+
+	// The guest overwrites its own kernel and moves on before it resets.
+	if _, err := m.WriteAt([]byte{0xf4, 0xf4, 0xf4, 0xf4}, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetRegs(0, &kvm.Regs{RIP: 0x2000, RFLAGS: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Reset(); err != nil {
+		t.Fatalf("Reset: got %v, want nil", err)
+	}
+
+	got := make([]byte, len(code))
+	if _, err := m.ReadAt(got, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, code) {
+		t.Errorf("kernel after Reset: got % x, want % x", got, code)
+	}
+
+	r, err := m.GetRegs(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.RIP != entry {
+		t.Errorf("RIP after Reset: got %#x, want %#x", r.RIP, entry)
+	}
+}
+
+func TestLoadLinuxEntry(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	// A bzImage header of protocol 2.15 with a 64-bit entry point.
+	hdr := bootparam.SetupHeader{
+		SetupSects: 4,
+		SysSize:    0x100,
+		BootFlag:   bootparam.BootFlag,
+		Header:     bootparam.MagicSignature,
+		Version:    0x020f,
+		XloadFlags: bootparam.XLFKernel64,
+	}
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+
+	img := make([]byte, 5*bootparam.SectorSize+0x100*16)
+	copy(img[0x1f1:], buf.Bytes())
+
+	for _, tt := range []struct {
+		name    string
+		entry32 bool
+		rip     uint64
+		cs, ds  uint16
+		efer    uint64
+	}{
+		// __BOOT_CS and __BOOT_DS, in a GDT that has them.
+		{name: "64-bit", rip: 0x100200, cs: 0x10, ds: 0x18, efer: machine.EFERxLME | machine.EFERxLMA},
+		{name: "32-bit", entry32: true, rip: 0x100000},
+	} {
+		m, err := machine.NewWithOptions("/dev/kvm", 1, machine.MinMemSize,
+			machine.Options{Entry32: tt.entry32, MemInit: machine.MemInitNone})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := m.LoadLinux(bytes.NewReader(img), nil, ""); err != nil {
+			t.Fatalf("%s: LoadLinux: got %v, want nil", tt.name, err)
+		}
+
+		r, err := m.GetRegs(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := m.GetSRegs(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.RIP != tt.rip || s.EFER != tt.efer {
+			t.Errorf("%s: RIP %#x, EFER %#x, want %#x, %#x", tt.name, r.RIP, s.EFER, tt.rip, tt.efer)
+		}
+
+		if tt.entry32 {
+			continue
+		}
+
+		if s.CS.Selector != tt.cs || s.CS.L != 1 || s.DS.Selector != tt.ds || s.SS.Selector != tt.ds {
+			t.Errorf("%s: CS %#x (L %d), DS %#x, SS %#x, want %#x (L 1), %#x, %#x",
+				tt.name, s.CS.Selector, s.CS.L, s.DS.Selector, s.SS.Selector, tt.cs, tt.ds, tt.ds)
+		}
+
+		gdt := make([]byte, int(s.GDT.Limit)+1)
+		if _, err := m.ReadAt(gdt, int64(s.GDT.Base)); err != nil {
+			t.Fatal(err)
+		}
+
+		// The descriptors the guest reloads must match the segments.
+		for _, seg := range []kvm.Segment{s.CS, s.DS} {
+			if int(seg.Selector)+8 > len(gdt) {
+				t.Errorf("%s: selector %#x is past the GDT limit %#x", tt.name, seg.Selector, s.GDT.Limit)
+
+				continue
+			}
+
+			d := binary.LittleEndian.Uint64(gdt[seg.Selector:])
+			if got := pvh.SegmentFromGDT(d, uint8(seg.Selector>>3)); got != seg {
+				t.Errorf("%s: GDT entry %#x: got %+v, want %+v", tt.name, seg.Selector, got, seg)
+			}
+		}
+	}
+}
+
+func TestLoadGzipInitrd(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, 1<<29)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := bytes.Repeat([]byte("gokvm initrd\n"), 100)
+
+	var buf bytes.Buffer
+
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(want); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := m.LoadInitrd(bytes.NewReader(buf.Bytes()))
+	if err != nil || n != len(want) {
+		t.Fatalf("LoadInitrd: (%d, %v) != (%d, nil)", n, err, len(want))
+	}
+
+	// initrd is loaded at 0xf000000.
+	got := make([]byte, len(want))
+	if _, err := m.ReadAt(got, 0xf000000); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Fatalf("initrd in memory: %q != %q", got[:16], want[:16])
+	}
+}
+
+func TestLoadSMBIOS(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.LoadSMBIOS("00112233-4455-6677-8899-aabbccddeeff", "GOKVM-0001", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Look for the anchor like the guest does.
+	bios := make([]byte, 0x10000)
+	if _, err := m.ReadAt(bios, 0xf0000); err != nil {
+		t.Fatal(err)
+	}
+
+	ep := -1
+
+	for off := 0; off < len(bios); off += 16 {
+		if bytes.HasPrefix(bios[off:], []byte("_SM_")) {
+			ep = off
+
+			break
+		}
+	}
+
+	if ep < 0 {
+		t.Fatal("SMBIOS anchor not found")
+	}
+
+	addr := int(binary.LittleEndian.Uint32(bios[ep+0x18:])) - 0xf0000
+	count := int(binary.LittleEndian.Uint16(bios[ep+0x1c:]))
+
+	for i := 0; i < count; i++ {
+		typ, length := bios[addr], int(bios[addr+1])
+
+		if typ == 1 {
+			want := []byte{
+				0x33, 0x22, 0x11, 0x00, 0x55, 0x44, 0x77, 0x66,
+				0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff,
+			}
+			if got := bios[addr+8 : addr+24]; !bytes.Equal(got, want) {
+				t.Fatalf("system UUID: got %x, want %x", got, want)
+			}
+
+			return
+		}
+
+		// Skip the formatted area and the double NUL terminated strings.
+		addr += length
+		for bios[addr] != 0 || bios[addr+1] != 0 {
+			addr++
+		}
+
+		addr += 2
+	}
+
+	t.Fatal("no system information structure found")
+}
+
+func TestVCPUState(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("Open: got %v, want nil", err)
+	}
+
+	if s := m.VCPUState(0); s != machine.RunStateStopped {
+		t.Fatalf("VCPUState before run: got %v, want %v", s, machine.RunStateStopped)
+	}
+
+	// The guest runs straight into poisoned memory.
+	if err := m.SetupRegs(0x1_00_000, 0x10_000, true); err != nil {
+		t.Fatalf("SetupRegs: got %v, want nil", err)
+	}
+
+	if err := m.SingleStep(true); err != nil {
+		t.Fatalf("SingleStep: got %v, want nil", err)
+	}
+
+	if _, err := m.RunOnce(0); !errors.Is(err, kvm.ErrDebug) {
+		t.Fatalf("RunOnce: got %v, want %v", err, kvm.ErrDebug)
+	}
+
+	if s := m.VCPUState(0); s != machine.RunStatePaused {
+		t.Fatalf("VCPUState after single step: got %v, want %v", s, machine.RunStatePaused)
+	}
+
+	if err := m.SingleStep(false); err != nil {
+		t.Fatalf("SingleStep: got %v, want nil", err)
+	}
+
+	if err := m.RunInfiniteLoop(0); err == nil {
+		t.Fatal("RunInfiniteLoop: got nil, want error")
+	}
+
+	if s := m.VCPUState(0); s != machine.RunStateError {
+		t.Fatalf("VCPUState after crash: got %v, want %v", s, machine.RunStateError)
+	}
+}
+
+func TestNewWithMemInit(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	zeros := make([]byte, len(machine.Poison))
+
+	for _, tt := range []struct {
+		mode string
+		want []byte
+	}{
+		{mode: "poison", want: []byte(machine.Poison)},
+		{mode: "zero", want: zeros},
+		{mode: "none", want: zeros},
+	} {
+		mode, err := machine.ParseMemInit(tt.mode)
+		if err != nil {
+			t.Fatalf("ParseMemInit(%q): got %v, want nil", tt.mode, err)
+		}
+
+		m, err := machine.NewWithMemInit("/dev/kvm", 1, machine.MinMemSize, mode)
+		if err != nil {
+			t.Fatalf("NewWithMemInit(%v): got %v, want nil", mode, err)
+		}
+
+		for _, off := range []int64{0x1_00_000, 0x1_000_000, machine.MinMemSize - 8} {
+			got := make([]byte, len(tt.want))
+			if _, err := m.ReadAt(got, off); err != nil {
+				t.Fatalf("%v: ReadAt(%#x): got %v, want nil", mode, off, err)
+			}
+
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("%v: memory at %#x: got %#x, want %#x", mode, off, got, tt.want)
+			}
+		}
+	}
+
+	if _, err := machine.ParseMemInit("random"); !errors.Is(err, machine.ErrBadMemInit) {
+		t.Errorf("ParseMemInit(random): got %v, want %v", err, machine.ErrBadMemInit)
+	}
+}
+
+func TestLoadLinux64BitEntry(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	kern, err := os.Open("../bzImage")
+	if err != nil {
+		t.Skipf("Skipping test: %v", err)
+	}
+	defer kern.Close()
+
+	b, err := bootparam.New(kern)
+	if err != nil {
+		t.Skipf("Skipping test: %v", err)
+	}
+
+	if !b.Has64BitEntry() {
+		t.Skip("Skipping test since bzImage has no 64-bit entry point")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, 1<<29)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.LoadLinux(kern, nil, "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := m.GetRegs(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The protected-mode kernel is loaded at 1 MiB.
+	if want := uint64(0x1_00_000 + bootparam.Startup64Offset); r.RIP != want {
+		t.Errorf("RIP: got %#x, want %#x", r.RIP, want)
+	}
+
+	if r.RSI != 0x10_000 {
+		t.Errorf("RSI: got %#x, want boot params at %#x", r.RSI, 0x10_000)
+	}
+
+	s, err := m.GetSRegs(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.EFER&machine.EFERxLMA == 0 {
+		t.Errorf("EFER %#x: long mode is not active", s.EFER)
+	}
+}
+
+func TestInjectSMI(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.InjectSMI(0); errors.Is(err, machine.ErrUnsupported) {
+		t.Skipf("Skipping test since SMM is not supported")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.InjectSMI(42); !errors.Is(err, machine.ErrBadCPU) {
+		t.Errorf("InjectSMI(42): got %v, want %v", err, machine.ErrBadCPU)
+	}
+}
+
+func TestSetTSCDeadline(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := m.CPUToFD(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := func() bool {
+		t.Helper()
+
+		cpuid := kvm.CPUID{
+			Nent:    100,
+			Entries: make([]kvm.CPUIDEntry2, 100),
+		}
+
+		if err := kvm.GetCPUID2(fd, &cpuid); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, e := range cpuid.Entries[:cpuid.Nent] {
+			if e.Function == kvm.CPUIDFuncInfo {
+				return e.Ecx&kvm.CPUIDInfoECXTSCDeadline != 0
+			}
+		}
+
+		t.Fatal("no CPUID leaf 1")
+
+		return false
+	}
+
+	if err := m.SetTSCDeadline(true); errors.Is(err, machine.ErrUnsupported) {
+		t.Skip("Skipping test since KVM has no TSC deadline timer")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	if !deadline() {
+		t.Error("TSC deadline bit is clear after SetTSCDeadline(true)")
+	}
+
+	if err := m.SetTSCDeadline(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if deadline() {
+		t.Error("TSC deadline bit is set after SetTSCDeadline(false)")
+	}
+}
+
+func TestPoisonError(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("Open: got %v, want nil", err)
+	}
+
+	// Nothing is loaded at 16 MiB.
+	if err := m.SetupRegs(0x1_000_000, 0x10_000, true); err != nil {
+		t.Fatalf("SetupRegs: got %v, want nil", err)
+	}
+
+	_, err = m.RunOnce(0)
+	if !errors.Is(err, machine.ErrPoison) || !errors.Is(err, kvm.ErrUnexpectedExitReason) {
+		t.Fatalf("RunOnce: got %v, want %v", err, machine.ErrPoison)
+	}
+
+	// The ud2 is 6 bytes into the pattern.
+	if msg := err.Error(); !strings.Contains(msg, "Poison") || !strings.Contains(msg, "RIP 0x1000006") {
+		t.Errorf("RunOnce: %q does not name Poison and the RIP", msg)
+	}
+}
+
+func TestPendingIRQs(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("Open: got %v, want nil", err)
+	}
+
+	// The PIC is not initialized, so IRQ 4 shows up as vector 4.
+	if err := m.InjectSerialIRQ(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := m.PendingIRQs(); err != nil || len(got) != 1 || got[0] != 4 {
+		t.Fatalf("PendingIRQs: got (%v, %v), want ([4], nil)", got, err)
+	}
+
+	code := []byte{
+		0xb0, 0x0c, // mov al, 0x0c (OCW3: poll)
+		0xe6, 0x20, // out 0x20, al
+		0xe4, 0x20, // in al, 0x20 (acknowledges IRQ 4)
+		0xb0, 0x20, // mov al, 0x20 (OCW2: non-specific EOI)
+		0xe6, 0x20, // out 0x20, al
+		0xb0, 0xfe, // mov al, 0xfe
+		0xe6, 0x64, // out 0x64, al (reset)
+	}
+
+	if _, err := m.WriteAt(code, 0x1_00_000); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetupRegs(0x1_00_000, 0x10_000, true); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		if _, err := m.RunOnce(0); err != nil {
+			if !errors.Is(err, machine.ErrWriteToCF9) {
+				t.Fatalf("RunOnce: got %v, want %v", err, machine.ErrWriteToCF9)
+			}
+
+			break
+		}
+	}
+
+	if got, err := m.PendingIRQs(); err != nil || len(got) != 0 {
+		t.Fatalf("PendingIRQs after EOI: got (%v, %v), want ([], nil)", got, err)
+	}
+
+	if err := m.InjectSerialIRQ(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.ClearPendingIRQs(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := m.PendingIRQs(); err != nil || len(got) != 0 {
+		t.Fatalf("PendingIRQs after clearing: got (%v, %v), want ([], nil)", got, err)
+	}
+}
+
+func TestLoadLinuxCmdlineTooLong(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("Open: got %v, want nil", err)
+	}
+
+	kern, err := os.CreateTemp(t.TempDir(), "kernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kern.Close()
+
+	params := strings.Repeat("a", machine.MaxCmdlineSize+1)
+	if err := m.LoadLinux(kern, nil, params); !errors.Is(err, machine.ErrCmdlineTooLong) {
+		t.Fatalf("LoadLinux: got %v, want %v", err, machine.ErrCmdlineTooLong)
+	}
+}
+
+func TestResetMemInit(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	pattern := []byte("left over from the last boot")
+
+	for _, tt := range []struct {
+		name string
+		opts machine.Options
+		want []byte
+	}{
+		{name: "zero", opts: machine.Options{MemInit: machine.MemInitZero}, want: make([]byte, len(pattern))},
+		{name: "zero, prealloc", opts: machine.Options{MemInit: machine.MemInitZero, Prealloc: true}, want: make([]byte, len(pattern))},
+		{name: "none", opts: machine.Options{MemInit: machine.MemInitNone}, want: pattern},
+	} {
+		m, err := machine.NewWithOptions("/dev/kvm", 1, machine.MinMemSize, tt.opts)
+		if err != nil {
+			t.Fatalf("%s: NewWithOptions: got %v, want nil", tt.name, err)
+		}
+
+		if err := m.SetupRegs(0x1_00_000, 0x10_000, true); err != nil {
+			t.Fatal(err)
+		}
+
+		offs := []int64{0x1_00_000, 0x1_000_000, machine.MinMemSize - int64(len(pattern))}
+
+		for _, off := range offs {
+			if _, err := m.WriteAt(pattern, off); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := m.Reset(); err != nil {
+			t.Fatalf("%s: Reset: got %v, want nil", tt.name, err)
+		}
+
+		for _, off := range offs {
+			got := make([]byte, len(pattern))
+			if _, err := m.ReadAt(got, off); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("%s: memory at %#x after Reset: got %q, want %q", tt.name, off, got, tt.want)
+			}
+		}
+
+		if err := m.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.NewWithMemInit("/dev/kvm", 1, machine.MinMemSize, machine.MemInitZero)
+	if err != nil {
+		t.Fatalf("Open: got %v, want nil", err)
+	}
+
+	pattern := []byte("gokvm-scan-marker")
+	// The last one straddles a page boundary.
+	want := []int64{0x100_000, 0x100_840, 0x1f0_001, 0x200_ff8}
+
+	for _, off := range want {
+		if _, err := m.WriteAt(pattern, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := m.Scan(pattern, 1); !reflect.DeepEqual(got, want) {
+		t.Errorf("Scan: got %#x, want %#x", got, want)
+	}
+
+	if got := m.Scan(pattern, 8); !reflect.DeepEqual(got, []int64{0x100_000, 0x100_840, 0x200_ff8}) {
+		t.Errorf("Scan aligned to 8: got %#x", got)
+	}
+
+	if got := m.Scan(nil, 1); len(got) != 0 {
+		t.Errorf("Scan of nothing: got %#x, want none", got)
+	}
+
+	// The 64-bit page tables map the low memory one to one.
+	if err := m.SetupRegs(0x1_00_000, 0x10_000, true); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := m.ScanVirtual(0, 0x100_000, 0x202_000, pattern, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("ScanVirtual: got %#x, want %#x", got, want)
+	}
+
+	for i := range got {
+		if got[i] != uint64(want[i]) {
+			t.Fatalf("ScanVirtual: got %#x, want %#x", got, want)
+		}
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("Open: got %v, want nil", err)
+	}
+
+	if err := m.SetupRegs(0x1_00_000, 0x10_000, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SelfTest(0); err != nil {
+		t.Fatalf("SelfTest: got %v, want nil", err)
+	}
+
+	s, err := m.GetSRegs(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Poisoned memory makes no page table.
+	s.CR3 = 0x1_000_000
+
+	if err := m.SetSRegs(0, s); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SelfTest(0); !errors.Is(err, machine.ErrSelfTest) {
+		t.Fatalf("SelfTest with CR3 clobbered: got %v, want %v", err, machine.ErrSelfTest)
+	}
+}
+
+func TestSplitIRQChip(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devKVM.Close()
+
+	if ok, err := kvm.CheckExtension(devKVM.Fd(), kvm.CapSplitIRQChip); err != nil || ok == 0 {
+		t.Skipf("KVM_CAP_SPLIT_IRQCHIP is not supported")
+	}
+
+	m, err := machine.NewWithOptions("/dev/kvm", 1, machine.MinMemSize,
+		machine.Options{IRQChip: machine.IRQChipSplit})
+	if err != nil {
+		t.Fatalf("NewWithOptions: got %v, want nil", err)
+	}
+
+	fd, err := m.CPUToFD(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Software enable the LAPIC, as a guest would, so it accepts interrupts.
+	lapic := &kvm.LAPICState{}
+	if err := kvm.GetLocalAPIC(fd, lapic); err != nil {
+		t.Fatal(err)
+	}
+
+	lapic.Regs[0xf1] |= 1
+
+	if err := kvm.SetLocalAPIC(fd, lapic); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every IOAPIC pin is masked at power on.
+	if err := m.InjectSerialIRQ(); err != nil {
+		t.Fatalf("InjectSerialIRQ: got %v, want nil", err)
+	}
+
+	if got, err := m.PendingIRQs(); err != nil || len(got) != 0 {
+		t.Fatalf("PendingIRQs while masked: got (%#x, %v), want ([], nil)", got, err)
+	}
+
+	code := []byte{
+		0xbb, 0x00, 0x00, 0xc0, 0xfe, // mov ebx, 0xfec00000
+		0xc7, 0x03, 0x18, 0x00, 0x00, 0x00, // mov dword [rbx], 0x18 (IOREGSEL: pin 4, low half)
+		0xc7, 0x43, 0x10, 0x34, 0x00, 0x00, 0x00, // mov dword [rbx+0x10], 0x34 (IOWIN: vector 0x34 to APIC 0)
+		0xb0, 0xfe, // mov al, 0xfe
+		0xe6, 0x64, // out 0x64, al (reset)
+	}
+
+	if _, err := m.WriteAt(code, 0x1_00_000); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetupRegs(0x1_00_000, 0x10_000, true); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		if _, err := m.RunOnce(0); err != nil {
+			if !errors.Is(err, machine.ErrWriteToCF9) {
+				t.Fatalf("RunOnce: got %v, want %v", err, machine.ErrWriteToCF9)
+			}
+
+			break
+		}
+	}
+
+	if err := m.InjectSerialIRQ(); err != nil {
+		t.Fatalf("InjectSerialIRQ: got %v, want nil", err)
+	}
+
+	// IRQ 4 arrives at the LAPIC as the vector the guest gave it.
+	if got, err := m.PendingIRQs(); err != nil || len(got) != 1 || got[0] != 0x34 {
+		t.Fatalf("PendingIRQs: got (%#x, %v), want ([0x34], nil)", got, err)
+	}
+}
+
+func TestAllRegs(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 2, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("Open: got %v, want nil", err)
+	}
+
+	if err := m.SetupRegs(0x1_00_000, 0x10_000, true); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := m.GetRegs(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.RAX = 0x1234
+
+	if err := m.SetRegs(1, r); err != nil {
+		t.Fatal(err)
+	}
+
+	regs, err := m.AllRegs()
+	if err != nil || len(regs) != 2 {
+		t.Fatalf("AllRegs: got (%d regs, %v), want (2, nil)", len(regs), err)
+	}
+
+	for cpu, r := range regs {
+		if r == nil || r.RIP != 0x1_00_000 {
+			t.Errorf("cpu %d: got %+v, want RIP 0x100000", cpu, r)
+		}
+	}
+
+	if regs[0].RAX == 0x1234 || regs[1].RAX != 0x1234 {
+		t.Errorf("RAX: got %#x and %#x, want only cpu 1's set", regs[0].RAX, regs[1].RAX)
+	}
+
+	sregs, err := m.AllSRegs()
+	if err != nil || len(sregs) != 2 {
+		t.Fatalf("AllSRegs: got (%d sregs, %v), want (2, nil)", len(sregs), err)
+	}
+
+	for cpu, s := range sregs {
+		if s == nil || s.CR3 == 0 {
+			t.Errorf("cpu %d: got %+v, want paging set up", cpu, s)
+		}
+	}
+}
+
+func TestTrapMSRs(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("Open: got %v, want nil", err)
+	}
+
+	const tscAdjust = 0x3b
+
+	var accesses []string
+
+	err = m.TrapMSRs(func(cpu int, index uint32, write bool, data uint64) (uint64, error) {
+		accesses = append(accesses, fmt.Sprintf("cpu %d %#x write %v %#x", cpu, index, write, data))
+
+		return 0x11223344_55667788, nil
+	}, tscAdjust)
+	if errors.Is(err, machine.ErrUnsupported) {
+		t.Skipf("MSR filtering is not supported: %v", err)
+	}
+
+	if err != nil {
+		t.Fatalf("TrapMSRs: got %v, want nil", err)
+	}
+
+	code := []byte{
+		0xb9, tscAdjust, 0, 0, 0, // mov ecx, 0x3b
+		0x0f, 0x32, // rdmsr
+		0x0f, 0x30, // wrmsr, of what was read
+		0xb0, 0xfe, // mov al, 0xfe
+		0xe6, 0x64, // out 0x64, al (reset)
+	}
+
+	if _, err := m.WriteAt(code, 0x1_00_000); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetupRegs(0x1_00_000, 0x10_000, true); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		if _, err := m.RunOnce(0); err != nil {
+			if !errors.Is(err, machine.ErrWriteToCF9) {
+				t.Fatalf("RunOnce: got %v, want %v", err, machine.ErrWriteToCF9)
+			}
+
+			break
+		}
+	}
+
+	want := []string{
+		"cpu 0 0x3b write false 0x0",
+		"cpu 0 0x3b write true 0x1122334455667788",
+	}
+	if !reflect.DeepEqual(accesses, want) {
+		t.Fatalf("accesses: got %q, want %q", accesses, want)
+	}
+}
+
+func TestMemFD(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	anon, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("Open: got %v, want nil", err)
+	}
+
+	if fd := anon.MemFD(); fd != -1 {
+		t.Errorf("MemFD without Options.MemFD: got %d, want -1", fd)
+	}
+
+	m, err := machine.NewWithOptions("/dev/kvm", 1, machine.MinMemSize, machine.Options{MemFD: true})
+	if err != nil {
+		t.Fatalf("NewWithOptions: got %v, want nil", err)
+	}
+
+	want := []byte("guest RAM seen through the memfd")
+	if _, err := m.WriteAt(want, 0x1_23_456); err != nil {
+		t.Fatal(err)
+	}
+
+	// Map it read-only, as another process would.
+	mem, err := syscall.Mmap(m.MemFD(), 0, machine.MinMemSize, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Munmap(mem)
+
+	if got := mem[0x1_23_456 : 0x1_23_456+len(want)]; !bytes.Equal(got, want) {
+		t.Fatalf("through the memfd: got %q, want %q", got, want)
+	}
+
+	got := make([]byte, len(want))
+	if _, err := syscall.Pread(m.MemFD(), got, 0x1_23_456); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("pread: got (%q, %v), want (%q, nil)", got, err, want)
+	}
+}
+
+func TestSendKey(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("Open: got %v, want nil", err)
+	}
+
+	if err := m.SendKey(0x1e); err != nil {
+		t.Fatal(err)
+	}
+
+	// The PIC is not initialized, so IRQ 1 shows up as vector 1.
+	if got, err := m.PendingIRQs(); err != nil || len(got) != 1 || got[0] != 1 {
+		t.Fatalf("PendingIRQs: got (%v, %v), want ([1], nil)", got, err)
+	}
+
+	code := []byte{
+		0xe4, 0x60, // in al, 0x60
+		0x88, 0x04, 0x25, 0x00, 0x20, 0x00, 0x00, // mov [0x2000], al
+		0xb0, 0xfe, // mov al, 0xfe
+		0xe6, 0x64, // out 0x64, al (reset)
+	}
+
+	if _, err := m.WriteAt(code, 0x1_00_000); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetupRegs(0x1_00_000, 0x10_000, true); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		if _, err := m.RunOnce(0); err != nil {
+			if !errors.Is(err, machine.ErrWriteToCF9) {
+				t.Fatalf("RunOnce: got %v, want %v", err, machine.ErrWriteToCF9)
+			}
+
+			break
+		}
+	}
+
+	b := []byte{0}
+	if _, err := m.ReadAt(b, 0x2000); err != nil {
+		t.Fatal(err)
+	}
+
+	if b[0] != 0x1e {
+		t.Errorf("scancode: got %#x, want 0x1e", b[0])
+	}
+}
+
+func TestTraceRange(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("Open: got %v, want nil", err)
+	}
+
+	if err := m.SetTraceRange(0x1_00_002, 0x1_00_002); !errors.Is(err, machine.ErrBadTraceRange) {
+		t.Fatalf("SetTraceRange(empty): got %v, want %v", err, machine.ErrBadTraceRange)
+	}
+
+	// Two nops, then the Poison stub: mov eax, 0xcafebabe; nop; ud2.
+	// Only the mov and the nop after it are in the range.
+	code := append([]byte{0x90, 0x90}, machine.Poison...)
+
+	if _, err := m.WriteAt(code, 0x1_00_000); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetupRegs(0x1_00_000, 0x10_000, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetTraceRange(0x1_00_002, 0x1_00_008); err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+
+	if err := m.VCPU(&b, 0, 1); err == nil {
+		t.Fatal("VCPU: got nil, want an error from ud2")
+	}
+
+	want := "0x100002:mov $-0x35014542,%eax\r\n0x100007:nop\r\n"
+	if b.String() != want {
+		t.Errorf("trace: got %q, want %q", b.String(), want)
+	}
+}
+
+func TestDisableExits(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.NewWithOptions("/dev/kvm", 1, machine.MinMemSize,
+		machine.Options{DisableExits: kvm.X86DisableExitsHLT | kvm.X86DisableExitsPause})
+	if err != nil {
+		t.Fatalf("NewWithOptions: got %v, want nil", err)
+	}
+
+	if m.DisabledExits()&kvm.X86DisableExitsHLT == 0 {
+		t.Skipf("Skipping test since HLT exits can not be disabled")
+	}
+
+	// Delivering an interrupt needs a GDT with the code segment, and an
+	// IDT whose vector 4, IRQ 4 with the PIC not initialized, points
+	// at a handler that resets.
+	gdtr := []byte{0x17, 0x00, 0x00, 0x20, 0, 0, 0, 0, 0, 0}
+	gdt := []byte{
+		0, 0, 0, 0, 0, 0, 0, 0,
+		0xff, 0xff, 0, 0, 0, 0x9b, 0xaf, 0x00, // 64-bit code
+		0xff, 0xff, 0, 0, 0, 0x93, 0xcf, 0x00, // data
+	}
+	idtr := []byte{0xff, 0x0f, 0x00, 0x30, 0, 0, 0, 0, 0, 0}
+	gate := []byte{0x00, 0x01, 0x08, 0x00, 0x00, 0x8e, 0x10, 0x00, 0, 0, 0, 0, 0, 0, 0, 0}
+	code := []byte{
+		0x48, 0xc7, 0xc4, 0x00, 0x80, 0x00, 0x00, // mov rsp, 0x8000
+		0x0f, 0x01, 0x14, 0x25, 0xe0, 0x2f, 0x00, 0x00, // lgdt [0x2fe0]
+		0x0f, 0x01, 0x1c, 0x25, 0xf0, 0x2f, 0x00, 0x00, // lidt [0x2ff0]
+		0xfb,       // sti
+		0xf3, 0x90, // pause
+		0xf4,       // hlt
+		0xeb, 0xfd, // jmp hlt
+	}
+	handler := []byte{
+		0xb0, 0xfe, // mov al, 0xfe
+		0xe6, 0x64, // out 0x64, al (reset)
+	}
+
+	for _, w := range []struct {
+		b   []byte
+		off int64
+	}{
+		{b: gdtr, off: 0x2fe0},
+		{b: gdt, off: 0x2000},
+		{b: idtr, off: 0x2ff0},
+		{b: gate, off: 0x3000 + 4*16},
+		{b: code, off: 0x1_00_000},
+		{b: handler, off: 0x1_00_100},
+	} {
+		if _, err := m.WriteAt(w.b, w.off); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := m.SetupRegs(0x1_00_000, 0x10_000, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// The guest halts in guest mode; only the interrupt gets it going.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+
+		if err := m.InjectSerialIRQ(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	for {
+		isContinue, err := m.RunOnce(0)
+		if errors.Is(err, machine.ErrWriteToCF9) {
+			break
+		}
+
+		if !isContinue {
+			t.Fatalf("RunOnce: got (%v, %v), want an exit on the reset, not on hlt", isContinue, err)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("Open: got %v, want nil", err)
+	}
+
+	if err := m.AddTapIf("test_close"); err != nil {
+		t.Fatal(err)
+	}
+
+	disk, err := os.CreateTemp(t.TempDir(), "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	disk.Close()
+
+	if err := m.AddDisk(disk.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close only returns once every device thread has.
+	done := make(chan error)
+
+	go func() {
+		done <- m.Close()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Close: got %v, want nil", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Close did not return, device threads are still running")
+	}
+
+	if err := m.QuiesceDevices(); err != nil {
+		t.Errorf("QuiesceDevices after Close: got %v, want nil", err)
+	}
+}
+
+// cpuTime returns the user and system time of the process.
+func cpuTime(t *testing.T) time.Duration {
+	t.Helper()
+
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		t.Fatal(err)
+	}
+
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+func TestCPULimit(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("Open: got %v, want nil", err)
+	}
+
+	defer m.Close()
+
+	if err := m.SetCPULimit(101); !errors.Is(err, machine.ErrBadCPULimit) {
+		t.Fatalf("SetCPULimit(101): got %v, want %v", err, machine.ErrBadCPULimit)
+	}
+
+	if err := m.SetCPULimit(25); err != nil {
+		t.Fatal(err)
+	}
+
+	// A guest that never exits until it is done counting.
+	code := []byte{
+		0xb9, 0x00, 0x00, 0x08, 0x00, // mov ecx, 0x80000
+		0xff, 0xc9, // dec ecx
+		0x75, 0xfc, // jnz dec
+		0xb0, 0xfe, // mov al, 0xfe
+		0xe6, 0x64, // out 0x64, al (reset)
+	}
+
+	if _, err := m.WriteAt(code, 0x1_00_000); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetupRegs(0x1_00_000, 0x10_000, true); err != nil {
+		t.Fatal(err)
+	}
+
+	start, cpu := time.Now(), cpuTime(t)
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrWriteToCF9) {
+		t.Fatalf("RunInfiniteLoop: got %v, want %v", err, machine.ErrWriteToCF9)
+	}
+
+	wall, used := time.Since(start), cpuTime(t)-cpu
+
+	// Allow for the timers and kicks, which cost CPU outside the vCPU
+	// thread, and for scheduling noise.
+	if share := float64(used) / float64(wall); share > 0.4 {
+		t.Errorf("guest used %v of CPU in %v, %.0f%%, want about 25%%", used, wall, share*100)
+	}
+}
+
+func TestCloseConcurrent(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 2, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("Open: got %v, want nil", err)
+	}
+
+	// A second teardown would fail with EBADF, or worse, close fds
+	// that have been reused in the meantime.
+	errs := make(chan error)
+
+	for i := 0; i < 8; i++ {
+		go func() {
+			errs <- m.Close()
+		}()
+	}
+
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Close: got %v, want nil", err)
+		}
+	}
+}
+
+func TestSerialOutput(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("Open: got %v, want nil", err)
+	}
+
+	var out bytes.Buffer
+
+	m.GetSerial().SetOutput(&out)
+
+	code := []byte{
+		0x66, 0xba, 0xf8, 0x03, // mov dx, 0x3f8
+		0xb0, 'h', // mov al, 'h'
+		0xee,      // out dx, al
+		0xb0, 'i', // mov al, 'i'
+		0xee,       // out dx, al
+		0xb0, 0xe9, // mov al, 0xe9
+		0xee,       // out dx, al
+		0xb0, 0xfe, // mov al, 0xfe
+		0xe6, 0x64, // out 0x64, al (reset)
+	}
+
+	if _, err := m.WriteAt(code, 0x1_00_000); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetupRegs(0x1_00_000, 0x10_000, true); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		if _, err := m.RunOnce(0); err != nil {
+			if !errors.Is(err, machine.ErrWriteToCF9) {
+				t.Fatalf("RunOnce: got %v, want %v", err, machine.ErrWriteToCF9)
+			}
+
+			break
+		}
+	}
+
+	// Bytes from 0x80 up come out UTF-8 encoded, as they always have.
+	if want := "hié"; out.String() != want {
+		t.Errorf("serial output: got %q, want %q", out.String(), want)
+	}
+}
+
+func TestSetClockOffset(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("Open: got %v, want nil", err)
+	}
+
+	before, err := m.GetGuestTime()
+	if err != nil {
+		t.Fatalf("GetGuestTime: got %v, want nil", err)
+	}
+
+	if err := m.SetClockOffset(time.Hour); err != nil {
+		t.Fatalf("SetClockOffset: got %v, want nil", err)
+	}
+
+	after, err := m.GetGuestTime()
+	if err != nil {
+		t.Fatalf("GetGuestTime: got %v, want nil", err)
+	}
+
+	// Allow for the time the calls take on a busy host.
+	if d := after - before; d < time.Hour || d > time.Hour+5*time.Second {
+		t.Errorf("guest time moved by %v, want about %v", d, time.Hour)
+	}
+}
+
+func TestValidateImages(t *testing.T) {
+	t.Parallel()
+
+	if _, err := os.Stat("../bzImage"); err != nil {
+		t.Skipf("Skipping test: %v", err)
+	}
+
+	info, err := machine.ValidateImages("../bzImage", "", nil, 1<<30)
+	if err != nil {
+		t.Fatalf("ValidateImages: got %v, want nil", err)
+	}
+
+	if info.KernelFormat != machine.KernelBzImage || info.KernelSize == 0 {
+		t.Errorf("kernel: got %s, %d bytes, want %s, more than 0",
+			info.KernelFormat, info.KernelSize, machine.KernelBzImage)
+	}
+
+	// Too little memory is refused before looking at the images.
+	if _, err := machine.ValidateImages("../bzImage", "", nil, 2<<20); !errors.Is(err, machine.ErrMemTooSmall) {
+		t.Errorf("ValidateImages with 2M: got %v, want %v", err, machine.ErrMemTooSmall)
+	}
+}
+
+func TestValidateImagesBadKernel(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	kernel := filepath.Join(dir, "kernel")
+
+	if err := os.WriteFile(kernel, bytes.Repeat([]byte{0x5a}, 4096), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := machine.ValidateImages(kernel, "", nil, 1<<30); !errors.Is(err, bootparam.ErrorSignatureNotMatch) {
+		t.Errorf("ValidateImages(garbage): got %v, want %v", err, bootparam.ErrorSignatureNotMatch)
+	}
+
+	if _, err := machine.ValidateImages(filepath.Join(dir, "missing"), "", nil, 1<<30); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ValidateImages(missing): got %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestMMIOHole(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devKVM.Close()
+
+	// With a split irqchip the IOAPIC page is in the hole too.
+	if ok, err := kvm.CheckExtension(devKVM.Fd(), kvm.CapSplitIRQChip); err != nil || ok == 0 {
+		t.Skipf("KVM_CAP_SPLIT_IRQCHIP is not supported")
+	}
+
+	// RAM runs past the hole at 3G, so some of it is above 4G.
+	m, err := machine.NewWithOptions("/dev/kvm", 1, 0xC000_0000+machine.MinMemSize,
+		machine.Options{IRQChip: machine.IRQChipSplit, MemInit: machine.MemInitNone})
+	if err != nil {
+		t.Fatalf("NewWithOptions: got %v, want nil", err)
+	}
+	defer m.Close()
+
+	for _, addr := range []int64{0xFEC0_0000, 0xFEE0_0000} {
+		var b [4]byte
+		if n, err := m.ReadAt(b[:], addr); !errors.Is(err, machine.ErrNotRAM) {
+			t.Errorf("ReadAt(_, %#x): got (%d, %v), want (0, %v)", addr, n, err, machine.ErrNotRAM)
+		}
+	}
+
+	if _, err := m.WriteAt([]byte{1, 2, 3, 4}, 1<<32); err != nil {
+		t.Errorf("WriteAt(_, 4G): got %v, want nil", err)
+	}
+
+	var got []uint64
+
+	m.RegisterMMIO(0xFED0_0000, 0x1000, func(addr uint64, data []byte, write bool) error {
+		got = append(got, addr)
+		binary.LittleEndian.PutUint32(data, 0x11223344)
+
+		return nil
+	})
+
+	code := []byte{
+		0xbb, 0x00, 0x00, 0xd0, 0xfe, // mov ebx, 0xfed00000
+		0x8b, 0x0b, // mov ecx, [rbx]
+		0xb0, 0xfe, // mov al, 0xfe
+		0xe6, 0x64, // out 0x64, al (reset)
+	}
+
+	if _, err := m.WriteAt(code, 0x1_00_000); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetupRegs(0x1_00_000, 0x10_000, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// With the LAPIC in the kernel, hlt would not exit; stop on the reset.
+	for {
+		if _, err := m.RunOnce(0); err != nil {
+			if !errors.Is(err, machine.ErrWriteToCF9) {
+				t.Fatalf("RunOnce: got %v, want %v", err, machine.ErrWriteToCF9)
+			}
+
+			break
+		}
+	}
+
+	if len(got) != 1 || got[0] != 0xFED0_0000 {
+		t.Errorf("MMIO handler: got %#x, want [0xfed00000]", got)
+	}
+
+	r, err := m.GetRegs(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.RCX != 0x11223344 {
+		t.Errorf("RCX: got %#x, want 0x11223344", r.RCX)
+	}
+}
+
+// sizedReaderAt reads as size bytes, without touching the buffer, so
+// that loading it does not fault in guest memory.
+type sizedReaderAt int64
+
+func (s sizedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(s) {
+		return 0, io.EOF
+	}
+
+	if n := int64(s) - off; n < int64(len(p)) {
+		return int(n), io.EOF
+	}
+
+	return len(p), nil
+}
+
+func TestInitrdBelowMMIOHole(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	const (
+		memSize    = 0xC000_0000 + machine.MinMemSize
+		initrdAddr = 0xf000000
+		// Just too large to fit below 3G, though 4G would be enough.
+		tooLarge = 0xC000_0000 - initrdAddr + 1
+	)
+
+	m, err := machine.NewWithOptions("/dev/kvm", 1, memSize, machine.Options{MemInit: machine.MemInitNone})
+	if err != nil {
+		t.Fatalf("NewWithOptions: got %v, want nil", err)
+	}
+	defer m.Close()
+
+	if _, err := m.LoadInitrd(sizedReaderAt(tooLarge)); !errors.Is(err, machine.ErrInitrdTooLarge) {
+		t.Errorf("LoadInitrd(%#x bytes): got %v, want %v", tooLarge, err, machine.ErrInitrdTooLarge)
+	}
+
+	if n, err := m.LoadInitrd(sizedReaderAt(tooLarge - 1)); err != nil || n != tooLarge-1 {
+		t.Errorf("LoadInitrd(%#x bytes): got (%#x, %v), want (%#x, nil)", tooLarge-1, n, err, tooLarge-1)
+	}
+
+	initrd := filepath.Join(t.TempDir(), "initrd")
+
+	f, err := os.Create(initrd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sparse, so this takes no space.
+	if err := f.Truncate(tooLarge); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Close()
+
+	if _, err := machine.ValidateImages("../bzImage", initrd, nil, memSize); !errors.Is(err, machine.ErrInitrdTooLarge) {
+		t.Errorf("ValidateImages: got %v, want %v", err, machine.ErrInitrdTooLarge)
+	}
+}
+
+func TestDeviceStatesJSON(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("New: got %v, want nil", err)
+	}
+	defer m.Close()
+
+	disk := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(disk, make([]byte, 1<<20), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.AddDisk(disk); err != nil {
+		t.Fatalf("AddDisk: got %v, want nil", err)
+	}
+
+	b, err := m.DeviceStatesJSON()
+	if err != nil {
+		t.Fatalf("DeviceStatesJSON: got %v, want nil", err)
+	}
+
+	var got struct {
+		Blk []struct {
+			Capacity *uint64 `json:"capacity"`
+			Queues   []struct {
+				LastAvailIdx *uint16 `json:"lastAvailIdx"`
+			} `json:"queues"`
+		} `json:"blk"`
+	}
+
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("Unmarshal(%s): got %v, want nil", b, err)
+	}
+
+	if len(got.Blk) != 1 {
+		t.Fatalf("blk: got %d devices, want 1 in %s", len(got.Blk), b)
+	}
+
+	if c := got.Blk[0].Capacity; c == nil || *c != (1<<20)/512 {
+		t.Errorf("blk capacity: got %v, want %d in %s", c, (1<<20)/512, b)
+	}
+
+	if q := got.Blk[0].Queues; len(q) != 1 || q[0].LastAvailIdx == nil {
+		t.Errorf("blk queues: got %+v, want one with lastAvailIdx in %s", q, b)
+	}
+}
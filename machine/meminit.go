@@ -0,0 +1,97 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// MemInit selects how guest RAM above 1 MiB is initialized.
+type MemInit int
+
+const (
+	// MemInitPoison fills RAM with Poison, so that a guest running off
+	// into memory nobody loaded exits right away.
+	MemInitPoison MemInit = iota
+	// MemInitZero guarantees RAM reads as zero, at power on and again
+	// after every Reset.
+	MemInitZero
+	// MemInitNone leaves RAM as allocated, which saves touching every
+	// page at startup.
+	MemInitNone
+)
+
+var memInitNames = [...]string{
+	MemInitPoison: "poison",
+	MemInitZero:   "zero",
+	MemInitNone:   "none",
+}
+
+// ErrBadMemInit is returned for an unknown memory init mode.
+var ErrBadMemInit = errors.New("memory init mode must be poison, zero or none")
+
+func (i MemInit) String() string {
+	if i < 0 || int(i) >= len(memInitNames) {
+		return fmt.Sprintf("MemInit(%d)", int(i))
+	}
+
+	return memInitNames[i]
+}
+
+// ParseMemInit returns the mode named s.
+func ParseMemInit(s string) (MemInit, error) {
+	for i, n := range memInitNames {
+		if n == s {
+			return MemInit(i), nil
+		}
+	}
+
+	return MemInitPoison, fmt.Errorf("%q: %w", s, ErrBadMemInit)
+}
+
+func (m *Machine) initMemory(mode MemInit) {
+	switch mode {
+	case MemInitPoison:
+		// 0 is valid instruction and if you start running in the middle of all those
+		// 0's it is impossible to diagnore.
+		for _, r := range m.ramAbove(highMemBase) {
+			ram := m.mem[r.start : r.start+r.size]
+			for i := 0; i < len(ram); i += len(Poison) {
+				copy(ram[i:], Poison)
+			}
+		}
+	case MemInitZero, MemInitNone:
+		// Fresh anonymous mappings are already zero filled.
+	}
+}
+
+// resetMemory clears RAM above 1 MiB for MemInitZero, where whatever the
+// guest left there must not survive a Reset. The other modes leave RAM
+// as it is, as a reset on real hardware would.
+func (m *Machine) resetMemory() error {
+	if m.memInit != MemInitZero {
+		return nil
+	}
+
+	for _, r := range m.ramAbove(highMemBase) {
+		ram := m.mem[r.start : r.start+r.size]
+
+		if m.prealloc {
+			// Keep the pages, they were faulted in up front.
+			for i := range ram {
+				ram[i] = 0
+			}
+
+			continue
+		}
+
+		// Guest RAM is shared memory; dropping the pages is cheaper than
+		// writing them, and they read as zero after.
+		if err := unix.Madvise(ram, unix.MADV_REMOVE); err != nil {
+			return fmt.Errorf("zeroing RAM at %#x: %w", r.start, err)
+		}
+	}
+
+	return nil
+}
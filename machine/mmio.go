@@ -0,0 +1,161 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// mmioHoleStart is where RAM below 4G ends, as on a PC with a PCI
+	// hole. [mmioHoleStart, highRAMStart) holds the IOAPIC at 0xfec00000
+	// and the LAPIC at 0xfee00000 and is never backed by RAM.
+	mmioHoleStart = 0xC000_0000
+	// highRAMStart is where RAM beyond the first mmioHoleStart bytes goes.
+	highRAMStart = 1 << 32
+)
+
+// ErrNotRAM indicates a guest physical address that is not backed by RAM.
+var ErrNotRAM = errors.New("address is not RAM")
+
+// memRegion is guest RAM in one KVM memory slot.
+type memRegion struct {
+	start, size uint64
+}
+
+// memRegions splits memSize bytes of RAM around the MMIO hole.
+func memRegions(memSize int) []memRegion {
+	if memSize <= mmioHoleStart {
+		return []memRegion{{start: 0, size: uint64(memSize)}}
+	}
+
+	return []memRegion{
+		{start: 0, size: mmioHoleStart},
+		{start: highRAMStart, size: uint64(memSize) - mmioHoleStart},
+	}
+}
+
+// memSpan returns how much guest physical address space memSize bytes
+// of RAM take up, including the MMIO hole if RAM goes past it.
+func memSpan(memSize int) int {
+	r := memRegions(memSize)
+	last := r[len(r)-1]
+
+	return int(last.start + last.size)
+}
+
+// isRAM reports whether the guest physical range [addr, addr+size) is RAM.
+func (m *Machine) isRAM(addr, size uint64) bool {
+	end := addr + size
+	if end < addr || end > uint64(len(m.mem)) {
+		return false
+	}
+
+	return end <= mmioHoleStart || addr >= highRAMStart
+}
+
+// setMemoryRegions registers guest RAM with KVM, one slot per region.
+// m.mem spans the hole as well, so guest physical address N is always
+// at offset N, but the hole is not registered and its pages are dropped.
+func (m *Machine) setMemoryRegions(memSize int) error {
+	for slot, r := range memRegions(memSize) {
+		err := kvm.SetUserMemoryRegion(m.vmFd, &kvm.UserspaceMemoryRegion{
+			Slot: uint32(slot), Flags: 0, GuestPhysAddr: r.start, MemorySize: r.size,
+			UserspaceAddr: uint64(uintptr(unsafe.Pointer(&m.mem[r.start]))),
+		})
+		if err != nil {
+			return fmt.Errorf("memory slot %d at %#x: %w", slot, r.start, err)
+		}
+	}
+
+	if len(m.mem) > mmioHoleStart {
+		// Give back what MAP_POPULATE or a memfd allocated for the hole.
+		if err := unix.Madvise(m.mem[mmioHoleStart:highRAMStart], unix.MADV_REMOVE); err != nil {
+			return fmt.Errorf("MMIO hole: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// MMIOHandler handles a guest read or write of data at the guest
+// physical address addr. For a read it fills in data.
+type MMIOHandler func(addr uint64, data []byte, write bool) error
+
+type mmioRange struct {
+	start, end uint64
+	h          MMIOHandler
+}
+
+// RegisterMMIO has guest accesses to [start, start+size) that are not
+// RAM, and not handled in KVM, go to h.
+func (m *Machine) RegisterMMIO(start, size uint64, h MMIOHandler) {
+	m.mmio = append(m.mmio, mmioRange{start: start, end: start + size, h: h})
+}
+
+// handleMMIO completes a KVM_EXIT_MMIO. Addresses nobody registered read
+// as all ones and ignore writes, as absent hardware would.
+func (m *Machine) handleMMIO(cpu int) (bool, error) {
+	addr, data, write := m.runs[cpu].MMIO()
+
+	for _, r := range m.mmio {
+		if addr >= r.start && addr < r.end {
+			if err := r.h(addr, data, write); err != nil {
+				return false, fmt.Errorf("MMIO at %#x: %w", addr, err)
+			}
+
+			return true, nil
+		}
+	}
+
+	if !write {
+		for i := range data {
+			data[i] = 0xff
+		}
+	}
+
+	return true, nil
+}
+
+// ramFrom returns m.mem cut off at the end of the RAM region off is in,
+// so that accesses starting at off do not run into the MMIO hole.
+func (m *Machine) ramFrom(off int64) []byte {
+	if off >= 0 && off < mmioHoleStart && len(m.mem) > mmioHoleStart {
+		return m.mem[:mmioHoleStart]
+	}
+
+	return m.mem
+}
+
+// ramAbove returns the RAM regions from start on, for the memory map
+// handed to the guest.
+func (m *Machine) ramAbove(start uint64) []memRegion {
+	var ram []memRegion
+
+	for _, r := range memRegions(m.memSize()) {
+		if r.start+r.size <= start {
+			continue
+		}
+
+		if r.start < start {
+			r.size -= start - r.start
+			r.start = start
+		}
+
+		ram = append(ram, r)
+	}
+
+	return ram
+}
+
+// memSize returns the amount of RAM, without the MMIO hole.
+func (m *Machine) memSize() int {
+	if len(m.mem) > mmioHoleStart {
+		return len(m.mem) - (highRAMStart - mmioHoleStart)
+	}
+
+	return len(m.mem)
+}
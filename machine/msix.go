@@ -0,0 +1,67 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/pci"
+)
+
+// msixBARStart is where the MSI-X memory BARs go, one page each, in the
+// MMIO hole well below the IOAPIC and LAPIC.
+const msixBARStart = 0xE000_0000
+
+// msixDevice is a virtio device that can interrupt through MSI-X.
+type msixDevice interface {
+	SetMSIX(x *pci.MSIX)
+}
+
+// initMSIX checks that MSIs can be injected, before any device is added.
+func (m *Machine) initMSIX() error {
+	if ok, err := kvm.CheckExtension(m.kvmFd, kvm.CapSignalMSI); err != nil || ok == 0 {
+		return fmt.Errorf("MSI-X: %w", ErrUnsupported)
+	}
+
+	m.msix = true
+
+	return nil
+}
+
+// addMSIX gives d an MSI-X table of vectors vectors in the next free
+// memory BAR, if MSI-X is on. Otherwise d keeps using its INTx line.
+func (m *Machine) addMSIX(d msixDevice, vectors int) {
+	if !m.msix {
+		return
+	}
+
+	addr := uint64(msixBARStart + m.msixBARs*pci.MSIXBARSize)
+	m.msixBARs++
+
+	x := pci.NewMSIX(vectors, uint32(addr), func(a uint64, data uint32) error {
+		err := kvm.SignalMSI(m.vmFd, &kvm.MSI{
+			AddressLo: uint32(a),
+			AddressHi: uint32(a >> 32),
+			Data:      data,
+		})
+		// The guest masked the vector in its LAPIC; like real
+		// hardware we drop the message.
+		if errors.Is(err, kvm.ErrMSIBlocked) {
+			return nil
+		}
+
+		return err
+	})
+
+	m.RegisterMMIO(addr, pci.MSIXBARSize, func(a uint64, data []byte, write bool) error {
+		if write {
+			return x.WriteTable(a-addr, data)
+		}
+
+		x.ReadTable(a-addr, data)
+
+		return nil
+	})
+
+	d.SetMSIX(x)
+}
@@ -0,0 +1,50 @@
+package machine
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/pci"
+)
+
+func TestMSIX(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := NewWithOptions("/dev/kvm", 1, MinMemSize, Options{MSIX: true})
+	if errors.Is(err, ErrUnsupported) {
+		t.Skip("Skipping test since CapSignalMSI is disable")
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if err := m.AddRng(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	d, ok := m.pci.Devices[len(m.pci.Devices)-1].(pci.MSIXDevice)
+	if !ok || d.MSIX() == nil {
+		t.Fatalf("rng has no MSI-X")
+	}
+
+	if got := d.MSIX().Addr(); got != msixBARStart {
+		t.Errorf("MSI-X BAR: got %#x, want %#x", got, msixBARStart)
+	}
+
+	// The vector control of entry 0 reads as masked through MMIO.
+	ctl := make([]byte, 4)
+	if err := m.mmio[len(m.mmio)-1].h(msixBARStart+12, ctl, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if ctl[0] != 1 {
+		t.Errorf("vector control: got %#x, want masked", ctl)
+	}
+}
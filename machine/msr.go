@@ -0,0 +1,74 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// ErrMSRFault is returned by a MSRHandler to give the guest a #GP.
+var ErrMSRFault = errors.New("MSR access faults")
+
+// MSRHandler handles a guest read, or a write of data, of the MSR index
+// on cpu. It returns the value for a read, ErrMSRFault to make the
+// access fault, or another error to stop the vCPU.
+type MSRHandler func(cpu int, index uint32, write bool, data uint64) (uint64, error)
+
+// TrapMSRs has guest reads and writes of msrs exit to h instead of being
+// handled by KVM. At most 16 MSRs can be trapped; each call replaces the
+// previous set.
+func (m *Machine) TrapMSRs(h MSRHandler, msrs ...uint32) error {
+	for _, c := range []kvm.Capability{kvm.CapX86UserSpaceMSR, kvm.CapX86MSRFilter} {
+		if ok, err := kvm.CheckExtension(m.kvmFd, c); err != nil || ok == 0 {
+			return fmt.Errorf("%v: %w", c, ErrUnsupported)
+		}
+	}
+
+	if err := kvm.EnableCap(m.vmFd, kvm.CapX86UserSpaceMSR, kvm.MSRExitReasonFilter); err != nil {
+		return err
+	}
+
+	ranges := make([]kvm.MSRFilterRange, 0, len(msrs))
+	for _, msr := range msrs {
+		ranges = append(ranges, kvm.MSRFilterRange{
+			Flags:  kvm.MSRFilterRead | kvm.MSRFilterWrite,
+			NMSRs:  1,
+			Base:   msr,
+			Bitmap: []byte{0}, // deny, i.e. exit
+		})
+	}
+
+	if err := kvm.SetMSRFilter(m.vmFd, 0, ranges); err != nil {
+		return err
+	}
+
+	m.msrHandler = h
+
+	return nil
+}
+
+// handleMSR completes a KVM_EXIT_X86_RDMSR or KVM_EXIT_X86_WRMSR.
+func (m *Machine) handleMSR(cpu int, exit kvm.ExitType) (bool, error) {
+	run := m.runs[cpu]
+	index, data := run.MSR()
+
+	if m.msrHandler == nil {
+		run.CompleteMSR(0, true)
+
+		return true, nil
+	}
+
+	data, err := m.msrHandler(cpu, index, exit == kvm.EXITX86WRMSR, data)
+
+	switch {
+	case errors.Is(err, ErrMSRFault):
+		run.CompleteMSR(0, true)
+	case err != nil:
+		return false, fmt.Errorf("%v of MSR %#x: %w", exit, index, err)
+	default:
+		run.CompleteMSR(data, false)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,63 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+func TestAddTapIfMultiple(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := New("/dev/kvm", 1, MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := m.AddTapIf(fmt.Sprintf("test_nic%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var nets []*virtio.Net
+
+	for _, dev := range m.pci.Devices {
+		if n, ok := dev.(*virtio.Net); ok {
+			nets = append(nets, n)
+		}
+	}
+
+	if len(nets) != 2 {
+		t.Fatalf("got %d virtio-net devices, want 2", len(nets))
+	}
+
+	a, b := nets[0], nets[1]
+	if a.IOPort()+a.Size() > b.IOPort() && b.IOPort()+b.Size() > a.IOPort() {
+		t.Errorf("IO ranges overlap: %#x+%#x and %#x+%#x", a.IOPort(), a.Size(), b.IOPort(), b.Size())
+	}
+
+	ha, hb := a.GetDeviceHeader(), b.GetDeviceHeader()
+	if ha.InterruptLine == hb.InterruptLine {
+		t.Errorf("both devices use IRQ %d", ha.InterruptLine)
+	}
+
+	if ha.BAR[0] != uint32(a.IOPort())|1 || hb.BAR[0] != uint32(b.IOPort())|1 {
+		t.Errorf("BAR0 %#x, %#x does not match IO ports %#x, %#x", ha.BAR[0], hb.BAR[0], a.IOPort(), b.IOPort())
+	}
+
+	for i := 2; i < 4; i++ {
+		if err := m.AddTapIf(fmt.Sprintf("test_nic%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := m.AddTapIf("test_nic4"); !errors.Is(err, ErrTooManyNICs) {
+		t.Errorf("fifth tap: got %v, want %v", err, ErrTooManyNICs)
+	}
+}
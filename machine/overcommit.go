@@ -0,0 +1,26 @@
+package machine
+
+import (
+	"log"
+	"runtime"
+)
+
+// numCPU is runtime.NumCPU, which tests replace.
+var numCPU = runtime.NumCPU
+
+// checkOvercommit warns if there are more vCPUs than host CPUs. That
+// works, but vCPUs then wait for each other, which can look like a
+// guest hang, e.g. when one spins on a lock held by a descheduled one.
+func (m *Machine) checkOvercommit() {
+	m.hostCPUs = numCPU()
+
+	if n := len(m.vcpuFds); n > m.hostCPUs {
+		log.Printf("warning: %d vCPUs on %d host CPUs, vCPUs will compete for CPU time", n, m.hostCPUs)
+	}
+}
+
+// CPUOvercommit returns the number of vCPUs per host CPU. Above 1,
+// vCPUs can not all run at once.
+func (m *Machine) CPUOvercommit() float64 {
+	return float64(len(m.vcpuFds)) / float64(m.hostCPUs)
+}
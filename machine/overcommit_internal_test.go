@@ -0,0 +1,40 @@
+package machine
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// The test replaces numCPU and the log output, which other tests use.
+func TestOvercommitWarning(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	var out bytes.Buffer
+
+	log.SetOutput(&out)
+	numCPU = func() int { return 1 }
+
+	defer func() {
+		log.SetOutput(os.Stderr)
+		numCPU = runtime.NumCPU
+	}()
+
+	m, err := New("/dev/kvm", 2, MinMemSize)
+	if err != nil {
+		t.Fatalf("New: got %v, want nil", err)
+	}
+
+	if !strings.Contains(out.String(), "2 vCPUs on 1 host CPUs") {
+		t.Errorf("log: got %q, want an overcommit warning", out.String())
+	}
+
+	if r := m.CPUOvercommit(); r != 2 {
+		t.Errorf("CPUOvercommit: got %v, want 2", r)
+	}
+}
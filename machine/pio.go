@@ -0,0 +1,34 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrBadIO indicates an IO exit with a size or count that makes no sense.
+var ErrBadIO = errors.New("bad IO exit")
+
+// KVM passes the data of an IO exit in the page after the kvm_run
+// structure (KVM_PIO_PAGE_OFFSET), so a string IO never has more than
+// that page holds.
+const (
+	pioDataStart = pageSize
+	pioDataEnd   = 2 * pageSize
+)
+
+// checkIO validates the size, count and data offset of an IO exit
+// before RunOnce loops over it, so a bogus count cannot hold the vCPU
+// thread or walk past the mapping.
+func checkIO(size, count, offset uint64) error {
+	switch size {
+	case 1, 2, 4:
+	default:
+		return fmt.Errorf("size %d: %w", size, ErrBadIO)
+	}
+
+	if offset < pioDataStart || offset >= pioDataEnd || count > (pioDataEnd-offset)/size {
+		return fmt.Errorf("%d times %d bytes at offset %#x: %w", count, size, offset, ErrBadIO)
+	}
+
+	return nil
+}
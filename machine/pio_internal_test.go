@@ -0,0 +1,29 @@
+package machine
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckIO(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name                string
+		size, count, offset uint64
+		err                 error
+	}{
+		{name: "outb", size: 1, count: 1, offset: 0x1000},
+		{name: "rep outsl", size: 4, count: 0x400, offset: 0x1000},
+		{name: "size 3", size: 3, count: 1, offset: 0x1000, err: ErrBadIO},
+		{name: "size 0", size: 0, count: 1, offset: 0x1000, err: ErrBadIO},
+		{name: "past the page", size: 4, count: 0x401, offset: 0x1000, err: ErrBadIO},
+		{name: "absurd count", size: 1, count: 0xffffffff, offset: 0x1000, err: ErrBadIO},
+		{name: "inside kvm_run", size: 1, count: 1, offset: 0x100, err: ErrBadIO},
+		{name: "absurd offset", size: 1, count: 1, offset: 1 << 63, err: ErrBadIO},
+	} {
+		if err := checkIO(tt.size, tt.count, tt.offset); !errors.Is(err, tt.err) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package machine
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// ErrPoison indicates the guest ran into memory nothing was loaded into.
+var ErrPoison = errors.New("guest executed Poison")
+
+// poisonUD2 is the offset of the ud2 instruction in Poison.
+const poisonUD2 = 6
+
+// poisonError returns an error naming the RIP if cpu stopped with exit on
+// the ud2 of a Poison pattern, and nil otherwise.
+func (m *Machine) poisonError(cpu int, exit kvm.ExitType) error {
+	r, err := m.GetRegs(cpu)
+	if err != nil {
+		return nil
+	}
+
+	pa, err := m.VtoP(cpu, r.RIP)
+	if err != nil || pa < poisonUD2 || int(pa)-poisonUD2+len(Poison) > len(m.mem) {
+		return nil
+	}
+
+	start := int(pa) - poisonUD2
+	if string(m.mem[start:start+len(Poison)]) != Poison {
+		return nil
+	}
+
+	return fmt.Errorf("%w at RIP %#x (physical %#x)%s: nothing was loaded there, "+
+		"so the guest jumped through a bad pointer or ran off its code (%w: %s)",
+		ErrPoison, r.RIP, pa, m.symbolNear(r.RIP), kvm.ErrUnexpectedExitReason, exit)
+}
+
+// setSymbols remembers the function symbols of an ELF kernel, for errors.
+func (m *Machine) setSymbols(syms []elf.Symbol) {
+	m.symbols = m.symbols[:0]
+
+	for _, s := range syms {
+		if elf.ST_TYPE(s.Info) == elf.STT_FUNC && s.Value != 0 {
+			m.symbols = append(m.symbols, s)
+		}
+	}
+
+	sort.Slice(m.symbols, func(i, j int) bool {
+		return m.symbols[i].Value < m.symbols[j].Value
+	})
+}
+
+// symbolNear returns " near sym+off" for the closest function symbol
+// at or below addr, or "" if there is none.
+func (m *Machine) symbolNear(addr uint64) string {
+	i := sort.Search(len(m.symbols), func(i int) bool {
+		return m.symbols[i].Value > addr
+	})
+	if i == 0 {
+		return ""
+	}
+
+	s := m.symbols[i-1]
+
+	return fmt.Sprintf(" near %s+%#x", s.Name, addr-s.Value)
+}
@@ -0,0 +1,31 @@
+package machine
+
+import (
+	"debug/elf"
+	"testing"
+)
+
+func TestSymbolNear(t *testing.T) {
+	t.Parallel()
+
+	m := &Machine{}
+	m.setSymbols([]elf.Symbol{
+		{Name: "b", Value: 0x2000, Info: byte(elf.STT_FUNC)},
+		{Name: "a", Value: 0x1000, Info: byte(elf.STT_FUNC)},
+		{Name: "data", Value: 0x1800, Info: byte(elf.STT_OBJECT)},
+	})
+
+	for _, tt := range []struct {
+		addr uint64
+		want string
+	}{
+		{addr: 0x800, want: ""},
+		{addr: 0x1000, want: " near a+0x0"},
+		{addr: 0x1900, want: " near a+0x900"},
+		{addr: 0x2010, want: " near b+0x10"},
+	} {
+		if got := m.symbolNear(tt.addr); got != tt.want {
+			t.Errorf("symbolNear(%#x): got %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package machine
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// resident returns how many pages of b are in memory.
+func resident(t *testing.T, b []byte) int {
+	t.Helper()
+
+	vec := make([]byte, (len(b)+os.Getpagesize()-1)/os.Getpagesize())
+	if _, _, errno := syscall.Syscall(syscall.SYS_MINCORE, uintptr(unsafe.Pointer(&b[0])),
+		uintptr(len(b)), uintptr(unsafe.Pointer(&vec[0]))); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	n := 0
+
+	for _, v := range vec {
+		n += int(v & 1)
+	}
+
+	return n
+}
+
+func TestPrealloc(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	const memSize = 1 << 27
+
+	pages := memSize / os.Getpagesize()
+
+	// Without poisoning, only what New writes itself is touched.
+	lazy, err := NewWithOptions("/dev/kvm", 1, memSize, Options{MemInit: MemInitNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := resident(t, lazy.mem); n > pages/2 {
+		t.Skipf("%d of %d pages resident without prealloc; cannot tell the difference", n, pages)
+	}
+
+	m, err := NewWithOptions("/dev/kvm", 1, memSize, Options{MemInit: MemInitNone, Prealloc: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := resident(t, m.mem); n < pages*9/10 {
+		t.Fatalf("%d of %d pages resident with prealloc, want nearly all", n, pages)
+	}
+}
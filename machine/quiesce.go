@@ -0,0 +1,65 @@
+package machine
+
+import (
+	"errors"
+	"io"
+	"syscall"
+)
+
+// goDevice runs a device thread, e.g. virtio.Blk.IOThreadEntry, so that
+// QuiesceDevices can wait for it.
+func (m *Machine) goDevice(f func()) {
+	m.deviceThreads.Add(1)
+
+	go func() {
+		defer m.deviceThreads.Done()
+		f()
+	}()
+}
+
+// QuiesceDevices closes the PCI devices, which makes their threads
+// return, and waits for that. Guest writes to a closed device are
+// dropped, so a vCPU that is still running does not block. Calling it
+// again does nothing.
+func (m *Machine) QuiesceDevices() error {
+	var errs []error
+
+	m.quiesceOnce.Do(func() {
+		for _, dev := range m.pci.Devices {
+			if c, ok := dev.(io.Closer); ok {
+				errs = append(errs, c.Close())
+			}
+		}
+
+		m.deviceThreads.Wait()
+	})
+
+	return errors.Join(errs...)
+}
+
+// Close quiesces the devices, closes the vCPU and VM fds and the memfd,
+// if any, and unmaps guest memory. The vCPUs must not be running, and
+// the Machine must not be used afterwards. Close may be called more
+// than once, also concurrently; the teardown happens once, and every
+// call returns its result.
+func (m *Machine) Close() error {
+	m.closeOnce.Do(func() {
+		errs := []error{m.QuiesceDevices()}
+
+		for _, fd := range m.vcpuFds {
+			errs = append(errs, syscall.Close(int(fd)))
+		}
+
+		errs = append(errs, syscall.Close(int(m.vmFd)))
+
+		if m.memFd >= 0 {
+			errs = append(errs, syscall.Close(m.memFd))
+		}
+
+		errs = append(errs, syscall.Munmap(m.mem))
+
+		m.closeErr = errors.Join(errs...)
+	})
+
+	return m.closeErr
+}
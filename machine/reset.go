@@ -0,0 +1,177 @@
+package machine
+
+import (
+	"fmt"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// resetMSRs are the MSRs a guest sets up as it boots that Reset puts
+// back as they were at power on: the SYSENTER and SYSCALL entry points,
+// PAT, the TSC deadline, and the kvmclock, async PF, PV EOI and steal
+// time areas that KVM would otherwise keep writing to.
+var resetMSRs = []uint32{
+	0x174,      // IA32_SYSENTER_CS
+	0x175,      // IA32_SYSENTER_ESP
+	0x176,      // IA32_SYSENTER_EIP
+	0x277,      // IA32_PAT
+	0x6e0,      // IA32_TSC_DEADLINE
+	0xc0000081, // STAR
+	0xc0000082, // LSTAR
+	0xc0000083, // CSTAR
+	0xc0000084, // SFMASK
+	0xc0000100, // FS_BASE
+	0xc0000101, // GS_BASE
+	0xc0000102, // KERNEL_GS_BASE
+	0x4b564d00, // MSR_KVM_WALL_CLOCK_NEW
+	0x4b564d01, // MSR_KVM_SYSTEM_TIME_NEW
+	0x4b564d02, // MSR_KVM_ASYNC_PF_EN
+	0x4b564d03, // MSR_KVM_STEAL_TIME
+	0x4b564d04, // MSR_KVM_PV_EOI_EN
+}
+
+// powerOn is the state of a vCPU as KVM created it.
+type powerOn struct {
+	regs  *kvm.Regs
+	sregs *kvm.Sregs
+	fpu   kvm.FPU
+	lapic kvm.LAPICState
+	mp    kvm.MPState
+	msrs  kvm.MSRS
+}
+
+// ioapicChip is the IRQChip ID of the in-kernel IOAPIC.
+const ioapicChip = 2
+
+// vmPowerOn is the state of the in-kernel PICs, IOAPIC and PIT as KVM
+// created them, if there are any.
+type vmPowerOn struct {
+	chips []kvm.IRQChip
+	pit   *kvm.PITState2
+}
+
+// savePowerOn records the state of every vCPU and of the in-kernel
+// interrupt controllers, for Reset. It must run before the guest does.
+func (m *Machine) savePowerOn() error {
+	list := kvm.MSRList{NMSRs: uint32(len(kvm.MSRList{}.Indicies))}
+	if err := kvm.GetMSRIndexList(m.kvmFd, &list); err != nil {
+		return fmt.Errorf("MSR index list: %w", err)
+	}
+
+	supported := map[uint32]bool{}
+	for _, i := range list.Indicies[:list.NMSRs] {
+		supported[i] = true
+	}
+
+	var entries []kvm.MSREntry
+
+	for _, i := range resetMSRs {
+		if supported[i] {
+			entries = append(entries, kvm.MSREntry{Index: i})
+		}
+	}
+
+	m.powerOn = make([]powerOn, len(m.vcpuFds))
+
+	for cpu, fd := range m.vcpuFds {
+		p := &m.powerOn[cpu]
+
+		var err error
+
+		if p.regs, err = kvm.GetRegs(fd); err != nil {
+			return fmt.Errorf("cpu %d: %w", cpu, err)
+		}
+
+		if p.sregs, err = kvm.GetSregs(fd); err != nil {
+			return fmt.Errorf("cpu %d: %w", cpu, err)
+		}
+
+		if err := kvm.GetFPU(fd, &p.fpu); err != nil {
+			return fmt.Errorf("cpu %d: %w", cpu, err)
+		}
+
+		if err := kvm.GetLocalAPIC(fd, &p.lapic); err != nil {
+			return fmt.Errorf("cpu %d: %w", cpu, err)
+		}
+
+		if err := kvm.GetMPState(fd, &p.mp); err != nil {
+			return fmt.Errorf("cpu %d: %w", cpu, err)
+		}
+
+		p.msrs = kvm.MSRS{NMSRs: uint32(len(entries)), Entries: append([]kvm.MSREntry(nil), entries...)}
+		if err := kvm.GetMSRs(fd, &p.msrs); err != nil {
+			return fmt.Errorf("cpu %d: %w", cpu, err)
+		}
+	}
+
+	if m.irqChip != IRQChipKernel {
+		return nil
+	}
+
+	for _, id := range []uint32{picMaster, picSlave, ioapicChip} {
+		chip := kvm.IRQChip{ChipID: id}
+		if err := kvm.GetIRQChip(m.vmFd, &chip); err != nil {
+			return err
+		}
+
+		m.vmPowerOn.chips = append(m.vmPowerOn.chips, chip)
+	}
+
+	m.vmPowerOn.pit = &kvm.PITState2{}
+
+	return kvm.GetPIT2(m.vmFd, m.vmPowerOn.pit)
+}
+
+// restorePowerOn puts vCPU cpu back as savePowerOn found it.
+func (m *Machine) restorePowerOn(cpu int) error {
+	fd, p := m.vcpuFds[cpu], &m.powerOn[cpu]
+
+	regs, sregs, fpu, lapic, mp := *p.regs, *p.sregs, p.fpu, p.lapic, p.mp
+	msrs := kvm.MSRS{NMSRs: p.msrs.NMSRs, Entries: append([]kvm.MSREntry(nil), p.msrs.Entries...)}
+
+	// The APIC base in sregs comes before the LAPIC registers.
+	if err := kvm.SetSregs(fd, &sregs); err != nil {
+		return err
+	}
+
+	if err := kvm.SetRegs(fd, &regs); err != nil {
+		return err
+	}
+
+	if err := kvm.SetFPU(fd, &fpu); err != nil {
+		return err
+	}
+
+	if err := kvm.SetLocalAPIC(fd, &lapic); err != nil {
+		return err
+	}
+
+	if err := kvm.SetMSRs(fd, &msrs); err != nil {
+		return err
+	}
+
+	return kvm.SetMPState(fd, &mp)
+}
+
+// restoreVMPowerOn puts the in-kernel PICs, IOAPIC and PIT back as
+// savePowerOn found them, or masks the userspace IOAPIC again.
+func (m *Machine) restoreVMPowerOn() error {
+	if m.ioapic != nil {
+		return m.ioapic.reset()
+	}
+
+	for _, chip := range m.vmPowerOn.chips {
+		chip := chip
+		if err := kvm.SetIRQChip(m.vmFd, &chip); err != nil {
+			return err
+		}
+	}
+
+	if m.vmPowerOn.pit != nil {
+		pit := *m.vmPowerOn.pit
+
+		return kvm.SetPIT2(m.vmFd, &pit)
+	}
+
+	return nil
+}
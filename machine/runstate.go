@@ -0,0 +1,54 @@
+package machine
+
+import (
+	"errors"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// RunState is what a vCPU is doing, as far as the VMM can tell.
+//
+//go:generate stringer -type=RunState
+type RunState int32
+
+const (
+	// RunStateStopped means the vCPU has not been run yet.
+	RunStateStopped RunState = iota
+	// RunStateRunning means the vCPU is inside KVM_RUN, or about to
+	// re-enter it.
+	RunStateRunning
+	// RunStateHalted means the guest executed HLT and the vCPU has stopped.
+	// This needs HLT to exit to userspace, which it does not do while the
+	// LAPIC is emulated in the kernel.
+	RunStateHalted
+	// RunStatePaused means the vCPU stopped for the debugger,
+	// e.g. after a single step, and can be run again.
+	RunStatePaused
+	// RunStateError means the vCPU stopped because of an error.
+	RunStateError
+)
+
+// VCPUState returns the state of the vCPU, as of its last exit.
+// It does not block, even while the vCPU is running.
+func (m *Machine) VCPUState(cpu int) RunState {
+	if cpu < 0 || cpu >= len(m.vcpuStates) {
+		return RunStateStopped
+	}
+
+	return RunState(m.vcpuStates[cpu].Load())
+}
+
+// exitState returns the state of a vCPU that left KVM_RUN with exit,
+// after RunOnce has handled it.
+func exitState(exit kvm.ExitType, isContinue bool, err error) RunState {
+	switch {
+	case isContinue:
+		return RunStateRunning
+	case exit == kvm.EXITHLT:
+		return RunStateHalted
+	case err != nil && !errors.Is(err, kvm.ErrDebug):
+		return RunStateError
+	}
+
+	return RunStatePaused
+}
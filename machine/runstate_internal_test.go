@@ -0,0 +1,29 @@
+package machine
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+func TestExitState(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		exit       kvm.ExitType
+		isContinue bool
+		err        error
+		want       RunState
+	}{
+		{exit: kvm.EXITIO, isContinue: true, want: RunStateRunning},
+		{exit: kvm.EXITHLT, want: RunStateHalted},
+		{exit: kvm.EXITDEBUG, err: kvm.ErrDebug, want: RunStatePaused},
+		{exit: kvm.EXITSHUTDOWN, err: fmt.Errorf("%w: EXITSHUTDOWN", kvm.ErrUnexpectedExitReason), want: RunStateError},
+		{exit: kvm.EXITIO, err: ErrWriteToCF9, want: RunStateError},
+	} {
+		if got := exitState(tt.exit, tt.isContinue, tt.err); got != tt.want {
+			t.Errorf("exitState(%v, %v, %v): got %v, want %v", tt.exit, tt.isContinue, tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package machine
+
+import (
+	"bytes"
+)
+
+const pageSize = 0x1000
+
+// Scan returns the guest physical offsets of all matches of pattern in
+// guest memory that are a multiple of align. An align below 1 is taken
+// as 1; an empty pattern matches nothing.
+func (m *Machine) Scan(pattern []byte, align int) []int64 {
+	return scan(m.mem, pattern, align)
+}
+
+// ScanVirtual is Scan over the virtual addresses [start, end) as mapped
+// by the page tables of cpu. Unmapped pages are skipped, and matches may
+// span pages that are mapped to discontiguous physical memory.
+func (m *Machine) ScanVirtual(cpu int, start, end uint64, pattern []byte, align int) ([]uint64, error) {
+	if _, err := m.CPUToFD(cpu); err != nil {
+		return nil, err
+	}
+
+	var (
+		found []uint64
+		// win holds the tail of the previous page, if it was mapped,
+		// followed by the current page; base is the address of win[0].
+		win  []byte
+		base uint64
+	)
+
+	for page := start &^ (pageSize - 1); page < end; page += pageSize {
+		pa, err := m.VtoP(cpu, page)
+		if err != nil || pa+pageSize > int64(len(m.mem)) {
+			win = nil
+
+			continue
+		}
+
+		if len(win) == 0 {
+			base = page
+		}
+
+		win = append(win, m.mem[pa:pa+pageSize]...)
+
+		for _, off := range scan(win, pattern, 1) {
+			va := base + uint64(off)
+			if va >= start && va+uint64(len(pattern)) <= end && (align <= 1 || va%uint64(align) == 0) &&
+				va+uint64(len(pattern)) > page {
+				found = append(found, va)
+			}
+		}
+
+		// Keep what a match starting in this page could still need.
+		keep := len(pattern) - 1
+		if keep < 0 {
+			keep = 0
+		}
+
+		if len(win) > keep {
+			base += uint64(len(win) - keep)
+			win = append([]byte(nil), win[len(win)-keep:]...)
+		}
+	}
+
+	return found, nil
+}
+
+// scan returns the offsets of all matches of pattern in b that are a
+// multiple of align.
+func scan(b, pattern []byte, align int) []int64 {
+	if len(pattern) == 0 {
+		return nil
+	}
+
+	if align < 1 {
+		align = 1
+	}
+
+	var found []int64
+
+	for off := 0; off+len(pattern) <= len(b); {
+		i := bytes.Index(b[off:], pattern)
+		if i < 0 {
+			break
+		}
+
+		off += i
+
+		if off%align == 0 {
+			found = append(found, int64(off))
+		}
+
+		off++
+	}
+
+	return found
+}
@@ -0,0 +1,67 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// ErrSelfTest is returned when a vCPU is not in the long mode set up by
+// SetupRegs.
+var ErrSelfTest = errors.New("long mode self test failed")
+
+// identityMapSize is how much the page tables from initSregs map one to
+// one, with 2M pages.
+const identityMapSize = 0x1_0000_0000
+
+// SelfTest checks that cpu is in the long mode SetupRegs(..., true) set
+// up: paging and long mode bits in CR0, CR4 and EFER, and page tables that
+// map the first 4G one to one. All mismatches are reported.
+func (m *Machine) SelfTest(cpu int) error {
+	fd, err := m.CPUToFD(cpu)
+	if err != nil {
+		return err
+	}
+
+	s, err := kvm.GetSregs(fd)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+
+	check := func(name string, got, want uint64) {
+		if got&want != want {
+			errs = append(errs, fmt.Errorf("%s %#x: want bits %#x set: %w", name, got, want, ErrSelfTest))
+		}
+	}
+
+	check("CR0", s.CR0, CR0xPE|CR0xPG)
+	check("CR4", s.CR4, CR4xPAE)
+	check("EFER", s.EFER, EFERxLME|EFERxLMA)
+
+	if s.CS.L != 1 {
+		errs = append(errs, fmt.Errorf("CS is not a 64-bit segment: %w", ErrSelfTest))
+	}
+
+	for va := uint64(0); va < identityMapSize; va += 0x2_00_000 {
+		// The last byte of each page catches a wrong page size too.
+		for _, a := range []uint64{va, va + 0x1f_ffff} {
+			t := &kvm.Translation{LinearAddress: a}
+			if err := kvm.Translate(fd, t); err != nil {
+				return err
+			}
+
+			if t.Valid == 0 || t.PhysicalAddress != a {
+				errs = append(errs, fmt.Errorf("CR3 %#x: %#x maps to %#x (valid %d), want itself: %w",
+					s.CR3, a, t.PhysicalAddress, t.Valid, ErrSelfTest))
+
+				// One bad page is usually the whole table.
+				return errors.Join(errs...)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,52 @@
+package machine
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/serial"
+)
+
+func TestSerial2(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := New("/dev/kvm", 1, MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	var com1, com2 bytes.Buffer
+
+	m.GetSerial().SetOutput(&com1)
+	m.GetSerial2().SetOutput(&com2)
+
+	for _, b := range []byte("ttyS1") {
+		if err := m.ioportHandlers[serial.COM2Addr][kvm.EXITIOOUT](serial.COM2Addr, []byte{b}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if com2.String() != "ttyS1" {
+		t.Errorf("COM2 output: got %q, want %q", com2.String(), "ttyS1")
+	}
+
+	if com1.Len() != 0 {
+		t.Errorf("COM1 output: got %q, want none", com1.String())
+	}
+
+	// With the THRE interrupt enabled, a write interrupts on IRQ 3.
+	if err := m.ioportHandlers[serial.COM2Addr+1][kvm.EXITIOOUT](serial.COM2Addr+1, []byte{0x02}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.ioportHandlers[serial.COM2Addr][kvm.EXITIOOUT](serial.COM2Addr, []byte{'!'}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,23 @@
+package machine
+
+import "golang.org/x/sys/unix"
+
+// Shutdown makes every vCPU run loop return nil at its next exit, and
+// kicks vCPUs that are in the guest out of it. It does not wait for
+// them; Close may be called once they have returned.
+func (m *Machine) Shutdown() {
+	// immediate_exit covers a vCPU that is just about to enter KVM_RUN
+	// and would miss the kick, so set it before the flag.
+	for _, r := range m.runs {
+		r.ImmediateExit = 1
+	}
+
+	m.shutdown.Store(true)
+
+	for i := range m.vcpuTids {
+		if tid := m.vcpuTids[i].Load(); tid != 0 {
+			// See throttle.enter for why SIGURG.
+			_ = unix.Tgkill(unix.Getpid(), int(tid), unix.SIGURG)
+		}
+	}
+}
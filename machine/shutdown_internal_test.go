@@ -0,0 +1,102 @@
+package machine
+
+import (
+	"os"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+func TestGuestPoweroff(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := NewWithOptions("/dev/kvm", 1, MinMemSize, Options{MemInit: MemInitNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	code := []byte{
+		0x66, 0xba, 0x00, 0x06, // mov dx, 0x600
+		0xb0, 0x34, // mov al, 0x34 (SLP_EN, S5)
+		0xee,       // out dx, al
+		0xb0, 0xfe, // mov al, 0xfe
+		0xe6, 0x64, // out 0x64, al (reset)
+	}
+
+	if _, err := m.WriteAt(code, 0x1_00_000); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetupRegs(0x1_00_000, 0x10_000, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// The guest never gets to the reset.
+	if err := m.RunInfiniteLoop(0); err != nil {
+		t.Fatalf("RunInfiniteLoop: got %v, want nil", err)
+	}
+
+	if !m.shutdown.Load() {
+		t.Errorf("the other vCPUs were not shut down")
+	}
+}
+
+// The CMOS shutdown status, register 0x0f, tells the BIOS what to do
+// after a reset; Reset must not clear it.
+func TestCMOSShutdownStatusAcrossReset(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := NewWithOptions("/dev/kvm", 1, MinMemSize, Options{MemInit: MemInitNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	if err := m.SetupRegs(0x1_00_000, 0x10_000, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// As LoadLinux does.
+	m.AddDevice(m.newCMOS(0xC000_0000, 0x0))
+	m.initIOPortHandlers()
+
+	out := func(port uint64, b byte) {
+		if err := m.ioportHandlers[port][kvm.EXITIOOUT](port, []byte{b}); err != nil {
+			t.Fatalf("out %#x: %v", port, err)
+		}
+	}
+
+	in := func(port uint64) byte {
+		b := []byte{0}
+		if err := m.ioportHandlers[port][kvm.EXITIOIN](port, b); err != nil {
+			t.Fatalf("in %#x: %v", port, err)
+		}
+
+		return b[0]
+	}
+
+	// Through the NMI-masked index, as Linux writes it.
+	out(0x70, 0x8f)
+	out(0x71, 0x0a)
+
+	if err := m.Reset(); err != nil {
+		t.Fatalf("Reset: got %v, want nil", err)
+	}
+
+	out(0x70, 0x0f)
+
+	if got := in(0x71); got != 0x0a {
+		t.Errorf("shutdown status after Reset: got %#x, want 0xa", got)
+	}
+}
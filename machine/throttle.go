@@ -0,0 +1,92 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrBadCPULimit is returned for a CPU limit outside 0..100.
+var ErrBadCPULimit = errors.New("CPU limit must be in range 0..100")
+
+// throttlePeriod is the period a vCPU's CPU budget is accounted over.
+// A throttled vCPU sleeps for the rest of the period once its budget
+// is used up, so interrupts wait at most this long.
+const throttlePeriod = 10 * time.Millisecond
+
+// SetCPULimit caps each vCPU to percent of a host CPU, without cgroups.
+// 0 and 100 remove the cap. It takes effect when RunInfiniteLoop is
+// next called.
+func (m *Machine) SetCPULimit(percent int) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("%d: %w", percent, ErrBadCPULimit)
+	}
+
+	m.cpuLimit = percent
+
+	return nil
+}
+
+// throttle is a token bucket of CPU time for the vCPU running on thread
+// tid. A guest that does not exit by itself is kicked out of KVM_RUN
+// with a signal when its budget runs out.
+type throttle struct {
+	tid    int
+	budget time.Duration
+
+	periodStart time.Time
+	used        time.Duration
+	cpuStart    time.Duration
+	kick        *time.Timer
+}
+
+// threadCPUTime returns the CPU time of the calling thread. Time in
+// guest mode counts as well, and so does the cost of the kicks.
+func threadCPUTime() time.Duration {
+	var ts unix.Timespec
+
+	_ = unix.ClockGettime(unix.CLOCK_THREAD_CPUTIME_ID, &ts)
+
+	return time.Duration(ts.Nano())
+}
+
+func newThrottle(tid, percent int) *throttle {
+	return &throttle{
+		tid:         tid,
+		budget:      throttlePeriod * time.Duration(percent) / 100,
+		periodStart: time.Now(),
+	}
+}
+
+// enter is called before KVM_RUN. It sleeps out the period if the
+// budget is used up, and arms the kick for what is left of it.
+func (t *throttle) enter() {
+	now := time.Now()
+
+	if t.used >= t.budget {
+		time.Sleep(time.Until(t.periodStart.Add(throttlePeriod)))
+
+		now = time.Now()
+	}
+
+	if now.Sub(t.periodStart) >= throttlePeriod {
+		t.periodStart, t.used = now, 0
+	}
+
+	t.cpuStart = threadCPUTime()
+
+	// SIGURG is what the Go runtime preempts with, so it has a handler
+	// and a spurious one is harmless. It makes KVM_RUN return EXITINTR.
+	t.kick = time.AfterFunc(t.budget-t.used, func() {
+		_ = unix.Tgkill(unix.Getpid(), t.tid, unix.SIGURG)
+	})
+}
+
+// leave is called after KVM_RUN and accounts the CPU time used since
+// enter, which includes handling the exit.
+func (t *throttle) leave() {
+	t.kick.Stop()
+	t.used += threadCPUTime() - t.cpuStart
+}
@@ -0,0 +1,97 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// ErrBadTraceRange is returned for a trace range that is empty.
+var ErrBadTraceRange = errors.New("bad trace range")
+
+// dr7L0 enables DR0 as an instruction breakpoint.
+const dr7L0 = 1
+
+// SetTraceRange limits tracing to instructions with start <= RIP < end.
+// The guest runs at full speed up to a hardware breakpoint at start,
+// is single-stepped while RIP stays in the range, and runs freely
+// again once it leaves. The range must be set before the vCPUs run.
+func (m *Machine) SetTraceRange(start, end uint64) error {
+	if start >= end {
+		return fmt.Errorf("[%#x, %#x): %w", start, end, ErrBadTraceRange)
+	}
+
+	m.traceStart, m.traceEnd = start, end
+
+	for cpu := range m.vcpuFds {
+		if err := m.traceStep(cpu, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// traceStep single-steps cpu if step is set, and otherwise lets it run
+// until it hits the start of the trace range. The breakpoint is off
+// while stepping, or the guest would trap on it again when resumed.
+func (m *Machine) traceStep(cpu int, step bool) error {
+	ctl := uint32(kvm.GuestDebugEnable | kvm.GuestDebugSingleStep)
+	dr := [8]uint64{}
+
+	if !step {
+		ctl = kvm.GuestDebugEnable | kvm.GuestDebugUseHWBP
+		dr[0], dr[7] = m.traceStart, dr7L0
+	}
+
+	if err := kvm.SetGuestDebug(m.vcpuFds[cpu], ctl, dr); err != nil {
+		return fmt.Errorf("trace range on CPU %d: %w", cpu, err)
+	}
+
+	return nil
+}
+
+// vcpuTraceRange is VCPU with a trace range set.
+func (m *Machine) vcpuTraceRange(stdout io.Writer, cpu, traceCount int) error {
+	if traceCount < 1 {
+		traceCount = 1
+	}
+
+	for tc := 0; ; {
+		err := m.RunInfiniteLoop(cpu)
+		if err == nil {
+			return nil
+		}
+
+		if !errors.Is(err, kvm.ErrDebug) {
+			return fmt.Errorf("CPU %d: %w", cpu, err)
+		}
+
+		r, err := m.GetRegs(cpu)
+		if err != nil {
+			return err
+		}
+
+		in := m.traceStart <= r.RIP && r.RIP < m.traceEnd
+
+		if err := m.traceStep(cpu, in); err != nil {
+			return err
+		}
+
+		if !in {
+			continue
+		}
+
+		if tc++; (tc-1)%traceCount != 0 {
+			continue
+		}
+
+		if _, _, s, err := m.Inst(cpu); err != nil {
+			fmt.Fprintf(stdout, "disassembling after debug exit:%v", err)
+		} else {
+			fmt.Fprintf(stdout, "%#x:%s\r\n", r.RIP, s)
+		}
+	}
+}
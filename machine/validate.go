@@ -0,0 +1,189 @@
+package machine
+
+import (
+	"compress/gzip"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bobuhiro11/gokvm/bootparam"
+	"github.com/bobuhiro11/gokvm/pvh"
+)
+
+// ErrKernelTooLarge is returned by ValidateImages for a kernel that
+// does not fit in guest memory.
+var ErrKernelTooLarge = errors.New("kernel does not fit in memory")
+
+// Kernel formats reported by ValidateImages.
+const (
+	KernelBzImage = "bzImage"
+	KernelELF     = "ELF"
+	KernelPVH     = "PVH ELF"
+)
+
+// ImageInfo describes boot images as ValidateImages found them.
+type ImageInfo struct {
+	KernelFormat string
+	// KernelSize is how much of the kernel is loaded into memory.
+	KernelSize uint64
+	// InitrdSize is the size after decompression, if it is gzipped.
+	InitrdSize uint64
+	// DiskSizes are the sizes of the disks, in order.
+	DiskSizes []int64
+}
+
+// ValidateImages checks that the kernel, initrd and disks can be loaded
+// into a guest with memSize bytes of memory, without creating one.
+// The initrd and disks are optional.
+func ValidateImages(kernel, initrd string, disks []string, memSize int) (*ImageInfo, error) {
+	if memSize < MinMemSize {
+		return nil, fmt.Errorf("memory size %d:%w", memSize, ErrMemTooSmall)
+	}
+
+	info := &ImageInfo{}
+
+	// Without an initrd, the kernel may use all of high memory, up to
+	// the MMIO hole. So may the initrd.
+	lowEnd := memRegions(memSize)[0].size
+	kernelEnd := lowEnd
+
+	if initrd != "" {
+		size, err := initrdSize(initrd)
+		if err != nil {
+			return nil, err
+		}
+
+		if initrdAddr+size > lowEnd {
+			return nil, fmt.Errorf("initrd %q, %d bytes: %w", initrd, size, ErrInitrdTooLarge)
+		}
+
+		info.InitrdSize = size
+		kernelEnd = initrdAddr
+	}
+
+	if err := validateKernel(kernel, kernelEnd, info); err != nil {
+		return nil, err
+	}
+
+	for _, disk := range disks {
+		size, err := diskSize(disk)
+		if err != nil {
+			return nil, err
+		}
+
+		info.DiskSizes = append(info.DiskSizes, size)
+	}
+
+	return info, nil
+}
+
+// diskSize returns the size of the disk at path, if it can be opened.
+func diskSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return fi.Size(), nil
+}
+
+// validateKernel fills in the kernel format and size, if the kernel
+// loads below end.
+func validateKernel(path string, end uint64, info *ImageInfo) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if fi.Size() == 0 {
+		return fmt.Errorf("%q: %w", path, ErrZeroSizeKernel)
+	}
+
+	if k, err := elf.NewFile(f); err == nil {
+		isPVH, err := pvh.CheckPVH(f)
+		if err != nil {
+			return fmt.Errorf("%q: %w", path, err)
+		}
+
+		info.KernelFormat = KernelELF
+		if isPVH {
+			info.KernelFormat = KernelPVH
+		}
+
+		for _, p := range k.Progs {
+			if p.Type != elf.PT_LOAD {
+				continue
+			}
+
+			if p.Paddr+p.Memsz > end {
+				return fmt.Errorf("%q: segment at %#x, %#x bytes: %w", path, p.Paddr, p.Memsz, ErrKernelTooLarge)
+			}
+
+			info.KernelSize += p.Memsz
+		}
+
+		return nil
+	}
+
+	bp, err := bootparam.New(f)
+	if err != nil {
+		return fmt.Errorf("%q is neither ELF nor bzImage: %w", path, err)
+	}
+
+	// See LoadLinux for where the protected mode kernel goes.
+	setupsz := (int64(bp.Hdr.SetupSects) + 1) * bootparam.SectorSize
+	info.KernelFormat = KernelBzImage
+	info.KernelSize = uint64(fi.Size() - setupsz)
+
+	if highMemBase+info.KernelSize > end {
+		return fmt.Errorf("%q, %d bytes: %w", path, info.KernelSize, ErrKernelTooLarge)
+	}
+
+	return nil
+}
+
+// initrdSize returns the size of the initrd at path, as LoadInitrd
+// would load it.
+func initrdSize(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var magic [2]byte
+	if n, _ := f.ReadAt(magic[:], 0); n < len(magic) || magic != [2]byte{0x1f, 0x8b} {
+		fi, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+
+		return uint64(fi.Size()), nil
+	}
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, fmt.Errorf("initrd %q: %w", path, err)
+	}
+
+	n, err := io.Copy(io.Discard, zr)
+	if err != nil {
+		return 0, fmt.Errorf("initrd %q: %w", path, err)
+	}
+
+	return uint64(n), nil
+}
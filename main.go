@@ -1,10 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 
 	"github.com/bobuhiro11/gokvm/flag"
+	"github.com/bobuhiro11/gokvm/machine"
 	"github.com/bobuhiro11/gokvm/probe"
 	"github.com/bobuhiro11/gokvm/vmm"
 )
@@ -15,17 +17,65 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if bootArgs != nil && bootArgs.Validate {
+		info, err := machine.ValidateImages(bootArgs.Kernel, bootArgs.Initrd, bootArgs.Disk, bootArgs.MemSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("kernel: %s, %d bytes\n", info.KernelFormat, info.KernelSize)
+
+		if bootArgs.Initrd != "" {
+			fmt.Printf("initrd: %d bytes\n", info.InitrdSize)
+		}
+
+		for i, size := range info.DiskSizes {
+			fmt.Printf("disk %s: %d bytes\n", bootArgs.Disk[i], size)
+		}
+
+		return
+	}
+
 	if bootArgs != nil {
 		c := &vmm.Config{
-			Dev:        bootArgs.Dev,
-			Kernel:     bootArgs.Kernel,
-			Initrd:     bootArgs.Initrd,
-			Params:     bootArgs.Params,
-			TapIfName:  bootArgs.TapIfName,
-			Disk:       bootArgs.Disk,
-			NCPUs:      bootArgs.NCPUs,
-			MemSize:    bootArgs.MemSize,
-			TraceCount: bootArgs.TraceCount,
+			Debug:         bootArgs.Debug,
+			Dev:           bootArgs.Dev,
+			Kernel:        bootArgs.Kernel,
+			Initrd:        bootArgs.Initrd,
+			Params:        bootArgs.Params,
+			TapIfNames:    bootArgs.TapIfNames,
+			Disks:         bootArgs.Disk,
+			BlockSize:     bootArgs.BlockSize,
+			DiskSerial:    bootArgs.DiskSerial,
+			DiskMmap:      bootArgs.DiskMmap,
+			Rng:           bootArgs.Rng,
+			NCPUs:         bootArgs.NCPUs,
+			CPULimit:      bootArgs.CPULimit,
+			MemSize:       bootArgs.MemSize,
+			TraceCount:    bootArgs.TraceCount,
+			TraceStart:    bootArgs.TraceStart,
+			TraceEnd:      bootArgs.TraceEnd,
+			PidFile:       bootArgs.PidFile,
+			UUID:          bootArgs.UUID,
+			Serial:        bootArgs.Serial,
+			MemInit:       bootArgs.MemInit,
+			Exception:     bootArgs.Exception,
+			IRQChip:       bootArgs.IRQChip,
+			CPUModel:      bootArgs.CPUModel,
+			Name:          bootArgs.Name,
+			SerialLog:     bootArgs.SerialLog,
+			SerialLogSize: bootArgs.SerialLogSize,
+			SerialLogKeep: bootArgs.SerialLogKeep,
+			Serial2:       bootArgs.Serial2,
+			Prealloc:      bootArgs.Prealloc,
+			MemFD:         bootArgs.MemFD,
+			DisableExits:  bootArgs.DisableExits,
+			CoalescedPIO:  bootArgs.CoalescedPIO,
+			MSIX:          bootArgs.MSIX,
+			Entry32:       bootArgs.Entry32,
+			PauseOnEntry:  bootArgs.Paused,
+			MaxReboots:    bootArgs.MaxReboots,
+			CPUID:         bootArgs.CPUID,
 		}
 
 		vmm := vmm.New(*c)
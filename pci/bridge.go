@@ -10,7 +10,8 @@ func (br bridge) GetDeviceHeader() DeviceHeader {
 	return DeviceHeader{
 		DeviceID:      0x0d57,
 		VendorID:      0x8086,
-		HeaderType:    1,
+		ClassCode:     ClassCodeHostBridge,
+		HeaderType:    0,
 		SubsystemID:   0,
 		InterruptLine: 0,
 		InterruptPin:  0,
@@ -0,0 +1,132 @@
+package pci
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Capability IDs.
+//
+// refs https://wiki.osdev.org/PCI#Capabilities_List
+const (
+	CapIDPM     = 0x01
+	CapIDVendor = 0x09
+	CapIDMSIX   = 0x11
+)
+
+const (
+	// configSpaceSize is the size of the conventional PCI config space.
+	configSpaceSize = 0x100
+	// capStart is where the capability list begins, just past the header.
+	capStart = 0x40
+	// statusCapList is set in Status when CapPointer is valid.
+	statusCapList = 0x10
+)
+
+var ErrCapListFull = errors.New("capabilities do not fit in config space")
+
+// Capability is one entry of the capability list. Body follows the
+// ID and next pointer bytes, which are filled in when the list is built.
+type Capability struct {
+	ID   uint8
+	Body []byte
+}
+
+// CapabilityLister is implemented by devices that expose capabilities.
+type CapabilityLister interface {
+	Capabilities() []Capability
+}
+
+// PMCapability returns a power management capability (version 1.2)
+// that only supports D0, which is all our devices know about.
+func PMCapability() Capability {
+	body := make([]byte, 6)
+	binary.LittleEndian.PutUint16(body[0:], 0x3) // PMC: version 3
+	// PMCSR: D0, No_Soft_Reset, so a D3hot->D0 transition keeps state.
+	binary.LittleEndian.PutUint16(body[2:], 0x8)
+
+	return Capability{ID: CapIDPM, Body: body}
+}
+
+// MSIXCapability returns an MSI-X capability for a table of tableSize
+// entries at tableOffset in BAR tableBAR, and the pending bit array
+// at pbaOffset in BAR pbaBAR. Offsets must be 8-byte aligned.
+func MSIXCapability(tableSize uint16, tableBAR uint8, tableOffset uint32, pbaBAR uint8, pbaOffset uint32) Capability {
+	body := make([]byte, 10)
+	binary.LittleEndian.PutUint16(body[0:], (tableSize-1)&0x7ff)
+	binary.LittleEndian.PutUint32(body[2:], tableOffset&^0x7|uint32(tableBAR&0x7))
+	binary.LittleEndian.PutUint32(body[6:], pbaOffset&^0x7|uint32(pbaBAR&0x7))
+
+	return Capability{ID: CapIDMSIX, Body: body}
+}
+
+// VendorCapability returns a vendor-specific capability carrying data.
+func VendorCapability(data []byte) Capability {
+	// The length byte counts the ID, next pointer and itself.
+	return Capability{ID: CapIDVendor, Body: append([]byte{uint8(len(data) + 3)}, data...)}
+}
+
+// findCapability returns the offset of the first capability with id in
+// the config space cs, or 0 if there is none.
+func findCapability(cs []byte, id uint8) int {
+	off := int(cs[0x34])
+
+	// Each entry takes at least 4 bytes, which bounds a looping list.
+	for n := 0; off != 0 && off+1 < len(cs) && n < len(cs)/4; n++ {
+		if cs[off] == id {
+			return off
+		}
+
+		off = int(cs[off+1])
+	}
+
+	return 0
+}
+
+// ConfigSpace returns the 256 byte config space of dev: its header,
+// followed by its capabilities, if any, linked from CapPointer.
+func ConfigSpace(dev Device) ([]byte, error) {
+	h := dev.GetDeviceHeader()
+
+	var caps []Capability
+	if l, ok := dev.(CapabilityLister); ok {
+		caps = l.Capabilities()
+	}
+
+	if len(caps) > 0 {
+		h.Status |= statusCapList
+		h.CapPointer = capStart
+	}
+
+	b, err := h.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	cs := make([]byte, configSpaceSize)
+	copy(cs, b)
+
+	off := capStart
+
+	for i, c := range caps {
+		// Entries are dword aligned.
+		end := off + 2 + len(c.Body)
+		next := (end + 3) &^ 3
+
+		if end > configSpaceSize {
+			return nil, fmt.Errorf("capability %#x at %#x: %w", c.ID, off, ErrCapListFull)
+		}
+
+		cs[off] = c.ID
+		if i < len(caps)-1 {
+			cs[off+1] = uint8(next)
+		}
+
+		copy(cs[off+2:], c.Body)
+
+		off = next
+	}
+
+	return cs, nil
+}
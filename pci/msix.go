@@ -0,0 +1,189 @@
+package pci
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+const (
+	// msixEntrySize is the size of an MSI-X table entry: message
+	// address low and high, message data and vector control.
+	msixEntrySize = 16
+
+	// Bits of the MSI-X Message Control register.
+	msixCtlEnable       = 1 << 15
+	msixCtlFunctionMask = 1 << 14
+
+	// msixVectorMasked is the mask bit of an entry's vector control.
+	msixVectorMasked = 1
+
+	// MSIXBAR is the BAR devices put their MSI-X table in, BAR0 being
+	// their IO ports.
+	MSIXBAR = 1
+	// MSIXBARSize is the size of the memory BAR holding the MSI-X table
+	// and pending bit array.
+	MSIXBARSize = 0x1000
+	// msixPBAOffset is where the pending bit array starts in the BAR.
+	msixPBAOffset = 0x800
+)
+
+// MSIX is the MSI-X state of a device: the enable and function mask
+// bits of its capability, and the vector table and pending bit array
+// in its memory BAR, MSIXBAR.
+type MSIX struct {
+	mu      sync.Mutex
+	addr    uint32
+	ctl     uint16
+	table   []byte
+	pending []bool
+	signal  func(addr uint64, data uint32) error
+}
+
+// NewMSIX returns the MSI-X state for vectors vectors, with the table in
+// a memory BAR at addr. signal sends a message, e.g. with kvm.SignalMSI.
+// Vectors start out masked and MSI-X disabled, as after reset.
+func NewMSIX(vectors int, addr uint32, signal func(addr uint64, data uint32) error) *MSIX {
+	x := &MSIX{
+		addr:    addr,
+		table:   make([]byte, vectors*msixEntrySize),
+		pending: make([]bool, vectors),
+		signal:  signal,
+	}
+
+	for v := 0; v < vectors; v++ {
+		x.table[v*msixEntrySize+12] = msixVectorMasked
+	}
+
+	return x
+}
+
+// MSIXDevice is a Device with an MSI-X capability. MSIX returns nil
+// for a device that has none.
+type MSIXDevice interface {
+	Device
+	MSIX() *MSIX
+}
+
+// Addr returns the address of the memory BAR.
+func (x *MSIX) Addr() uint32 {
+	return x.addr
+}
+
+// Capability returns the MSI-X capability, with the current enable and
+// function mask bits.
+func (x *MSIX) Capability() Capability {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	c := MSIXCapability(uint16(len(x.pending)), MSIXBAR, 0, MSIXBAR, msixPBAOffset)
+	binary.LittleEndian.PutUint16(c.Body, binary.LittleEndian.Uint16(c.Body)|x.ctl)
+
+	return c
+}
+
+// Enabled reports whether the guest enabled MSI-X. Whether or not the
+// function is masked, the device then must not use its INTx line.
+func (x *MSIX) Enabled() bool {
+	if x == nil {
+		return false
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	return x.ctl&msixCtlEnable != 0
+}
+
+// WriteControl handles a guest write of the Message Control register;
+// only the enable and function mask bits are writable. Unmasking the
+// function sends the messages that were held back meanwhile.
+func (x *MSIX) WriteControl(ctl uint16) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.ctl = ctl & (msixCtlEnable | msixCtlFunctionMask)
+
+	return x.sendPending()
+}
+
+// ReadTable handles a guest read of the memory BAR at offset off.
+func (x *MSIX) ReadTable(off uint64, data []byte) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for i := range data {
+		data[i] = x.byteAt(off + uint64(i))
+	}
+}
+
+func (x *MSIX) byteAt(off uint64) byte {
+	switch {
+	case off < uint64(len(x.table)):
+		return x.table[off]
+	case off >= msixPBAOffset && off < msixPBAOffset+uint64(len(x.pending)+7)/8:
+		var b byte
+
+		for bit := 0; bit < 8; bit++ {
+			if v := int(off-msixPBAOffset)*8 + bit; v < len(x.pending) && x.pending[v] {
+				b |= 1 << bit
+			}
+		}
+
+		return b
+	}
+
+	return 0
+}
+
+// WriteTable handles a guest write of the memory BAR at offset off.
+// The pending bit array is read-only. Unmasking a vector sends its
+// message if one is pending.
+func (x *MSIX) WriteTable(off uint64, data []byte) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if off >= uint64(len(x.table)) {
+		return nil
+	}
+
+	copy(x.table[off:], data)
+
+	return x.sendPending()
+}
+
+// Notify sends the message of vector, or marks it pending while the
+// vector or the function is masked.
+func (x *MSIX) Notify(vector uint16) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if int(vector) >= len(x.pending) {
+		return nil
+	}
+
+	x.pending[vector] = true
+
+	return x.sendPending()
+}
+
+// sendPending sends the pending messages that are no longer masked.
+func (x *MSIX) sendPending() error {
+	if x.ctl&msixCtlEnable == 0 || x.ctl&msixCtlFunctionMask != 0 {
+		return nil
+	}
+
+	for v, p := range x.pending {
+		e := x.table[v*msixEntrySize : (v+1)*msixEntrySize]
+		if !p || binary.LittleEndian.Uint32(e[12:])&msixVectorMasked != 0 {
+			continue
+		}
+
+		x.pending[v] = false
+
+		if err := x.signal(binary.LittleEndian.Uint64(e[0:]), binary.LittleEndian.Uint32(e[8:])); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -44,23 +44,38 @@ type Device interface {
 	Size() uint64
 }
 
+// HeaderTypeMultiFunction is set in HeaderType of function 0 of a
+// device with more functions; the guest does not look for them otherwise.
+const HeaderTypeMultiFunction = 0x80
+
+// Class codes, in the order ClassCode holds them: programming interface,
+// subclass and base class.
+//
+// refs https://wiki.osdev.org/PCI#Class_Codes
+var (
+	ClassCodeSCSI       = [3]uint8{0x00, 0x00, 0x01}
+	ClassCodeEthernet   = [3]uint8{0x00, 0x00, 0x02}
+	ClassCodeHostBridge = [3]uint8{0x00, 0x00, 0x06}
+	ClassCodeOther      = [3]uint8{0x00, 0x00, 0xff}
+)
+
 type DeviceHeader struct {
 	VendorID      uint16
 	DeviceID      uint16
 	Command       uint16
-	_             uint16   // status
-	_             uint8    // revisonID
-	_             [3]uint8 // classCode
-	_             uint8    // cacheLineSize
-	_             uint8    // latencyTimer
+	Status        uint16
+	RevisionID    uint8
+	ClassCode     [3]uint8
+	_             uint8 // cacheLineSize
+	_             uint8 // latencyTimer
 	HeaderType    uint8
 	_             uint8 // bist
 	BAR           [6]uint32
 	_             uint32 // cardbusCISPointer
 	_             uint16 // subsystemVendorID
 	SubsystemID   uint16
-	_             uint32   // expansionROMBaseAddress
-	_             uint8    // capabilitiesPointer
+	_             uint32 // expansionROMBaseAddress
+	CapPointer    uint8
 	_             [7]uint8 // reserved
 	InterruptLine uint8
 	InterruptPin  uint8
@@ -81,54 +96,147 @@ func (h DeviceHeader) Bytes() ([]byte, error) {
 type PCI struct {
 	addr        address
 	isBAR0Probe bool
-	Devices     []Device
+	// isMSIXBARProbe is like isBAR0Probe, for MSIXBAR.
+	isMSIXBARProbe bool
+	Devices        []Device
+	// regs holds, by slot, the header registers the guest has written.
+	regs []*writableRegs
+}
+
+const (
+	commandOffset = 0x04
+
+	// commandWritable are the Command bits a guest can change: IO and
+	// memory space, bus master and INTx disable.
+	commandWritable = 0x0407
+)
+
+// barOffset is where BAR bar is in config space.
+func barOffset(bar int) int {
+	return 0x10 + 4*bar
+}
+
+// writableRegs are the registers of a device header that keep what the
+// guest writes. The rest of config space is generated from the device
+// on every read.
+type writableRegs struct {
+	command uint16
+}
+
+// writable returns the writable registers of the device in slot,
+// starting out as its header has them.
+func (p *PCI) writable(slot int) *writableRegs {
+	for len(p.regs) <= slot {
+		p.regs = append(p.regs, nil)
+	}
+
+	if p.regs[slot] == nil {
+		h := p.Devices[slot].GetDeviceHeader()
+		p.regs[slot] = &writableRegs{command: h.Command}
+	}
+
+	return p.regs[slot]
+}
+
+// configSpace returns the config space of the device in slot, with the
+// registers the guest has written.
+func (p *PCI) configSpace(slot int) ([]byte, error) {
+	cs, err := ConfigSpace(p.Devices[slot])
+	if err != nil {
+		return nil, err
+	}
+
+	binary.LittleEndian.PutUint16(cs[commandOffset:], p.writable(slot).command)
+
+	return cs, nil
+}
+
+// writeHeader applies a guest write of values at offset to the Command
+// register of the device in slot. BAR0 is read-only but for the size
+// probe: the device answers at the IO ports it was created with, and
+// BAR0 keeps saying so.
+func (p *PCI) writeHeader(slot, offset int, values []byte) error {
+	cs, err := p.configSpace(slot)
+	if err != nil {
+		return err
+	}
+
+	if offset < len(cs) {
+		copy(cs[offset:], values)
+	}
+
+	r := p.writable(slot)
+
+	command := binary.LittleEndian.Uint16(cs[commandOffset:])
+	r.command = r.command&^commandWritable | command&commandWritable
+
+	return nil
 }
 
 func New(devices ...Device) *PCI {
 	return &PCI{Devices: devices}
 }
 
+// slot returns the slot of the device the config address selects, if
+// there is one. All devices are on bus 0 and have only function 0.
+func (p *PCI) slot() (int, bool) {
+	if !p.addr.isEnable() || p.addr.getBusNumber() != 0 || p.addr.getFunctionNumber() != 0 {
+		return 0, false
+	}
+
+	slot := int(p.addr.getDeviceNumber())
+
+	return slot, slot < len(p.Devices)
+}
+
 func (p *PCI) PciConfDataIn(port uint64, values []byte) error {
 	// offset can be obtained from many source as below:
 	//        (address from IO port 0xcf8) & 0xfc + (IO port address for Data) - 0xCFC
 	// see pci_conf1_read in linux/arch/x86/pci/direct.c for more detail.
 	offset := int(p.addr.getRegisterOffset() + uint32(port-0xCFC))
 
-	if !p.addr.isEnable() {
-		return nil
-	}
-
-	if p.addr.getBusNumber() != 0 {
-		return nil
-	}
+	slot, ok := p.slot()
+	if !ok {
+		// No device, and no function but 0 of any device, answers;
+		// the guest reads all ones, a vendor ID of 0xffff.
+		for i := range values {
+			values[i] = 0xff
+		}
 
-	if p.addr.getFunctionNumber() != 0 {
 		return nil
 	}
 
-	slot := int(p.addr.getDeviceNumber())
-
-	if slot >= len(p.Devices) {
-		return nil
+	b, err := p.configSpace(slot)
+	if err != nil {
+		return err
 	}
 
-	// Probing BAR0 Size
+	// The answer to a BAR size probe stands in for the BAR, for one
+	// read of any size.
 	if bar := offset/4 - 4; bar == 0 && p.isBAR0Probe {
-		size := p.Devices[slot].Size()
-		copy(values[:4], NumToBytes(SizeToBits(size)))
+		binary.LittleEndian.PutUint32(b[barOffset(bar):], SizeToBits(p.Devices[slot].Size()))
 
 		p.isBAR0Probe = false
+	}
 
-		return nil
+	if bar := offset/4 - 4; bar == MSIXBAR && p.isMSIXBARProbe {
+		p.isMSIXBARProbe = false
+
+		if d, ok := p.Devices[slot].(MSIXDevice); ok && d.MSIX() != nil {
+			// A 32-bit memory BAR.
+			binary.LittleEndian.PutUint32(b[barOffset(bar):], ^uint32(MSIXBARSize-1))
+		}
 	}
 
-	b, err := p.Devices[slot].GetDeviceHeader().Bytes()
-	if err != nil {
-		return err
+	// A misaligned access through the data port can run past the end
+	// of config space; those bytes read as all ones, like absent ones.
+	for i := range values {
+		values[i] = 0xff
 	}
 
-	l := len(values)
-	copy(values[:l], b[offset:offset+l])
+	if offset < len(b) {
+		copy(values, b[offset:min(offset+len(values), len(b))])
+	}
 
 	return nil
 }
@@ -136,32 +244,57 @@ func (p *PCI) PciConfDataIn(port uint64, values []byte) error {
 func (p *PCI) PciConfDataOut(port uint64, values []byte) error {
 	offset := int(p.addr.getRegisterOffset() + uint32(port-0xCFC))
 
-	if !p.addr.isEnable() {
+	slot, ok := p.slot()
+	if !ok {
 		return nil
 	}
 
-	if p.addr.getBusNumber() != 0 {
+	// Probing BAR0 Size
+	if bar := offset/4 - 4; bar == 0 && BytesToNum(values) == 0xffffffff {
+		p.isBAR0Probe = true
+
 		return nil
 	}
 
-	if p.addr.getFunctionNumber() != 0 {
+	if bar := offset/4 - 4; bar == MSIXBAR && BytesToNum(values) == 0xffffffff {
+		p.isMSIXBARProbe = true
+
 		return nil
 	}
 
-	slot := int(p.addr.getDeviceNumber())
+	if err := p.writeHeader(slot, offset, values); err != nil {
+		return err
+	}
 
-	if slot >= len(p.Devices) {
-		return nil
+	if d, ok := p.Devices[slot].(MSIXDevice); ok && d.MSIX() != nil {
+		return writeMSIXControl(d, offset, values)
 	}
 
-	// Probing BAR0 Size
-	if bar := offset/4 - 4; bar == 0 && BytesToNum(values) == 0xffffffff {
-		p.isBAR0Probe = true
+	return nil
+}
 
+// writeMSIXControl passes the part of a config space write at offset
+// that hits the Message Control register of the MSI-X capability of d
+// on to its MSIX.
+func writeMSIXControl(d MSIXDevice, offset int, values []byte) error {
+	cs, err := ConfigSpace(d)
+	if err != nil {
+		return err
+	}
+
+	ctl := findCapability(cs, CapIDMSIX) + 2
+	if ctl == 2 || offset+len(values) <= ctl || offset >= ctl+2 {
 		return nil
 	}
 
-	return nil
+	b := cs[ctl : ctl+2]
+	for i, v := range values {
+		if j := offset + i - ctl; j >= 0 && j < 2 {
+			b[j] = v
+		}
+	}
+
+	return d.MSIX().WriteControl(binary.LittleEndian.Uint16(b))
 }
 
 func (p *PCI) PciConfAddrIn(port uint64, values []byte) error {
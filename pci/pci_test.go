@@ -3,6 +3,7 @@ package pci_test
 import (
 	"bytes"
 	"errors"
+	"reflect"
 	"testing"
 
 	"github.com/bobuhiro11/gokvm/pci"
@@ -223,3 +224,380 @@ func TestPciConfDataInOut(t *testing.T) {
 		})
 	}
 }
+
+type capDevice struct {
+	pci.Device
+	caps []pci.Capability
+}
+
+func (d capDevice) Capabilities() []pci.Capability {
+	return d.caps
+}
+
+func TestCapabilityList(t *testing.T) {
+	t.Parallel()
+
+	dev := capDevice{
+		Device: pci.NewBridge(),
+		caps: []pci.Capability{
+			pci.VendorCapability([]byte{0xaa}),
+			pci.PMCapability(),
+			pci.MSIXCapability(4, 1, 0, 1, 0x800),
+		},
+	}
+	p := pci.New(dev)
+
+	read := func(offset uint32, size int) uint64 {
+		_ = p.PciConfAddrOut(0xCF8, pci.NumToBytes(0x80000000|offset&^3))
+
+		b := make([]byte, size)
+		if err := p.PciConfDataIn(0xCFC+uint64(offset&3), b); err != nil {
+			t.Fatal(err)
+		}
+
+		return pci.BytesToNum(b)
+	}
+
+	if status := read(0x6, 2); status&0x10 == 0 {
+		t.Fatalf("status: got %#x, want capability list bit 0x10 set", status)
+	}
+
+	var ids []uint64
+
+	pm := uint64(0)
+
+	for ptr := read(0x34, 1); ptr != 0; ptr = read(uint32(ptr)+1, 1) {
+		if len(ids) > 3 {
+			t.Fatalf("capability list does not terminate: %#x", ids)
+		}
+
+		id := read(uint32(ptr), 1)
+		if id == pci.CapIDPM {
+			pm = ptr
+		}
+
+		ids = append(ids, id)
+	}
+
+	if want := []uint64{pci.CapIDVendor, pci.CapIDPM, pci.CapIDMSIX}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("capability ids: got %#x, want %#x", ids, want)
+	}
+
+	// The vendor capability is 4 bytes long, so PM comes right after it.
+	if pm != 0x44 {
+		t.Errorf("PM capability: got %#x, want 0x44", pm)
+	}
+
+	if pmc := read(uint32(pm)+2, 2); pmc&0x7 != 3 {
+		t.Errorf("PMC version: got %d, want 3", pmc&0x7)
+	}
+}
+
+func TestCapabilityListFull(t *testing.T) {
+	t.Parallel()
+
+	dev := capDevice{
+		Device: pci.NewBridge(),
+		caps:   []pci.Capability{pci.VendorCapability(make([]byte, 0xc0))},
+	}
+
+	if _, err := pci.ConfigSpace(dev); !errors.Is(err, pci.ErrCapListFull) {
+		t.Errorf("got %v, want %v", err, pci.ErrCapListFull)
+	}
+}
+
+func TestPciConfDataInPastEnd(t *testing.T) {
+	t.Parallel()
+
+	p := pci.New(pci.NewBridge())
+
+	for _, tt := range []struct {
+		port uint64
+		want uint64
+	}{
+		// The last dword of config space is there, and zero.
+		{port: 0xCFC, want: 0},
+		// Through the last data port, 3 of 4 bytes are past the end.
+		{port: 0xCFF, want: 0xffffff00},
+	} {
+		_ = p.PciConfAddrOut(0xCF8, pci.NumToBytes(uint32(0x800000FC)))
+
+		b := make([]byte, 4)
+		if err := p.PciConfDataIn(tt.port, b); err != nil {
+			t.Fatalf("PciConfDataIn(%#x): got %v, want nil", tt.port, err)
+		}
+
+		if got := pci.BytesToNum(b); got != tt.want {
+			t.Errorf("PciConfDataIn(%#x) at 0xfc: got %#x, want %#x", tt.port, got, tt.want)
+		}
+	}
+}
+
+type msixDevice struct {
+	pci.Device
+	x *pci.MSIX
+}
+
+func (d msixDevice) Capabilities() []pci.Capability {
+	return []pci.Capability{d.x.Capability()}
+}
+
+func (d msixDevice) MSIX() *pci.MSIX {
+	return d.x
+}
+
+func TestMSIX(t *testing.T) {
+	t.Parallel()
+
+	type msg struct {
+		addr uint64
+		data uint32
+	}
+
+	var sent []msg
+
+	x := pci.NewMSIX(2, 0xE000_0000, func(addr uint64, data uint32) error {
+		sent = append(sent, msg{addr, data})
+
+		return nil
+	})
+	p := pci.New(msixDevice{Device: pci.NewBridge(), x: x})
+
+	access := func(offset uint32, b []byte, write bool) {
+		_ = p.PciConfAddrOut(0xCF8, pci.NumToBytes(0x80000000|offset&^3))
+
+		f := p.PciConfDataIn
+		if write {
+			f = p.PciConfDataOut
+		}
+
+		if err := f(0xCFC+uint64(offset&3), b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Probing BAR1 reports a 4K memory BAR.
+	access(0x14, pci.NumToBytes(uint32(0xffffffff)), true)
+
+	bar := make([]byte, 4)
+	access(0x14, bar, false)
+
+	if got := pci.BytesToNum(bar); got != 0xfffff000 {
+		t.Errorf("BAR1 probe: got %#x, want 0xfffff000", got)
+	}
+
+	// And its high byte, alone.
+	access(0x14, pci.NumToBytes(uint32(0xffffffff)), true)
+
+	hi := make([]byte, 1)
+	access(0x17, hi, false)
+
+	if hi[0] != 0xff {
+		t.Errorf("BAR1 probe, high byte: got %#x, want 0xff", hi[0])
+	}
+
+	b := make([]byte, 2)
+	access(0x42, b, false)
+
+	if got := pci.BytesToNum(b); got != 1 {
+		t.Errorf("Message Control: got %#x, want table size 2 encoded as 1", got)
+	}
+
+	// Vector 1: address 0xfee00000, data 0x41, unmasked.
+	entry := make([]byte, 16)
+	copy(entry[0:], pci.NumToBytes(uint32(0xfee00000)))
+	copy(entry[8:], pci.NumToBytes(uint32(0x41)))
+
+	if err := x.WriteTable(16, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	// Disabled, the device has to use INTx.
+	if err := x.Notify(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if x.Enabled() || len(sent) != 0 {
+		t.Fatalf("MSI-X disabled: enabled %v, sent %v", x.Enabled(), sent)
+	}
+
+	// Enable with the function masked; the message stays pending.
+	access(0x42, pci.NumToBytes(uint16(0xc000)), true)
+
+	if err := x.Notify(1); err != nil {
+		t.Fatal(err)
+	}
+
+	pba := make([]byte, 1)
+	x.ReadTable(0x800, pba)
+
+	if !x.Enabled() || len(sent) != 0 || pba[0] != 0x2 {
+		t.Fatalf("function masked: enabled %v, sent %v, PBA %#x", x.Enabled(), sent, pba[0])
+	}
+
+	// Unmasking the function sends it.
+	access(0x42, pci.NumToBytes(uint16(0x8000)), true)
+
+	if want := []msg{{0xfee00000, 0x41}}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("sent: got %v, want %v", sent, want)
+	}
+
+	// Vector 0 is still masked, as after reset.
+	if err := x.Notify(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sent) != 1 {
+		t.Errorf("masked vector 0 was sent: %v", sent)
+	}
+}
+
+// ioDevice is a bridge with 0x100 IO ports at BAR0.
+type ioDevice struct {
+	pci.Device
+}
+
+func (d ioDevice) GetDeviceHeader() pci.DeviceHeader {
+	h := d.Device.GetDeviceHeader()
+	h.Command = 1
+	h.BAR[0] = 0x6200 | 0x1
+
+	return h
+}
+
+func (d ioDevice) Size() uint64 {
+	return 0x100
+}
+
+func TestPciConfDataOutHeader(t *testing.T) {
+	t.Parallel()
+
+	p := pci.New(pci.NewBridge(), ioDevice{pci.NewBridge()})
+
+	access := func(slot, offset uint32, b []byte, write bool) {
+		_ = p.PciConfAddrOut(0xCF8, pci.NumToBytes(0x80000000|slot<<11|offset&^3))
+
+		f := p.PciConfDataIn
+		if write {
+			f = p.PciConfDataOut
+		}
+
+		if err := f(0xCFC+uint64(offset&3), b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	read := func(slot, offset uint32, size int) uint64 {
+		b := make([]byte, size)
+		access(slot, offset, b, false)
+
+		return pci.BytesToNum(b)
+	}
+
+	// Bus master on; bit 3, special cycles, is not writable.
+	access(1, 0x4, pci.NumToBytes(uint16(0x000d)), true)
+
+	if got := read(1, 0x4, 2); got != 0x5 {
+		t.Errorf("command: got %#x, want 0x5", got)
+	}
+
+	// Status shares the dword, and is not affected.
+	access(1, 0x4, pci.NumToBytes(uint32(0xffff0001)), true)
+
+	if got := read(1, 0x4, 4); got != 0x1 {
+		t.Errorf("command and status: got %#x, want 0x1", got)
+	}
+
+	// BAR0 keeps the IO ports the device decodes.
+	access(1, 0x10, pci.NumToBytes(uint32(0xc000)), true)
+
+	if got := read(1, 0x10, 4); got != 0x6201 {
+		t.Errorf("BAR0: got %#x, want 0x6201", got)
+	}
+
+	// The probe still reports the size, and leaves BAR0 as it was.
+	access(1, 0x10, pci.NumToBytes(uint32(0xffffffff)), true)
+
+	if got := read(1, 0x10, 4); got != uint64(pci.SizeToBits(0x100)) {
+		t.Errorf("BAR0 probe: got %#x, want %#x", got, pci.SizeToBits(0x100))
+	}
+
+	if got := read(1, 0x10, 4); got != 0x6201 {
+		t.Errorf("BAR0 after probe: got %#x, want 0x6201", got)
+	}
+
+	// A probe answered a byte or a word at a time, as from 0xcfc and 0xcfe.
+	access(1, 0x10, pci.NumToBytes(uint32(0xffffffff)), true)
+
+	if got, want := read(1, 0x10, 1), uint64(pci.SizeToBits(0x100)&0xff); got != want {
+		t.Errorf("BAR0 probe, byte: got %#x, want %#x", got, want)
+	}
+
+	access(1, 0x10, pci.NumToBytes(uint32(0xffffffff)), true)
+
+	if got, want := read(1, 0x12, 2), uint64(pci.SizeToBits(0x100)>>16); got != want {
+		t.Errorf("BAR0 probe, high word: got %#x, want %#x", got, want)
+	}
+
+	// The bridge has no BAR0 to write, and its own command register.
+	access(0, 0x10, pci.NumToBytes(uint32(0xc000)), true)
+
+	if got := read(0, 0x10, 4); got != 0 {
+		t.Errorf("bridge BAR0: got %#x, want 0", got)
+	}
+
+	if got := read(0, 0x4, 2); got != 0 {
+		t.Errorf("bridge command: got %#x, want 0", got)
+	}
+}
+
+func TestBytesClassCode(t *testing.T) {
+	t.Parallel()
+
+	dh := pci.DeviceHeader{
+		RevisionID: 0x1,
+		ClassCode:  pci.ClassCodeEthernet,
+		HeaderType: pci.HeaderTypeMultiFunction,
+	}
+
+	b, err := dh.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := b[0x08:0x0c], []byte{0x01, 0x00, 0x00, 0x02}; !bytes.Equal(got, want) {
+		t.Errorf("revision and class code: got %#x, want %#x", got, want)
+	}
+
+	if b[0x0e] != 0x80 {
+		t.Errorf("header type: got %#x, want 0x80", b[0x0e])
+	}
+}
+
+func TestPciConfDataInAbsent(t *testing.T) {
+	t.Parallel()
+
+	p := pci.New(pci.NewBridge())
+
+	for _, tt := range []struct {
+		name string
+		addr uint32
+		want uint64
+	}{
+		{name: "bridge", addr: 0x80000008, want: 0x0600_0000},
+		{name: "function 1", addr: 0x80000100, want: 0xffffffff},
+		{name: "slot 1", addr: 0x80000800, want: 0xffffffff},
+		{name: "bus 1", addr: 0x80010000, want: 0xffffffff},
+	} {
+		_ = p.PciConfAddrOut(0xCF8, pci.NumToBytes(tt.addr))
+
+		b := make([]byte, 4)
+		if err := p.PciConfDataIn(0xCFC, b); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		if got := pci.BytesToNum(b); got != tt.want {
+			t.Errorf("%s: got %#x, want %#x", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package serial
+
+import (
+	"io"
+	"sync"
+)
+
+// Agent frames are sent by the guest on COM1 between console bytes:
+//
+//	DLE STX type payload... DLE ETX
+//
+// A DLE inside a frame is sent as DLE DLE. Outside of a frame, a DLE
+// that does not start one is passed through as console output.
+const (
+	dle = 0x10
+	stx = 0x02
+	etx = 0x03
+
+	// maxAgentFrame bounds a frame, so a lost DLE ETX cannot swallow
+	// the console.
+	maxAgentFrame = 4096
+)
+
+// AgentMsgType is the type of an agent message.
+type AgentMsgType uint8
+
+const (
+	// AgentPing is sent by the guest agent once it is up.
+	AgentPing AgentMsgType = 'p'
+	// AgentExecDone reports a command finished; the payload is its status.
+	AgentExecDone AgentMsgType = 'x'
+	// AgentShutdownAck acknowledges a shutdown request.
+	AgentShutdownAck AgentMsgType = 's'
+)
+
+// AgentMsg is a control message from the guest agent.
+type AgentMsg struct {
+	Type AgentMsgType
+	Data []byte
+}
+
+type agentState int
+
+const (
+	agentConsole agentState = iota
+	agentConsoleDLE
+	agentFrame
+	agentFrameDLE
+)
+
+// Agent separates agent frames from console output. It is meant to be
+// set as the output of a Serial with SetOutput.
+type Agent struct {
+	out   io.Writer
+	msgs  chan AgentMsg
+	ready chan struct{}
+
+	mu        sync.Mutex
+	state     agentState
+	frame     []byte
+	readyOnce sync.Once
+}
+
+// NewAgent returns an Agent passing console output on to console.
+func NewAgent(console io.Writer) *Agent {
+	return &Agent{
+		out:   console,
+		msgs:  make(chan AgentMsg, 16),
+		ready: make(chan struct{}),
+	}
+}
+
+// Msgs returns the agent messages received. Messages are dropped if
+// nobody reads them, rather than stalling the vCPU writing the port.
+func (a *Agent) Msgs() <-chan AgentMsg {
+	return a.msgs
+}
+
+// Ready is closed when the first ping arrives.
+func (a *Agent) Ready() <-chan struct{} {
+	return a.ready
+}
+
+// Write implements io.Writer.
+func (a *Agent) Write(p []byte) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	console := make([]byte, 0, len(p))
+
+	for _, b := range p {
+		switch a.state {
+		case agentConsole:
+			if b == dle {
+				a.state = agentConsoleDLE
+
+				continue
+			}
+
+			console = append(console, b)
+		case agentConsoleDLE:
+			switch b {
+			case stx:
+				a.state = agentFrame
+				a.frame = a.frame[:0]
+			case dle:
+				// Stay here: the second DLE may start a frame.
+				console = append(console, dle)
+			default:
+				a.state = agentConsole
+				console = append(console, dle, b)
+			}
+		case agentFrame:
+			if b == dle {
+				a.state = agentFrameDLE
+
+				continue
+			}
+
+			a.appendFrame(b)
+		case agentFrameDLE:
+			switch b {
+			case etx:
+				a.state = agentConsole
+				a.deliver()
+			case stx:
+				// The guest restarted a frame; drop the partial one.
+				a.state = agentFrame
+				a.frame = a.frame[:0]
+			default:
+				a.state = agentFrame
+				a.appendFrame(b)
+			}
+		}
+	}
+
+	if len(console) > 0 {
+		if _, err := a.out.Write(console); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+func (a *Agent) appendFrame(b byte) {
+	if len(a.frame) >= maxAgentFrame {
+		a.state = agentConsole
+
+		return
+	}
+
+	a.frame = append(a.frame, b)
+}
+
+func (a *Agent) deliver() {
+	if len(a.frame) == 0 {
+		return
+	}
+
+	m := AgentMsg{Type: AgentMsgType(a.frame[0]), Data: append([]byte(nil), a.frame[1:]...)}
+
+	if m.Type == AgentPing {
+		a.readyOnce.Do(func() { close(a.ready) })
+	}
+
+	select {
+	case a.msgs <- m:
+	default:
+	}
+}
+
+// EncodeAgentMsg returns the frame the guest agent sends for m.
+func EncodeAgentMsg(m AgentMsg) []byte {
+	b := []byte{dle, stx, byte(m.Type)}
+
+	for _, c := range m.Data {
+		if c == dle {
+			b = append(b, dle)
+		}
+
+		b = append(b, c)
+	}
+
+	return append(b, dle, etx)
+}
@@ -0,0 +1,61 @@
+package serial_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/serial"
+)
+
+func TestAgentFramer(t *testing.T) {
+	t.Parallel()
+
+	s, err := serial.New(&mockInjector{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+
+	a := serial.NewAgent(&out)
+	s.SetOutput(a)
+
+	var in []byte
+
+	in = append(in, "login: "...)
+	in = append(in, serial.EncodeAgentMsg(serial.AgentMsg{Type: serial.AgentPing})...)
+	in = append(in, "\x10ok\r\n"...)
+	in = append(in, serial.EncodeAgentMsg(serial.AgentMsg{Type: serial.AgentExecDone, Data: []byte{'0', 0x10}})...)
+	in = append(in, '$')
+
+	// The guest writes the port a byte at a time.
+	for _, b := range in {
+		if err := s.Out(serial.COM1Addr, []byte{b}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if want := "login: \x10ok\r\n$"; out.String() != want {
+		t.Errorf("console: got %q, want %q", out.String(), want)
+	}
+
+	select {
+	case <-a.Ready():
+	default:
+		t.Error("Ready: not closed after ping")
+	}
+
+	for _, want := range []serial.AgentMsg{
+		{Type: serial.AgentPing, Data: []byte{}},
+		{Type: serial.AgentExecDone, Data: []byte{'0', 0x10}},
+	} {
+		select {
+		case got := <-a.Msgs():
+			if got.Type != want.Type || !bytes.Equal(got.Data, want.Data) {
+				t.Errorf("msg: got %c %q, want %c %q", got.Type, got.Data, want.Type, want.Data)
+			}
+		default:
+			t.Fatalf("msg: none, want %c", want.Type)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package serial_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/serial"
+)
+
+func TestRotatingFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "serial.log")
+
+	r, err := serial.NewRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := serial.New(&mockInjector{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetOutput(r)
+
+	// 35 bytes fill four files, but only two rotations are kept,
+	// so the first 10 bytes are gone.
+	for _, b := range []byte("0123456789abcdefghijKLMNOPQRSTuvwxy") {
+		if err := s.Out(serial.COM1Addr, []byte{b}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		path:        "uvwxy",
+		path + ".1": "KLMNOPQRST",
+		path + ".2": "abcdefghij",
+	} {
+		got, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(got) != want {
+			t.Errorf("%s: got %q, want %q", filepath.Base(name), got, want)
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("%s.3: got %v, want %v", filepath.Base(path), err, os.ErrNotExist)
+	}
+}
+
+func TestRotatingFileBadArgs(t *testing.T) {
+	t.Parallel()
+
+	if _, err := serial.NewRotatingFile(filepath.Join(t.TempDir(), "log"), 0, 1); !errors.Is(err, serial.ErrBadRotation) {
+		t.Errorf("got %v, want %v", err, serial.ErrBadRotation)
+	}
+}
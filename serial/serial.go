@@ -3,13 +3,16 @@ package serial
 import (
 	"bufio"
 	"errors"
-	"fmt"
 	"io"
 	"log"
+	"os"
+	"sync"
+	"unicode/utf8"
 )
 
 const (
 	COM1Addr = 0x03f8
+	COM2Addr = 0x02f8
 )
 
 // Note that this identical interface is defined across
@@ -19,19 +22,93 @@ type IRQInjector interface {
 	InjectSerialIRQ() error
 }
 
+// The registers this model uses; see a 16550A data sheet.
+const (
+	ierRDA  = 0x01 // received data available interrupt
+	ierTHRE = 0x02 // transmitter holding register empty interrupt
+	ierMask = 0x0f // the upper bits read as 0 on a 16550A
+
+	iirNoInt   = 0x01
+	iirTHRE    = 0x02
+	iirRDA     = 0x04
+	iirTimeout = 0x0c // character timeout: data below the trigger level
+	iirFIFO    = 0xc0 // FIFOs enabled
+
+	fcrEnable  = 0x01
+	fcrClearRX = 0x02
+	fcrClearTX = 0x04
+	fcrTrigger = 0xc0
+
+	lsrDR   = 0x01 // Data Ready
+	lsrTHRE = 0x20 // Empty Transmitter Holding Register
+	lsrTEMT = 0x40 // Empty Data Holding Registers
+
+	// fifoSize is the depth of the 16550A FIFOs.
+	fifoSize = 16
+)
+
+// Serial is a 16550A UART. The transmitter sends each byte as it is
+// written, so its FIFO is always empty and a THRE interrupt follows every
+// write to THR. Received bytes move from the input channel into a
+// 16 byte receive FIFO as the guest reads them.
 type Serial struct {
 	IER byte
 	LCR byte
 
+	base uint64
+
+	mu   sync.Mutex
+	fcr  byte
+	thre bool // a THRE interrupt is pending
+	rx   []byte
+
 	inputChan chan byte
+	out       io.Writer
 
 	irqInjector IRQInjector
 }
 
+// State is the register state of a Serial, for saving and restoring it.
+// Bytes in the receive FIFO are not part of it.
+type State struct {
+	IER byte
+	LCR byte
+	// FCR is the FIFO control register, without the bits that clear the
+	// FIFOs.
+	FCR byte
+	// THRE is whether a THRE interrupt is pending, i.e. latched in IIR
+	// until the guest reads IIR or writes THR.
+	THRE bool
+}
+
+// TriggerLevel returns after how many received bytes the guest gets a
+// received data interrupt, or 1 with the FIFOs disabled.
+func (st State) TriggerLevel() int {
+	return triggerLevel(st.FCR)
+}
+
+func triggerLevel(fcr byte) int {
+	if fcr&fcrEnable == 0 {
+		return 1
+	}
+
+	return [...]int{1, 4, 8, 14}[(fcr&fcrTrigger)>>6]
+}
+
 func New(irqInjector IRQInjector) (*Serial, error) {
+	return NewAt(COM1Addr, irqInjector)
+}
+
+// NewAt returns a Serial whose eight registers start at the IO port
+// base, e.g. COM2Addr. Its interrupts go to irqInjector, which decides
+// the IRQ line.
+func NewAt(base uint64, irqInjector IRQInjector) (*Serial, error) {
 	s := &Serial{
 		IER: 0, LCR: 0,
+		base:        base,
+		rx:          make([]byte, 0, fifoSize),
 		inputChan:   make(chan byte, 10000),
+		out:         os.Stdout,
 		irqInjector: irqInjector,
 	}
 
@@ -42,18 +119,79 @@ func (s *Serial) GetInputChan() chan<- byte {
 	return s.inputChan
 }
 
+// SetOutput sets where the guest's output goes. The default is os.Stdout.
+// It must be called before the guest runs.
+func (s *Serial) SetOutput(w io.Writer) {
+	s.out = w
+}
+
+// GetState returns the register state.
+func (s *Serial) GetState() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return State{IER: s.IER, LCR: s.LCR, FCR: s.fcr, THRE: s.thre}
+}
+
+// SetState restores a register state from GetState. It must be called
+// before the guest runs.
+func (s *Serial) SetState(st State) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.IER, s.LCR, s.fcr, s.thre = st.IER&ierMask, st.LCR, st.FCR&^(fcrClearRX|fcrClearTX), st.THRE
+}
+
 func (s *Serial) dlab() bool {
 	return s.LCR&0x80 != 0
 }
 
+// fill moves received bytes into the receive FIFO, which holds a single
+// byte with the FIFOs disabled.
+func (s *Serial) fill() {
+	size := 1
+	if s.fcr&fcrEnable != 0 {
+		size = fifoSize
+	}
+
+	for len(s.rx) < size && len(s.inputChan) > 0 {
+		s.rx = append(s.rx, <-s.inputChan)
+	}
+}
+
+// iir returns the highest priority pending interrupt, as IIR shows it.
+func (s *Serial) iir() byte {
+	var fifo byte
+	if s.fcr&fcrEnable != 0 {
+		fifo = iirFIFO
+	}
+
+	switch {
+	case s.IER&ierRDA != 0 && len(s.rx) >= triggerLevel(s.fcr):
+		return fifo | iirRDA
+	case s.IER&ierRDA != 0 && len(s.rx) > 0:
+		return fifo | iirTimeout
+	case s.IER&ierTHRE != 0 && s.thre:
+		return fifo | iirTHRE
+	}
+
+	return fifo | iirNoInt
+}
+
 func (s *Serial) In(port uint64, values []byte) error {
-	port -= COM1Addr
+	port -= s.base
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fill()
 
 	switch {
 	case port == 0 && !s.dlab():
 		// RBR
-		if len(s.inputChan) > 0 {
-			values[0] = <-s.inputChan
+		if len(s.rx) > 0 {
+			values[0] = s.rx[0]
+			s.rx = append(s.rx[:0], s.rx[1:]...)
 		}
 	case port == 0 && s.dlab():
 		// DLL
@@ -66,17 +204,22 @@ func (s *Serial) In(port uint64, values []byte) error {
 		values[0] = 0x0 // baud rate 9600
 	case port == 2:
 		// IIR
+		values[0] = s.iir()
+
+		// Reading IIR acknowledges a THRE interrupt.
+		if values[0]&0x0f == iirTHRE {
+			s.thre = false
+		}
 	case port == 3:
 		// LCR
 	case port == 4:
 		// MCR
 	case port == 5:
 		// LSR
-		values[0] |= 0x20 // Empty Transmitter Holding Register
-		values[0] |= 0x40 // Empty Data Holding Registers
+		values[0] |= lsrTHRE | lsrTEMT
 
-		if len(s.inputChan) > 0 {
-			values[0] |= 0x1 // Data Ready
+		if len(s.rx) > 0 {
+			values[0] |= lsrDR
 		}
 	case port == 6:
 		// MSR
@@ -87,26 +230,44 @@ func (s *Serial) In(port uint64, values []byte) error {
 }
 
 func (s *Serial) Out(port uint64, values []byte) error {
-	port -= COM1Addr
+	port -= s.base
 
-	var err error
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	switch {
 	case port == 0 && !s.dlab():
 		// THR
-		fmt.Printf("%c", values[0])
+		s.writeTHR(values[0])
+
+		return s.raiseTHRE()
 	case port == 0 && s.dlab():
 		// DLL
 	case port == 1 && !s.dlab():
 		// IER
-		s.IER = values[0]
-		if s.IER != 0 {
-			err = s.irqInjector.InjectSerialIRQ()
+		enabled := values[0] &^ s.IER
+		s.IER = values[0] & ierMask
+
+		// Enabling the THRE interrupt raises it, since THR is empty.
+		if enabled&ierTHRE != 0 {
+			s.thre = true
+		}
+
+		s.fill()
+
+		if s.iir()&iirNoInt == 0 {
+			return s.irqInjector.InjectSerialIRQ()
 		}
 	case port == 1 && s.dlab():
 		// DLM
 	case port == 2:
 		// FCR
+		// Turning the FIFOs on or off clears them.
+		if (values[0]^s.fcr)&fcrEnable != 0 || values[0]&fcrClearRX != 0 {
+			s.rx = s.rx[:0]
+		}
+
+		s.fcr = values[0] &^ (fcrClearRX | fcrClearTX)
 	case port == 3:
 		// LCR
 		s.LCR = values[0]
@@ -117,7 +278,53 @@ func (s *Serial) Out(port uint64, values []byte) error {
 		break
 	}
 
-	return err
+	return nil
+}
+
+// raiseTHRE latches a THRE interrupt, THR being empty again, and
+// injects it if the guest enabled it.
+func (s *Serial) raiseTHRE() error {
+	s.thre = true
+
+	if s.IER&ierTHRE == 0 {
+		return nil
+	}
+
+	return s.irqInjector.InjectSerialIRQ()
+}
+
+// WriteTHR writes b to the transmitter holding register, as Out does,
+// and reports whether it did. It is the fast path for a guest printing
+// a byte at a time; if DLAB is set, the port is DLL instead, and if the
+// guest wants a THRE interrupt, it has to be injected, so the caller
+// must go through Out.
+func (s *Serial) WriteTHR(b byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dlab() || s.IER&ierTHRE != 0 {
+		return false
+	}
+
+	s.writeTHR(b)
+	s.thre = true
+
+	return true
+}
+
+// thrBytes holds what writeTHR sends for each byte, so that it does not
+// allocate: the byte itself, or for 0x80 and up, the UTF-8 encoding of
+// that code point, as fmt's %c verb produced before.
+var thrBytes = func() (t [256][]byte) {
+	for i := range t {
+		t[i] = utf8.AppendRune(nil, rune(i))
+	}
+
+	return t
+}()
+
+func (s *Serial) writeTHR(b byte) {
+	_, _ = s.out.Write(thrBytes[b])
 }
 
 func (s *Serial) Start(in bufio.Reader, restoreMode func(), irqInject func() error) error {
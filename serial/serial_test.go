@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"testing"
 
@@ -16,6 +17,17 @@ func (m *mockInjector) InjectSerialIRQ() error {
 	return nil
 }
 
+// countInjector counts the serial interrupts injected.
+type countInjector struct {
+	n int
+}
+
+func (c *countInjector) InjectSerialIRQ() error {
+	c.n++
+
+	return nil
+}
+
 func TestNew(t *testing.T) {
 	t.Parallel()
 
@@ -91,3 +103,260 @@ func TestStartSerial(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestSetOutput(t *testing.T) {
+	t.Parallel()
+
+	s, err := serial.New(&mockInjector{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+
+	s.SetOutput(&out)
+
+	for _, b := range []byte("ok") {
+		if err := s.Out(serial.COM1Addr, []byte{b}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if out.String() != "ok" {
+		t.Fatalf("output: got %q, want %q", out.String(), "ok")
+	}
+}
+
+func TestWriteTHR(t *testing.T) {
+	t.Parallel()
+
+	s, err := serial.New(&mockInjector{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out, fast bytes.Buffer
+
+	for i := 0; i < 256; i++ {
+		s.SetOutput(&out)
+
+		if err := s.Out(serial.COM1Addr, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+
+		s.SetOutput(&fast)
+
+		if !s.WriteTHR(byte(i)) {
+			t.Fatalf("WriteTHR(%#x): got false, want true", i)
+		}
+
+		// This is what Out wrote before it had a fast path.
+		if want := fmt.Sprintf("%c", byte(i)); out.String() != want || fast.String() != want {
+			t.Fatalf("byte %#x: Out wrote %q, WriteTHR wrote %q, want %q", i, out.String(), fast.String(), want)
+		}
+
+		out.Reset()
+		fast.Reset()
+	}
+
+	// With DLAB set, port 0 is the divisor latch.
+	if err := s.Out(serial.COM1Addr+3, []byte{0x80}); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.WriteTHR('x') || fast.Len() != 0 {
+		t.Errorf("WriteTHR with DLAB: got true or output %q, want false and none", fast.String())
+	}
+}
+
+func TestIIR(t *testing.T) {
+	t.Parallel()
+
+	inj := &countInjector{}
+
+	s, err := serial.New(inj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetOutput(io.Discard)
+
+	out := func(reg int, v byte) {
+		t.Helper()
+
+		if err := s.Out(uint64(serial.COM1Addr+reg), []byte{v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	in := func(reg int) byte {
+		t.Helper()
+
+		v := []byte{0}
+		if err := s.In(uint64(serial.COM1Addr+reg), v); err != nil {
+			t.Fatal(err)
+		}
+
+		return v[0]
+	}
+
+	iir := func(want byte) {
+		t.Helper()
+
+		if got := in(2); got != want {
+			t.Errorf("IIR: got %#x, want %#x", got, want)
+		}
+	}
+
+	// Set 9600 8N1 as the 8250 driver does, then enable the FIFOs with
+	// a trigger level of 14 bytes.
+	out(3, 0x80)
+	out(0, 0x0c)
+	out(1, 0)
+	out(3, 0x03)
+	out(2, 0xc7)
+
+	iir(0xc1)
+
+	if got := s.GetState().TriggerLevel(); got != 14 {
+		t.Errorf("trigger level: got %d, want 14", got)
+	}
+
+	// Enabling the THRE interrupt raises it right away; reading IIR
+	// acknowledges it.
+	out(1, 0x02)
+
+	if inj.n != 1 {
+		t.Errorf("after enabling THRE: got %d interrupts, want 1", inj.n)
+	}
+
+	iir(0xc2)
+	iir(0xc1)
+
+	out(0, 'a')
+
+	if inj.n != 2 {
+		t.Errorf("after writing THR: got %d interrupts, want 2", inj.n)
+	}
+
+	if s.WriteTHR('b') {
+		t.Error("WriteTHR with the THRE interrupt enabled: got true, want false")
+	}
+
+	// Received data below the trigger level shows as a timeout, and
+	// takes priority over THRE.
+	out(1, 0x03)
+	s.GetInputChan() <- 'x'
+
+	iir(0xcc)
+
+	if lsr := in(5); lsr&0x01 == 0 {
+		t.Errorf("LSR: got %#x, want Data Ready", lsr)
+	}
+
+	if got := in(0); got != 'x' {
+		t.Errorf("RBR: got %q, want 'x'", got)
+	}
+
+	iir(0xc2)
+	iir(0xc1)
+
+	for i := 0; i < 14; i++ {
+		s.GetInputChan() <- byte(i)
+	}
+
+	iir(0xc4)
+
+	// Clearing the receive FIFO leaves no interrupt.
+	out(2, 0xc3)
+	iir(0xc1)
+
+	// Without FIFOs, IIR has no FIFO bits and one byte is enough.
+	out(2, 0)
+	s.GetInputChan() <- 'y'
+
+	iir(0x04)
+}
+
+func TestSerialState(t *testing.T) {
+	t.Parallel()
+
+	s, err := serial.New(&mockInjector{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := serial.State{IER: 0x03, LCR: 0x03, FCR: 0x81, THRE: true}
+	s.SetState(want)
+
+	if got := s.GetState(); got != want {
+		t.Errorf("GetState: got %+v, want %+v", got, want)
+	}
+
+	if got := want.TriggerLevel(); got != 8 {
+		t.Errorf("TriggerLevel: got %d, want 8", got)
+	}
+
+	v := []byte{0}
+	if err := s.In(serial.COM1Addr+2, v); err != nil {
+		t.Fatal(err)
+	}
+
+	if v[0] != 0xc2 {
+		t.Errorf("IIR after SetState: got %#x, want 0xc2", v[0])
+	}
+}
+
+func BenchmarkTHR(b *testing.B) {
+	s, err := serial.New(&mockInjector{})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	s.SetOutput(io.Discard)
+
+	b.Run("Fprintf", func(b *testing.B) {
+		// How Out wrote a byte before.
+		for i := 0; i < b.N; i++ {
+			fmt.Fprintf(io.Discard, "%c", byte(i))
+		}
+	})
+
+	b.Run("Out", func(b *testing.B) {
+		v := []byte{0}
+
+		for i := 0; i < b.N; i++ {
+			v[0] = byte(i)
+			_ = s.Out(serial.COM1Addr, v)
+		}
+	})
+
+	b.Run("WriteTHR", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s.WriteTHR(byte(i))
+		}
+	})
+}
+
+func TestNewAt(t *testing.T) {
+	t.Parallel()
+
+	s, err := serial.NewAt(serial.COM2Addr, &mockInjector{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+
+	s.SetOutput(&out)
+
+	for _, b := range []byte("ok") {
+		if err := s.Out(serial.COM2Addr, []byte{b}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if out.String() != "ok" {
+		t.Fatalf("output: got %q, want %q", out.String(), "ok")
+	}
+}
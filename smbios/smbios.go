@@ -0,0 +1,250 @@
+// Package smbios builds minimal SMBIOS tables, so that guests can read a
+// system UUID and serial number as they would on real hardware.
+// See the DMTF System Management BIOS Reference Specification (DSP0134).
+package smbios
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// Start is where the tables are placed. The guest looks for the
+	// entry point anchor on a 16-byte boundary between 0xf0000 and 0xfffff.
+	Start = 0xf0000
+
+	// tableOffset is the offset of the structure table from Start.
+	tableOffset = 0x20
+
+	entryPointLength = 0x1f
+
+	typeBIOS       = 0
+	typeSystem     = 1
+	typeEndOfTable = 127
+
+	// BIOS characteristics: BIOS characteristics are not supported.
+	biosCharNotSupported = 1 << 3
+	// BIOS characteristics extension byte 2: this is a virtual machine.
+	biosCharExt2VM = 1 << 4
+
+	wakeUpPowerSwitch = 6
+
+	vendor = "gokvm"
+)
+
+// ErrBadUUID is returned for a UUID that is not 32 hex digits.
+var ErrBadUUID = errors.New("uuid must be 32 hex digits, optionally separated by dashes")
+
+type (
+	// SMBIOS describes the identity of the system presented to the guest.
+	SMBIOS struct {
+		UUID   [16]byte
+		Serial string
+		// Product is the system product name; empty means the default.
+		Product string
+	}
+
+	// SMBIOS 2.1 (32-bit) entry point structure.
+	entryPoint struct {
+		Anchor               [4]byte
+		Checksum             uint8
+		Length               uint8
+		MajorVersion         uint8
+		MinorVersion         uint8
+		MaxStructureSize     uint16
+		EntryPointRevision   uint8
+		FormattedArea        [5]byte
+		IntermediateAnchor   [5]byte
+		IntermediateChecksum uint8
+		TableLength          uint16
+		TableAddress         uint32
+		NumberOfStructures   uint16
+		BCDRevision          uint8
+	}
+
+	header struct {
+		Type   uint8
+		Length uint8
+		Handle uint16
+	}
+
+	// BIOS Information (Type 0).
+	biosInfo struct {
+		header
+		Vendor                 uint8
+		Version                uint8
+		StartingSegment        uint16
+		ReleaseDate            uint8
+		ROMSize                uint8
+		Characteristics        uint64
+		CharacteristicsExt1    uint8
+		CharacteristicsExt2    uint8
+		SystemBIOSMajorRelease uint8
+		SystemBIOSMinorRelease uint8
+		ECFirmwareMajorRelease uint8
+		ECFirmwareMinorRelease uint8
+	}
+
+	// System Information (Type 1).
+	systemInfo struct {
+		header
+		Manufacturer uint8
+		ProductName  uint8
+		Version      uint8
+		SerialNumber uint8
+		UUID         [16]byte
+		WakeUpType   uint8
+		SKUNumber    uint8
+		Family       uint8
+	}
+)
+
+// New returns tables for a system with the given UUID and serial number.
+// An empty uuid is reported as all zeros, which means "not present".
+func New(uuid, serial string) (*SMBIOS, error) {
+	s := &SMBIOS{Serial: serial}
+
+	if uuid == "" {
+		return s, nil
+	}
+
+	b, err := hex.DecodeString(strings.ReplaceAll(uuid, "-", ""))
+	if err != nil || len(b) != len(s.UUID) {
+		return nil, fmt.Errorf("%q: %w", uuid, ErrBadUUID)
+	}
+
+	// The first three fields are stored little-endian since SMBIOS 2.6.
+	s.UUID = [16]byte{
+		b[3], b[2], b[1], b[0],
+		b[5], b[4],
+		b[7], b[6],
+	}
+	copy(s.UUID[8:], b[8:])
+
+	return s, nil
+}
+
+// Bytes returns the entry point followed by the structure table,
+// to be copied to guest memory at Start.
+func (s *SMBIOS) Bytes() ([]byte, error) {
+	table := new(bytes.Buffer)
+
+	var maxSize, n int
+
+	add := func(v interface{}, strs ...string) error {
+		start := table.Len()
+
+		if err := binary.Write(table, binary.LittleEndian, v); err != nil {
+			return err
+		}
+
+		writeStrings(table, strs)
+
+		if size := table.Len() - start; size > maxSize {
+			maxSize = size
+		}
+
+		n++
+
+		return nil
+	}
+
+	bios := &biosInfo{
+		header:                 header{Type: typeBIOS, Length: 0x18, Handle: 0},
+		Vendor:                 1,
+		Version:                2,
+		StartingSegment:        0xe800,
+		ReleaseDate:            3,
+		Characteristics:        biosCharNotSupported,
+		CharacteristicsExt2:    biosCharExt2VM,
+		ECFirmwareMajorRelease: 0xff,
+		ECFirmwareMinorRelease: 0xff,
+	}
+	if err := add(bios, vendor, "0", "01/01/2021"); err != nil {
+		return nil, err
+	}
+
+	sys := &systemInfo{
+		header:       header{Type: typeSystem, Length: 0x1b, Handle: 1},
+		Manufacturer: 1,
+		ProductName:  2,
+		UUID:         s.UUID,
+		WakeUpType:   wakeUpPowerSwitch,
+	}
+	strs := []string{vendor, "gokvm virtual machine"}
+
+	if s.Product != "" {
+		strs[1] = s.Product
+	}
+
+	if s.Serial != "" {
+		strs = append(strs, s.Serial)
+		sys.SerialNumber = uint8(len(strs))
+	}
+
+	if err := add(sys, strs...); err != nil {
+		return nil, err
+	}
+
+	if err := add(&header{Type: typeEndOfTable, Length: 4, Handle: 2}); err != nil {
+		return nil, err
+	}
+
+	ep := &entryPoint{
+		Anchor:             [4]byte{'_', 'S', 'M', '_'},
+		Length:             entryPointLength,
+		MajorVersion:       2,
+		MinorVersion:       8,
+		MaxStructureSize:   uint16(maxSize),
+		IntermediateAnchor: [5]byte{'_', 'D', 'M', 'I', '_'},
+		TableLength:        uint16(table.Len()),
+		TableAddress:       Start + tableOffset,
+		NumberOfStructures: uint16(n),
+		BCDRevision:        0x28,
+	}
+
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, ep); err != nil {
+		return nil, err
+	}
+
+	b := buf.Bytes()
+	b[0x15] = checksum(b[0x10:entryPointLength])
+	b[0x04] = checksum(b[:entryPointLength])
+
+	out := make([]byte, tableOffset+table.Len())
+	copy(out, b)
+	copy(out[tableOffset:], table.Bytes())
+
+	return out, nil
+}
+
+// writeStrings appends the string set that follows each structure.
+// An empty set is still terminated by two NUL bytes.
+func writeStrings(buf *bytes.Buffer, strs []string) {
+	if len(strs) == 0 {
+		buf.WriteByte(0)
+	}
+
+	for _, s := range strs {
+		buf.WriteString(s)
+		buf.WriteByte(0)
+	}
+
+	buf.WriteByte(0)
+}
+
+// checksum returns the byte that makes b sum to zero.
+// The checksum field itself must be zero in b.
+func checksum(b []byte) uint8 {
+	var sum uint8
+	for _, v := range b {
+		sum += v
+	}
+
+	return -sum
+}
@@ -0,0 +1,82 @@
+package smbios_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/smbios"
+)
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	s, err := smbios.New("00112233-4455-6677-8899-aabbccddeeff", "sn")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [16]byte{
+		0x33, 0x22, 0x11, 0x00, 0x55, 0x44, 0x77, 0x66,
+		0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff,
+	}
+	if s.UUID != want {
+		t.Fatalf("UUID: got %x, want %x", s.UUID, want)
+	}
+
+	b, err := s.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range []struct {
+		name       string
+		start, end int
+	}{
+		{"entry point", 0, 0x1f},
+		{"intermediate", 0x10, 0x1f},
+	} {
+		var sum uint8
+		for _, v := range b[r.start:r.end] {
+			sum += v
+		}
+
+		if sum != 0 {
+			t.Errorf("%s checksum: got sum %#x, want 0", r.name, sum)
+		}
+	}
+}
+
+func TestNewBadUUID(t *testing.T) {
+	t.Parallel()
+
+	for _, uuid := range []string{"xyz", "0011", "00112233-4455-6677-8899-aabbccddeeff00"} {
+		if _, err := smbios.New(uuid, ""); !errors.Is(err, smbios.ErrBadUUID) {
+			t.Errorf("New(%q): got %v, want %v", uuid, err, smbios.ErrBadUUID)
+		}
+	}
+}
+
+func TestProduct(t *testing.T) {
+	t.Parallel()
+
+	s, err := smbios.New("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Product = "web-01"
+
+	b, err := s.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(b, []byte("\x00web-01\x00")) {
+		t.Errorf("product name %q not in tables", s.Product)
+	}
+
+	if bytes.Contains(b, []byte("gokvm virtual machine")) {
+		t.Error("default product name still in tables")
+	}
+}
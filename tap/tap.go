@@ -79,6 +79,11 @@ func New(name string) (*Tap, error) {
 	return t, nil
 }
 
+// Fd returns the fd of the tap, e.g. to poll it.
+func (t *Tap) Fd() uintptr {
+	return uintptr(t.fd)
+}
+
 func (t *Tap) Close() error {
 	return syscall.Close(t.fd)
 }
@@ -3,6 +3,12 @@ package virtio
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/bits"
 	"os"
 	"unsafe"
 
@@ -14,20 +20,56 @@ const (
 	BlkIOPortSize  = 0x100
 
 	SectorSize = 512
+
+	// refs https://docs.oasis-open.org/virtio/virtio/v1.1/cs01/virtio-v1.1-cs01.html#x1-2420003
+	// The device is read-only.
+	blkFeatureRO = 1 << 5
+	// blkSize in the config is valid.
+	blkFeatureBlkSize = 1 << 6
+	// The topology fields in the config are valid.
+	blkFeatureTopology = 1 << 10
+	// The device handles discard requests.
+	blkFeatureDiscard = 1 << 13
+
+	blkStatusOK    = 0
+	blkStatusIOErr = 1
+
+	// Request types other than in (0) and out (1).
+	blkTypeGetID   = 8
+	blkTypeDiscard = 11
+
+	// blkDiscardSegSize is the size of a discard segment: the le64 first
+	// sector, le32 number of sectors and le32 flags.
+	blkDiscardSegSize = 16
+	blkMaxDiscardSeg  = 32
+
+	// BlkSerialSize is the size of the serial returned by GET_ID.
+	BlkSerialSize = 20
 )
 
+// ErrSerialTooLong is returned for a disk serial over BlkSerialSize bytes.
+var ErrSerialTooLong = errors.New("disk serial too long")
+
 type Blk struct {
-	file *os.File
-	Hdr  blkHdr
+	ioPort   uint64
+	file     DiskBackend
+	readonly bool
+	serial   [BlkSerialSize]byte
+	Hdr      blkHdr
 
 	VirtQueue    [1]*VirtQueue
 	Mem          []byte
 	LastAvailIdx [1]uint16
 
 	kick chan interface{}
+	done chan struct{}
 
 	irq         uint8
 	IRQInjector IRQInjector
+
+	regLog *regLog
+
+	msix msixVectors
 }
 
 type blkHdr struct {
@@ -45,35 +87,138 @@ func (h blkHdr) Bytes() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// Requests and capacity are always in SectorSize units; blkSize and the
+// topology only tell the guest how to align its I/O.
 type blkHeader struct {
-	capacity uint64
+	capacity               uint64
+	_                      uint32 // sizeMax
+	_                      uint32 // segMax
+	_                      uint32 // geometry
+	blkSize                uint32
+	physicalBlockExp       uint8
+	alignmentOffset        uint8
+	minIOSize              uint16
+	optIOSize              uint32
+	_                      uint8 // writeback
+	_                      [3]uint8
+	maxDiscardSectors      uint32
+	maxDiscardSeg          uint32
+	discardSectorAlignment uint32
+}
+
+// ErrBadBlockSize is returned for a block size that is not a power of
+// two of at least SectorSize, or a physical size below the logical size.
+var ErrBadBlockSize = errors.New("bad block size")
+
+// SetBlockSize advertises the logical and physical block sizes, e.g. 4096
+// and 4096 for a 4K native disk. Guests then align their I/O to them.
+// Requests still address SectorSize units, as virtio requires.
+func (v *Blk) SetBlockSize(logical, physical uint32) error {
+	if logical < SectorSize || logical&(logical-1) != 0 ||
+		physical < logical || physical&(physical-1) != 0 {
+		return fmt.Errorf("logical %d, physical %d: %w", logical, physical, ErrBadBlockSize)
+	}
+
+	h := &v.Hdr.blkHeader
+	h.blkSize = logical
+	h.physicalBlockExp = uint8(bits.TrailingZeros32(physical / logical))
+	h.minIOSize = uint16(physical / logical)
+	h.optIOSize = 0
+
+	v.Hdr.commonHeader.hostFeatures |= blkFeatureBlkSize | blkFeatureTopology
+
+	return nil
+}
+
+// discard punches holes in the backing file for the discard segments
+// in data, so a sparse image gets the space back.
+func (v *Blk) discard(data []byte) error {
+	for ; len(data) >= blkDiscardSegSize; data = data[blkDiscardSegSize:] {
+		sector := binary.LittleEndian.Uint64(data[0:8])
+		n := binary.LittleEndian.Uint32(data[8:12])
+
+		if n == 0 {
+			continue
+		}
+
+		if err := punchHole(v.file, int64(sector*SectorSize), int64(n)*SectorSize); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetSerial sets the serial the guest reads with GET_ID, as used
+// for /dev/disk/by-id.
+func (v *Blk) SetSerial(serial string) error {
+	if len(serial) > BlkSerialSize {
+		return fmt.Errorf("%q: %w", serial, ErrSerialTooLong)
+	}
+
+	v.serial = [BlkSerialSize]byte{}
+	copy(v.serial[:], serial)
+
+	return nil
 }
 
 func (v Blk) GetDeviceHeader() pci.DeviceHeader {
-	return pci.DeviceHeader{
+	h := pci.DeviceHeader{
 		DeviceID:    0x1001,
 		VendorID:    0x1AF4,
+		ClassCode:   pci.ClassCodeSCSI, // as QEMU has it
 		HeaderType:  0,
 		SubsystemID: 2, // Block Device
 		Command:     1, // Enable IO port
 		BAR: [6]uint32{
-			BlkIOPortStart | 0x1,
+			uint32(v.ioPort) | 0x1,
 		},
 		// https://github.com/torvalds/linux/blob/fb3b0673b7d5b477ed104949450cd511337ba3c6/drivers/pci/setup-irq.c#L30-L55
 		InterruptPin: 1,
 		// https://www.webopedia.com/reference/irqnumbers/
 		InterruptLine: v.irq,
 	}
+
+	if x := v.msix.msix; x != nil {
+		h.BAR[pci.MSIXBAR] = x.Addr()
+		h.Command |= 2 // Enable memory space
+	}
+
+	return h
+}
+
+// Capabilities lists a power management capability, so the guest
+// finds the device in D0, and MSI-X once set with SetMSIX.
+func (v Blk) Capabilities() []pci.Capability {
+	if x := v.msix.msix; x != nil {
+		return []pci.Capability{pci.PMCapability(), x.Capability()}
+	}
+
+	return []pci.Capability{pci.PMCapability()}
+}
+
+// SetMSIX gives the device an MSI-X table, with a vector for config
+// changes and one for each queue. Until the guest enables MSI-X, the
+// device keeps using its INTx line.
+func (v *Blk) SetMSIX(x *pci.MSIX) {
+	v.msix = newMSIXVectors(x, len(v.VirtQueue))
+}
+
+// MSIX returns the MSI-X table set with SetMSIX, or nil.
+func (v Blk) MSIX() *pci.MSIX {
+	return v.msix.msix
 }
 
 func (v Blk) Read(port uint64, bytes []byte) error {
-	offset := int(port - BlkIOPortStart)
+	offset := int(port - v.ioPort)
 
 	b, err := v.Hdr.Bytes()
 	if err != nil {
 		return err
 	}
 
+	b = v.msix.header(b, v.Hdr.commonHeader.queueSEL)
+
 	l := len(bytes)
 	copy(bytes[:l], b[offset:offset+l])
 
@@ -81,12 +226,25 @@ func (v Blk) Read(port uint64, bytes []byte) error {
 }
 
 func (v *Blk) IOThreadEntry() {
-	for range v.kick {
-		for v.IO() == nil {
+	for {
+		select {
+		case <-v.kick:
+			for v.IO() == nil {
+			}
+		case <-v.done:
+			return
 		}
 	}
 }
 
+// Close makes IOThreadEntry return. Later kicks from the guest are
+// dropped rather than blocking the vCPU. Close must be called once.
+func (v *Blk) Close() error {
+	close(v.done)
+
+	return nil
+}
+
 type BlkReq struct {
 	Type   uint32
 	_      uint32
@@ -103,6 +261,8 @@ func (v *Blk) IO() error {
 		return ErrNoTxPacket
 	}
 
+	old := usedRing.Idx
+
 	for v.LastAvailIdx[sel] != availRing.Idx {
 		descID := availRing.Ring[v.LastAvailIdx[sel]%QueueSize]
 
@@ -111,14 +271,46 @@ func (v *Blk) IO() error {
 		usedRing.Ring[usedRing.Idx%QueueSize].Idx = uint32(descID)
 		usedRing.Ring[usedRing.Idx%QueueSize].Len = 0
 
+		// A request is always three descriptors, linked by Next; an
+		// indirect one has the rest of them in its table.
+		var chain []desc
+
+		for len(chain) < 3 {
+			d := desc(v.VirtQueue[sel].DescTable[descID%QueueSize])
+			if d.Flags&descFlagIndirect != 0 {
+				table, err := indirectDescs(v.Mem, d)
+				if err != nil {
+					return err
+				}
+
+				chain = append(chain, table...)
+
+				break
+			}
+
+			chain = append(chain, d)
+			descID = d.Next
+		}
+
+		if len(chain) < 3 {
+			return fmt.Errorf("request of %d descriptors: %w", len(chain), ErrBadDescChain)
+		}
+
 		var buf [3][]byte
 
-		for i := 0; i < 3; i++ {
-			desc := v.VirtQueue[sel].DescTable[descID]
+		for i, desc := range chain[:3] {
+			if !inMem(v.Mem, desc.Addr, desc.Len) {
+				return fmt.Errorf("descriptor of %d bytes at %#x: %w", desc.Len, desc.Addr, ErrBadDescChain)
+			}
+
 			buf[i] = v.Mem[desc.Addr : desc.Addr+uint64(desc.Len)]
 
 			usedRing.Ring[usedRing.Idx%QueueSize].Len += desc.Len
-			descID = desc.Next
+		}
+
+		// The header must hold a whole BlkReq, and the status a byte.
+		if len(buf[0]) < int(unsafe.Sizeof(BlkReq{})) || len(buf[2]) < 1 {
+			return fmt.Errorf("header of %d bytes, status of %d: %w", len(buf[0]), len(buf[2]), ErrBadDescChain)
 		}
 
 		// buf[0] contains type, reserved, and sector fields.
@@ -130,26 +322,51 @@ func (v *Blk) IO() error {
 		data := buf[1]
 
 		var err error
-		if blkReq.Type&0x1 == 0x1 {
+
+		buf[2][0] = blkStatusOK
+
+		switch {
+		case blkReq.Type == blkTypeGetID:
+			// Zero padded, and not NUL terminated when it fills the buffer.
+			copy(data, v.serial[:])
+		case blkReq.Type == blkTypeDiscard:
+			if v.readonly || v.discard(data) != nil {
+				buf[2][0] = blkStatusIOErr
+			}
+		case blkReq.Type&0x1 == 0x1 && v.readonly:
+			// The guest was told the device is read-only.
+			buf[2][0] = blkStatusIOErr
+		case blkReq.Type&0x1 == 0x1:
 			// write to file
-			_, err = v.file.WriteAt(data, int64(blkReq.Sector*SectorSize))
-		} else {
+			if _, err = v.file.WriteAt(data, int64(blkReq.Sector*SectorSize)); err != nil {
+				return err
+			}
+
+			if err = v.file.Sync(); err != nil {
+				return err
+			}
+		default:
 			// read from file
-			_, err = v.file.ReadAt(data, int64(blkReq.Sector*SectorSize))
-		}
-
-		if err != nil {
-			return err
-		}
-
-		if err = v.file.Sync(); err != nil {
-			return err
+			if _, err = v.file.ReadAt(data, int64(blkReq.Sector*SectorSize)); err != nil {
+				return err
+			}
 		}
 
 		usedRing.Idx++
 		v.LastAvailIdx[sel]++
 	}
 
+	features := v.Hdr.commonHeader.guestFeatures
+	notifyAt(v.VirtQueue[sel], features, v.LastAvailIdx[sel])
+
+	if !interruptWanted(v.VirtQueue[sel], features, old) {
+		return nil
+	}
+
+	if ok, err := v.msix.notify(int(sel)); ok {
+		return err
+	}
+
 	v.Hdr.commonHeader.isr = 0x1
 	if err := v.IRQInjector.InjectVirtioBlkIRQ(); err != nil {
 		return err
@@ -159,27 +376,49 @@ func (v *Blk) IO() error {
 }
 
 func (v *Blk) Write(port uint64, bytes []byte) error {
-	offset := int(port - BlkIOPortStart)
+	offset := int(port - v.ioPort)
+
+	if v.msix.write(offset, v.Hdr.commonHeader.queueSEL, bytes) {
+		return nil
+	}
 
 	switch offset {
+	case 4:
+		v.Hdr.commonHeader.guestFeatures = uint32(pci.BytesToNum(bytes))
 	case 8:
+		v.regLog.note("pfn")
 		// Queue PFN is aligned to page (4096 bytes)
 		physAddr := uint32(pci.BytesToNum(bytes) * 4096)
 		v.VirtQueue[v.Hdr.commonHeader.queueSEL] = (*VirtQueue)(unsafe.Pointer(&v.Mem[physAddr]))
 	case 14:
+		v.regLog.note("sel")
 		v.Hdr.commonHeader.queueSEL = uint16(pci.BytesToNum(bytes))
 	case 16:
+		v.regLog.note("kick")
 		v.Hdr.commonHeader.isr = 0x0
-		v.kick <- true
+		select {
+		case v.kick <- true:
+		case <-v.done:
+		}
 	case 19:
+		v.regLog.note("isr")
 	default:
 	}
 
 	return nil
 }
 
+// SetDebugOutput prints counts of guest register writes to w, at most
+// once a second. A nil w turns this off.
+func (v *Blk) SetDebugOutput(w io.Writer) {
+	v.regLog = nil
+	if w != nil {
+		v.regLog = newRegLog(w, fmt.Sprintf("virtio-blk@%#x", v.ioPort))
+	}
+}
+
 func (v Blk) IOPort() uint64 {
-	return BlkIOPortStart
+	return v.ioPort
 }
 
 func (v Blk) Size() uint64 {
@@ -192,27 +431,68 @@ func NewBlk(path string, irq uint8, irqInjector IRQInjector, mem []byte) (*Blk,
 		return nil, err
 	}
 
+	return NewBlkFromFile(file, false, irq, irqInjector, mem)
+}
+
+// NewBlkFromFile returns a block device backed by an already open file,
+// e.g. one passed in by a parent process. The capacity is taken from
+// fstat. If readonly is set, the guest is told so and writes fail.
+func NewBlkFromFile(file *os.File, readonly bool, irq uint8, irqInjector IRQInjector, mem []byte) (*Blk, error) {
 	fileInfo, err := file.Stat()
 	if err != nil {
 		return nil, err
 	}
 
-	fileSize := uint64(fileInfo.Size())
+	return NewBlkFromBackend(file, uint64(fileInfo.Size()), readonly, irq, irqInjector, mem)
+}
+
+// NewBlkFromBackend returns a block device of fileSize bytes served by
+// backend, e.g. a mapping from NewMmapBackend.
+func NewBlkFromBackend(backend DiskBackend, fileSize uint64, readonly bool,
+	irq uint8, irqInjector IRQInjector, mem []byte,
+) (*Blk, error) {
+	return NewBlkFromBackendAt(BlkIOPortStart, backend, fileSize, readonly, irq, irqInjector, mem)
+}
+
+// NewBlkFromBackendAt is like NewBlkFromBackend, but places the device
+// registers at ioPort, so that a machine can have more than one disk.
+func NewBlkFromBackendAt(ioPort uint64, backend DiskBackend, fileSize uint64, readonly bool,
+	irq uint8, irqInjector IRQInjector, mem []byte,
+) (*Blk, error) {
+	// The guest can only address whole sectors; the tail is left out.
+	if fileSize%SectorSize != 0 {
+		log.Printf("warning: disk size %d is not a multiple of %d, the last %d bytes are not used",
+			fileSize, SectorSize, fileSize%SectorSize)
+	}
+
+	features := uint32(featureEventIdx | featureIndirectDesc)
+	if readonly {
+		features |= blkFeatureRO
+	} else {
+		features |= blkFeatureDiscard
+	}
 
 	res := &Blk{
+		ioPort: ioPort,
 		Hdr: blkHdr{
 			commonHeader: commonHeader{
-				queueNUM: QueueSize,
-				isr:      0x0,
+				hostFeatures: features,
+				queueNUM:     QueueSize,
+				isr:          0x0,
 			},
 			blkHeader: blkHeader{
-				capacity: fileSize / SectorSize,
+				capacity:               fileSize / SectorSize,
+				maxDiscardSectors:      math.MaxUint32,
+				maxDiscardSeg:          blkMaxDiscardSeg,
+				discardSectorAlignment: 1,
 			},
 		},
-		file:         file,
+		file:         backend,
+		readonly:     readonly,
 		irq:          irq,
 		IRQInjector:  irqInjector,
 		kick:         make(chan interface{}),
+		done:         make(chan struct{}),
 		Mem:          mem,
 		VirtQueue:    [1]*VirtQueue{},
 		LastAvailIdx: [1]uint16{0},
@@ -2,10 +2,16 @@ package virtio_test
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 	"unsafe"
 
+	"github.com/bobuhiro11/gokvm/pci"
 	"github.com/bobuhiro11/gokvm/virtio"
 )
 
@@ -79,7 +85,7 @@ func TestIO(t *testing.T) {
 
 	// for blk request
 	vq.DescTable[0].Addr = 0
-	vq.DescTable[0].Len = 1
+	vq.DescTable[0].Len = 16
 	vq.DescTable[0].Next = 1
 
 	blkReq := (*virtio.BlkReq)(unsafe.Pointer(&mem[0]))
@@ -91,6 +97,10 @@ func TestIO(t *testing.T) {
 	vq.DescTable[1].Len = 0x200
 	vq.DescTable[1].Next = 2
 
+	// for status
+	vq.DescTable[2].Addr = 0x800
+	vq.DescTable[2].Len = 1
+
 	v.VirtQueue[0] = &vq
 
 	if err := v.IO(); err != nil {
@@ -108,3 +118,640 @@ func TestIO(t *testing.T) {
 		t.Fatalf("expected: %v, actual: %v", expected, actual)
 	}
 }
+
+// blkRequest submits a single request for sector, with the data buffer
+// at 0x400 and the status byte at 0x800, and runs it.
+func blkRequest(t *testing.T, v *virtio.Blk, mem []byte, typ uint32, sector uint64) error {
+	t.Helper()
+
+	vq := virtio.VirtQueue{}
+	vq.AvailRing.Idx = 1
+
+	vq.DescTable[0].Addr = 0
+	vq.DescTable[0].Len = 16
+	vq.DescTable[0].Next = 1
+
+	blkReq := (*virtio.BlkReq)(unsafe.Pointer(&mem[0]))
+	blkReq.Type = typ
+	blkReq.Sector = sector
+
+	vq.DescTable[1].Addr = 0x400
+	vq.DescTable[1].Len = virtio.SectorSize
+	vq.DescTable[1].Next = 2
+
+	vq.DescTable[2].Addr = 0x800
+	vq.DescTable[2].Len = 1
+
+	v.VirtQueue[0] = &vq
+	v.LastAvailIdx[0] = 0
+
+	return v.IO()
+}
+
+func TestBlkCapacity(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name string
+		size int64
+		want uint64
+	}{
+		{name: "1M", size: 1 << 20, want: (1 << 20) / virtio.SectorSize},
+		{name: "partial sector", size: 1<<20 + 100, want: (1 << 20) / virtio.SectorSize},
+		{name: "under a sector", size: 100, want: 0},
+	} {
+		path := filepath.Join(t.TempDir(), "disk")
+		if err := os.WriteFile(path, make([]byte, tt.size), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		v, err := virtio.NewBlk(path, 10, &mockInjector{}, []byte{})
+		if err != nil {
+			t.Fatalf("%s: NewBlk: %v", tt.name, err)
+		}
+
+		if id := v.GetDeviceHeader().DeviceID; id != 0x1001 {
+			t.Errorf("%s: DeviceID: got %#x, want 0x1001", tt.name, id)
+		}
+
+		capacity := make([]byte, 8)
+		if err := v.Read(virtio.BlkIOPortStart+20, capacity); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := binary.LittleEndian.Uint64(capacity); got != tt.want {
+			t.Errorf("%s: capacity: got %d, want %d sectors", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBlkFromFD(t *testing.T) {
+	t.Parallel()
+
+	f, err := os.CreateTemp(t.TempDir(), "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := f.Truncate(4 * virtio.SectorSize); err != nil {
+		t.Fatal(err)
+	}
+
+	// As if the fd had been passed in by a parent process.
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem := make([]byte, 0x1000)
+
+	v, err := virtio.NewBlkFromFile(os.NewFile(uintptr(fd), "disk"), false, 10, &mockInjector{}, mem)
+	if err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	capacity := make([]byte, 8)
+	if err := v.Read(virtio.BlkIOPortStart+20, capacity); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(capacity, []byte{4, 0, 0, 0, 0, 0, 0, 0}) {
+		t.Fatalf("capacity: got %v, want 4 sectors", capacity)
+	}
+
+	want := bytes.Repeat([]byte{0xa5}, virtio.SectorSize)
+	copy(mem[0x400:], want)
+
+	if err := blkRequest(t, v, mem, 1, 3); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	copy(mem[0x400:], make([]byte, virtio.SectorSize))
+
+	if err := blkRequest(t, v, mem, 0, 3); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	if !bytes.Equal(mem[0x400:0x600], want) {
+		t.Fatalf("sector 3: got %#x, want %#x", mem[0x400:0x410], want[:16])
+	}
+
+	got := make([]byte, virtio.SectorSize)
+	if _, err := f.ReadAt(got, 3*virtio.SectorSize); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("file at sector 3: (%#x, %v), want (%#x, nil)", got[:16], err, want[:16])
+	}
+}
+
+func TestBlkReadOnly(t *testing.T) {
+	t.Parallel()
+
+	f, err := os.CreateTemp(t.TempDir(), "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := f.Truncate(virtio.SectorSize); err != nil {
+		t.Fatal(err)
+	}
+
+	mem := make([]byte, 0x1000)
+
+	v, err := virtio.NewBlkFromFile(f, true, 10, &mockInjector{}, mem)
+	if err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	features := make([]byte, 4)
+	if err := v.Read(virtio.BlkIOPortStart, features); err != nil {
+		t.Fatal(err)
+	}
+
+	if features[0]&(1<<5) == 0 {
+		t.Fatalf("host features %#x: read-only bit not set", features)
+	}
+
+	copy(mem[0x400:], bytes.Repeat([]byte{0xa5}, virtio.SectorSize))
+
+	if err := blkRequest(t, v, mem, 1, 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if mem[0x800] != 1 {
+		t.Fatalf("status: got %d, want 1 (IOERR)", mem[0x800])
+	}
+
+	got := make([]byte, virtio.SectorSize)
+	if _, err := f.ReadAt(got, 0); err != nil || !bytes.Equal(got, make([]byte, virtio.SectorSize)) {
+		t.Fatalf("file was written: (%#x, %v)", got[:16], err)
+	}
+}
+
+func TestBlkBlockSize4K(t *testing.T) {
+	t.Parallel()
+
+	f, err := os.CreateTemp(t.TempDir(), "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := f.Truncate(4 * 4096); err != nil {
+		t.Fatal(err)
+	}
+
+	want := bytes.Repeat([]byte{0x5a}, virtio.SectorSize)
+	if _, err := f.WriteAt(want, 4096); err != nil {
+		t.Fatal(err)
+	}
+
+	mem := make([]byte, 0x1000)
+
+	v, err := virtio.NewBlkFromFile(f, false, 10, &mockInjector{}, mem)
+	if err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	if err := v.SetBlockSize(4096, 2048); err == nil {
+		t.Fatal("physical below logical: got nil, want error")
+	}
+
+	if err := v.SetBlockSize(4096, 4096); err != nil {
+		t.Fatal(err)
+	}
+
+	features := make([]byte, 4)
+	if err := v.Read(virtio.BlkIOPortStart, features); err != nil {
+		t.Fatal(err)
+	}
+
+	if features[0]&(1<<6) == 0 || features[1]&(1<<2) == 0 {
+		t.Fatalf("host features %#x: blk_size or topology bit not set", features)
+	}
+
+	// capacity, blk_size and the topology, from the start of the device config.
+	config := make([]byte, 32)
+	if err := v.Read(virtio.BlkIOPortStart+20, config); err != nil {
+		t.Fatal(err)
+	}
+
+	if capacity := config[0:8]; !bytes.Equal(capacity, []byte{32, 0, 0, 0, 0, 0, 0, 0}) {
+		t.Fatalf("capacity: got %v, want 32 sectors", capacity)
+	}
+
+	if blkSize := config[20:24]; !bytes.Equal(blkSize, []byte{0, 0x10, 0, 0}) {
+		t.Fatalf("blk_size: got %v, want 4096", blkSize)
+	}
+
+	if topology := config[24:28]; !bytes.Equal(topology, []byte{0, 0, 1, 0}) {
+		t.Fatalf("topology: got %v, want exp 0, offset 0, min_io 1", topology)
+	}
+
+	// The guest addresses the second 4K block as 512-byte sector 8.
+	if err := blkRequest(t, v, mem, 0, 4096/virtio.SectorSize); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	if !bytes.Equal(mem[0x400:0x600], want) {
+		t.Fatalf("block 1: got %#x, want %#x", mem[0x400:0x410], want[:16])
+	}
+}
+
+func TestBlkGetID(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x1000)
+
+	v, err := virtio.NewBlk("/dev/zero", 10, &mockInjector{}, mem)
+	if err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	if err := v.SetSerial("this serial is much too long"); err == nil {
+		t.Fatal("long serial: got nil, want error")
+	}
+
+	if err := v.SetSerial("GOKVM-DISK-0001"); err != nil {
+		t.Fatal(err)
+	}
+
+	copy(mem[0x400:], bytes.Repeat([]byte{0xff}, virtio.SectorSize))
+	mem[0x800] = 0xff
+
+	if err := blkRequest(t, v, mem, 8, 0); err != nil {
+		t.Fatalf("get id: %v", err)
+	}
+
+	want := append([]byte("GOKVM-DISK-0001"), 0, 0, 0, 0, 0)
+	if got := mem[0x400 : 0x400+virtio.BlkSerialSize]; !bytes.Equal(got, want) {
+		t.Fatalf("serial: got %q, want %q", got, want)
+	}
+
+	if mem[0x800] != 0 {
+		t.Fatalf("status: got %d, want 0 (OK)", mem[0x800])
+	}
+}
+
+func TestBlkDiscard(t *testing.T) {
+	t.Parallel()
+
+	f, err := os.CreateTemp(t.TempDir(), "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Fully allocated, so that the only hole is the one discard makes.
+	if _, err := f.Write(bytes.Repeat([]byte{0xa5}, 4*4096)); err != nil {
+		t.Fatal(err)
+	}
+
+	mem := make([]byte, 0x1000)
+
+	v, err := virtio.NewBlkFromFile(f, false, 10, &mockInjector{}, mem)
+	if err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	features := make([]byte, 4)
+	if err := v.Read(virtio.BlkIOPortStart, features); err != nil {
+		t.Fatal(err)
+	}
+
+	if features[1]&(1<<5) == 0 {
+		t.Fatalf("host features %#x: discard bit not set", features)
+	}
+
+	// Discard the second 4K block: sectors 8 to 15.
+	vq := virtio.VirtQueue{}
+	vq.AvailRing.Idx = 1
+
+	vq.DescTable[0].Addr = 0
+	vq.DescTable[0].Len = 16
+	vq.DescTable[0].Next = 1
+
+	blkReq := (*virtio.BlkReq)(unsafe.Pointer(&mem[0]))
+	blkReq.Type = 11
+
+	vq.DescTable[1].Addr = 0x400
+	vq.DescTable[1].Len = 16
+	vq.DescTable[1].Next = 2
+
+	binary.LittleEndian.PutUint64(mem[0x400:], 8)
+	binary.LittleEndian.PutUint32(mem[0x408:], 8)
+	binary.LittleEndian.PutUint32(mem[0x40c:], 0)
+
+	vq.DescTable[2].Addr = 0x800
+	vq.DescTable[2].Len = 1
+	mem[0x800] = 0xff
+
+	v.VirtQueue[0] = &vq
+
+	if err := v.IO(); err != nil {
+		t.Fatalf("discard: %v", err)
+	}
+
+	switch mem[0x800] {
+	case 0:
+	case 1:
+		t.Skipf("the file system of %s cannot punch holes", f.Name())
+	default:
+		t.Fatalf("status: got %d, want 0 (OK)", mem[0x800])
+	}
+
+	got := make([]byte, 4096)
+	if _, err := f.ReadAt(got, 4096); err != nil || !bytes.Equal(got, make([]byte, 4096)) {
+		t.Fatalf("discarded block: got (%#x, %v), want zeros", got[:16], err)
+	}
+
+	if _, err := f.ReadAt(got, 0); err != nil || got[0] != 0xa5 {
+		t.Fatalf("block 0: got (%#x, %v), want it untouched", got[:16], err)
+	}
+
+	const seekHole = 4
+
+	if hole, err := f.Seek(0, seekHole); err != nil || hole != 4096 {
+		t.Fatalf("first hole: got (%d, %v), want (4096, nil)", hole, err)
+	}
+}
+
+func TestBlkClose(t *testing.T) {
+	t.Parallel()
+
+	v, err := virtio.NewBlkFromFile(tempDisk(t, virtio.SectorSize), false, 10, &mockInjector{}, make([]byte, 0x1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		v.IOThreadEntry()
+		close(done)
+	}()
+
+	if err := v.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A kick nobody receives must not block the vCPU.
+	if err := v.Write(virtio.BlkIOPortStart+16, []byte{0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("IOThreadEntry did not return after Close")
+	}
+}
+
+func TestBlkMSIX(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "disk")
+	if err := os.WriteFile(path, make([]byte, 1<<20), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	inj := &mockInjector{}
+
+	v, err := virtio.NewBlk(path, 10, inj, []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x := pci.NewMSIX(2, 0xE000_0000, func(uint64, uint32) error { return nil })
+	v.SetMSIX(x)
+
+	if h := v.GetDeviceHeader(); h.BAR[pci.MSIXBAR] != 0xE000_0000 || h.Command&2 == 0 {
+		t.Errorf("header: got BAR1 %#x, command %#x, want 0xe0000000 with memory space enabled",
+			h.BAR[pci.MSIXBAR], h.Command)
+	}
+
+	read := func(offset uint64, size int) uint64 {
+		b := make([]byte, size)
+		if err := v.Read(virtio.BlkIOPortStart+offset, b); err != nil {
+			t.Fatal(err)
+		}
+
+		return pci.BytesToNum(b)
+	}
+
+	// Until the guest enables MSI-X, the device config is at 20.
+	if got := read(20, 8); got != (1<<20)/virtio.SectorSize {
+		t.Fatalf("capacity at 20: got %d", got)
+	}
+
+	if err := x.WriteControl(0x8000); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := read(20, 2); got != 0xffff {
+		t.Errorf("config vector: got %#x, want no vector", got)
+	}
+
+	if err := v.Write(virtio.BlkIOPortStart+22, pci.NumToBytes(uint16(1))); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := read(22, 2); got != 1 {
+		t.Errorf("queue vector: got %#x, want 1", got)
+	}
+
+	if got := read(24, 8); got != (1<<20)/virtio.SectorSize {
+		t.Errorf("capacity at 24: got %d", got)
+	}
+}
+
+func TestBlkEventIdx(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "disk")
+	if err := os.WriteFile(path, make([]byte, 1<<20), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	mem := make([]byte, 0x10000)
+	inj := &mockInjector{}
+
+	v, err := virtio.NewBlk(path, 10, inj, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// VIRTIO_RING_F_EVENT_IDX
+	if err := v.Write(virtio.BlkIOPortStart+4, []byte{0, 0, 0, 0x20}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The queue at 0x4000, in guest memory, where the guest sees availEvent.
+	if err := v.Write(virtio.BlkIOPortStart+8, []byte{4, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	vq := v.VirtQueue[0]
+	availEvent := 0x4000 + int(unsafe.Offsetof(vq.UsedRing)) + 4 + 8*virtio.QueueSize
+
+	// Every request reads sector 0 into 0x400, status at 0x800.
+	blkReq := (*virtio.BlkReq)(unsafe.Pointer(&mem[0]))
+	blkReq.Type = 0
+
+	vq.DescTable[0].Addr = 0
+	vq.DescTable[0].Len = 16
+	vq.DescTable[0].Flags = 0x1
+	vq.DescTable[0].Next = 1
+	vq.DescTable[1].Addr = 0x400
+	vq.DescTable[1].Len = virtio.SectorSize
+	vq.DescTable[1].Flags = 0x1
+	vq.DescTable[1].Next = 2
+	vq.DescTable[2].Addr = 0x800
+	vq.DescTable[2].Len = 1
+
+	// The guest wants an interrupt once the used index passes 2.
+	vq.AvailRing.UsedEvent = 2
+
+	for idx, want := range []bool{false, false, true} {
+		inj.called = false
+		vq.AvailRing.Idx = uint16(idx + 1)
+
+		if err := v.IO(); err != nil {
+			t.Fatalf("IO %d: got %v, want nil", idx, err)
+		}
+
+		if inj.called != want {
+			t.Errorf("IO %d: interrupt %v, want %v", idx, inj.called, want)
+		}
+
+		// The guest is asked to kick for the next request.
+		if got := binary.LittleEndian.Uint16(mem[availEvent:]); got != uint16(idx+1) {
+			t.Errorf("IO %d: availEvent %d, want %d", idx, got, idx+1)
+		}
+	}
+}
+
+func TestBlkIndirect(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "disk")
+	if err := os.WriteFile(path, bytes.Repeat([]byte{0x5a}, 1<<20), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	mem := make([]byte, 0x2000)
+
+	v, err := virtio.NewBlk(path, 10, &mockInjector{}, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	features := make([]byte, 4)
+	if err := v.Read(virtio.BlkIOPortStart, features); err != nil {
+		t.Fatal(err)
+	}
+
+	if features[3]&(1<<4) == 0 {
+		t.Fatalf("host features %#x: indirect descriptors not offered", features)
+	}
+
+	blkReq := (*virtio.BlkReq)(unsafe.Pointer(&mem[0]))
+	blkReq.Type = 0
+
+	// The whole request in a table at 0x1000.
+	table := func(dataAddr uint64) {
+		for i, d := range []struct {
+			addr uint64
+			len  uint32
+		}{{0, 16}, {dataAddr, virtio.SectorSize}, {0x800, 1}} {
+			flags := uint16(0x1)
+			if i == 2 {
+				flags = 0
+			}
+
+			e := mem[0x1000+i*16:]
+			binary.LittleEndian.PutUint64(e[0:], d.addr)
+			binary.LittleEndian.PutUint32(e[8:], d.len)
+			binary.LittleEndian.PutUint16(e[12:], flags)
+			binary.LittleEndian.PutUint16(e[14:], uint16(i+1))
+		}
+	}
+
+	vq := virtio.VirtQueue{}
+	vq.DescTable[0].Addr = 0x1000
+	vq.DescTable[0].Len = 3 * 16
+	vq.DescTable[0].Flags = 0x4
+	v.VirtQueue[0] = &vq
+
+	table(0x400)
+	vq.AvailRing.Idx = 1
+
+	if err := v.IO(); err != nil {
+		t.Fatalf("indirect request: got %v, want nil", err)
+	}
+
+	if !bytes.Equal(mem[0x400:0x600], bytes.Repeat([]byte{0x5a}, virtio.SectorSize)) {
+		t.Errorf("indirect request: sector not read")
+	}
+
+	// A buffer past the end of memory is refused, not a panic.
+	table(uint64(len(mem)) - 0x100)
+	vq.AvailRing.Idx = 2
+
+	if err := v.IO(); !errors.Is(err, virtio.ErrBadDescChain) {
+		t.Errorf("buffer past memory: got %v, want %v", err, virtio.ErrBadDescChain)
+	}
+
+	// So is a table whose end wraps around.
+	vq.DescTable[1].Addr = 0xffff_ffff_ffff_fff0
+	vq.DescTable[1].Len = 16
+	vq.DescTable[1].Flags = 0x4
+	vq.AvailRing.Ring[2] = 1
+	vq.AvailRing.Idx = 3
+
+	if err := v.IO(); !errors.Is(err, virtio.ErrBadDescChain) {
+		t.Errorf("table past the end of the address space: got %v, want %v", err, virtio.ErrBadDescChain)
+	}
+}
+
+func TestBlkShortHeader(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "disk")
+	if err := os.WriteFile(path, make([]byte, 1<<20), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name              string
+		hdrLen, statusLen uint32
+	}{
+		{name: "empty header", hdrLen: 0, statusLen: 1},
+		{name: "short header", hdrLen: 8, statusLen: 1},
+		{name: "empty status", hdrLen: 16, statusLen: 0},
+	} {
+		mem := make([]byte, 0x1000)
+
+		v, err := virtio.NewBlk(path, 10, &mockInjector{}, mem)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		vq := virtio.VirtQueue{}
+		vq.DescTable[0].Len = tt.hdrLen
+		vq.DescTable[0].Flags = 0x1
+		vq.DescTable[0].Next = 1
+		vq.DescTable[1].Addr = 0x400
+		vq.DescTable[1].Len = virtio.SectorSize
+		vq.DescTable[1].Flags = 0x1
+		vq.DescTable[1].Next = 2
+		vq.DescTable[2].Addr = 0x800
+		vq.DescTable[2].Len = tt.statusLen
+		vq.AvailRing.Idx = 1
+		v.VirtQueue[0] = &vq
+
+		if err := v.IO(); !errors.Is(err, virtio.ErrBadDescChain) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, virtio.ErrBadDescChain)
+		}
+	}
+}
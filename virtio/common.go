@@ -1,5 +1,13 @@
 package virtio
 
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+)
+
 const (
 	// The number of free descriptors in virt queue must exceed
 	// MAX_SKB_FRAGS (16). Otherwise, packet transmission from
@@ -12,17 +20,18 @@ const (
 type IRQInjector interface {
 	InjectVirtioNetIRQ() error
 	InjectVirtioBlkIRQ() error
+	InjectVirtioRngIRQ() error
 }
 
 type commonHeader struct {
-	_        uint32 // hostFeatures
-	_        uint32 // guestFeatures
-	_        uint32 // queuePFN
-	queueNUM uint16
-	queueSEL uint16
-	_        uint16 // queueNotify
-	_        uint8  // status
-	isr      uint8
+	hostFeatures  uint32
+	guestFeatures uint32
+	_             uint32 // queuePFN
+	queueNUM      uint16
+	queueSEL      uint16
+	_             uint16 // queueNotify
+	_             uint8  // status
+	isr           uint8
 }
 
 // refs: https://wiki.osdev.org/Virtio#Virtual_Queue_Descriptor
@@ -54,3 +63,180 @@ type VirtQueue struct {
 		availEvent uint16
 	}
 }
+
+const (
+	// Descriptor flags.
+	descFlagNext     = 0x1
+	descFlagWrite    = 0x2
+	descFlagIndirect = 0x4
+
+	// descSize is the size of a descriptor, also in an indirect table.
+	descSize = 16
+
+	// featureIndirectDesc is VIRTIO_RING_F_INDIRECT_DESC: the guest may
+	// put a chain in a table of its own, pointed to by descFlagIndirect.
+	featureIndirectDesc = 1 << 28
+)
+
+// ErrBadDescChain is returned for a descriptor chain that loops, an
+// indirect table that is not a whole number of descriptors inside guest
+// memory, or a buffer outside guest memory.
+var ErrBadDescChain = errors.New("bad descriptor chain")
+
+// inMem reports whether the l bytes at addr are all in mem, without
+// letting addr+l wrap around.
+func inMem(mem []byte, addr uint64, l uint32) bool {
+	return addr <= uint64(len(mem)) && uint64(l) <= uint64(len(mem))-addr
+}
+
+// ErrBadQueuePFN is returned when the guest puts a queue where it does
+// not fit in guest memory.
+var ErrBadQueuePFN = errors.New("queue outside guest memory")
+
+// queueAt returns the queue the guest put at page pfn of mem.
+func queueAt(mem []byte, pfn uint64) (*VirtQueue, error) {
+	// Queue PFN is aligned to page (4096 bytes)
+	if pfn > uint64(len(mem))/4096 || !inMem(mem, pfn*4096, uint32(unsafe.Sizeof(VirtQueue{}))) {
+		return nil, fmt.Errorf("PFN %#x: %w", pfn, ErrBadQueuePFN)
+	}
+
+	return (*VirtQueue)(unsafe.Pointer(&mem[pfn*4096])), nil
+}
+
+// desc is a descriptor as in VirtQueue.DescTable.
+type desc struct {
+	Addr  uint64
+	Len   uint32
+	Flags uint16
+	Next  uint16
+}
+
+// descChain returns the descriptors of the chain at head in vq. An
+// indirect descriptor is replaced by the chain in its table in mem.
+//
+// refs https://docs.oasis-open.org/virtio/virtio/v1.1/cs01/virtio-v1.1-cs01.html#x1-320005
+func descChain(vq *VirtQueue, mem []byte, head uint16) ([]desc, error) {
+	var chain []desc
+
+	id := head
+
+	for n := 0; n < QueueSize; n++ {
+		d := desc(vq.DescTable[id%QueueSize])
+
+		// An indirect descriptor ends the chain.
+		if d.Flags&descFlagIndirect != 0 {
+			table, err := indirectDescs(mem, d)
+			if err != nil {
+				return nil, err
+			}
+
+			return append(chain, table...), nil
+		}
+
+		if !inMem(mem, d.Addr, d.Len) {
+			return nil, fmt.Errorf("buffer of %d bytes at %#x: %w", d.Len, d.Addr, ErrBadDescChain)
+		}
+
+		chain = append(chain, d)
+
+		if d.Flags&descFlagNext == 0 {
+			return chain, nil
+		}
+
+		id = d.Next
+	}
+
+	return nil, fmt.Errorf("head %d loops: %w", head, ErrBadDescChain)
+}
+
+// indirectDescs returns the chain in the indirect table ind points to,
+// which starts at its first entry.
+func indirectDescs(mem []byte, ind desc) ([]desc, error) {
+	n := int(ind.Len / descSize)
+
+	if n == 0 || ind.Len%descSize != 0 || !inMem(mem, ind.Addr, ind.Len) {
+		return nil, fmt.Errorf("indirect table of %d bytes at %#x: %w", ind.Len, ind.Addr, ErrBadDescChain)
+	}
+
+	table := mem[ind.Addr : ind.Addr+uint64(ind.Len)]
+
+	var chain []desc
+
+	for i, id := 0, 0; i < n; i++ {
+		e := table[id*descSize : (id+1)*descSize]
+		d := desc{
+			Addr:  binary.LittleEndian.Uint64(e[0:]),
+			Len:   binary.LittleEndian.Uint32(e[8:]),
+			Flags: binary.LittleEndian.Uint16(e[12:]),
+			Next:  binary.LittleEndian.Uint16(e[14:]),
+		}
+
+		// Indirect tables do not nest.
+		if d.Flags&descFlagIndirect != 0 {
+			return nil, fmt.Errorf("nested indirect table at %#x: %w", ind.Addr, ErrBadDescChain)
+		}
+
+		if !inMem(mem, d.Addr, d.Len) {
+			return nil, fmt.Errorf("buffer of %d bytes at %#x: %w", d.Len, d.Addr, ErrBadDescChain)
+		}
+
+		chain = append(chain, d)
+
+		if d.Flags&descFlagNext == 0 {
+			return chain, nil
+		}
+
+		if id = int(d.Next); id >= n {
+			return nil, fmt.Errorf("next %d past indirect table of %d: %w", id, n, ErrBadDescChain)
+		}
+	}
+
+	return nil, fmt.Errorf("indirect table at %#x loops: %w", ind.Addr, ErrBadDescChain)
+}
+
+// featureEventIdx is VIRTIO_RING_F_EVENT_IDX. With it the guest puts in
+// UsedEvent the used index it next wants an interrupt at, and we put in
+// availEvent the available index we next want a notification at.
+//
+// refs https://docs.oasis-open.org/virtio/virtio/v1.1/cs01/virtio-v1.1-cs01.html#x1-380006
+const featureEventIdx = 1 << 29
+
+var fenceWord int32
+
+// fence keeps our stores to a ring from being reordered after the loads
+// that follow, as x86 otherwise may. The guest fences on its side too,
+// so that one of us sees the other's update and no event is lost.
+func fence() {
+	atomic.AddInt32(&fenceWord, 0)
+}
+
+// needEvent is vring_need_event: whether moving an index from old to
+// newIdx passes event.
+func needEvent(event, newIdx, old uint16) bool {
+	return newIdx-event-1 < newIdx-old
+}
+
+// interruptWanted reports whether the guest wants an interrupt for what
+// was added to the used ring of vq since its index was old. Without
+// event idx it always does.
+func interruptWanted(vq *VirtQueue, features uint32, old uint16) bool {
+	if features&featureEventIdx == 0 {
+		return true
+	}
+
+	fence()
+
+	return needEvent(vq.AvailRing.UsedEvent, vq.UsedRing.Idx, old)
+}
+
+// notifyAt asks the guest, with event idx, to notify us once it has made
+// available the entry at idx, the first one we have not seen yet.
+func notifyAt(vq *VirtQueue, features uint32, idx uint16) {
+	if features&featureEventIdx == 0 {
+		return
+	}
+
+	vq.UsedRing.availEvent = idx
+
+	fence()
+}
@@ -0,0 +1,101 @@
+package virtio
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrReadOnlyBackend is returned when writing to a read-only mapping.
+var ErrReadOnlyBackend = errors.New("backend is read-only")
+
+// ErrDiscardUnsupported is returned when a backend cannot deallocate.
+var ErrDiscardUnsupported = errors.New("backend does not support discard")
+
+// DiskBackend is the storage behind a Blk. *os.File serves requests with
+// pread and pwrite.
+type DiskBackend interface {
+	io.ReaderAt
+	io.WriterAt
+	// Sync makes completed writes durable.
+	Sync() error
+}
+
+// mmapBackend serves requests by copying from and to a shared mapping
+// of the disk image, saving a syscall per request.
+type mmapBackend struct {
+	file     *os.File
+	data     []byte
+	readonly bool
+}
+
+// NewMmapBackend maps file into memory. If the file cannot be mapped,
+// e.g. because it is empty or a pipe, the file itself is returned.
+func NewMmapBackend(file *os.File, readonly bool) (DiskBackend, error) {
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	prot := syscall.PROT_READ
+	if !readonly {
+		prot |= syscall.PROT_WRITE
+	}
+
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(fi.Size()), prot, syscall.MAP_SHARED)
+	if err != nil {
+		return file, nil //nolint:nilerr
+	}
+
+	return &mmapBackend{file: file, data: data, readonly: readonly}, nil
+}
+
+func (b *mmapBackend) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off >= int64(len(b.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, b.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (b *mmapBackend) WriteAt(p []byte, off int64) (int, error) {
+	if b.readonly {
+		return 0, ErrReadOnlyBackend
+	}
+
+	if off < 0 || off+int64(len(p)) > int64(len(b.data)) {
+		return 0, io.ErrShortWrite
+	}
+
+	return copy(b.data[off:], p), nil
+}
+
+// Discard punches a hole in the file; the mapping then reads zeros there.
+func (b *mmapBackend) Discard(off, n int64) error {
+	return punchHole(b.file, off, n)
+}
+
+func (b *mmapBackend) Sync() error {
+	return unix.Msync(b.data, unix.MS_SYNC)
+}
+
+// punchHole deallocates n bytes at off of backend, which then read as
+// zeros, if it is a file or has a Discard method.
+func punchHole(backend DiskBackend, off, n int64) error {
+	switch b := backend.(type) {
+	case interface{ Discard(off, n int64) error }:
+		return b.Discard(off, n)
+	case *os.File:
+		return unix.Fallocate(int(b.Fd()), unix.FALLOC_FL_KEEP_SIZE|unix.FALLOC_FL_PUNCH_HOLE, off, n)
+	}
+
+	return ErrDiscardUnsupported
+}
@@ -0,0 +1,125 @@
+package virtio_test
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+func tempDisk(tb testing.TB, size int64) *os.File {
+	tb.Helper()
+
+	f, err := os.CreateTemp(tb.TempDir(), "disk")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	tb.Cleanup(func() { f.Close() })
+
+	if err := f.Truncate(size); err != nil {
+		tb.Fatal(err)
+	}
+
+	return f
+}
+
+func TestMmapBackend(t *testing.T) {
+	t.Parallel()
+
+	f := tempDisk(t, 4*virtio.SectorSize)
+
+	b, err := virtio.NewMmapBackend(f, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := b.(*os.File); ok {
+		t.Fatal("got the file back, want a mapping")
+	}
+
+	want := bytes.Repeat([]byte{0xa5}, virtio.SectorSize)
+	if _, err := b.WriteAt(want, 2*virtio.SectorSize); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, virtio.SectorSize)
+	if _, err := f.ReadAt(got, 2*virtio.SectorSize); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("file at sector 2: (%#x, %v), want (%#x, nil)", got[:16], err, want[:16])
+	}
+
+	if _, err := b.WriteAt(want, 4*virtio.SectorSize); err == nil {
+		t.Fatal("write past the end: got nil, want error")
+	}
+}
+
+func TestMmapBackendReadOnly(t *testing.T) {
+	t.Parallel()
+
+	f := tempDisk(t, virtio.SectorSize)
+
+	b, err := virtio.NewMmapBackend(f, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.WriteAt([]byte{1}, 0); err == nil {
+		t.Fatal("write: got nil, want error")
+	}
+}
+
+func TestMmapBackendFallback(t *testing.T) {
+	t.Parallel()
+
+	// An empty file cannot be mapped.
+	f := tempDisk(t, 0)
+
+	b, err := virtio.NewMmapBackend(f, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b != f {
+		t.Fatalf("got %T, want the file", b)
+	}
+}
+
+func benchmarkRandomRead(b *testing.B, backend func(*os.File) virtio.DiskBackend) {
+	b.Helper()
+
+	const sectors = 1 << 13
+
+	d := backend(tempDisk(b, sectors*virtio.SectorSize))
+	buf := make([]byte, virtio.SectorSize)
+	r := rand.New(rand.NewSource(1)) //nolint:gosec
+
+	b.SetBytes(virtio.SectorSize)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := d.ReadAt(buf, r.Int63n(sectors)*virtio.SectorSize); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRandomReadPread(b *testing.B) {
+	benchmarkRandomRead(b, func(f *os.File) virtio.DiskBackend { return f })
+}
+
+func BenchmarkRandomReadMmap(b *testing.B) {
+	benchmarkRandomRead(b, func(f *os.File) virtio.DiskBackend {
+		d, err := virtio.NewMmapBackend(f, true)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		return d
+	})
+}
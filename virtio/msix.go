@@ -0,0 +1,96 @@
+package virtio
+
+import (
+	"encoding/binary"
+
+	"github.com/bobuhiro11/gokvm/pci"
+)
+
+const (
+	// vectorNone is VIRTIO_MSI_NO_VECTOR: no interrupt at all.
+	vectorNone = 0xffff
+
+	// commonHeaderSize is the size of commonHeader; the device config
+	// follows it, or the MSI-X vectors while MSI-X is enabled.
+	commonHeaderSize = 20
+	// The config and queue vector registers of the legacy header.
+	configVectorOffset = 20
+	queueVectorOffset  = 22
+)
+
+// msixVectors is the MSI-X part of a legacy virtio device: which vector
+// config changes and each queue interrupt through.
+//
+// refs https://docs.oasis-open.org/virtio/virtio/v1.1/cs01/virtio-v1.1-cs01.html#x1-1430002
+type msixVectors struct {
+	msix   *pci.MSIX
+	config uint16
+	queue  []uint16
+}
+
+func newMSIXVectors(x *pci.MSIX, queues int) msixVectors {
+	m := msixVectors{msix: x, config: vectorNone, queue: make([]uint16, queues)}
+	for i := range m.queue {
+		m.queue[i] = vectorNone
+	}
+
+	return m
+}
+
+// header returns the legacy header b, with the vector registers for the
+// queue sel put in front of the device config while MSI-X is enabled.
+func (m *msixVectors) header(b []byte, sel uint16) []byte {
+	if !m.msix.Enabled() {
+		return b
+	}
+
+	regs := make([]byte, 4)
+	binary.LittleEndian.PutUint16(regs[0:], m.config)
+	binary.LittleEndian.PutUint16(regs[2:], vectorNone)
+
+	if int(sel) < len(m.queue) {
+		binary.LittleEndian.PutUint16(regs[2:], m.queue[sel])
+	}
+
+	h := append([]byte{}, b[:commonHeaderSize]...)
+	h = append(h, regs...)
+
+	return append(h, b[commonHeaderSize:]...)
+}
+
+// write handles a guest write at offset in the legacy header, if it is
+// one of the vector registers, and reports whether it was.
+func (m *msixVectors) write(offset int, sel uint16, b []byte) bool {
+	if !m.msix.Enabled() {
+		return false
+	}
+
+	vector := uint16(pci.BytesToNum(b))
+
+	switch offset {
+	case configVectorOffset:
+		m.config = vector
+	case queueVectorOffset:
+		if int(sel) < len(m.queue) {
+			m.queue[sel] = vector
+		}
+	default:
+		return false
+	}
+
+	return true
+}
+
+// notify signals the vector of queue and reports true if MSI-X is
+// enabled. Otherwise the device has to use its INTx line.
+func (m *msixVectors) notify(queue int) (bool, error) {
+	if !m.msix.Enabled() {
+		return false, nil
+	}
+
+	if queue >= len(m.queue) || m.queue[queue] == vectorNone {
+		return true, nil
+	}
+
+	return true, m.msix.Notify(m.queue[queue])
+}
@@ -12,6 +12,7 @@ import (
 	"unsafe"
 
 	"github.com/bobuhiro11/gokvm/pci"
+	"golang.org/x/sys/unix"
 )
 
 var (
@@ -21,6 +22,7 @@ var (
 	ErrNoRxPacket  = errors.New("no packet for rx")
 	ErrVQNotInit   = errors.New("vq not initialized")
 	ErrNoRxBuf     = errors.New("no buffer found for rx")
+	ErrShortNetHdr = errors.New("packet shorter than virtio_net_hdr")
 )
 
 const (
@@ -34,7 +36,8 @@ type netHdr struct {
 }
 
 type Net struct {
-	Hdr netHdr
+	Hdr    netHdr
+	ioPort uint64
 
 	VirtQueue    [2]*VirtQueue
 	Mem          []byte
@@ -44,9 +47,17 @@ type Net struct {
 
 	txKick chan interface{}
 	rxKick chan os.Signal
+	done   chan struct{}
+	// wakeFd is an eventfd that ends the poll in pollRx, or -1 if
+	// the tap has no fd and RxThreadEntry waits for SIGIO instead.
+	wakeFd int
 
 	irq         uint8
 	IRQInjector IRQInjector
+
+	regLog *regLog
+
+	msix msixVectors
 }
 
 func (h netHdr) Bytes() ([]byte, error) {
@@ -59,6 +70,52 @@ func (h netHdr) Bytes() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// netFeatureMrgRxBuf means the guest can merge receive buffers, and
+// adds numBuffers to virtioNetHdr.
+const netFeatureMrgRxBuf = 1 << 15
+
+// virtioNetHdr is struct virtio_net_hdr, which comes before every packet.
+//
+// refs https://github.com/torvalds/linux/blob/38f80f42/include/uapi/linux/virtio_net.h#L178-L191
+type virtioNetHdr struct {
+	Flags      uint8
+	GSOType    uint8
+	HdrLen     uint16
+	GSOSize    uint16
+	CsumStart  uint16
+	CsumOffset uint16
+	// NumBuffers is only there with netFeatureMrgRxBuf.
+	NumBuffers uint16
+}
+
+// netHdrSize returns the size of virtioNetHdr with the negotiated features.
+func (v *Net) netHdrSize() int {
+	if v.Hdr.commonHeader.guestFeatures&netFeatureMrgRxBuf != 0 {
+		return 12
+	}
+
+	return 10
+}
+
+// parseNetHdr splits buf into its virtioNetHdr and the packet.
+func (v *Net) parseNetHdr(buf []byte) (virtioNetHdr, []byte, error) {
+	var h virtioNetHdr
+
+	n := v.netHdrSize()
+	if len(buf) < n {
+		return h, nil, fmt.Errorf("%d bytes: %w", len(buf), ErrShortNetHdr)
+	}
+
+	b := make([]byte, binary.Size(h))
+	copy(b, buf[:n])
+
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &h); err != nil {
+		return h, nil, err
+	}
+
+	return h, buf[n:], nil
+}
+
 type netHeader struct {
 	_ [6]uint8 // mac
 	_ uint16   // netStatus
@@ -66,38 +123,121 @@ type netHeader struct {
 }
 
 func (v Net) GetDeviceHeader() pci.DeviceHeader {
-	return pci.DeviceHeader{
+	h := pci.DeviceHeader{
 		DeviceID:    0x1000,
 		VendorID:    0x1AF4,
+		ClassCode:   pci.ClassCodeEthernet,
 		HeaderType:  0,
 		SubsystemID: 1, // Network Card
 		Command:     1, // Enable IO port
 		BAR: [6]uint32{
-			NetIOPortStart | 0x1,
+			uint32(v.ioPort) | 0x1,
 		},
 		// https://github.com/torvalds/linux/blob/fb3b0673b7d5b477ed104949450cd511337ba3c6/drivers/pci/setup-irq.c#L30-L55
 		InterruptPin: 1,
 		// https://www.webopedia.com/reference/irqnumbers/
 		InterruptLine: v.irq,
 	}
+
+	if x := v.msix.msix; x != nil {
+		h.BAR[pci.MSIXBAR] = x.Addr()
+		h.Command |= 2 // Enable memory space
+	}
+
+	return h
+}
+
+// Capabilities lists a power management capability, so the guest
+// finds the device in D0, and MSI-X once set with SetMSIX.
+func (v Net) Capabilities() []pci.Capability {
+	if x := v.msix.msix; x != nil {
+		return []pci.Capability{pci.PMCapability(), x.Capability()}
+	}
+
+	return []pci.Capability{pci.PMCapability()}
+}
+
+// SetMSIX gives the device an MSI-X table, with a vector for config
+// changes and one for each queue. Until the guest enables MSI-X, the
+// device keeps using its INTx line.
+func (v *Net) SetMSIX(x *pci.MSIX) {
+	v.msix = newMSIXVectors(x, len(v.VirtQueue))
+}
+
+// MSIX returns the MSI-X table set with SetMSIX, or nil.
+func (v Net) MSIX() *pci.MSIX {
+	return v.msix.msix
 }
 
 func (v Net) Read(port uint64, bytes []byte) error {
-	offset := int(port - NetIOPortStart)
+	offset := int(port - v.ioPort)
 
 	b, err := v.Hdr.Bytes()
 	if err != nil {
 		return err
 	}
 
+	b = v.msix.header(b, v.Hdr.commonHeader.queueSEL)
+
 	l := len(bytes)
 	copy(bytes[:l], b[offset:offset+l])
 
 	return nil
 }
 
+// fder is a tap that exposes its fd, like *tap.Tap.
+type fder interface {
+	Fd() uintptr
+}
+
 func (v *Net) RxThreadEntry() {
-	for range v.rxKick {
+	if v.wakeFd >= 0 {
+		v.pollRx()
+
+		return
+	}
+
+	for {
+		select {
+		case <-v.rxKick:
+			for v.Rx() == nil {
+			}
+		case <-v.done:
+			return
+		}
+	}
+}
+
+// pollRx blocks in poll(2) until the tap is readable, then hands packets
+// to the guest until it would block again. SIGIO may never come, e.g.
+// when no process owns the fd, and then nothing would be received.
+// Close wakes it up through wakeFd.
+func (v *Net) pollRx() {
+	defer unix.Close(v.wakeFd)
+
+	fds := []unix.PollFd{
+		{Fd: int32(v.tap.(fder).Fd()), Events: unix.POLLIN},
+		{Fd: int32(v.wakeFd), Events: unix.POLLIN},
+	}
+
+	for {
+		if _, err := unix.Poll(fds, -1); err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+
+			return
+		}
+
+		if fds[1].Revents != 0 {
+			return
+		}
+
+		if fds[0].Revents&unix.POLLIN == 0 {
+			// Hung up or closed, nothing more will come.
+			return
+		}
+
 		for v.Rx() == nil {
 		}
 	}
@@ -114,8 +254,14 @@ func (v *Net) Rx() error {
 
 	packet = packet[:n]
 
-	// append struct virtio_net_hdr
-	packet = append(make([]byte, 10), packet...)
+	// prepend struct virtio_net_hdr, all zero except for one buffer
+	// with mergeable buffers.
+	hdr := make([]byte, v.netHdrSize())
+	if len(hdr) == 12 {
+		binary.LittleEndian.PutUint16(hdr[10:], 1)
+	}
+
+	packet = append(hdr, packet...)
 
 	sel := 0
 
@@ -130,6 +276,8 @@ func (v *Net) Rx() error {
 		return ErrNoRxBuf
 	}
 
+	old := usedRing.Idx
+
 	const NONE = uint16(256)
 	headDescID := NONE
 	prevDescID := NONE
@@ -171,18 +319,54 @@ func (v *Net) Rx() error {
 
 	usedRing.Idx++
 
+	features := v.Hdr.commonHeader.guestFeatures
+	notifyAt(v.VirtQueue[sel], features, v.LastAvailIdx[sel])
+
+	if !interruptWanted(v.VirtQueue[sel], features, old) {
+		return nil
+	}
+
+	if ok, err := v.msix.notify(sel); ok {
+		return err
+	}
+
 	v.Hdr.commonHeader.isr = 0x1
 
 	return v.IRQInjector.InjectVirtioNetIRQ()
 }
 
 func (v *Net) TxThreadEntry() {
-	for range v.txKick {
-		for v.Tx() == nil {
+	for {
+		select {
+		case <-v.txKick:
+			for v.Tx() == nil {
+			}
+		case <-v.done:
+			return
 		}
 	}
 }
 
+// Close makes RxThreadEntry and TxThreadEntry return, and closes the
+// tap if it is an io.Closer. Later kicks from the guest are dropped
+// rather than blocking the vCPU. Close must be called once.
+func (v *Net) Close() error {
+	signal.Stop(v.rxKick)
+	close(v.done)
+
+	if v.wakeFd >= 0 {
+		if _, err := unix.Write(v.wakeFd, []byte{1, 0, 0, 0, 0, 0, 0, 0}); err != nil {
+			return err
+		}
+	}
+
+	if c, ok := v.tap.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
 func (v *Net) Tx() error {
 	sel := v.Hdr.commonHeader.queueSEL
 	if sel == 0 {
@@ -196,6 +380,8 @@ func (v *Net) Tx() error {
 		return ErrNoTxPacket
 	}
 
+	old := usedRing.Idx
+
 	for v.LastAvailIdx[sel] != availRing.Idx {
 		buf := []byte{}
 		descID := availRing.Ring[v.LastAvailIdx[sel]%QueueSize]
@@ -205,25 +391,24 @@ func (v *Net) Tx() error {
 		usedRing.Ring[usedRing.Idx%QueueSize].Idx = uint32(descID)
 		usedRing.Ring[usedRing.Idx%QueueSize].Len = 0
 
-		for {
-			desc := v.VirtQueue[sel].DescTable[descID]
+		chain, err := descChain(v.VirtQueue[sel], v.Mem, descID)
+		if err != nil {
+			return err
+		}
 
+		for _, desc := range chain {
 			b := make([]byte, desc.Len)
 			copy(b, v.Mem[desc.Addr:desc.Addr+uint64(desc.Len)])
 			buf = append(buf, b...)
 
 			usedRing.Ring[usedRing.Idx%QueueSize].Len += desc.Len
-
-			if desc.Flags&0x1 != 0 {
-				descID = desc.Next
-			} else {
-				break
-			}
 		}
 
-		// Skip struct virtio_net_hdr
-		// refs https://github.com/torvalds/linux/blob/38f80f42/include/uapi/linux/virtio_net.h#L178-L191
-		buf = buf[10:]
+		// No offloads are offered, so the header has nothing to act on.
+		_, buf, err = v.parseNetHdr(buf)
+		if err != nil {
+			return err
+		}
 
 		if _, err := v.tap.Write(buf); err != nil {
 			return err
@@ -232,34 +417,66 @@ func (v *Net) Tx() error {
 		v.LastAvailIdx[sel]++
 	}
 
+	features := v.Hdr.commonHeader.guestFeatures
+	notifyAt(v.VirtQueue[sel], features, v.LastAvailIdx[sel])
+
+	if !interruptWanted(v.VirtQueue[sel], features, old) {
+		return nil
+	}
+
+	if ok, err := v.msix.notify(int(sel)); ok {
+		return err
+	}
+
 	v.Hdr.commonHeader.isr = 0x1
 
 	return v.IRQInjector.InjectVirtioNetIRQ()
 }
 
 func (v *Net) Write(port uint64, bytes []byte) error {
-	offset := int(port - NetIOPortStart)
+	offset := int(port - v.ioPort)
+
+	if v.msix.write(offset, v.Hdr.commonHeader.queueSEL, bytes) {
+		return nil
+	}
 
 	switch offset {
+	case 4:
+		v.Hdr.commonHeader.guestFeatures = uint32(pci.BytesToNum(bytes))
 	case 8:
+		v.regLog.note("pfn")
 		// Queue PFN is aligned to page (4096 bytes)
 		physAddr := uint32(pci.BytesToNum(bytes) * 4096)
 		v.VirtQueue[v.Hdr.commonHeader.queueSEL] = (*VirtQueue)(unsafe.Pointer(&v.Mem[physAddr]))
 	case 14:
+		v.regLog.note("sel")
 		v.Hdr.commonHeader.queueSEL = uint16(pci.BytesToNum(bytes))
 	case 16:
+		v.regLog.note("kick")
 		v.Hdr.commonHeader.isr = 0x0
-		v.txKick <- true
+		select {
+		case v.txKick <- true:
+		case <-v.done:
+		}
 	case 19:
-		fmt.Printf("ISR was written!\r\n")
+		v.regLog.note("isr")
 	default:
 	}
 
 	return nil
 }
 
+// SetDebugOutput prints counts of guest register writes to w, at most
+// once a second. A nil w turns this off.
+func (v *Net) SetDebugOutput(w io.Writer) {
+	v.regLog = nil
+	if w != nil {
+		v.regLog = newRegLog(w, fmt.Sprintf("virtio-net@%#x", v.ioPort))
+	}
+}
+
 func (v Net) IOPort() uint64 {
-	return NetIOPortStart
+	return v.ioPort
 }
 
 func (v Net) Size() uint64 {
@@ -267,17 +484,27 @@ func (v Net) Size() uint64 {
 }
 
 func NewNet(irq uint8, irqInjector IRQInjector, tap io.ReadWriter, mem []byte) *Net {
+	return NewNetAt(NetIOPortStart, irq, irqInjector, tap, mem)
+}
+
+// NewNetAt is like NewNet, but places the device registers at ioPort,
+// so that a machine can have more than one network device.
+func NewNetAt(ioPort uint64, irq uint8, irqInjector IRQInjector, tap io.ReadWriter, mem []byte) *Net {
 	res := &Net{
+		ioPort: ioPort,
 		Hdr: netHdr{
 			commonHeader: commonHeader{
-				queueNUM: QueueSize,
-				isr:      0x0,
+				hostFeatures: featureEventIdx,
+				queueNUM:     QueueSize,
+				isr:          0x0,
 			},
 		},
 		irq:          irq,
 		IRQInjector:  irqInjector,
 		txKick:       make(chan interface{}),
 		rxKick:       make(chan os.Signal),
+		done:         make(chan struct{}),
+		wakeFd:       -1,
 		tap:          tap,
 		Mem:          mem,
 		VirtQueue:    [2]*VirtQueue{},
@@ -286,5 +513,11 @@ func NewNet(irq uint8, irqInjector IRQInjector, tap io.ReadWriter, mem []byte) *
 
 	signal.Notify(res.rxKick, syscall.SIGIO)
 
+	if _, ok := tap.(fder); ok {
+		if fd, err := unix.Eventfd(0, unix.EFD_CLOEXEC); err == nil {
+			res.wakeFd = fd
+		}
+	}
+
 	return res
 }
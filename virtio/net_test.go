@@ -2,7 +2,11 @@ package virtio_test
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"syscall"
 	"testing"
+	"time"
 	"unsafe"
 
 	"github.com/bobuhiro11/gokvm/virtio"
@@ -24,6 +28,12 @@ func (m *mockInjector) InjectVirtioBlkIRQ() error {
 	return nil
 }
 
+func (m *mockInjector) InjectVirtioRngIRQ() error {
+	m.called = true
+
+	return nil
+}
+
 func TestNetGetDeviceHeader(t *testing.T) {
 	t.Parallel()
 
@@ -166,3 +176,329 @@ func TestRx(t *testing.T) {
 		t.Fatalf("expected: %v, actual: %v", expected, actual)
 	}
 }
+
+func TestNetClose(t *testing.T) {
+	t.Parallel()
+
+	v := virtio.NewNet(9, &mockInjector{}, bytes.NewBuffer([]byte{}), make([]byte, 0x1000))
+	done := make(chan struct{})
+
+	go func() {
+		v.RxThreadEntry()
+		v.TxThreadEntry()
+		close(done)
+	}()
+
+	if err := v.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A kick nobody receives must not block the vCPU.
+	if err := v.Write(virtio.NetIOPortStart+16, []byte{1, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("thread entries did not return after Close")
+	}
+}
+
+// pipeTap is a tap backed by a non-blocking pipe.
+type pipeTap struct {
+	r, w int
+}
+
+func (p *pipeTap) Read(b []byte) (int, error) {
+	return syscall.Read(p.r, b)
+}
+
+func (p *pipeTap) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (p *pipeTap) Fd() uintptr {
+	return uintptr(p.r)
+}
+
+// chanInjector reports each interrupt on a channel.
+type chanInjector chan struct{}
+
+func (c chanInjector) InjectVirtioNetIRQ() error {
+	c <- struct{}{}
+
+	return nil
+}
+
+func (c chanInjector) InjectVirtioBlkIRQ() error {
+	return nil
+}
+
+func (c chanInjector) InjectVirtioRngIRQ() error {
+	return nil
+}
+
+func TestRxPoll(t *testing.T) {
+	t.Parallel()
+
+	var fds [2]int
+	if err := syscall.Pipe2(fds[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &pipeTap{r: fds[0], w: fds[1]}
+	defer syscall.Close(p.r)
+	defer syscall.Close(p.w)
+
+	irq := make(chanInjector, 1)
+	mem := make([]byte, 0x1000)
+	v := virtio.NewNet(9, irq, p, mem)
+
+	vq := virtio.VirtQueue{}
+	vq.AvailRing.Idx = 1
+	vq.DescTable[0].Addr = 0x100
+	vq.DescTable[0].Len = 0x200
+	v.VirtQueue[0] = &vq
+
+	done := make(chan struct{})
+
+	go func() {
+		v.RxThreadEntry()
+		close(done)
+	}()
+
+	// With nothing to read, the thread waits.
+	select {
+	case <-irq:
+		t.Fatal("got an interrupt with no packet")
+	case <-done:
+		t.Fatal("RxThreadEntry returned with no packet")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	want := []byte{0xaa, 0xbb}
+	if _, err := syscall.Write(p.w, want); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-irq:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no interrupt after a packet was written")
+	}
+
+	// Size of struct virtio_net_hdr
+	const K = 10
+
+	if got := mem[0x100+K : 0x100+K+2]; !bytes.Equal(got, want) {
+		t.Errorf("packet: got %v, want %v", got, want)
+	}
+
+	if err := v.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("RxThreadEntry did not return after Close")
+	}
+}
+
+func TestTxNetHdrSize(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name     string
+		features uint32
+		hdrSize  int
+	}{
+		{name: "legacy", features: 0, hdrSize: 10},
+		{name: "mergeable rx buffers", features: 1 << 15, hdrSize: 12},
+	} {
+		want := []byte{0xaa, 0xbb, 0xcc, 0xdd}
+		b := bytes.NewBuffer([]byte{})
+		mem := make([]byte, 0x1000)
+		v := virtio.NewNet(9, &mockInjector{}, b, mem)
+
+		features := []byte{byte(tt.features), byte(tt.features >> 8), 0, 0}
+		if err := v.Write(virtio.NetIOPortStart+4, features); err != nil {
+			t.Fatal(err)
+		}
+
+		// A header of 0xff bytes, so that any of it in the packet shows.
+		for i := 0; i < tt.hdrSize; i++ {
+			mem[0x100+i] = 0xff
+		}
+
+		copy(mem[0x100+tt.hdrSize:], want)
+
+		sel := byte(1)
+		_ = v.Write(virtio.NetIOPortStart+14, []byte{sel, 0x0})
+
+		vq := virtio.VirtQueue{}
+		vq.DescTable[0].Addr = 0x100
+		vq.DescTable[0].Len = uint32(tt.hdrSize + len(want))
+		vq.AvailRing.Idx = 1
+		v.VirtQueue[sel] = &vq
+
+		if err := v.Tx(); err != nil {
+			t.Fatalf("%s: Tx: got %v, want nil", tt.name, err)
+		}
+
+		if !bytes.Equal(b.Bytes(), want) {
+			t.Errorf("%s: packet: got %#x, want %#x", tt.name, b.Bytes(), want)
+		}
+	}
+}
+
+func TestTxShortNetHdr(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x1000)
+	v := virtio.NewNet(9, &mockInjector{}, bytes.NewBuffer([]byte{}), mem)
+
+	sel := byte(1)
+	_ = v.Write(virtio.NetIOPortStart+14, []byte{sel, 0x0})
+
+	vq := virtio.VirtQueue{}
+	vq.DescTable[0].Addr = 0x100
+	vq.DescTable[0].Len = 4
+	vq.AvailRing.Idx = 1
+	v.VirtQueue[sel] = &vq
+
+	if err := v.Tx(); !errors.Is(err, virtio.ErrShortNetHdr) {
+		t.Errorf("Tx: got %v, want %v", err, virtio.ErrShortNetHdr)
+	}
+}
+
+func TestTxIndirect(t *testing.T) {
+	t.Parallel()
+
+	want := []byte{0xaa, 0xbb, 0xcc, 0xdd}
+	b := bytes.NewBuffer([]byte{})
+	mem := make([]byte, 0x1000)
+	v := virtio.NewNet(9, &mockInjector{}, b, mem)
+
+	// The header at 0x100 and the packet at 0x200, chained in an
+	// indirect table at 0x800.
+	copy(mem[0x200:], want)
+
+	putDesc := func(i int, addr uint64, l uint32, flags, next uint16) {
+		e := mem[0x800+16*i:]
+		binary.LittleEndian.PutUint64(e[0:], addr)
+		binary.LittleEndian.PutUint32(e[8:], l)
+		binary.LittleEndian.PutUint16(e[12:], flags)
+		binary.LittleEndian.PutUint16(e[14:], next)
+	}
+
+	putDesc(0, 0x100, 10, 0x1, 1)
+	putDesc(1, 0x200, uint32(len(want)), 0, 0)
+
+	sel := byte(1)
+	_ = v.Write(virtio.NetIOPortStart+14, []byte{sel, 0x0})
+
+	vq := virtio.VirtQueue{}
+	vq.DescTable[0].Addr = 0x800
+	vq.DescTable[0].Len = 2 * 16
+	vq.DescTable[0].Flags = 0x4
+	vq.AvailRing.Idx = 1
+	v.VirtQueue[sel] = &vq
+
+	if err := v.Tx(); err != nil {
+		t.Fatalf("Tx: got %v, want nil", err)
+	}
+
+	if !bytes.Equal(b.Bytes(), want) {
+		t.Errorf("packet: got %#x, want %#x", b.Bytes(), want)
+	}
+
+	if got := vq.UsedRing.Ring[0].Len; got != 14 {
+		t.Errorf("used length: got %d, want 14", got)
+	}
+
+	// A table whose chain runs past its end is refused.
+	putDesc(1, 0x200, uint32(len(want)), 0x1, 2)
+
+	vq.AvailRing.Idx = 2
+
+	if err := v.Tx(); !errors.Is(err, virtio.ErrBadDescChain) {
+		t.Errorf("Tx with a bad table: got %v, want %v", err, virtio.ErrBadDescChain)
+	}
+
+	// So is a table whose end wraps around.
+	vq.DescTable[1].Addr = 0xffff_ffff_ffff_fff0
+	vq.DescTable[1].Len = 16
+	vq.DescTable[1].Flags = 0x4
+	vq.AvailRing.Ring[2] = 1
+	vq.AvailRing.Idx = 3
+
+	if err := v.Tx(); !errors.Is(err, virtio.ErrBadDescChain) {
+		t.Errorf("Tx with a table past the end of the address space: got %v, want %v", err, virtio.ErrBadDescChain)
+	}
+}
+
+func TestTxBufferPastMemory(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x1000)
+	v := virtio.NewNet(9, &mockInjector{}, bytes.NewBuffer([]byte{}), mem)
+
+	sel := byte(1)
+	_ = v.Write(virtio.NetIOPortStart+14, []byte{sel, 0x0})
+
+	vq := virtio.VirtQueue{}
+	vq.DescTable[0].Addr = 0x100
+	vq.DescTable[0].Len = 10
+	vq.DescTable[0].Flags = 0x1
+	vq.DescTable[0].Next = 1
+	vq.DescTable[1].Addr = 0xf00
+	vq.DescTable[1].Len = 0x200
+	vq.AvailRing.Idx = 1
+	v.VirtQueue[sel] = &vq
+
+	if err := v.Tx(); !errors.Is(err, virtio.ErrBadDescChain) {
+		t.Errorf("Tx: got %v, want %v", err, virtio.ErrBadDescChain)
+	}
+}
+
+func TestTxEventIdx(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x1000)
+	inj := &mockInjector{}
+	v := virtio.NewNet(9, inj, bytes.NewBuffer([]byte{}), mem)
+
+	// VIRTIO_RING_F_EVENT_IDX
+	if err := v.Write(virtio.NetIOPortStart+4, []byte{0, 0, 0, 0x20}); err != nil {
+		t.Fatal(err)
+	}
+
+	sel := byte(1)
+	_ = v.Write(virtio.NetIOPortStart+14, []byte{sel, 0x0})
+
+	vq := virtio.VirtQueue{}
+	for i := range vq.DescTable {
+		vq.DescTable[i].Addr = 0x100
+		vq.DescTable[i].Len = 14
+		vq.AvailRing.Ring[i] = uint16(i)
+	}
+
+	// The guest wants an interrupt once the used index passes 2.
+	vq.AvailRing.UsedEvent = 2
+	v.VirtQueue[sel] = &vq
+
+	for idx, want := range []bool{false, false, true} {
+		inj.called = false
+		vq.AvailRing.Idx = uint16(idx + 1)
+
+		if err := v.Tx(); err != nil {
+			t.Fatalf("Tx %d: got %v, want nil", idx, err)
+		}
+
+		if inj.called != want {
+			t.Errorf("Tx %d: interrupt %v, want %v", idx, inj.called, want)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package virtio
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// regLogInterval is how often register access counts are printed.
+const regLogInterval = time.Second
+
+// regLog counts guest accesses to device registers and prints the counts
+// at most once per regLogInterval, e.g.
+//
+//	virtio-blk@0x6300: kick x1234, sel x2 in last 1s
+//
+// instead of a line per access, which at boot floods the console. A nil
+// *regLog, the default, counts nothing.
+type regLog struct {
+	mu     sync.Mutex
+	out    io.Writer
+	name   string
+	counts map[string]int
+	since  time.Time
+	now    func() time.Time
+}
+
+func newRegLog(out io.Writer, name string) *regLog {
+	return &regLog{
+		out:    out,
+		name:   name,
+		counts: map[string]int{},
+		since:  time.Now(),
+		now:    time.Now,
+	}
+}
+
+func (l *regLog) note(reg string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.counts[reg]++
+
+	now := l.now()
+	if now.Sub(l.since) < regLogInterval {
+		return
+	}
+
+	regs := make([]string, 0, len(l.counts))
+	for r, n := range l.counts {
+		regs = append(regs, fmt.Sprintf("%s x%d", r, n))
+	}
+
+	sort.Strings(regs)
+
+	fmt.Fprintf(l.out, "%s: %s in last %v\r\n", l.name, strings.Join(regs, ", "),
+		now.Sub(l.since).Round(time.Second))
+
+	l.counts = map[string]int{}
+	l.since = now
+}
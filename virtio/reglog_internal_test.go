@@ -0,0 +1,48 @@
+package virtio
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegLog(t *testing.T) {
+	t.Parallel()
+
+	out := &bytes.Buffer{}
+	v := NewNet(9, nil, nil, make([]byte, 0x1000))
+	v.SetDebugOutput(out)
+
+	// 3s worth of ISR and queue select writes, 1ms apart.
+	now := v.regLog.since
+	v.regLog.now = func() time.Time { return now }
+
+	for i := 0; i < 3000; i++ {
+		now = now.Add(time.Millisecond)
+
+		if err := v.Write(NetIOPortStart+19, []byte{0}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := v.Write(NetIOPortStart+14, []byte{0, 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) > 3 {
+		t.Fatalf("got %d lines for 3s, want at most 3:\n%s", len(lines), out)
+	}
+
+	if want := "virtio-net@0x6200: isr x1000, sel x999 in last 1s"; !strings.HasPrefix(lines[0], want) {
+		t.Errorf("first line: got %q, want %q", lines[0], want)
+	}
+
+	v.SetDebugOutput(nil)
+	out.Reset()
+
+	if err := v.Write(NetIOPortStart+19, []byte{0}); err != nil || out.Len() != 0 {
+		t.Errorf("after SetDebugOutput(nil): got (%q, %v), want no output", out, err)
+	}
+}
@@ -0,0 +1,283 @@
+package virtio
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/bobuhiro11/gokvm/pci"
+)
+
+const (
+	RngIOPortStart = 0x6100
+	RngIOPortSize  = 0x100
+)
+
+// ErrNoRngBuf is returned by Rng.IO when the guest has no buffer waiting.
+var ErrNoRngBuf = errors.New("no buffer for rng")
+
+// Rng is a virtio entropy device. It fills the buffers the guest puts
+// on its single queue with bytes from its source, usually the host
+// crypto/rand.Reader.
+type Rng struct {
+	Hdr rngHdr
+
+	source io.Reader
+
+	VirtQueue    [1]*VirtQueue
+	Mem          []byte
+	LastAvailIdx [1]uint16
+
+	kick chan interface{}
+	done chan struct{}
+
+	irq         uint8
+	IRQInjector IRQInjector
+
+	regLog *regLog
+
+	msix msixVectors
+}
+
+// rngHdr is only the common header; virtio-rng has no device config.
+type rngHdr struct {
+	commonHeader commonHeader
+}
+
+func (h rngHdr) Bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.LittleEndian, h); err != nil {
+		return []byte{}, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (v Rng) GetDeviceHeader() pci.DeviceHeader {
+	h := pci.DeviceHeader{
+		DeviceID:    0x1005,
+		VendorID:    0x1AF4,
+		ClassCode:   pci.ClassCodeOther,
+		HeaderType:  0,
+		SubsystemID: 4, // Entropy Source
+		Command:     1, // Enable IO port
+		BAR: [6]uint32{
+			RngIOPortStart | 0x1,
+		},
+		InterruptPin:  1,
+		InterruptLine: v.irq,
+	}
+
+	if x := v.msix.msix; x != nil {
+		h.BAR[pci.MSIXBAR] = x.Addr()
+		h.Command |= 2 // Enable memory space
+	}
+
+	return h
+}
+
+// Capabilities lists a power management capability, so the guest
+// finds the device in D0, and MSI-X once set with SetMSIX.
+func (v Rng) Capabilities() []pci.Capability {
+	if x := v.msix.msix; x != nil {
+		return []pci.Capability{pci.PMCapability(), x.Capability()}
+	}
+
+	return []pci.Capability{pci.PMCapability()}
+}
+
+// SetMSIX gives the device an MSI-X table, with a vector for config
+// changes and one for each queue. Until the guest enables MSI-X, the
+// device keeps using its INTx line.
+func (v *Rng) SetMSIX(x *pci.MSIX) {
+	v.msix = newMSIXVectors(x, len(v.VirtQueue))
+}
+
+// MSIX returns the MSI-X table set with SetMSIX, or nil.
+func (v Rng) MSIX() *pci.MSIX {
+	return v.msix.msix
+}
+
+func (v Rng) Read(port uint64, bytes []byte) error {
+	offset := int(port - RngIOPortStart)
+
+	b, err := v.Hdr.Bytes()
+	if err != nil {
+		return err
+	}
+
+	b = v.msix.header(b, v.Hdr.commonHeader.queueSEL)
+
+	// Past the header there is nothing.
+	if offset >= len(b) {
+		return nil
+	}
+
+	copy(bytes, b[offset:])
+
+	return nil
+}
+
+func (v *Rng) Write(port uint64, bytes []byte) error {
+	offset := int(port - RngIOPortStart)
+
+	if v.msix.write(offset, v.Hdr.commonHeader.queueSEL, bytes) {
+		return nil
+	}
+
+	switch offset {
+	case 4:
+		v.Hdr.commonHeader.guestFeatures = uint32(pci.BytesToNum(bytes))
+	case 8:
+		v.regLog.note("pfn")
+
+		vq, err := queueAt(v.Mem, pci.BytesToNum(bytes))
+		if err != nil {
+			return err
+		}
+
+		v.VirtQueue[0] = vq
+	case 14:
+		v.regLog.note("sel")
+		v.Hdr.commonHeader.queueSEL = uint16(pci.BytesToNum(bytes))
+	case 16:
+		v.regLog.note("kick")
+		v.Hdr.commonHeader.isr = 0x0
+		select {
+		case v.kick <- true:
+		case <-v.done:
+		}
+	case 19:
+		v.regLog.note("isr")
+	default:
+	}
+
+	return nil
+}
+
+func (v *Rng) IOThreadEntry() {
+	for {
+		select {
+		case <-v.kick:
+			for v.IO() == nil {
+			}
+		case <-v.done:
+			return
+		}
+	}
+}
+
+// Close makes IOThreadEntry return. Later kicks from the guest are
+// dropped rather than blocking the vCPU. Close must be called once.
+func (v *Rng) Close() error {
+	close(v.done)
+
+	return nil
+}
+
+// IO fills every buffer the guest has made available with random bytes.
+func (v *Rng) IO() error {
+	if v.VirtQueue[0] == nil {
+		return ErrVQNotInit
+	}
+
+	availRing := &v.VirtQueue[0].AvailRing
+	usedRing := &v.VirtQueue[0].UsedRing
+
+	if v.LastAvailIdx[0] == availRing.Idx {
+		return ErrNoRngBuf
+	}
+
+	old := usedRing.Idx
+
+	for v.LastAvailIdx[0] != availRing.Idx {
+		descID := availRing.Ring[v.LastAvailIdx[0]%QueueSize]
+
+		usedRing.Ring[usedRing.Idx%QueueSize].Idx = uint32(descID)
+		usedRing.Ring[usedRing.Idx%QueueSize].Len = 0
+
+		chain, err := descChain(v.VirtQueue[0], v.Mem, descID)
+		if err != nil {
+			return err
+		}
+
+		for _, desc := range chain {
+			if desc.Flags&descFlagWrite == 0 {
+				return fmt.Errorf("read-only buffer at %#x: %w", desc.Addr, ErrBadDescChain)
+			}
+
+			n, err := io.ReadFull(v.source, v.Mem[desc.Addr:desc.Addr+uint64(desc.Len)])
+			if err != nil {
+				return err
+			}
+
+			usedRing.Ring[usedRing.Idx%QueueSize].Len += uint32(n)
+		}
+
+		usedRing.Idx++
+		v.LastAvailIdx[0]++
+	}
+
+	features := v.Hdr.commonHeader.guestFeatures
+	notifyAt(v.VirtQueue[0], features, v.LastAvailIdx[0])
+
+	if !interruptWanted(v.VirtQueue[0], features, old) {
+		return nil
+	}
+
+	if ok, err := v.msix.notify(0); ok {
+		return err
+	}
+
+	v.Hdr.commonHeader.isr = 0x1
+
+	return v.IRQInjector.InjectVirtioRngIRQ()
+}
+
+// SetDebugOutput prints counts of guest register writes to w, at most
+// once a second. A nil w turns this off.
+func (v *Rng) SetDebugOutput(w io.Writer) {
+	v.regLog = nil
+	if w != nil {
+		v.regLog = newRegLog(w, fmt.Sprintf("virtio-rng@%#x", RngIOPortStart))
+	}
+}
+
+func (v Rng) IOPort() uint64 {
+	return RngIOPortStart
+}
+
+func (v Rng) Size() uint64 {
+	return RngIOPortSize
+}
+
+// NewRng returns an entropy device that raises irq through irqInjector
+// and reads what it gives the guest from source. A nil source is
+// crypto/rand.Reader; tests pass a seeded one to get the same bytes
+// every run.
+func NewRng(irq uint8, irqInjector IRQInjector, mem []byte, source io.Reader) *Rng {
+	if source == nil {
+		source = rand.Reader
+	}
+
+	return &Rng{
+		Hdr: rngHdr{
+			commonHeader: commonHeader{
+				hostFeatures: featureEventIdx,
+				queueNUM:     QueueSize,
+			},
+		},
+		source:       source,
+		irq:          irq,
+		IRQInjector:  irqInjector,
+		kick:         make(chan interface{}),
+		done:         make(chan struct{}),
+		Mem:          mem,
+		VirtQueue:    [1]*VirtQueue{},
+		LastAvailIdx: [1]uint16{0},
+	}
+}
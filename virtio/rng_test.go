@@ -0,0 +1,146 @@
+package virtio_test
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/pci"
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+func TestRngGetDeviceHeader(t *testing.T) {
+	t.Parallel()
+
+	v := virtio.NewRng(6, &mockInjector{}, []byte{}, nil)
+
+	if h := v.GetDeviceHeader(); h.DeviceID != 0x1005 || h.InterruptLine != 6 {
+		t.Fatalf("got device %#x, IRQ %d, want 0x1005, 6", h.DeviceID, h.InterruptLine)
+	}
+
+	if v.IOPort() != virtio.RngIOPortStart || v.Size() != virtio.RngIOPortSize {
+		t.Fatalf("got IO range %#x+%#x, want %#x+%#x", v.IOPort(), v.Size(),
+			virtio.RngIOPortStart, virtio.RngIOPortSize)
+	}
+}
+
+func TestRngIO(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x1000)
+	inj := &mockInjector{}
+	v := virtio.NewRng(6, inj, mem, nil)
+
+	if err := v.IO(); !errors.Is(err, virtio.ErrVQNotInit) {
+		t.Fatalf("IO without a queue: got %v, want %v", err, virtio.ErrVQNotInit)
+	}
+
+	// One request of two chained buffers.
+	vq := virtio.VirtQueue{}
+	vq.AvailRing.Idx = 1
+
+	vq.DescTable[0].Addr = 0x100
+	vq.DescTable[0].Len = 0x40
+	vq.DescTable[0].Flags = 0x1 | 0x2
+	vq.DescTable[0].Next = 1
+
+	vq.DescTable[1].Addr = 0x400
+	vq.DescTable[1].Len = 0x40
+	vq.DescTable[1].Flags = 0x2
+
+	v.VirtQueue[0] = &vq
+
+	if err := v.IO(); err != nil {
+		t.Fatalf("IO: got %v, want nil", err)
+	}
+
+	zero := make([]byte, 0x40)
+	for _, addr := range []int{0x100, 0x400} {
+		if bytes.Equal(mem[addr:addr+0x40], zero) {
+			t.Errorf("buffer at %#x was not filled", addr)
+		}
+	}
+
+	if mem[0x200] != 0 {
+		t.Errorf("memory outside the buffers was written")
+	}
+
+	if vq.UsedRing.Idx != 1 || vq.UsedRing.Ring[0].Len != 0x80 {
+		t.Errorf("used ring: got idx %d, len %#x, want 1, 0x80", vq.UsedRing.Idx, vq.UsedRing.Ring[0].Len)
+	}
+
+	if !inj.called {
+		t.Errorf("no interrupt was injected")
+	}
+
+	if err := v.IO(); !errors.Is(err, virtio.ErrNoRngBuf) {
+		t.Errorf("IO with nothing queued: got %v, want %v", err, virtio.ErrNoRngBuf)
+	}
+}
+
+func TestRngBadGuest(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x1000)
+	v := virtio.NewRng(6, &mockInjector{}, mem, nil)
+
+	// The queue does not fit in 4 KiB, and a huge PFN must not wrap.
+	for _, pfn := range []uint32{1, 0x10000, 0xffffffff} {
+		if err := v.Write(virtio.RngIOPortStart+8, pci.NumToBytes(pfn)); !errors.Is(err, virtio.ErrBadQueuePFN) {
+			t.Errorf("PFN %#x: got %v, want %v", pfn, err, virtio.ErrBadQueuePFN)
+		}
+	}
+
+	for _, tt := range []struct {
+		name  string
+		addr  uint64
+		len   uint32
+		flags uint16
+	}{
+		{name: "past memory", addr: 0x2000, len: 0x40, flags: 0x2},
+		{name: "wraps around", addr: 0xffff_ffff_ffff_ffc0, len: 0x80, flags: 0x2},
+		{name: "read-only", addr: 0x100, len: 0x40},
+	} {
+		vq := virtio.VirtQueue{}
+		vq.AvailRing.Idx = 1
+		vq.DescTable[0].Addr = tt.addr
+		vq.DescTable[0].Len = tt.len
+		vq.DescTable[0].Flags = tt.flags
+		v.VirtQueue[0] = &vq
+		v.LastAvailIdx[0] = 0
+
+		if err := v.IO(); !errors.Is(err, virtio.ErrBadDescChain) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, virtio.ErrBadDescChain)
+		}
+	}
+}
+
+func TestRngSource(t *testing.T) {
+	t.Parallel()
+
+	const seed = 1739
+
+	mem := make([]byte, 0x1000)
+	v := virtio.NewRng(6, &mockInjector{}, mem, rand.New(rand.NewSource(seed))) //nolint:gosec
+
+	vq := virtio.VirtQueue{}
+	vq.AvailRing.Idx = 1
+	vq.DescTable[0].Addr = 0x100
+	vq.DescTable[0].Len = 0x40
+	vq.DescTable[0].Flags = 0x2
+	v.VirtQueue[0] = &vq
+
+	if err := v.IO(); err != nil {
+		t.Fatalf("IO: got %v, want nil", err)
+	}
+
+	want := make([]byte, 0x40)
+	if _, err := rand.New(rand.NewSource(seed)).Read(want); err != nil { //nolint:gosec
+		t.Fatal(err)
+	}
+
+	if got := mem[0x100:0x140]; !bytes.Equal(got, want) {
+		t.Errorf("buffer: got %#x, want %#x", got, want)
+	}
+}
@@ -0,0 +1,65 @@
+package virtio
+
+// QueueState is what the device knows about a virtqueue. The avail and
+// used indices are only there once the guest has set the queue up.
+type QueueState struct {
+	Ready        bool   `json:"ready"`
+	LastAvailIdx uint16 `json:"lastAvailIdx"`
+	AvailIdx     uint16 `json:"availIdx"`
+	UsedIdx      uint16 `json:"usedIdx"`
+}
+
+// DeviceState is the state of a virtio device, for debugging.
+type DeviceState struct {
+	IOPort        uint64       `json:"ioPort"`
+	IRQ           uint8        `json:"irq"`
+	HostFeatures  uint32       `json:"hostFeatures"`
+	GuestFeatures uint32       `json:"guestFeatures"`
+	ISR           uint8        `json:"isr"`
+	Queues        []QueueState `json:"queues"`
+}
+
+// BlkState is the state of a Blk. Capacity is in SectorSize units.
+type BlkState struct {
+	DeviceState
+	Capacity uint64 `json:"capacity"`
+	ReadOnly bool   `json:"readOnly"`
+}
+
+func deviceState(ioPort uint64, irq uint8, h commonHeader, vqs []*VirtQueue, lastAvailIdx []uint16) DeviceState {
+	s := DeviceState{
+		IOPort:        ioPort,
+		IRQ:           irq,
+		HostFeatures:  h.hostFeatures,
+		GuestFeatures: h.guestFeatures,
+		ISR:           h.isr,
+		Queues:        make([]QueueState, len(vqs)),
+	}
+
+	for i, vq := range vqs {
+		s.Queues[i].LastAvailIdx = lastAvailIdx[i]
+
+		if vq != nil {
+			s.Queues[i].Ready = true
+			s.Queues[i].AvailIdx = vq.AvailRing.Idx
+			s.Queues[i].UsedIdx = vq.UsedRing.Idx
+		}
+	}
+
+	return s
+}
+
+// State returns the state of the device. The queue indices are read from
+// guest memory without synchronization, so they may be slightly stale.
+func (v *Blk) State() BlkState {
+	return BlkState{
+		DeviceState: deviceState(v.ioPort, v.irq, v.Hdr.commonHeader, v.VirtQueue[:], v.LastAvailIdx[:]),
+		Capacity:    v.Hdr.blkHeader.capacity,
+		ReadOnly:    v.readonly,
+	}
+}
+
+// State returns the state of the device, as Blk.State does.
+func (v *Net) State() DeviceState {
+	return deviceState(v.ioPort, v.irq, v.Hdr.commonHeader, v.VirtQueue[:], v.LastAvailIdx[:])
+}
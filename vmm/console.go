@@ -0,0 +1,113 @@
+package vmm
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrConsoleClosed is returned by a console Write once the machine is
+// closed.
+var ErrConsoleClosed = errors.New("console closed")
+
+// console connects the guest serial port to a caller instead of the
+// terminal. Output is buffered, so a slow reader never stalls the guest.
+type console struct {
+	v *VMM
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	out       bytes.Buffer
+	closed    bool
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Console returns the guest serial console. Writes go to the guest as
+// input, and reads return what the guest has written. Once Console has
+// been called, guest output no longer goes to stdout, only to the
+// serial log, if any. Once the machine is closed, reads return io.EOF
+// after what the guest wrote has been read, and writes fail with
+// ErrConsoleClosed.
+// It must be called after Init and before the guest runs.
+func (v *VMM) Console() io.ReadWriter {
+	v.consoleOnce.Do(func() {
+		c := &console{v: v, done: make(chan struct{})}
+		c.cond = sync.NewCond(&c.mu)
+
+		v.GetSerial().SetOutput(v.serialOutput(consoleOutput{c}))
+		v.console = c
+	})
+
+	return v.console
+}
+
+// Write sends p to the guest, as if typed. It waits while the guest
+// has not read earlier input, until the machine is closed.
+func (c *console) Write(p []byte) (int, error) {
+	in := c.v.GetInputChan()
+
+	for i, b := range p {
+		select {
+		case <-c.done:
+			return i, ErrConsoleClosed
+		default:
+		}
+
+		select {
+		case in <- b:
+		case <-c.done:
+			return i, ErrConsoleClosed
+		}
+	}
+
+	if err := c.v.InjectSerialIRQ(); err != nil {
+		return len(p), err
+	}
+
+	return len(p), nil
+}
+
+// Read waits until the guest has written something, and returns it.
+func (c *console) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.out.Len() == 0 {
+		if c.closed {
+			return 0, io.EOF
+		}
+
+		c.cond.Wait()
+	}
+
+	return c.out.Read(p)
+}
+
+// close wakes up readers and writers that wait for the guest.
+func (c *console) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+
+		c.mu.Lock()
+		c.closed = true
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	})
+}
+
+// consoleOutput is the serial port side of a console.
+type consoleOutput struct {
+	c *console
+}
+
+func (o consoleOutput) Write(p []byte) (int, error) {
+	o.c.mu.Lock()
+	defer o.c.mu.Unlock()
+
+	n, err := o.c.out.Write(p)
+	o.c.cond.Broadcast()
+
+	return n, err
+}
@@ -0,0 +1,144 @@
+package vmm_test
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/machine"
+	"github.com/bobuhiro11/gokvm/vmm"
+)
+
+func TestConsole(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("New: got %v, want nil", err)
+	}
+
+	// Echo one byte from COM1, then reset through the 8042.
+	code := []byte{
+		0x66, 0xba, 0xfd, 0x03, // mov dx, 0x3fd
+		0xec,       // in al, dx
+		0xa8, 0x01, // test al, 1
+		0x74, 0xf7, // jz 0
+		0x66, 0xba, 0xf8, 0x03, // mov dx, 0x3f8
+		0xec,       // in al, dx
+		0xee,       // out dx, al
+		0xb0, 0xfe, // mov al, 0xfe
+		0xe6, 0x64, // out 0x64, al
+	}
+
+	if _, err := m.WriteAt(code, 0x1_00_000); err != nil {
+		t.Fatalf("WriteAt: got %v, want nil", err)
+	}
+
+	if err := m.SetupRegs(0x1_00_000, 0x10_000, true); err != nil {
+		t.Fatalf("SetupRegs: got %v, want nil", err)
+	}
+
+	v := vmm.New(vmm.Config{NCPUs: 1})
+	v.Machine = m
+
+	c := v.Console()
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- v.RunVCPU(0)
+	}()
+
+	if _, err := c.Write([]byte("k")); err != nil {
+		t.Fatalf("Write: got %v, want nil", err)
+	}
+
+	got := make(chan string, 1)
+
+	go func() {
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(c, b); err != nil {
+			t.Errorf("Read: got %v, want nil", err)
+		}
+
+		got <- string(b)
+	}()
+
+	select {
+	case s := <-got:
+		if s != "k" {
+			t.Errorf("echo: got %q, want %q", s, "k")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no echo from the guest")
+	}
+
+	if err := <-done; !errors.Is(err, machine.ErrWriteToCF9) {
+		t.Errorf("RunVCPU: got %v, want %v", err, machine.ErrWriteToCF9)
+	}
+}
+
+func TestConsoleClose(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("New: got %v, want nil", err)
+	}
+
+	v := vmm.New(vmm.Config{NCPUs: 1})
+	v.Machine = m
+
+	c := v.Console()
+
+	read := make(chan error, 1)
+
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		read <- err
+	}()
+
+	// The guest never runs, so this fills its input and waits.
+	written := make(chan error, 1)
+
+	go func() {
+		_, err := c.Write(make([]byte, 1<<16))
+		written <- err
+	}()
+
+	if err := v.Close(); err != nil {
+		t.Fatalf("Close: got %v, want nil", err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		got  chan error
+		want error
+	}{
+		{name: "Read", got: read, want: io.EOF},
+		{name: "Write", got: written, want: vmm.ErrConsoleClosed},
+	} {
+		select {
+		case err := <-tt.got:
+			if !errors.Is(err, tt.want) {
+				t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s still waits after Close", tt.name)
+		}
+	}
+
+	if _, err := c.Write([]byte("k")); !errors.Is(err, vmm.ErrConsoleClosed) {
+		t.Errorf("Write after Close: got %v, want %v", err, vmm.ErrConsoleClosed)
+	}
+}
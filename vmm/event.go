@@ -0,0 +1,156 @@
+package vmm
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/bobuhiro11/gokvm/iodev"
+	"github.com/bobuhiro11/gokvm/machine"
+)
+
+// EventType is the kind of a lifecycle event.
+//
+//go:generate stringer -type=EventType
+type EventType int
+
+const (
+	// EventBootStarted is sent once Boot has started the vCPUs.
+	EventBootStarted EventType = iota
+	// EventPowerOff is sent when a vCPU stops because the guest halted
+	// or powered off.
+	EventPowerOff
+	// EventReset is sent when the guest asks for a reset.
+	EventReset
+	// EventCrashed is sent when a vCPU stops with an error.
+	EventCrashed
+	// EventGuestBooted is sent when the guest reports it reached userspace.
+	EventGuestBooted
+	// EventGuestReady is sent when the guest reports its workload is up.
+	EventGuestReady
+	// EventGuestPanic is sent when the guest reports it panicked.
+	EventGuestPanic
+	// EventStopped is sent instead of EventPowerOff when a vCPU stops
+	// because a signal stopped the guest.
+	EventStopped
+)
+
+// eventQueueSize is how many events may be pending before new ones
+// are dropped.
+const eventQueueSize = 64
+
+// Event describes something that happened to the virtual machine.
+// CPU is -1 for events that do not belong to a single vCPU.
+type Event struct {
+	Type EventType
+	CPU  int
+	Err  error
+}
+
+type eventHub struct {
+	mu       sync.Mutex
+	handlers []func(Event)
+	queue    chan Event
+}
+
+// OnEvent registers f to be called for every lifecycle event.
+// Handlers run on their own goroutine, one event at a time, so a slow
+// handler delays other handlers but never the guest. If handlers fall
+// too far behind, events are dropped.
+func (v *VMM) OnEvent(f func(Event)) {
+	v.events.mu.Lock()
+	defer v.events.mu.Unlock()
+
+	if v.events.queue == nil {
+		v.events.queue = make(chan Event, eventQueueSize)
+		go v.dispatchEvents()
+	}
+
+	v.events.handlers = append(v.events.handlers, f)
+}
+
+func (v *VMM) dispatchEvents() {
+	for e := range v.events.queue {
+		v.events.mu.Lock()
+		handlers := v.events.handlers
+		v.events.mu.Unlock()
+
+		for _, f := range handlers {
+			f(e)
+		}
+	}
+}
+
+func (v *VMM) emit(e Event) {
+	v.events.mu.Lock()
+	defer v.events.mu.Unlock()
+
+	if v.events.queue == nil {
+		return
+	}
+
+	select {
+	case v.events.queue <- e:
+	default:
+		log.Printf("event queue full, dropping %v", e.Type)
+	}
+}
+
+// exitEvent returns the event for a vCPU whose run loop returned err.
+func exitEvent(cpu int, err error) Event {
+	switch {
+	case err == nil:
+		return Event{Type: EventPowerOff, CPU: cpu}
+	case errors.Is(err, machine.ErrWriteToCF9):
+		return Event{Type: EventReset, CPU: cpu, Err: err}
+	default:
+		return Event{Type: EventCrashed, CPU: cpu, Err: err}
+	}
+}
+
+// guestStatusEvents maps what the guest writes to the status port to
+// the event it sends.
+var guestStatusEvents = map[iodev.GuestStatusCode]EventType{
+	iodev.GuestBooted: EventGuestBooted,
+	iodev.GuestReady:  EventGuestReady,
+	iodev.GuestPanic:  EventGuestPanic,
+}
+
+// watchGuestStatus sends an event for each status the guest reports.
+func (v *VMM) watchGuestStatus() {
+	v.OnGuestStatus(func(c iodev.GuestStatusCode) {
+		if c == iodev.GuestBooted {
+			v.reboots.Store(0)
+		}
+
+		if t, ok := guestStatusEvents[c]; ok {
+			v.emit(Event{Type: t, CPU: -1})
+		}
+	})
+}
+
+// RunVCPU runs a vCPU until it stops, and sends an event describing why.
+// With PauseOnEntry, it first waits for Continue.
+func (v *VMM) RunVCPU(cpu int) error {
+	v.waitForContinue()
+
+	for {
+		err := v.VCPU(os.Stderr, cpu, v.TraceCount)
+
+		e := exitEvent(cpu, err)
+		if e.Type == EventPowerOff && v.stopping.Load() {
+			e.Type = EventStopped
+		}
+
+		v.emit(e)
+
+		if !errors.Is(err, machine.ErrWriteToCF9) || !v.canReboot() {
+			return err
+		}
+
+		if err := v.reboot(); err != nil {
+			return err
+		}
+	}
+}
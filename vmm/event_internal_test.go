@@ -0,0 +1,146 @@
+package vmm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/machine"
+)
+
+func TestExitEvent(t *testing.T) {
+	t.Parallel()
+
+	errBoom := errors.New("boom")
+
+	for _, tt := range []struct {
+		err  error
+		want EventType
+	}{
+		{err: nil, want: EventPowerOff},
+		{err: fmt.Errorf("CPU 0: %w", machine.ErrWriteToCF9), want: EventReset},
+		{err: errBoom, want: EventCrashed},
+	} {
+		e := exitEvent(1, tt.err)
+		if e.Type != tt.want || e.CPU != 1 || !errors.Is(e.Err, tt.err) {
+			t.Errorf("exitEvent(1, %v): got %+v, want type %v", tt.err, e, tt.want)
+		}
+	}
+}
+
+func TestEmitPowerOff(t *testing.T) {
+	t.Parallel()
+
+	v := New(Config{})
+
+	// Nothing is registered yet, so this must not block or panic.
+	v.emit(exitEvent(0, nil))
+
+	got := make(chan Event, 1)
+
+	v.OnEvent(func(e Event) {
+		got <- e
+	})
+
+	v.emit(exitEvent(0, nil))
+
+	select {
+	case e := <-got:
+		if e.Type != EventPowerOff {
+			t.Errorf("event: got %v, want %v", e.Type, EventPowerOff)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event delivered")
+	}
+}
+
+func TestEmitDoesNotBlock(t *testing.T) {
+	t.Parallel()
+
+	v := New(Config{})
+	release := make(chan struct{})
+
+	v.OnEvent(func(Event) {
+		<-release
+	})
+
+	defer close(release)
+
+	done := make(chan struct{})
+
+	go func() {
+		for i := 0; i < 10*eventQueueSize; i++ {
+			v.emit(Event{Type: EventBootStarted, CPU: -1})
+		}
+
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("emit blocked on a slow handler")
+	}
+}
+
+func TestGuestStatusEvents(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("New: got %v, want nil", err)
+	}
+
+	code := []byte{
+		0x66, 0xba, 0xf0, 0x04, // mov dx, 0x4f0
+		0xb0, 0x01, // mov al, 1 (booted)
+		0xee,       // out dx, al
+		0xb0, 0x7f, // mov al, 0x7f (unknown, ignored)
+		0xee,       // out dx, al
+		0xb0, 0x02, // mov al, 2 (ready)
+		0xee,       // out dx, al
+		0xb0, 0x03, // mov al, 3 (panic)
+		0xee,       // out dx, al
+		0xb0, 0xfe, // mov al, 0xfe
+		0xe6, 0x64, // out 0x64, al (reset)
+	}
+
+	if _, err := m.WriteAt(code, 0x1_00_000); err != nil {
+		t.Fatalf("WriteAt: got %v, want nil", err)
+	}
+
+	if err := m.SetupRegs(0x1_00_000, 0x10_000, true); err != nil {
+		t.Fatalf("SetupRegs: got %v, want nil", err)
+	}
+
+	v := New(Config{NCPUs: 1})
+	v.Machine = m
+	v.watchGuestStatus()
+
+	got := make(chan EventType, 8)
+
+	v.OnEvent(func(e Event) {
+		got <- e.Type
+	})
+
+	if err := v.RunVCPU(0); !errors.Is(err, machine.ErrWriteToCF9) {
+		t.Fatalf("RunVCPU: got %v, want %v", err, machine.ErrWriteToCF9)
+	}
+
+	for _, want := range []EventType{EventGuestBooted, EventGuestReady, EventGuestPanic, EventReset} {
+		select {
+		case e := <-got:
+			if e != want {
+				t.Errorf("event: got %v, want %v", e, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event delivered, want %v", want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package vmm_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/machine"
+	"github.com/bobuhiro11/gokvm/vmm"
+)
+
+func TestRunVCPUEvents(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name    string
+		code    []byte
+		want    vmm.EventType
+		wantErr bool
+	}{
+		// mov al, 0xfe; out 0x64, al
+		{name: "8042 reset", code: []byte{0xb0, 0xfe, 0xe6, 0x64}, want: vmm.EventReset, wantErr: true},
+		// The poison pattern ends with ud2, which kills the guest.
+		{name: "poison", code: []byte(machine.Poison), want: vmm.EventCrashed, wantErr: true},
+		// The guest halts for good by entering S5.
+		{name: "receives the PowerOff event when the guest halts", code: poweroff, want: vmm.EventPowerOff},
+	} {
+		m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+		if err != nil {
+			t.Fatalf("%s: New: got %v, want nil", tt.name, err)
+		}
+
+		if _, err := m.WriteAt(tt.code, 0x1_00_000); err != nil {
+			t.Fatalf("%s: WriteAt: got %v, want nil", tt.name, err)
+		}
+
+		if err := m.SetupRegs(0x1_00_000, 0x10_000, true); err != nil {
+			t.Fatalf("%s: SetupRegs: got %v, want nil", tt.name, err)
+		}
+
+		v := vmm.New(vmm.Config{NCPUs: 1})
+		v.Machine = m
+
+		got := make(chan vmm.Event, 1)
+
+		v.OnEvent(func(e vmm.Event) {
+			got <- e
+		})
+
+		err = v.RunVCPU(0)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("%s: RunVCPU: got %v, want err %v", tt.name, err, tt.wantErr)
+		}
+
+		select {
+		case e := <-got:
+			if e.Type != tt.want || !errors.Is(e.Err, err) {
+				t.Errorf("%s: event: got %v (%v), want %v (%v)", tt.name, e.Type, e.Err, tt.want, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: no event delivered", tt.name)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package vmm
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// waitForContinue blocks until Continue is called, if the VMM was
+// configured to pause on entry.
+func (v *VMM) waitForContinue() {
+	if v.PauseOnEntry {
+		<-v.resume
+	}
+}
+
+// Continue lets vCPUs held back by PauseOnEntry enter the guest.
+// It is safe to call more than once.
+func (v *VMM) Continue() {
+	v.resumeOnce.Do(func() {
+		close(v.resume)
+	})
+}
+
+// continueOnSignal calls Continue when the process gets SIGUSR1,
+// so that vCPUs paused on entry can be released from outside, e.g.
+// once a debugger has attached.
+func (v *VMM) continueOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+
+	go func() {
+		<-c
+		signal.Stop(c)
+		v.Continue()
+	}()
+}
@@ -0,0 +1,78 @@
+package vmm_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/machine"
+	"github.com/bobuhiro11/gokvm/vmm"
+)
+
+func TestPauseOnEntry(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("New: got %v, want nil", err)
+	}
+
+	const entry = 0x1_00_000
+
+	// mov al, 0xfe; out 0x64, al
+	if _, err := m.WriteAt([]byte{0xb0, 0xfe, 0xe6, 0x64}, entry); err != nil {
+		t.Fatalf("WriteAt: got %v, want nil", err)
+	}
+
+	if err := m.SetupRegs(entry, 0x10_000, true); err != nil {
+		t.Fatalf("SetupRegs: got %v, want nil", err)
+	}
+
+	v := vmm.New(vmm.Config{NCPUs: 1, PauseOnEntry: true})
+	v.Machine = m
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- v.RunVCPU(0)
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("RunVCPU returned %v while paused", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	r, err := m.GetRegs(0)
+	if err != nil {
+		t.Fatalf("GetRegs: got %v, want nil", err)
+	}
+
+	if r.RIP != entry {
+		t.Fatalf("RIP while paused: got %#x, want %#x", r.RIP, entry)
+	}
+
+	v.Continue()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, machine.ErrWriteToCF9) {
+			t.Fatalf("RunVCPU: got %v, want %v", err, machine.ErrWriteToCF9)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("vCPU did not run after Continue")
+	}
+
+	if r, err = m.GetRegs(0); err != nil {
+		t.Fatalf("GetRegs: got %v, want nil", err)
+	}
+
+	if r.RIP <= entry {
+		t.Fatalf("RIP after Continue: got %#x, want > %#x", r.RIP, entry)
+	}
+}
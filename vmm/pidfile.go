@@ -0,0 +1,66 @@
+package vmm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxProcessTitle is the size of the kernel comm field, including the
+// terminating NUL.
+const maxProcessTitle = 16
+
+// WritePidFile writes the pid of the current process to path.
+// The returned function removes the file again and is safe to call
+// more than once.
+func WritePidFile(path string) (func(), error) {
+	pid := strconv.Itoa(os.Getpid()) + "\n"
+
+	if err := os.WriteFile(path, []byte(pid), 0o644); err != nil {
+		return func() {}, fmt.Errorf("pidfile %q: %w", path, err)
+	}
+
+	return func() {
+		_ = os.Remove(path)
+	}, nil
+}
+
+// KernelParams returns the kernel command line params, with the guest
+// hostname appended if name is set.
+func KernelParams(params, name string) string {
+	if name == "" {
+		return params
+	}
+
+	return strings.TrimSpace(params + " systemd.hostname=" + name)
+}
+
+// ProcessTitle returns a short, descriptive name for a gokvm process
+// running the given kernel and disks.
+func ProcessTitle(kernel string, disks ...string) string {
+	t := "gokvm:" + filepath.Base(kernel)
+
+	for _, d := range disks {
+		if d != "" {
+			t += "," + filepath.Base(d)
+		}
+	}
+
+	return t
+}
+
+// SetProcessTitle sets the process name as shown by ps and top.
+// It writes the comm of the thread group leader, so it works no matter
+// which OS thread the calling goroutine is on. The kernel only keeps
+// the first 15 bytes.
+func SetProcessTitle(title string) error {
+	title = strings.ReplaceAll(title, "\x00", "")
+
+	if len(title) >= maxProcessTitle {
+		title = title[:maxProcessTitle-1]
+	}
+
+	return os.WriteFile("/proc/self/comm", []byte(title), 0o644)
+}
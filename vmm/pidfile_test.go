@@ -0,0 +1,146 @@
+package vmm_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/machine"
+	"github.com/bobuhiro11/gokvm/vmm"
+)
+
+func TestWritePidFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "gokvm.pid")
+
+	remove, err := vmm.WritePidFile(path)
+	if err != nil {
+		t.Fatalf("WritePidFile(%q): got %v, want nil", path, err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile(%q): got %v, want nil", path, err)
+	}
+
+	if got, want := strings.TrimSpace(string(b)), strconv.Itoa(os.Getpid()); got != want {
+		t.Errorf("pid: got %q, want %q", got, want)
+	}
+
+	remove()
+	remove()
+
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat(%q) after remove: got %v, want %v", path, err, os.ErrNotExist)
+	}
+}
+
+func TestPidFileLifecycle(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "gokvm.pid")
+
+	v := vmm.New(vmm.Config{
+		Dev:          "/dev/kvm",
+		NCPUs:        1,
+		MemSize:      machine.MinMemSize,
+		PidFile:      path,
+		PauseOnEntry: true,
+	})
+
+	if err := v.Init(); err != nil {
+		t.Fatalf("Init: got %v, want nil", err)
+	}
+
+	// Setup may still fail, and nothing would remove the file.
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat(%q) after Init: got %v, want %v", path, err, os.ErrNotExist)
+	}
+
+	if _, err := v.WriteAt(poweroff, 0x1_00_000); err != nil {
+		t.Fatalf("WriteAt: got %v, want nil", err)
+	}
+
+	if err := v.SetupRegs(0x1_00_000, 0x10_000, true); err != nil {
+		t.Fatalf("SetupRegs: got %v, want nil", err)
+	}
+
+	v.Console()
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- v.Boot()
+	}()
+
+	// The vCPUs stay paused, and Boot running, until Continue.
+	var (
+		b   []byte
+		err error
+	)
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if b, err = os.ReadFile(path); err == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		t.Errorf("ReadFile(%q) during Boot: got %v, want nil", path, err)
+	} else if got, want := strings.TrimSpace(string(b)), strconv.Itoa(os.Getpid()); got != want {
+		t.Errorf("pid: got %q, want %q", got, want)
+	}
+
+	v.Continue()
+
+	if err := <-done; err != nil {
+		t.Fatalf("Boot: got %v, want nil", err)
+	}
+
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat(%q) after Boot: got %v, want %v", path, err, os.ErrNotExist)
+	}
+}
+
+func TestWritePidFileBadPath(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "nonexistent", "gokvm.pid")
+
+	if _, err := vmm.WritePidFile(path); err == nil {
+		t.Errorf("WritePidFile(%q): got nil, want err", path)
+	}
+}
+
+func TestProcessTitle(t *testing.T) {
+	t.Parallel()
+
+	if got, want := vmm.ProcessTitle("/boot/bzImage", "/tmp/vda.img", ""), "gokvm:bzImage,vda.img"; got != want {
+		t.Errorf("ProcessTitle: got %q, want %q", got, want)
+	}
+}
+
+func TestKernelParams(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		params, name, want string
+	}{
+		{"console=ttyS0", "", "console=ttyS0"},
+		{"console=ttyS0", "web-01", "console=ttyS0 systemd.hostname=web-01"},
+		{"", "web-01", "systemd.hostname=web-01"},
+	} {
+		if got := vmm.KernelParams(tt.params, tt.name); got != tt.want {
+			t.Errorf("KernelParams(%q, %q): got %q, want %q", tt.params, tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package vmm
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// ErrTooManyReboots is returned when the guest reset more than
+// Config.MaxReboots times without reporting that it booted.
+var ErrTooManyReboots = errors.New("too many reboots")
+
+// canReboot reports whether a guest reset reboots the guest. Machine.Reset
+// must not run while other vCPUs are in the guest, so it is only done
+// with a single vCPU.
+func (v *VMM) canReboot() bool {
+	return v.MaxReboots > 0 && v.NCPUs == 1
+}
+
+// reboot loads the guest images again and starts over at their entry
+// point, unless the guest already reset MaxReboots times since it last
+// reported that it booted.
+func (v *VMM) reboot() error {
+	n := int(v.reboots.Add(1))
+	if n > v.MaxReboots {
+		return fmt.Errorf("guest reset %d times without booting: %w", n, ErrTooManyReboots)
+	}
+
+	log.Printf("guest reset, reboot %d of %d", n, v.MaxReboots)
+
+	return v.Reset()
+}
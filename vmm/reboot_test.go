@@ -0,0 +1,42 @@
+package vmm_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/machine"
+	"github.com/bobuhiro11/gokvm/vmm"
+)
+
+func TestMaxReboots(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("New: got %v, want nil", err)
+	}
+
+	const entry = 0x1_00_000
+
+	// mov al, 0xfe; out 0x64, al
+	if _, err := m.WriteAt([]byte{0xb0, 0xfe, 0xe6, 0x64}, entry); err != nil {
+		t.Fatalf("WriteAt: got %v, want nil", err)
+	}
+
+	if err := m.SetupRegs(entry, 0x10_000, true); err != nil {
+		t.Fatalf("SetupRegs: got %v, want nil", err)
+	}
+
+	// The fourth reset is one too many.
+	v := vmm.New(vmm.Config{NCPUs: 1, MaxReboots: 3})
+	v.Machine = m
+
+	if err := v.RunVCPU(0); !errors.Is(err, vmm.ErrTooManyReboots) {
+		t.Fatalf("RunVCPU: got %v, want %v", err, vmm.ErrTooManyReboots)
+	}
+}
@@ -0,0 +1,40 @@
+package vmm
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// ErrInterrupted is returned by Boot when a signal stopped the guest.
+var ErrInterrupted = errors.New("guest stopped by signal")
+
+// notifyStop returns a channel that receives SIGTERM and SIGINT,
+// and a func to stop listening for them.
+func notifyStop() (<-chan os.Signal, func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+
+	return c, func() { signal.Stop(c) }
+}
+
+// stop shuts the machine down after sig, once waitVCPUs says the
+// vCPUs have returned, and releases it.
+func (v *VMM) stop(sig os.Signal, waitVCPUs func() error) error {
+	log.Printf("got %v, stopping the guest", sig)
+
+	v.stopping.Store(true)
+	v.Shutdown()
+
+	if err := waitVCPUs(); err != nil {
+		log.Print(err)
+	}
+
+	if err := v.Close(); err != nil {
+		log.Printf("Close: %v", err)
+	}
+
+	return ErrInterrupted
+}
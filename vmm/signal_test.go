@@ -0,0 +1,90 @@
+package vmm_test
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/machine"
+	"github.com/bobuhiro11/gokvm/vmm"
+)
+
+// The signal goes to the whole test process, so nothing else may run.
+func TestBootStopsOnSignal(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("New: got %v, want nil", err)
+	}
+
+	const entry = 0x1_00_000
+
+	// jmp $
+	if _, err := m.WriteAt([]byte{0xeb, 0xfe}, entry); err != nil {
+		t.Fatalf("WriteAt: got %v, want nil", err)
+	}
+
+	if err := m.SetupRegs(entry, 0x10_000, true); err != nil {
+		t.Fatalf("SetupRegs: got %v, want nil", err)
+	}
+
+	v := vmm.New(vmm.Config{NCPUs: 1})
+	v.Machine = m
+	v.Console()
+
+	started := make(chan struct{})
+	exited := make(chan vmm.EventType, 1)
+
+	v.OnEvent(func(e vmm.Event) {
+		switch e.Type {
+		case vmm.EventBootStarted:
+			close(started)
+		case vmm.EventPowerOff, vmm.EventStopped:
+			exited <- e.Type
+		}
+	})
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- v.Boot()
+	}()
+
+	<-started
+
+	// Give the vCPU time to enter the guest.
+	time.Sleep(100 * time.Millisecond)
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("Kill: got %v, want nil", err)
+	}
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, vmm.ErrInterrupted) {
+			t.Fatalf("Boot: got %v, want %v", err, vmm.ErrInterrupted)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Boot did not return after SIGTERM")
+	}
+
+	// The guest did not power off itself.
+	select {
+	case typ := <-exited:
+		if typ != vmm.EventStopped {
+			t.Errorf("vCPU event: got %v, want %v", typ, vmm.EventStopped)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("no vCPU event delivered")
+	}
+
+	// The vCPU fd is gone once the machine has been closed.
+	if _, err := m.GetRegs(0); !errors.Is(err, syscall.EBADF) {
+		t.Errorf("GetRegs after Boot: got %v, want %v", err, syscall.EBADF)
+	}
+}
@@ -2,12 +2,18 @@ package vmm
 
 import (
 	"bufio"
+	"crypto/rand"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"sync"
+	"sync/atomic"
 
+	"github.com/bobuhiro11/gokvm/kvm"
 	"github.com/bobuhiro11/gokvm/machine"
 	"github.com/bobuhiro11/gokvm/pvh"
+	"github.com/bobuhiro11/gokvm/serial"
 	"github.com/bobuhiro11/gokvm/term"
 	"golang.org/x/sync/errgroup"
 )
@@ -20,45 +26,257 @@ type Config struct {
 	Kernel     string
 	Initrd     string
 	Params     string
-	TapIfName  string
-	Disk       string
+	TapIfNames []string
+	Disks      []string
+	BlockSize  int
+	DiskSerial string
+	DiskMmap   bool
+	Rng        bool
 	NCPUs      int
+	CPULimit   int
 	MemSize    int
 	TraceCount int
+	TraceStart uint64
+	TraceEnd   uint64
+	PidFile    string
+	UUID       string
+	Serial     string
+	MemInit    string
+	Exception  string
+	IRQChip    string
+	// CPUModel is kvm64 or host, as parsed by machine.ParseCPUModel.
+	CPUModel string
+	// Name is the guest hostname, also reported as SMBIOS product name.
+	Name string
+	// SerialLog is a file that also gets the guest serial output,
+	// rotated at SerialLogSize bytes, keeping SerialLogKeep old ones.
+	SerialLog     string
+	SerialLogSize int
+	SerialLogKeep int
+	// Serial2 is a file that gets the output of the second serial port.
+	Serial2 string
+
+	// Prealloc faults in guest memory at startup.
+	Prealloc bool
+	// MemFD backs guest memory with a memfd other processes can map.
+	MemFD bool
+	// DisableExits lets the guest idle without exiting, where supported.
+	DisableExits bool
+	// CoalescedPIO buffers writes to chatty output ports in KVM.
+	CoalescedPIO bool
+	// MSIX gives the virtio devices MSI-X.
+	MSIX bool
+	// Entry32 boots a bzImage through its 32-bit entry point.
+	Entry32 bool
+
+	// PauseOnEntry holds all vCPUs before their first instruction
+	// until Continue is called.
+	PauseOnEntry bool
+
+	// MaxReboots is how many resets in a row reboot the guest before
+	// RunVCPU fails with ErrTooManyReboots. The count starts over when
+	// the guest reports it booted. 0 means a reset stops the vCPU.
+	MaxReboots int
+
+	// CPUID holds CPUID overrides as parsed by
+	// machine.ParseCPUIDOverride.
+	CPUID []string
 }
 
 type VMM struct {
 	*machine.Machine
 	Config
+
+	events      eventHub
+	resume      chan struct{}
+	resumeOnce  sync.Once
+	console     *console
+	consoleOnce sync.Once
+	serialLog   io.Writer
+	reboots     atomic.Int32
+	stopping    atomic.Bool
 }
 
 func New(c Config) *VMM {
 	return &VMM{
 		Machine: nil,
 		Config:  c,
+		resume:  make(chan struct{}),
+	}
+}
+
+// serialOutput returns w, teed to the serial log if there is one.
+func (v *VMM) serialOutput(w io.Writer) io.Writer {
+	if v.serialLog == nil {
+		return w
+	}
+
+	return io.MultiWriter(w, v.serialLog)
+}
+
+// Close closes the machine, and the console, if there is one.
+func (v *VMM) Close() error {
+	if v.console != nil {
+		v.console.close()
 	}
+
+	return v.Machine.Close()
 }
 
 // Init instantiates a machine.
 func (v *VMM) Init() error {
-	m, err := machine.New(v.Dev, v.NCPUs, v.MemSize)
+	opts := machine.Options{
+		Prealloc:     v.Prealloc,
+		MemFD:        v.Config.MemFD,
+		CoalescedPIO: v.CoalescedPIO,
+		MSIX:         v.MSIX,
+		Entry32:      v.Entry32,
+	}
+
+	if v.DisableExits {
+		opts.DisableExits = kvm.X86DisableExitsHLT | kvm.X86DisableExitsPause |
+			kvm.X86DisableExitsMWait | kvm.X86DisableExitsCState
+	}
+
+	if len(v.MemInit) > 0 {
+		var err error
+
+		if opts.MemInit, err = machine.ParseMemInit(v.MemInit); err != nil {
+			return err
+		}
+	}
+
+	if len(v.IRQChip) > 0 {
+		var err error
+
+		if opts.IRQChip, err = machine.ParseIRQChip(v.IRQChip); err != nil {
+			return err
+		}
+	}
+
+	m, err := machine.NewWithOptions(v.Dev, v.NCPUs, v.MemSize, opts)
 	if err != nil {
 		return err
 	}
 
-	if len(v.TapIfName) > 0 {
-		if err := m.AddTapIf(v.TapIfName); err != nil {
+	for _, name := range v.TapIfNames {
+		if err := m.AddTapIf(name); err != nil {
+			return err
+		}
+	}
+
+	addDisk := m.AddDisk
+	if v.DiskMmap {
+		addDisk = m.AddDiskMmap
+	}
+
+	for _, disk := range v.Disks {
+		if err := addDisk(disk); err != nil {
+			return err
+		}
+	}
+
+	// The block size and serial are those of the first disk.
+	if len(v.Disks) > 0 {
+		if v.BlockSize > 0 {
+			if err := m.SetDiskBlockSize(uint32(v.BlockSize), uint32(v.BlockSize)); err != nil {
+				return err
+			}
+		}
+
+		if len(v.DiskSerial) > 0 {
+			if err := m.SetDiskSerial(v.DiskSerial); err != nil {
+				return err
+			}
+		}
+	}
+
+	if v.Rng {
+		if err := m.AddRng(rand.Reader); err != nil {
+			return err
+		}
+	}
+
+	if v.Debug {
+		m.SetVirtioDebugOutput(os.Stderr)
+	}
+
+	if len(v.CPUModel) > 0 {
+		model, err := machine.ParseCPUModel(v.CPUModel)
+		if err != nil {
+			return err
+		}
+
+		if err := m.SetCPUModel(model); err != nil {
+			return err
+		}
+	}
+
+	if len(v.CPUID) > 0 {
+		overrides := make([]machine.CPUIDOverride, 0, len(v.CPUID))
+
+		for _, s := range v.CPUID {
+			o, err := machine.ParseCPUIDOverride(s)
+			if err != nil {
+				return err
+			}
+
+			overrides = append(overrides, o)
+		}
+
+		if err := m.SetCPUIDOverrides(overrides); err != nil {
+			return err
+		}
+	}
+
+	if err := m.SetCPULimit(v.CPULimit); err != nil {
+		return err
+	}
+
+	if v.TraceEnd != 0 {
+		if err := m.SetTraceRange(v.TraceStart, v.TraceEnd); err != nil {
 			return err
 		}
 	}
 
-	if len(v.Disk) > 0 {
-		if err := m.AddDisk(v.Disk); err != nil {
+	if err := m.LoadSMBIOS(v.UUID, v.Serial, v.Name); err != nil {
+		return err
+	}
+
+	if len(v.Exception) > 0 {
+		p, err := machine.ParseExceptionPolicy(v.Exception)
+		if err != nil {
 			return err
 		}
+
+		m.SetExceptionPolicy(p)
 	}
 
 	v.Machine = m
+	v.watchGuestStatus()
+
+	if len(v.SerialLog) > 0 {
+		f, err := serial.NewRotatingFile(v.SerialLog, int64(v.SerialLogSize), v.SerialLogKeep)
+		if err != nil {
+			return err
+		}
+
+		v.serialLog = f
+		m.GetSerial().SetOutput(v.serialOutput(os.Stdout))
+	}
+
+	if len(v.Serial2) > 0 {
+		f, err := os.OpenFile(v.Serial2, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+
+		m.GetSerial2().SetOutput(f)
+	}
+
+	if err := SetProcessTitle(ProcessTitle(v.Kernel, v.Disks...)); err != nil {
+		log.Printf("SetProcessTitle: %v", err)
+	}
 
 	return nil
 }
@@ -83,12 +301,14 @@ func (v *VMM) Setup() error {
 		}
 	}
 
+	params := KernelParams(v.Params, v.Name)
+
 	if isPVH {
-		if err := v.Machine.LoadPVH(kern, initrd, v.Params); err != nil {
+		if err := v.Machine.LoadPVH(kern, initrd, params); err != nil {
 			return err
 		}
 	} else {
-		if err := v.Machine.LoadLinux(kern, initrd, v.Params); err != nil {
+		if err := v.Machine.LoadLinux(kern, initrd, params); err != nil {
 			return err
 		}
 	}
@@ -96,15 +316,41 @@ func (v *VMM) Setup() error {
 	return nil
 }
 
+// Boot runs the vCPUs until they all stop, as when the guest powers
+// off, and closes the machine. On SIGTERM or SIGINT, it stops them,
+// closes the machine and returns ErrInterrupted. While it runs, PidFile,
+// if set, holds the pid of the process.
 func (v *VMM) Boot() error {
 	var err error
 
+	// Only once the guest is about to run, so that a failed Init or
+	// Setup leaves no pidfile behind.
+	if len(v.PidFile) > 0 {
+		remove, err := WritePidFile(v.PidFile)
+		if err != nil {
+			return err
+		}
+
+		defer remove()
+	}
+
+	sig, stopSignals := notifyStop()
+	defer stopSignals()
+
+	// With a trace range, the vCPUs are already set up to break at its start.
 	trace := v.TraceCount > 0
-	if err := v.SingleStep(trace); err != nil {
-		return fmt.Errorf("setting trace to %v:%w", trace, err)
+	if v.TraceEnd == 0 {
+		if err := v.SingleStep(trace); err != nil {
+			return fmt.Errorf("setting trace to %v:%w", trace, err)
+		}
+	}
+
+	if v.PauseOnEntry {
+		log.Printf("vCPUs paused on entry, send SIGUSR1 to continue")
+		v.continueOnSignal()
 	}
 
-	g := new(errgroup.Group)
+	cpus := new(errgroup.Group)
 
 	for cpu := 0; cpu < v.NCPUs; cpu++ {
 		fmt.Printf("Start CPU %d of %d\r\n", cpu, v.NCPUs)
@@ -112,15 +358,48 @@ func (v *VMM) Boot() error {
 		i := cpu
 
 		f := func() error {
-			return v.VCPU(os.Stderr, i, v.TraceCount)
+			return v.RunVCPU(i)
 		}
 
-		g.Go(f)
+		cpus.Go(f)
+	}
+
+	v.emit(Event{Type: EventBootStarted, CPU: -1})
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- cpus.Wait()
+	}()
+
+	// wait returns once the vCPUs are done, whatever else is still
+	// running: the serial console never stops reading the terminal.
+	wait := func() error {
+		select {
+		case err := <-done:
+			if err != nil {
+				log.Print(err)
+			}
+
+			if err := v.Close(); err != nil {
+				log.Printf("Close: %v", err)
+			}
+
+			return nil
+		case s := <-sig:
+			return v.stop(s, cpus.Wait)
+		}
+	}
+
+	// A guest console driven through Console does not use the terminal.
+	if v.console != nil {
+		return wait()
 	}
 
 	if !term.IsTerminal() {
 		fmt.Fprintln(os.Stderr, "this is not terminal and does not accept input")
-		select {}
+
+		return wait()
 	}
 
 	restoreMode, err := term.SetRawMode()
@@ -130,25 +409,25 @@ func (v *VMM) Boot() error {
 
 	defer restoreMode()
 
-	if err := v.SingleStep(trace); err != nil {
-		log.Printf("SingleStep(%v): %v", trace, err)
+	if v.TraceEnd == 0 {
+		if err := v.SingleStep(trace); err != nil {
+			log.Printf("SingleStep(%v): %v", trace, err)
 
-		return err
+			return err
+		}
 	}
 
 	in := bufio.NewReader(os.Stdin)
 
-	g.Go(func() error {
+	go func() {
 		err := v.GetSerial().Start(*in, restoreMode, v.InjectSerialIRQ)
 		log.Printf("Serial exits: %v", err)
-
-		return err
-	})
+	}()
 
 	fmt.Printf("Waiting for CPUs to exit\r\n")
 
-	if err := g.Wait(); err != nil {
-		log.Print(err)
+	if err := wait(); err != nil {
+		return err
 	}
 
 	fmt.Printf("All cpus done\n\r")
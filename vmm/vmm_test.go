@@ -0,0 +1,71 @@
+package vmm_test
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/machine"
+	"github.com/bobuhiro11/gokvm/vmm"
+)
+
+// poweroff writes S5 with SLP_EN to the ACPI shutdown device.
+var poweroff = []byte{
+	0x66, 0xba, 0x00, 0x06, // mov dx, 0x600
+	0xb0, 0x34, // mov al, 0x34
+	0xee,       // out dx, al
+	0xeb, 0xfe, // jmp $
+}
+
+func TestBootReturnsOnPoweroff(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	// Without a console, a test has no terminal on stdin.
+	for _, console := range []bool{true, false} {
+		m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+		if err != nil {
+			t.Fatalf("New: got %v, want nil", err)
+		}
+
+		if _, err := m.WriteAt(poweroff, 0x1_00_000); err != nil {
+			t.Fatalf("WriteAt: got %v, want nil", err)
+		}
+
+		if err := m.SetupRegs(0x1_00_000, 0x10_000, true); err != nil {
+			t.Fatalf("SetupRegs: got %v, want nil", err)
+		}
+
+		v := vmm.New(vmm.Config{NCPUs: 1})
+		v.Machine = m
+
+		if console {
+			v.Console()
+		}
+
+		done := make(chan error, 1)
+
+		go func() {
+			done <- v.Boot()
+		}()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("console %v: Boot: got %v, want nil", console, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("console %v: Boot did not return after the guest powered off", console)
+		}
+
+		// The vCPU fd is gone once the machine has been closed.
+		if _, err := m.GetRegs(0); !errors.Is(err, syscall.EBADF) {
+			t.Errorf("console %v: GetRegs after Boot: got %v, want %v", console, err, syscall.EBADF)
+		}
+	}
+}